@@ -19,6 +19,11 @@ func Deserialize(reader io.Reader, value any) error {
 }
 
 func deserialize(firstChar byte, reader io.Reader, entity any) error {
+	entityValue := reflect.ValueOf(entity)
+	if entityValue.Kind() == reflect.Pointer && entityValue.Elem().Kind() == reflect.Interface {
+		return deserializeToInterface(firstChar, reader, entityValue.Elem())
+	}
+
 	switch firstChar {
 	case 'i':
 		err := deserializeInt(reader, entity)
@@ -52,6 +57,111 @@ func deserialize(firstChar byte, reader io.Reader, entity any) error {
 	return nil
 }
 
+// Deserializes value of any type into the interface, so it's up to the caller
+// to decide how to interpret it. Integers are stored as int64, strings as string,
+// lists as []any and dictionaries as map[string]any.
+func deserializeToInterface(firstChar byte, reader io.Reader, entityElem reflect.Value) error {
+	value, err := deserializeAny(firstChar, reader)
+	if err != nil {
+		return err
+	}
+
+	if !entityElem.CanSet() {
+		return fmt.Errorf("cannot set interface value %s", entityElem)
+	}
+
+	valueReflect := reflect.ValueOf(value)
+	if !valueReflect.Type().AssignableTo(entityElem.Type()) {
+		return fmt.Errorf(
+			"wrong field type: %s is not assignable to %s",
+			valueReflect.Type(),
+			entityElem.Type(),
+		)
+	}
+
+	entityElem.Set(valueReflect)
+
+	return nil
+}
+
+func deserializeAny(firstChar byte, reader io.Reader) (any, error) {
+	switch firstChar {
+	case 'i':
+		value, err := readInt(reader)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse int: %w", err)
+		}
+
+		return value, nil
+	case 'l':
+		list := make([]any, 0)
+		for {
+			firstChar, err := readOne(reader)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read list data: %w", err)
+			}
+
+			if firstChar == 'e' {
+				break
+			}
+
+			element, err := deserializeAny(firstChar, reader)
+			if err != nil {
+				return nil, fmt.Errorf("failed to deserialize list element: %w", err)
+			}
+
+			list = append(list, element)
+		}
+
+		return list, nil
+	case 'd':
+		dictionary := make(map[string]any)
+		for {
+			firstChar, err := readOne(reader)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read dictionary data: %w", err)
+			}
+
+			if firstChar == 'e' {
+				break
+			}
+
+			key, err := readString(firstChar, reader)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read dictionary key: %w", err)
+			}
+
+			firstChar, err = readOne(reader)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read dictionary data: %w", err)
+			}
+
+			value, err := deserializeAny(firstChar, reader)
+			if err != nil {
+				return nil, fmt.Errorf("failed to deserialize dictionary value: %w", err)
+			}
+
+			dictionary[key] = value
+		}
+
+		return dictionary, nil
+	default:
+		if firstChar >= '0' && firstChar <= '9' {
+			value, err := readString(firstChar, reader)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse string: %w", err)
+			}
+
+			return value, nil
+		}
+
+		return nil, fmt.Errorf(
+			"unexpected characted found: %s, expected one of `i`, `l`, `d`, `0-9`",
+			string(firstChar),
+		)
+	}
+}
+
 func deserializeAndDrop(firstChar byte, reader io.Reader) error {
 	switch firstChar {
 	case 'i':
@@ -185,6 +185,51 @@ func TestExtraFields(t *testing.T) {
 	testDeepEqualDeserailize(bencoded, expected, t)
 }
 
+func TestInterfaceDeserialize(t *testing.T) {
+	bencoded := removeWhitespaces(`
+		d
+			11:StringField
+				4:test
+			8:AnyField
+				l
+					i10e
+					4:test
+					d
+						3:key
+							5:value
+					e
+				e
+		e
+	`)
+
+	expected := dictionaryStructWithInterface{
+		StringField: "test",
+		AnyField: []any{
+			int64(10),
+			"test",
+			map[string]any{"key": "value"},
+		},
+	}
+
+	testDeepEqualDeserailize(bencoded, expected, t)
+
+	bencoded = removeWhitespaces(`
+		d
+			11:StringField
+				4:test
+			8:AnyField
+				4:test
+		e
+	`)
+
+	expected = dictionaryStructWithInterface{
+		StringField: "test",
+		AnyField:    "test",
+	}
+
+	testDeepEqualDeserailize(bencoded, expected, t)
+}
+
 type dictionaryStruct struct {
 	StringField string
 	DictField   dictionaryStructInner
@@ -204,6 +249,11 @@ type dictionaryStructWithTags struct {
 	StringField string `bencode:"string field"`
 }
 
+type dictionaryStructWithInterface struct {
+	StringField string
+	AnyField    any
+}
+
 func testStringDeserialize(bencoded string, expectedValue string, t *testing.T) {
 	deserialized := "garbage"
 	err := Deserialize(strings.NewReader(bencoded), &deserialized)
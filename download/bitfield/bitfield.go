@@ -15,6 +15,15 @@ func NewEmptyBitfield(pieceCount int) Bitfield {
 	return Bitfield{data: make([]byte, (pieceCount+7)/8), pieceCount: pieceCount}
 }
 
+func NewFullBitfield(pieceCount int) Bitfield {
+	bitfield := NewEmptyBitfield(pieceCount)
+	for piece := range pieceCount {
+		bitfield.AddPiece(uint64(piece))
+	}
+
+	return bitfield
+}
+
 func (bitfield *Bitfield) PieceCount() int {
 	return bitfield.pieceCount
 }
@@ -0,0 +1,179 @@
+package choker
+
+import (
+	"cmp"
+	"context"
+	"log"
+	"math/rand/v2"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/mertwole/bittorrent-cli/download/downloaded_files"
+)
+
+const UnchokeInterval = time.Second * 10
+const OptimisticUnchokeInterval = time.Second * 30
+const regularUploadSlots = 3
+const newPeerTimeout = time.Minute
+const newPeerOptimisticWeight = 3
+
+// Peer is the part of the peer connection the choker needs.
+type Peer interface {
+	IsInterested() bool
+	GetDownloadedBytes() uint64
+	GetUploadedBytes() uint64
+	// Sends choke or unchoke message, might block for a while.
+	SetChoking(choking bool) error
+}
+
+type Choker struct {
+	isSeeding func() bool
+
+	peers             map[Peer]*peerStats
+	optimisticUnchoke Peer
+	mutex             sync.Mutex
+}
+
+type peerStats struct {
+	connectedAt time.Time
+
+	lastDownloadedBytes uint64
+	lastUploadedBytes   uint64
+
+	downloadRate float64
+	uploadRate   float64
+}
+
+func New(downloadedFiles *downloaded_files.DownloadedFiles) *Choker {
+	return &Choker{
+		isSeeding: func() bool {
+			return downloadedFiles.GetStatus().State == downloaded_files.Ready
+		},
+		peers: make(map[Peer]*peerStats),
+	}
+}
+
+func (choker *Choker) AddPeer(newPeer Peer) {
+	choker.mutex.Lock()
+	defer choker.mutex.Unlock()
+
+	choker.peers[newPeer] = &peerStats{
+		connectedAt:         time.Now(),
+		lastDownloadedBytes: newPeer.GetDownloadedBytes(),
+		lastUploadedBytes:   newPeer.GetUploadedBytes(),
+	}
+}
+
+func (choker *Choker) RemovePeer(removedPeer Peer) {
+	choker.mutex.Lock()
+	defer choker.mutex.Unlock()
+
+	delete(choker.peers, removedPeer)
+	if choker.optimisticUnchoke == removedPeer {
+		choker.optimisticUnchoke = nil
+	}
+}
+
+func (choker *Choker) Run(ctx context.Context) {
+	rounds := 0
+	for {
+		select {
+		case <-time.After(UnchokeInterval):
+		case <-ctx.Done():
+			return
+		}
+
+		rotateOptimistic := rounds%int(OptimisticUnchokeInterval/UnchokeInterval) == 0
+		choker.rechoke(rotateOptimistic)
+
+		rounds++
+	}
+}
+
+// Choke messages are sent without the lock held, so a slow peer doesn't block adding and removing peers.
+func (choker *Choker) rechoke(rotateOptimistic bool) {
+	unchoked := choker.decide(rotateOptimistic)
+
+	for connectedPeer, unchoke := range unchoked {
+		err := connectedPeer.SetChoking(!unchoke)
+		if err != nil {
+			log.Printf("failed to update choke state: %v", err)
+		}
+	}
+}
+
+// Returns whether each connected peer should be unchoked.
+func (choker *Choker) decide(rotateOptimistic bool) map[Peer]bool {
+	choker.mutex.Lock()
+	defer choker.mutex.Unlock()
+
+	seeding := choker.isSeeding()
+
+	interested := make([]Peer, 0)
+	for connectedPeer, stats := range choker.peers {
+		downloaded := connectedPeer.GetDownloadedBytes()
+		uploaded := connectedPeer.GetUploadedBytes()
+
+		stats.downloadRate = float64(downloaded-stats.lastDownloadedBytes) / UnchokeInterval.Seconds()
+		stats.uploadRate = float64(uploaded-stats.lastUploadedBytes) / UnchokeInterval.Seconds()
+		stats.lastDownloadedBytes = downloaded
+		stats.lastUploadedBytes = uploaded
+
+		if connectedPeer.IsInterested() {
+			interested = append(interested, connectedPeer)
+		}
+	}
+
+	// When seeding there's nothing to reciprocate, so peers we upload the fastest to are preferred.
+	slices.SortFunc(interested, func(a, b Peer) int {
+		if seeding {
+			return cmp.Compare(choker.peers[b].uploadRate, choker.peers[a].uploadRate)
+		}
+
+		return cmp.Compare(choker.peers[b].downloadRate, choker.peers[a].downloadRate)
+	})
+
+	unchoked := make(map[Peer]bool, len(choker.peers))
+	for connectedPeer := range choker.peers {
+		unchoked[connectedPeer] = false
+	}
+
+	for _, interestedPeer := range interested[:min(regularUploadSlots, len(interested))] {
+		unchoked[interestedPeer] = true
+	}
+
+	if rotateOptimistic || choker.optimisticUnchoke == nil {
+		choker.optimisticUnchoke = choker.pickOptimisticUnchoke(unchoked)
+	}
+
+	if choker.optimisticUnchoke != nil {
+		unchoked[choker.optimisticUnchoke] = true
+	}
+
+	return unchoked
+}
+
+func (choker *Choker) pickOptimisticUnchoke(unchoked map[Peer]bool) Peer {
+	candidates := make([]Peer, 0)
+	for connectedPeer, stats := range choker.peers {
+		if unchoked[connectedPeer] || !connectedPeer.IsInterested() {
+			continue
+		}
+
+		candidates = append(candidates, connectedPeer)
+
+		// Newly connected peers have nothing to reciprocate with, so they're given a better chance.
+		if time.Since(stats.connectedAt) < newPeerTimeout {
+			for range newPeerOptimisticWeight - 1 {
+				candidates = append(candidates, connectedPeer)
+			}
+		}
+	}
+
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	return candidates[rand.IntN(len(candidates))]
+}
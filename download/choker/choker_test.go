@@ -0,0 +1,161 @@
+package choker
+
+import (
+	"testing"
+	"time"
+)
+
+type fakePeer struct {
+	name       string
+	interested bool
+	downloaded uint64
+	uploaded   uint64
+	choking    bool
+}
+
+func (peer *fakePeer) IsInterested() bool         { return peer.interested }
+func (peer *fakePeer) GetDownloadedBytes() uint64 { return peer.downloaded }
+func (peer *fakePeer) GetUploadedBytes() uint64   { return peer.uploaded }
+
+func (peer *fakePeer) SetChoking(choking bool) error {
+	peer.choking = choking
+	return nil
+}
+
+func newTestChoker(seeding bool, peers []*fakePeer) *Choker {
+	choker := &Choker{
+		isSeeding: func() bool { return seeding },
+		peers:     make(map[Peer]*peerStats),
+	}
+
+	for _, peer := range peers {
+		choker.AddPeer(peer)
+		// Peers connected long ago have no advantage in the optimistic unchoke.
+		choker.peers[peer].connectedAt = time.Now().Add(-newPeerTimeout)
+	}
+
+	return choker
+}
+
+func TestRegularSlots(t *testing.T) {
+	tests := []struct {
+		name     string
+		seeding  bool
+		peers    []*fakePeer
+		unchoked []string
+	}{
+		{
+			name:    "leeching prefers peers we download from the fastest",
+			seeding: false,
+			peers: []*fakePeer{
+				{name: "a", interested: true, downloaded: 100, uploaded: 900},
+				{name: "b", interested: true, downloaded: 400, uploaded: 100},
+				{name: "c", interested: true, downloaded: 300, uploaded: 200},
+				{name: "d", interested: true, downloaded: 200, uploaded: 300},
+			},
+			unchoked: []string{"b", "c", "d"},
+		},
+		{
+			name:    "seeding prefers peers we upload to the fastest",
+			seeding: true,
+			peers: []*fakePeer{
+				{name: "a", interested: true, downloaded: 100, uploaded: 900},
+				{name: "b", interested: true, downloaded: 400, uploaded: 100},
+				{name: "c", interested: true, downloaded: 300, uploaded: 200},
+				{name: "d", interested: true, downloaded: 200, uploaded: 300},
+			},
+			unchoked: []string{"a", "c", "d"},
+		},
+		{
+			name:    "uninterested peers are not unchoked",
+			seeding: false,
+			peers: []*fakePeer{
+				{name: "a", interested: false, downloaded: 900},
+				{name: "b", interested: true, downloaded: 100},
+			},
+			unchoked: []string{"b"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			choker := newTestChoker(test.seeding, test.peers)
+
+			for _, peer := range test.peers {
+				peer.downloaded *= 2
+				peer.uploaded *= 2
+			}
+
+			// Optimistic unchoke is not rotated, so only the regular slots are checked.
+			choker.optimisticUnchoke = test.peers[0]
+			unchoked := choker.decide(false)
+			delete(unchoked, test.peers[0])
+
+			for _, peer := range test.peers[1:] {
+				expected := false
+				for _, name := range test.unchoked {
+					expected = expected || name == peer.name
+				}
+
+				if unchoked[peer] != expected {
+					t.Errorf("expected peer %s to be unchoked: %v", peer.name, expected)
+				}
+			}
+		})
+	}
+}
+
+func TestOptimisticUnchokeRotation(t *testing.T) {
+	peers := []*fakePeer{
+		{name: "a", interested: true, downloaded: 400},
+		{name: "b", interested: true, downloaded: 300},
+		{name: "c", interested: true, downloaded: 200},
+		{name: "d", interested: true, downloaded: 100},
+		{name: "e", interested: true, downloaded: 0},
+	}
+	choker := newTestChoker(false, peers)
+
+	for _, peer := range peers {
+		peer.downloaded *= 2
+	}
+
+	choker.rechoke(true)
+
+	optimistic := choker.optimisticUnchoke
+	if optimistic != peers[3] && optimistic != peers[4] {
+		t.Fatalf("optimistic unchoke is not picked from the choked interested peers: %v", optimistic)
+	}
+
+	for _, peer := range peers {
+		expectedChoking := peer != peers[0] && peer != peers[1] && peer != peers[2] && peer != optimistic
+		if peer.choking != expectedChoking {
+			t.Errorf("unexpected choke state of peer %s: %v", peer.name, peer.choking)
+		}
+	}
+
+	choker.rechoke(false)
+	if choker.optimisticUnchoke != optimistic {
+		t.Errorf("optimistic unchoke is changed before the rotation")
+	}
+
+	// The only remaining candidate is picked on rotation.
+	optimistic.(*fakePeer).interested = false
+	for _, peer := range peers[:3] {
+		peer.downloaded += 1000
+	}
+	choker.rechoke(true)
+
+	remaining := peers[3]
+	if optimistic == peers[3] {
+		remaining = peers[4]
+	}
+
+	if choker.optimisticUnchoke != remaining {
+		t.Errorf("expected peer %s to be unchoked optimistically, got %v", remaining.name, choker.optimisticUnchoke)
+	}
+
+	choker.RemovePeer(remaining)
+	if choker.optimisticUnchoke != nil {
+		t.Errorf("removed peer is still unchoked optimistically")
+	}
+}
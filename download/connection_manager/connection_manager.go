@@ -0,0 +1,339 @@
+package connection_manager
+
+import (
+	"cmp"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/mertwole/bittorrent-cli/download/tracker"
+)
+
+const initialBackoff = time.Second * 15
+const maxBackoff = time.Minute * 30
+
+// Candidate is forgotten after this many consecutive failed connection attempts.
+const maxFailures = 6
+
+// Connection counters shared by all the downloads of a session. Limits equal to 0 mean unlimited.
+type Pool struct {
+	maxConnections int
+	maxHalfOpen    int
+
+	connections int
+	halfOpen    int
+	mutex       sync.Mutex
+}
+
+func NewPool(maxConnections int, maxHalfOpen int) *Pool {
+	return &Pool{maxConnections: maxConnections, maxHalfOpen: maxHalfOpen}
+}
+
+func (pool *Pool) reserve(halfOpen bool) bool {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	if pool.maxConnections != 0 && pool.connections >= pool.maxConnections {
+		return false
+	}
+
+	if halfOpen {
+		if pool.maxHalfOpen != 0 && pool.halfOpen >= pool.maxHalfOpen {
+			return false
+		}
+
+		pool.halfOpen++
+	}
+
+	pool.connections++
+
+	return true
+}
+
+func (pool *Pool) finishHalfOpen() {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	pool.halfOpen--
+}
+
+func (pool *Pool) release() {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	pool.connections--
+}
+
+type candidateState uint8
+
+const (
+	idle candidateState = iota
+	connecting
+	connected
+)
+
+type candidate struct {
+	info  tracker.PeerInfo
+	state candidateState
+	// Incoming connections come from ephemeral ports, so they are not reconnected to.
+	incoming bool
+	// Forgotten candidates are removed once disconnected.
+	forgotten bool
+
+	failures    int
+	nextAttempt time.Time
+	priority    uint32
+}
+
+// Manager decides which peers of a download to connect to.
+// Peers are identified by IP and port, and connections to the same peer ID are deduplicated.
+type Manager struct {
+	pool *Pool
+	// Limit for this download, 0 means unlimited.
+	maxConnections int
+	localAddress   netip.AddrPort
+
+	candidates  map[netip.AddrPort]*candidate
+	connections int
+	mutex       sync.Mutex
+}
+
+func New(pool *Pool, maxConnections int, localAddress netip.AddrPort) *Manager {
+	return &Manager{
+		pool:           pool,
+		maxConnections: maxConnections,
+		localAddress:   localAddress,
+		candidates:     make(map[netip.AddrPort]*candidate),
+	}
+}
+
+func (manager *Manager) AddCandidate(info tracker.PeerInfo) {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	address, ok := endpoint(info)
+	if !ok {
+		return
+	}
+
+	existing, ok := manager.candidates[address]
+	if ok {
+		if existing.info.PeerID == nil {
+			existing.info.PeerID = info.PeerID
+		}
+
+		return
+	}
+
+	manager.candidates[address] = &candidate{
+		info:     info,
+		priority: canonicalPriority(manager.localAddress, address),
+	}
+}
+
+// Picks candidates to connect to in the order of canonical priority and reserves connection slots for them.
+// Every returned candidate should be reported back with Connected or Disconnected.
+func (manager *Manager) NextCandidates(now time.Time) []tracker.PeerInfo {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	ready := make([]*candidate, 0)
+	for _, candidate := range manager.candidates {
+		if candidate.state == idle && !candidate.incoming && !now.Before(candidate.nextAttempt) {
+			ready = append(ready, candidate)
+		}
+	}
+
+	slices.SortFunc(ready, func(a, b *candidate) int {
+		return cmp.Compare(b.priority, a.priority)
+	})
+
+	picked := make([]tracker.PeerInfo, 0)
+	for _, candidate := range ready {
+		if !manager.hasFreeSlotLocked() || !manager.pool.reserve(true) {
+			break
+		}
+
+		candidate.state = connecting
+		manager.connections++
+		picked = append(picked, candidate.info)
+	}
+
+	return picked
+}
+
+// Called when the outgoing connection is established and handshaked.
+// Returns false if the peer is already connected under a different address.
+func (manager *Manager) Connected(info tracker.PeerInfo) bool {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	address, _ := endpoint(info)
+	candidate, ok := manager.candidates[address]
+	if !ok || candidate.state != connecting {
+		return false
+	}
+
+	manager.pool.finishHalfOpen()
+
+	if manager.isConnectedToLocked(info.PeerID) {
+		candidate.state = idle
+		candidate.nextAttempt = time.Now().Add(maxBackoff)
+		manager.releaseLocked()
+
+		return false
+	}
+
+	candidate.info.PeerID = info.PeerID
+	candidate.state = connected
+
+	return true
+}
+
+// Registers the incoming connection if the limits allow it and the peer isn't connected yet.
+func (manager *Manager) Accept(info tracker.PeerInfo) bool {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	address, ok := endpoint(info)
+	if !ok {
+		return false
+	}
+
+	if existing, ok := manager.candidates[address]; ok && existing.state != idle {
+		return false
+	}
+
+	if manager.isConnectedToLocked(info.PeerID) {
+		return false
+	}
+
+	if !manager.hasFreeSlotLocked() || !manager.pool.reserve(false) {
+		return false
+	}
+
+	manager.connections++
+
+	existing, ok := manager.candidates[address]
+	if !ok {
+		existing = &candidate{incoming: true, priority: canonicalPriority(manager.localAddress, address)}
+		manager.candidates[address] = existing
+	}
+	existing.info = info
+	existing.state = connected
+
+	return true
+}
+
+// Releases the slot of the connection. Failed attempts are retried with exponential backoff,
+// while the peers that disconnected after a successful handshake are retried after the initial delay.
+func (manager *Manager) Disconnected(info tracker.PeerInfo, failed bool) {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	address, _ := endpoint(info)
+	candidate, ok := manager.candidates[address]
+	if !ok || candidate.state == idle {
+		return
+	}
+
+	if candidate.state == connecting {
+		manager.pool.finishHalfOpen()
+	}
+
+	candidate.state = idle
+	manager.releaseLocked()
+
+	if candidate.incoming || candidate.forgotten {
+		delete(manager.candidates, address)
+		return
+	}
+
+	if !failed {
+		candidate.failures = 0
+		candidate.nextAttempt = time.Now().Add(initialBackoff)
+		return
+	}
+
+	candidate.failures++
+	if candidate.failures >= maxFailures {
+		delete(manager.candidates, address)
+		return
+	}
+
+	backoff := min(initialBackoff<<(candidate.failures-1), maxBackoff)
+	candidate.nextAttempt = time.Now().Add(backoff)
+}
+
+// Removes all the candidates with the address, e.g. when it's banned. Connected ones are removed on disconnect.
+func (manager *Manager) Forget(address netip.Addr) {
+	manager.ForgetMatching(func(candidate netip.Addr) bool { return candidate == address.Unmap() })
+}
+
+// Removes all the candidates which addresses match, e.g. when they're blocked by the reloaded IP filter.
+func (manager *Manager) ForgetMatching(match func(netip.Addr) bool) {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	for endpoint, candidate := range manager.candidates {
+		if !match(endpoint.Addr()) {
+			continue
+		}
+
+		if candidate.state == idle {
+			delete(manager.candidates, endpoint)
+		} else {
+			candidate.forgotten = true
+		}
+	}
+}
+
+// Makes all the known candidates available for connection immediately, e.g. when the download is resumed.
+func (manager *Manager) ResetBackoff() {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	for _, candidate := range manager.candidates {
+		candidate.nextAttempt = time.Time{}
+	}
+}
+
+func (manager *Manager) ConnectionCount() int {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	return manager.connections
+}
+
+func (manager *Manager) hasFreeSlotLocked() bool {
+	return manager.maxConnections == 0 || manager.connections < manager.maxConnections
+}
+
+func (manager *Manager) releaseLocked() {
+	manager.connections--
+	manager.pool.release()
+}
+
+func (manager *Manager) isConnectedToLocked(peerID *[20]byte) bool {
+	if peerID == nil {
+		return false
+	}
+
+	for _, candidate := range manager.candidates {
+		if candidate.state == connected && candidate.info.PeerID != nil && *candidate.info.PeerID == *peerID {
+			return true
+		}
+	}
+
+	return false
+}
+
+func endpoint(info tracker.PeerInfo) (netip.AddrPort, bool) {
+	addr, ok := netip.AddrFromSlice(info.IP)
+	if !ok {
+		return netip.AddrPort{}, false
+	}
+
+	return netip.AddrPortFrom(addr.Unmap(), info.Port), true
+}
@@ -0,0 +1,195 @@
+package connection_manager
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/mertwole/bittorrent-cli/download/tracker"
+)
+
+func TestCanonicalPriority(t *testing.T) {
+	tests := []struct {
+		local    string
+		remote   string
+		priority uint32
+	}{
+		{local: "123.213.32.10:0", remote: "98.76.54.32:0", priority: 0xec2d7224},
+		{local: "123.213.32.10:0", remote: "123.213.32.234:0", priority: 0x99568189},
+	}
+
+	for _, test := range tests {
+		local, remote := netip.MustParseAddrPort(test.local), netip.MustParseAddrPort(test.remote)
+
+		priority := canonicalPriority(local, remote)
+		if priority != test.priority {
+			t.Errorf("unexpected priority of %s and %s: expected %08x, got %08x", local, remote, test.priority, priority)
+		}
+
+		if canonicalPriority(remote, local) != priority {
+			t.Errorf("priority of %s and %s is not symmetric", local, remote)
+		}
+	}
+
+	samePort := canonicalPriority(
+		netip.MustParseAddrPort("10.0.0.1:6881"),
+		netip.MustParseAddrPort("10.0.0.1:6882"),
+	)
+	if samePort == 0 {
+		t.Errorf("priority of the peers with the same IP is not computed from the ports")
+	}
+}
+
+func TestNextCandidatesRespectsLimits(t *testing.T) {
+	pool := NewPool(3, 2)
+	first := New(pool, 2, netip.MustParseAddrPort("10.0.0.1:6881"))
+	second := New(pool, 0, netip.MustParseAddrPort("10.0.0.1:6881"))
+
+	for i := range 5 {
+		first.AddCandidate(peerInfo("1.1.1.1", uint16(1000+i), nil))
+		second.AddCandidate(peerInfo("2.2.2.2", uint16(1000+i), nil))
+	}
+
+	now := time.Now()
+
+	picked := first.NextCandidates(now)
+	if len(picked) != 2 {
+		t.Fatalf("expected 2 candidates limited by the download, got %d", len(picked))
+	}
+
+	if len(second.NextCandidates(now)) != 0 {
+		t.Errorf("half-open limit of the pool is exceeded")
+	}
+
+	for _, info := range picked {
+		if !first.Connected(info) {
+			t.Errorf("failed to register connection")
+		}
+	}
+
+	if len(second.NextCandidates(now)) != 1 {
+		t.Errorf("expected 1 candidate limited by the pool connection limit")
+	}
+
+	if first.Accept(peerInfo("3.3.3.3", 5000, nil)) {
+		t.Errorf("incoming connection is accepted over the limit")
+	}
+
+	first.Disconnected(picked[0], false)
+
+	if !first.Accept(peerInfo("3.3.3.3", 5000, nil)) {
+		t.Errorf("incoming connection is rejected while there are free slots")
+	}
+}
+
+func TestNextCandidatesOrderedByPriority(t *testing.T) {
+	local := netip.MustParseAddrPort("10.0.0.1:6881")
+	manager := New(NewPool(0, 1), 0, local)
+
+	addresses := []string{"1.2.3.4", "5.6.7.8", "9.10.11.12", "13.14.15.16"}
+	best := ""
+	bestPriority := uint32(0)
+	for _, address := range addresses {
+		manager.AddCandidate(peerInfo(address, 6881, nil))
+
+		priority := canonicalPriority(local, netip.MustParseAddrPort(address+":6881"))
+		if priority >= bestPriority {
+			best, bestPriority = address, priority
+		}
+	}
+
+	picked := manager.NextCandidates(time.Now())
+	if len(picked) != 1 || picked[0].IP.String() != best {
+		t.Errorf("expected the candidate with the highest priority %s to be picked, got %+v", best, picked)
+	}
+}
+
+func TestBackoffAndFailures(t *testing.T) {
+	manager := New(NewPool(0, 0), 0, netip.MustParseAddrPort("10.0.0.1:6881"))
+	info := peerInfo("1.1.1.1", 6881, nil)
+	manager.AddCandidate(info)
+
+	afterBackoff := time.Now()
+	for failure := range maxFailures {
+		picked := manager.NextCandidates(afterBackoff)
+		if len(picked) != 1 {
+			t.Fatalf("candidate is not picked after %d failures", failure)
+		}
+
+		manager.Disconnected(info, true)
+
+		if len(manager.NextCandidates(time.Now())) != 0 {
+			t.Fatalf("candidate is picked again before the backoff expires")
+		}
+
+		afterBackoff = time.Now().Add(maxBackoff)
+	}
+
+	if len(manager.NextCandidates(afterBackoff)) != 0 {
+		t.Errorf("candidate is not forgotten after %d failures", maxFailures)
+	}
+
+	if manager.ConnectionCount() != 0 {
+		t.Errorf("connection slots are not released")
+	}
+}
+
+func TestDeduplication(t *testing.T) {
+	manager := New(NewPool(0, 0), 0, netip.MustParseAddrPort("10.0.0.1:6881"))
+	peerID := [20]byte{1}
+
+	// Peers behind the same NAT share IP, but are different peers.
+	manager.AddCandidate(peerInfo("1.1.1.1", 6881, nil))
+	manager.AddCandidate(peerInfo("1.1.1.1", 6882, nil))
+	manager.AddCandidate(peerInfo("1.1.1.1", 6881, nil))
+
+	picked := manager.NextCandidates(time.Now())
+	if len(picked) != 2 {
+		t.Fatalf("expected 2 candidates, got %d", len(picked))
+	}
+
+	picked[0].PeerID = &peerID
+	picked[1].PeerID = &peerID
+
+	if !manager.Connected(picked[0]) {
+		t.Errorf("failed to register connection")
+	}
+
+	if manager.Connected(picked[1]) {
+		t.Errorf("connection to the same peer ID is registered twice")
+	}
+
+	if manager.Accept(peerInfo("4.4.4.4", 5000, &peerID)) {
+		t.Errorf("incoming connection from the same peer ID is accepted")
+	}
+
+	if manager.ConnectionCount() != 1 {
+		t.Errorf("expected 1 connection, got %d", manager.ConnectionCount())
+	}
+}
+
+func TestForget(t *testing.T) {
+	manager := New(NewPool(0, 0), 0, netip.MustParseAddrPort("10.0.0.1:6881"))
+
+	connected := peerInfo("1.1.1.1", 6881, nil)
+	manager.AddCandidate(connected)
+
+	picked := manager.NextCandidates(time.Now())
+	if len(picked) != 1 || !manager.Connected(picked[0]) {
+		t.Fatalf("failed to connect to the candidate")
+	}
+
+	manager.AddCandidate(peerInfo("1.1.1.1", 6882, nil))
+	manager.Forget(netip.MustParseAddr("1.1.1.1"))
+	manager.Disconnected(connected, false)
+
+	manager.ResetBackoff()
+	if picked := manager.NextCandidates(time.Now()); len(picked) != 0 {
+		t.Errorf("forgotten candidates are picked: %+v", picked)
+	}
+}
+
+func peerInfo(ip string, port uint16, peerID *[20]byte) tracker.PeerInfo {
+	return tracker.PeerInfo{IP: net.ParseIP(ip), Port: port, PeerID: peerID}
+}
@@ -0,0 +1,73 @@
+package connection_manager
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"net/netip"
+	"slices"
+)
+
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+// BEP 40 canonical peer priority. Both sides compute the same value, so they prefer the same connections,
+// while masking the low bits makes it hard to pick an address with high priority.
+func canonicalPriority(local netip.AddrPort, remote netip.AddrPort) uint32 {
+	localAddr, remoteAddr := local.Addr().Unmap(), remote.Addr().Unmap()
+
+	if localAddr == remoteAddr {
+		ports := [][]byte{
+			binary.BigEndian.AppendUint16(nil, local.Port()),
+			binary.BigEndian.AppendUint16(nil, remote.Port()),
+		}
+		slices.SortFunc(ports, bytes.Compare)
+
+		return crc32.Checksum(slices.Concat(ports...), castagnoliTable)
+	}
+
+	localBytes, remoteBytes := localAddr.AsSlice(), remoteAddr.AsSlice()
+	if len(localBytes) != len(remoteBytes) {
+		// Addresses of different families are never compared by the peers.
+		return 0
+	}
+
+	mask := priorityMask(localBytes, remoteBytes)
+	for i := range mask {
+		localBytes[i] &= mask[i]
+		remoteBytes[i] &= mask[i]
+	}
+
+	addresses := [][]byte{localBytes, remoteBytes}
+	slices.SortFunc(addresses, bytes.Compare)
+
+	return crc32.Checksum(slices.Concat(addresses...), castagnoliTable)
+}
+
+// IPv4: FF.FF.55.55, FF.FF.FF.55 for the same /16 and FF.FF.FF.FF for the same /24.
+// IPv6: the unmasked prefix is /48 and grows by a byte for each additional matching byte up to /64.
+func priorityMask(local []byte, remote []byte) []byte {
+	unmasked, maxUnmasked := 2, 4
+	if len(local) == netip.IPv6Unspecified().BitLen()/8 {
+		unmasked, maxUnmasked = 6, 8
+	}
+
+	commonPrefix := 0
+	for commonPrefix < len(local) && local[commonPrefix] == remote[commonPrefix] {
+		commonPrefix++
+	}
+
+	if commonPrefix >= unmasked {
+		unmasked = min(commonPrefix+1, maxUnmasked)
+	}
+
+	mask := make([]byte, len(local))
+	for i := range mask {
+		if i < unmasked {
+			mask[i] = 0xFF
+		} else {
+			mask[i] = 0x55
+		}
+	}
+
+	return mask
+}
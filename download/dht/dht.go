@@ -0,0 +1,659 @@
+package dht
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/netip"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mertwole/bittorrent-cli/download/dht/krpc"
+	"github.com/mertwole/bittorrent-cli/download/dht/routing_table"
+	"github.com/mertwole/bittorrent-cli/download/tracker"
+)
+
+const queryTimeout = time.Second * 5
+const lookupConcurrency = 3
+const readBufferSize = 2048
+const tokenSecretLength = 16
+const tokenSecretRotationInterval = time.Minute * 5
+const announcedPeerTimeout = time.Minute * 30
+const maxPeersInResponse = 50
+const getPeersInterval = time.Minute * 5
+const refreshInterval = time.Minute * 15
+const bootstrapRetryInterval = time.Second * 30
+
+func DefaultBootstrapNodes() []string {
+	return []string{
+		"router.bittorrent.com:6881",
+		"router.utorrent.com:6881",
+		"dht.transmissionbt.com:6881",
+	}
+}
+
+// Lets DHT share the UDP port with other protocols, e.g. uTP.
+type PacketConn interface {
+	ReadFromUDPAddrPort(buffer []byte) (int, netip.AddrPort, error)
+	WriteToUDPAddrPort(data []byte, address netip.AddrPort) (int, error)
+	LocalAddr() net.Addr
+	Close() error
+}
+
+type DHT struct {
+	id             routing_table.NodeID
+	connection     PacketConn
+	routingTable   *routing_table.RoutingTable
+	bootstrapNodes []string
+
+	transactions      map[string]chan *krpc.Message
+	transactionsMutex sync.Mutex
+	nextTransactionID atomic.Uint32
+
+	tokenSecrets      [2][tokenSecretLength]byte
+	tokenSecretsMutex sync.RWMutex
+
+	announcedPeers      map[[sha1.Size]byte]map[netip.AddrPort]time.Time
+	announcedPeersMutex sync.Mutex
+}
+
+type lookupResult struct {
+	node  routing_table.Node
+	token *string
+}
+
+func New(port uint16, bootstrapNodes []string) (*DHT, error) {
+	connection, err := net.ListenUDP("udp4", &net.UDPAddr{Port: int(port)})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create UDP listener for DHT: %w", err)
+	}
+
+	return NewWithConn(connection, bootstrapNodes), nil
+}
+
+func NewWithConn(connection PacketConn, bootstrapNodes []string) *DHT {
+	id := routing_table.RandomNodeID()
+
+	dht := DHT{
+		id:             id,
+		connection:     connection,
+		routingTable:   routing_table.New(id),
+		bootstrapNodes: bootstrapNodes,
+		transactions:   make(map[string]chan *krpc.Message),
+		announcedPeers: make(map[[sha1.Size]byte]map[netip.AddrPort]time.Time),
+	}
+	rand.Read(dht.tokenSecrets[0][:])
+	dht.tokenSecrets[1] = dht.tokenSecrets[0]
+
+	return &dht
+}
+
+func (dht *DHT) Port() uint16 {
+	return uint16(dht.connection.LocalAddr().(*net.UDPAddr).Port)
+}
+
+func (dht *DHT) NodeCount() int {
+	return dht.routingTable.Length()
+}
+
+func (dht *DHT) Serve(ctx context.Context) {
+	go func() {
+		<-ctx.Done()
+		dht.connection.Close()
+	}()
+
+	go dht.rotateTokenSecrets(ctx)
+	go dht.refreshRoutingTable(ctx)
+
+	buffer := make([]byte, readBufferSize)
+	for {
+		length, source, err := dht.connection.ReadFromUDPAddrPort(buffer)
+		if err != nil {
+			select {
+			case <-ctx.Done():
+				return
+			default:
+			}
+
+			log.Printf("failed to read DHT message: %v", err)
+			continue
+		}
+
+		// Only IPv4 nodes are supported, while the shared connection may receive IPv6 datagrams.
+		source = netip.AddrPortFrom(source.Addr().Unmap(), source.Port())
+		if !source.Addr().Is4() {
+			continue
+		}
+
+		message, err := krpc.Decode(buffer[:length])
+		if err != nil {
+			log.Printf("failed to decode DHT message from %s: %v", source.String(), err)
+			continue
+		}
+
+		switch message.Type {
+		case krpc.QueryType:
+			dht.handleQuery(message, source)
+		case krpc.ResponseType, krpc.ErrorType:
+			dht.transactionsMutex.Lock()
+			responseChannel, ok := dht.transactions[message.TransactionID]
+			delete(dht.transactions, message.TransactionID)
+			dht.transactionsMutex.Unlock()
+
+			if ok {
+				responseChannel <- message
+			}
+		}
+	}
+}
+
+func (dht *DHT) Bootstrap(ctx context.Context) error {
+	var wg sync.WaitGroup
+	for _, bootstrapNode := range dht.bootstrapNodes {
+		address, err := net.ResolveUDPAddr("udp4", bootstrapNode)
+		if err != nil {
+			log.Printf("failed to resolve DHT bootstrap node %s: %v", bootstrapNode, err)
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			target := string(dht.id[:])
+			addressPort := address.AddrPort()
+			_, err := dht.query(
+				ctx,
+				netip.AddrPortFrom(addressPort.Addr().Unmap(), addressPort.Port()),
+				krpc.FindNodeQuery,
+				krpc.Arguments{Target: &target},
+			)
+			if err != nil {
+				log.Printf("failed to query DHT bootstrap node %s: %v", bootstrapNode, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	dht.lookup(ctx, dht.id, false)
+
+	if dht.routingTable.Length() == 0 {
+		return fmt.Errorf("no DHT nodes discovered during bootstrap")
+	}
+
+	return nil
+}
+
+func (dht *DHT) ListenForPeers(
+	ctx context.Context,
+	infoHash [sha1.Size]byte,
+	listeningPort uint16,
+	peers chan<- tracker.PeerInfo,
+) {
+	for dht.routingTable.Length() == 0 {
+		err := dht.Bootstrap(ctx)
+		if err == nil {
+			break
+		}
+
+		log.Printf("failed to bootstrap DHT: %v", err)
+
+		select {
+		case <-time.After(bootstrapRetryInterval):
+		case <-ctx.Done():
+			return
+		}
+	}
+
+	for {
+		discoveredPeers, err := dht.Announce(ctx, infoHash, listeningPort)
+		if err != nil {
+			log.Printf("failed to announce to the DHT: %v", err)
+		}
+
+		log.Printf("Discovered %d peers in DHT", len(discoveredPeers))
+
+		for _, peer := range discoveredPeers {
+			select {
+			case peers <- peer:
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		select {
+		case <-time.After(getPeersInterval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (dht *DHT) GetPeers(ctx context.Context, infoHash [sha1.Size]byte) []tracker.PeerInfo {
+	peers, _ := dht.lookup(ctx, routing_table.NodeID(infoHash), true)
+	return peers
+}
+
+func (dht *DHT) Announce(
+	ctx context.Context,
+	infoHash [sha1.Size]byte,
+	listeningPort uint16,
+) ([]tracker.PeerInfo, error) {
+	peers, closest := dht.lookup(ctx, routing_table.NodeID(infoHash), true)
+
+	infoHashString := string(infoHash[:])
+	port := int(listeningPort)
+
+	announcedCount := 0
+	for _, result := range closest {
+		if result.token == nil {
+			continue
+		}
+
+		_, err := dht.query(ctx, result.node.Address, krpc.AnnouncePeerQuery, krpc.Arguments{
+			InfoHash: &infoHashString,
+			Port:     &port,
+			Token:    result.token,
+		})
+		if err != nil {
+			log.Printf("failed to announce to the DHT node %s: %v", result.node.Address.String(), err)
+			continue
+		}
+
+		announcedCount++
+	}
+
+	if announcedCount == 0 {
+		return peers, fmt.Errorf("no DHT node accepted the announce")
+	}
+
+	return peers, nil
+}
+
+func (dht *DHT) lookup(
+	ctx context.Context,
+	target routing_table.NodeID,
+	getPeers bool,
+) ([]tracker.PeerInfo, []lookupResult) {
+	type candidate struct {
+		node    routing_table.Node
+		queried bool
+		result  *lookupResult
+	}
+
+	candidates := make([]*candidate, 0)
+	knownNodes := make(map[routing_table.NodeID]bool)
+	addCandidate := func(node routing_table.Node) {
+		if knownNodes[node.ID] || node.ID == dht.id {
+			return
+		}
+
+		knownNodes[node.ID] = true
+		candidates = append(candidates, &candidate{node: node})
+	}
+
+	for _, node := range dht.routingTable.Closest(target, routing_table.BucketSize) {
+		addCandidate(node)
+	}
+
+	peers := make([]tracker.PeerInfo, 0)
+	knownPeers := make(map[string]bool)
+
+	queryName := krpc.FindNodeQuery
+	targetString := string(target[:])
+	arguments := krpc.Arguments{Target: &targetString}
+	if getPeers {
+		queryName = krpc.GetPeersQuery
+		arguments = krpc.Arguments{InfoHash: &targetString}
+	}
+
+	for {
+		slices.SortFunc(candidates, func(a, b *candidate) int {
+			return a.node.ID.Distance(target).Compare(b.node.ID.Distance(target))
+		})
+
+		toQuery := make([]*candidate, 0)
+		closestCount := 0
+		for _, candidate := range candidates {
+			if closestCount == routing_table.BucketSize || len(toQuery) == lookupConcurrency {
+				break
+			}
+
+			if candidate.queried && candidate.result == nil {
+				// Failed to respond.
+				continue
+			}
+
+			closestCount++
+
+			if !candidate.queried {
+				toQuery = append(toQuery, candidate)
+			}
+		}
+
+		if len(toQuery) == 0 {
+			break
+		}
+
+		responses := make([]*krpc.Response, len(toQuery))
+		var wg sync.WaitGroup
+		for i, candidate := range toQuery {
+			candidate.queried = true
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				response, err := dht.query(ctx, candidate.node.Address, queryName, arguments)
+				if err == nil {
+					responses[i] = response
+				}
+			}()
+		}
+		wg.Wait()
+
+		select {
+		case <-ctx.Done():
+			return peers, nil
+		default:
+		}
+
+		for i, response := range responses {
+			if response == nil {
+				continue
+			}
+
+			toQuery[i].result = &lookupResult{node: toQuery[i].node, token: response.Token}
+
+			if response.Nodes != nil {
+				nodes, err := krpc.DecodeNodes(*response.Nodes)
+				if err != nil {
+					log.Printf("failed to decode nodes from DHT response: %v", err)
+				}
+
+				for _, node := range nodes {
+					addCandidate(node)
+				}
+			}
+
+			if response.Values != nil {
+				for _, value := range *response.Values {
+					decoded, err := tracker.DecodeCompactPeerInfo([]byte(value))
+					if err != nil {
+						log.Printf("failed to decode peer from DHT response: %v", err)
+						continue
+					}
+
+					for _, peer := range decoded {
+						key := string(peer.EncodeCompact())
+						if !knownPeers[key] {
+							knownPeers[key] = true
+							peers = append(peers, peer)
+						}
+					}
+				}
+			}
+		}
+	}
+
+	results := make([]lookupResult, 0)
+	for _, candidate := range candidates {
+		if candidate.result != nil {
+			results = append(results, *candidate.result)
+		}
+
+		if len(results) == routing_table.BucketSize {
+			break
+		}
+	}
+
+	return peers, results
+}
+
+func (dht *DHT) query(
+	ctx context.Context,
+	address netip.AddrPort,
+	queryName string,
+	arguments krpc.Arguments,
+) (*krpc.Response, error) {
+	var transactionIDBytes [2]byte
+	binary.BigEndian.PutUint16(transactionIDBytes[:], uint16(dht.nextTransactionID.Add(1)))
+	transactionID := string(transactionIDBytes[:])
+
+	arguments.ID = string(dht.id[:])
+	encoded, err := krpc.NewQuery(transactionID, queryName, arguments).Encode()
+	if err != nil {
+		return nil, err
+	}
+
+	responseChannel := make(chan *krpc.Message, 1)
+
+	dht.transactionsMutex.Lock()
+	dht.transactions[transactionID] = responseChannel
+	dht.transactionsMutex.Unlock()
+
+	defer func() {
+		dht.transactionsMutex.Lock()
+		delete(dht.transactions, transactionID)
+		dht.transactionsMutex.Unlock()
+	}()
+
+	_, err = dht.connection.WriteToUDPAddrPort(encoded, address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send %s query: %w", queryName, err)
+	}
+
+	select {
+	case response := <-responseChannel:
+		if response.Type == krpc.ErrorType {
+			return nil, fmt.Errorf("node %s responded with error to %s query", address.String(), queryName)
+		}
+
+		nodeID, err := krpc.ParseNodeID(response.Response.ID)
+		if err != nil {
+			return nil, fmt.Errorf("invalid response from node %s: %w", address.String(), err)
+		}
+
+		dht.routingTable.Insert(nodeID, address)
+
+		return response.Response, nil
+	case <-time.After(queryTimeout):
+		dht.routingTable.MarkFailed(address)
+
+		return nil, fmt.Errorf("%s query to node %s timed out", queryName, address.String())
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (dht *DHT) handleQuery(message *krpc.Message, source netip.AddrPort) {
+	nodeID, err := krpc.ParseNodeID(message.Arguments.ID)
+	if err != nil {
+		dht.sendError(message.TransactionID, krpc.ProtocolError, "invalid node id", source)
+		return
+	}
+
+	response := krpc.Response{ID: string(dht.id[:])}
+
+	switch *message.Query {
+	case krpc.PingQuery:
+	case krpc.FindNodeQuery:
+		if message.Arguments.Target == nil {
+			dht.sendError(message.TransactionID, krpc.ProtocolError, "missing target", source)
+			return
+		}
+
+		target, err := krpc.ParseNodeID(*message.Arguments.Target)
+		if err != nil {
+			dht.sendError(message.TransactionID, krpc.ProtocolError, "invalid target", source)
+			return
+		}
+
+		nodes := krpc.EncodeNodes(dht.routingTable.Closest(target, routing_table.BucketSize))
+		response.Nodes = &nodes
+	case krpc.GetPeersQuery:
+		if message.Arguments.InfoHash == nil {
+			dht.sendError(message.TransactionID, krpc.ProtocolError, "missing info_hash", source)
+			return
+		}
+
+		infoHash, err := krpc.ParseNodeID(*message.Arguments.InfoHash)
+		if err != nil {
+			dht.sendError(message.TransactionID, krpc.ProtocolError, "invalid info_hash", source)
+			return
+		}
+
+		token := dht.generateToken(source.Addr(), 0)
+		response.Token = &token
+
+		values := dht.getAnnouncedPeers(infoHash)
+		if len(values) != 0 {
+			response.Values = &values
+		} else {
+			nodes := krpc.EncodeNodes(dht.routingTable.Closest(infoHash, routing_table.BucketSize))
+			response.Nodes = &nodes
+		}
+	case krpc.AnnouncePeerQuery:
+		arguments := message.Arguments
+		if arguments.InfoHash == nil || arguments.Token == nil || arguments.Port == nil {
+			dht.sendError(message.TransactionID, krpc.ProtocolError, "missing arguments", source)
+			return
+		}
+
+		infoHash, err := krpc.ParseNodeID(*arguments.InfoHash)
+		if err != nil {
+			dht.sendError(message.TransactionID, krpc.ProtocolError, "invalid info_hash", source)
+			return
+		}
+
+		if !dht.validateToken(*arguments.Token, source.Addr()) {
+			dht.sendError(message.TransactionID, krpc.ProtocolError, "bad token", source)
+			return
+		}
+
+		port := source.Port()
+		if arguments.ImpliedPort == nil || *arguments.ImpliedPort == 0 {
+			if *arguments.Port < 1 || *arguments.Port > math.MaxUint16 {
+				dht.sendError(message.TransactionID, krpc.ProtocolError, "invalid port", source)
+				return
+			}
+
+			port = uint16(*arguments.Port)
+		}
+
+		dht.addAnnouncedPeer(infoHash, netip.AddrPortFrom(source.Addr(), port))
+	default:
+		dht.sendError(message.TransactionID, krpc.UnknownMethod, "method unknown", source)
+		return
+	}
+
+	dht.routingTable.Insert(nodeID, source)
+
+	encoded, err := krpc.NewResponse(message.TransactionID, response).Encode()
+	if err != nil {
+		log.Printf("failed to encode DHT response: %v", err)
+		return
+	}
+
+	_, err = dht.connection.WriteToUDPAddrPort(encoded, source)
+	if err != nil {
+		log.Printf("failed to send DHT response to %s: %v", source.String(), err)
+	}
+}
+
+func (dht *DHT) sendError(transactionID string, code int, description string, destination netip.AddrPort) {
+	encoded, err := krpc.EncodeError(transactionID, code, description)
+	if err != nil {
+		log.Printf("failed to encode DHT error: %v", err)
+		return
+	}
+
+	_, err = dht.connection.WriteToUDPAddrPort(encoded, destination)
+	if err != nil {
+		log.Printf("failed to send DHT error to %s: %v", destination.String(), err)
+	}
+}
+
+func (dht *DHT) generateToken(address netip.Addr, secretIdx int) string {
+	dht.tokenSecretsMutex.RLock()
+	secret := dht.tokenSecrets[secretIdx]
+	dht.tokenSecretsMutex.RUnlock()
+
+	addressBytes := address.Unmap().AsSlice()
+	token := sha1.Sum(append(secret[:], addressBytes...))
+
+	return string(token[:])
+}
+
+func (dht *DHT) validateToken(token string, address netip.Addr) bool {
+	return token == dht.generateToken(address, 0) || token == dht.generateToken(address, 1)
+}
+
+func (dht *DHT) rotateTokenSecrets(ctx context.Context) {
+	for {
+		select {
+		case <-time.After(tokenSecretRotationInterval):
+		case <-ctx.Done():
+			return
+		}
+
+		dht.tokenSecretsMutex.Lock()
+		dht.tokenSecrets[1] = dht.tokenSecrets[0]
+		rand.Read(dht.tokenSecrets[0][:])
+		dht.tokenSecretsMutex.Unlock()
+	}
+}
+
+func (dht *DHT) refreshRoutingTable(ctx context.Context) {
+	for {
+		select {
+		case <-time.After(refreshInterval):
+		case <-ctx.Done():
+			return
+		}
+
+		dht.lookup(ctx, routing_table.RandomNodeID(), false)
+	}
+}
+
+func (dht *DHT) addAnnouncedPeer(infoHash routing_table.NodeID, address netip.AddrPort) {
+	dht.announcedPeersMutex.Lock()
+	defer dht.announcedPeersMutex.Unlock()
+
+	peers, ok := dht.announcedPeers[infoHash]
+	if !ok {
+		peers = make(map[netip.AddrPort]time.Time)
+		dht.announcedPeers[infoHash] = peers
+	}
+
+	peers[address] = time.Now().Add(announcedPeerTimeout)
+}
+
+func (dht *DHT) getAnnouncedPeers(infoHash routing_table.NodeID) []string {
+	dht.announcedPeersMutex.Lock()
+	defer dht.announcedPeersMutex.Unlock()
+
+	values := make([]string, 0)
+	for address, validUntil := range dht.announcedPeers[infoHash] {
+		if validUntil.Before(time.Now()) {
+			delete(dht.announcedPeers[infoHash], address)
+			continue
+		}
+
+		if len(values) == maxPeersInResponse {
+			continue
+		}
+
+		peer := tracker.PeerInfo{IP: address.Addr().Unmap().AsSlice(), Port: address.Port()}
+		values = append(values, string(peer.EncodeCompact()))
+	}
+
+	return values
+}
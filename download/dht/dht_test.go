@@ -0,0 +1,140 @@
+package dht
+
+import (
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"net/netip"
+	"testing"
+
+	"github.com/mertwole/bittorrent-cli/download/dht/krpc"
+	"github.com/mertwole/bittorrent-cli/download/dht/routing_table"
+)
+
+const swarmSize = 16
+
+func TestSwarmAnnounceAndGetPeers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	nodes := createSwarm(ctx, swarmSize, t)
+
+	infoHash := sha1.Sum([]byte("test torrent"))
+	var announcedPort uint16 = 51413
+
+	_, err := nodes[1].Announce(ctx, infoHash, announcedPort)
+	if err != nil {
+		t.Fatalf("failed to announce: %v", err)
+	}
+
+	peers := nodes[swarmSize-1].GetPeers(ctx, infoHash)
+	found := false
+	for _, peer := range peers {
+		if peer.IP.IsLoopback() && peer.Port == announcedPort {
+			found = true
+		}
+	}
+
+	if !found {
+		t.Errorf("announced peer is not found, got peers %v", peers)
+	}
+}
+
+func TestSwarmBootstrap(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	nodes := createSwarm(ctx, swarmSize, t)
+
+	for i, node := range nodes {
+		if node.NodeCount() == 0 {
+			t.Errorf("node #%d has empty routing table after bootstrap", i)
+		}
+	}
+}
+
+func createSwarm(ctx context.Context, size int, t *testing.T) []*DHT {
+	nodes := make([]*DHT, 0)
+
+	for i := range size {
+		bootstrapNodes := make([]string, 0)
+		if i != 0 {
+			bootstrapNodes = append(bootstrapNodes, fmt.Sprintf("127.0.0.1:%d", nodes[0].Port()))
+		}
+
+		node, err := New(0, bootstrapNodes)
+		if err != nil {
+			t.Fatalf("failed to create DHT node: %v", err)
+		}
+		go node.Serve(ctx)
+
+		if i != 0 {
+			err = node.Bootstrap(ctx)
+			if err != nil {
+				t.Fatalf("failed to bootstrap DHT node #%d: %v", i, err)
+			}
+		}
+
+		nodes = append(nodes, node)
+	}
+
+	return nodes
+}
+
+func TestAnnouncePeerPortValidation(t *testing.T) {
+	node, err := New(0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer node.connection.Close()
+
+	source := netip.MustParseAddrPort("127.0.0.1:6881")
+	zero, one := 0, 1
+
+	tests := []struct {
+		name        string
+		port        int
+		impliedPort *int
+		announced   netip.AddrPort
+	}{
+		{name: "valid port", port: 51413, announced: netip.MustParseAddrPort("127.0.0.1:51413")},
+		{name: "zero port", port: 0},
+		{name: "negative port", port: -1},
+		{name: "too large port", port: 70000},
+		{name: "explicit zero implied port", port: 70000, impliedPort: &zero},
+		{name: "implied port", port: 70000, impliedPort: &one, announced: source},
+	}
+
+	for i, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			infoHash := sha1.Sum([]byte(test.name))
+			infoHashString := string(infoHash[:])
+			token := node.generateToken(source.Addr(), 0)
+			id := routing_table.RandomNodeID()
+
+			query := krpc.NewQuery(fmt.Sprint(i), krpc.AnnouncePeerQuery, krpc.Arguments{
+				ID:          string(id[:]),
+				InfoHash:    &infoHashString,
+				Port:        &test.port,
+				ImpliedPort: test.impliedPort,
+				Token:       &token,
+			})
+			node.handleQuery(query, source)
+
+			node.announcedPeersMutex.Lock()
+			peers := node.announcedPeers[infoHash]
+			node.announcedPeersMutex.Unlock()
+
+			if !test.announced.IsValid() {
+				if len(peers) != 0 {
+					t.Errorf("peer with invalid port is announced: %v", peers)
+				}
+				return
+			}
+
+			if _, ok := peers[test.announced]; !ok || len(peers) != 1 {
+				t.Errorf("expected peer %s to be announced, got %v", test.announced, peers)
+			}
+		})
+	}
+}
@@ -0,0 +1,178 @@
+package krpc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+	"slices"
+
+	"github.com/mertwole/bittorrent-cli/download/bencode"
+	"github.com/mertwole/bittorrent-cli/download/dht/routing_table"
+)
+
+const compactNodeInfoLength = 20 + 4 + 2
+
+const (
+	QueryType    = "q"
+	ResponseType = "r"
+	ErrorType    = "e"
+)
+
+const (
+	PingQuery         = "ping"
+	FindNodeQuery     = "find_node"
+	GetPeersQuery     = "get_peers"
+	AnnouncePeerQuery = "announce_peer"
+)
+
+const (
+	GenericError  = 201
+	ProtocolError = 203
+	UnknownMethod = 204
+)
+
+type Message struct {
+	TransactionID string     `bencode:"t"`
+	Type          string     `bencode:"y"`
+	Query         *string    `bencode:"q"`
+	Arguments     *Arguments `bencode:"a"`
+	Response      *Response  `bencode:"r"`
+}
+
+type Arguments struct {
+	ID          string  `bencode:"id"`
+	Target      *string `bencode:"target"`
+	InfoHash    *string `bencode:"info_hash"`
+	Port        *int    `bencode:"port"`
+	ImpliedPort *int    `bencode:"implied_port"`
+	Token       *string `bencode:"token"`
+}
+
+type Response struct {
+	ID     string    `bencode:"id"`
+	Nodes  *string   `bencode:"nodes"`
+	Values *[]string `bencode:"values"`
+	Token  *string   `bencode:"token"`
+}
+
+type errorMessage struct {
+	TransactionID string `bencode:"t"`
+	Type          string `bencode:"y"`
+	Error         []any  `bencode:"e"`
+}
+
+func NewQuery(transactionID string, query string, arguments Arguments) *Message {
+	return &Message{
+		TransactionID: transactionID,
+		Type:          QueryType,
+		Query:         &query,
+		Arguments:     &arguments,
+	}
+}
+
+func NewResponse(transactionID string, response Response) *Message {
+	return &Message{
+		TransactionID: transactionID,
+		Type:          ResponseType,
+		Response:      &response,
+	}
+}
+
+func (message *Message) Encode() ([]byte, error) {
+	var encoded bytes.Buffer
+	err := bencode.Serialize(&encoded, message)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode KRPC message: %w", err)
+	}
+
+	return encoded.Bytes(), nil
+}
+
+func EncodeError(transactionID string, code int, description string) ([]byte, error) {
+	message := errorMessage{
+		TransactionID: transactionID,
+		Type:          ErrorType,
+		Error:         []any{code, description},
+	}
+
+	var encoded bytes.Buffer
+	err := bencode.Serialize(&encoded, message)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode KRPC error: %w", err)
+	}
+
+	return encoded.Bytes(), nil
+}
+
+func Decode(data []byte) (*Message, error) {
+	message := Message{}
+	err := bencode.Deserialize(bytes.NewReader(data), &message)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode KRPC message: %w", err)
+	}
+
+	switch message.Type {
+	case QueryType:
+		if message.Query == nil || message.Arguments == nil {
+			return nil, fmt.Errorf("query message without method name or arguments")
+		}
+	case ResponseType:
+		if message.Response == nil {
+			return nil, fmt.Errorf("response message without response body")
+		}
+	case ErrorType:
+	default:
+		return nil, fmt.Errorf("unknown KRPC message type: %s", message.Type)
+	}
+
+	return &message, nil
+}
+
+func ParseNodeID(id string) (routing_table.NodeID, error) {
+	if len(id) != len(routing_table.NodeID{}) {
+		return routing_table.NodeID{}, fmt.Errorf(
+			"invalid node ID length: expected %d, got %d",
+			len(routing_table.NodeID{}),
+			len(id),
+		)
+	}
+
+	return routing_table.NodeID([]byte(id)), nil
+}
+
+func EncodeNodes(nodes []routing_table.Node) string {
+	encoded := make([]byte, 0, len(nodes)*compactNodeInfoLength)
+	for _, node := range nodes {
+		if !node.Address.Addr().Unmap().Is4() {
+			continue
+		}
+
+		ip := node.Address.Addr().Unmap().As4()
+
+		encoded = append(encoded, node.ID[:]...)
+		encoded = append(encoded, ip[:]...)
+		encoded = binary.BigEndian.AppendUint16(encoded, node.Address.Port())
+	}
+
+	return string(encoded)
+}
+
+func DecodeNodes(nodes string) ([]routing_table.Node, error) {
+	if len(nodes)%compactNodeInfoLength != 0 {
+		return nil, fmt.Errorf("invalid compact node info length: %d", len(nodes))
+	}
+
+	decoded := make([]routing_table.Node, 0)
+	for info := range slices.Chunk([]byte(nodes), compactNodeInfoLength) {
+		ip := netip.AddrFrom4([4]byte(info[20:24]))
+		port := binary.BigEndian.Uint16(info[24:])
+
+		decoded = append(decoded, routing_table.Node{
+			ID:      routing_table.NodeID(info[:20]),
+			Address: netip.AddrPortFrom(ip, port),
+		})
+	}
+
+	return decoded, nil
+}
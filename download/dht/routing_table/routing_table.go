@@ -0,0 +1,168 @@
+package routing_table
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"math/bits"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+)
+
+const BucketSize = 8
+const maxFailedQueries = 2
+const questionableNodeTimeout = time.Minute * 15
+
+type NodeID [sha1.Size]byte
+
+func RandomNodeID() NodeID {
+	var id NodeID
+	rand.Read(id[:])
+	return id
+}
+
+func (id NodeID) Distance(other NodeID) NodeID {
+	var distance NodeID
+	for i := range id {
+		distance[i] = id[i] ^ other[i]
+	}
+
+	return distance
+}
+
+func (id NodeID) Compare(other NodeID) int {
+	return bytes.Compare(id[:], other[:])
+}
+
+func (id NodeID) commonPrefixLength(other NodeID) int {
+	distance := id.Distance(other)
+	for i, byte_ := range distance {
+		if byte_ != 0 {
+			return i*8 + bits.LeadingZeros8(byte_)
+		}
+	}
+
+	return len(distance) * 8
+}
+
+type Node struct {
+	ID      NodeID
+	Address netip.AddrPort
+
+	lastSeen      time.Time
+	failedQueries int
+}
+
+func (node *Node) isBad() bool {
+	return node.failedQueries >= maxFailedQueries
+}
+
+func (node *Node) isQuestionable() bool {
+	return time.Since(node.lastSeen) > questionableNodeTimeout
+}
+
+type RoutingTable struct {
+	ownID   NodeID
+	buckets [sha1.Size * 8][]*Node
+	mutex   sync.RWMutex
+}
+
+func New(ownID NodeID) *RoutingTable {
+	return &RoutingTable{ownID: ownID}
+}
+
+func (table *RoutingTable) Insert(id NodeID, address netip.AddrPort) bool {
+	if id == table.ownID {
+		return false
+	}
+
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+
+	bucketIdx := table.ownID.commonPrefixLength(id)
+	bucket := table.buckets[bucketIdx]
+
+	for _, node := range bucket {
+		if node.ID == id {
+			node.Address = address
+			node.lastSeen = time.Now()
+			node.failedQueries = 0
+
+			return true
+		}
+	}
+
+	newNode := &Node{ID: id, Address: address, lastSeen: time.Now()}
+
+	if len(bucket) < BucketSize {
+		table.buckets[bucketIdx] = append(bucket, newNode)
+		return true
+	}
+
+	replaceIdx := -1
+	for i, node := range bucket {
+		if node.isBad() {
+			replaceIdx = i
+			break
+		}
+
+		if node.isQuestionable() && replaceIdx == -1 {
+			replaceIdx = i
+		}
+	}
+
+	if replaceIdx == -1 {
+		return false
+	}
+
+	bucket[replaceIdx] = newNode
+
+	return true
+}
+
+func (table *RoutingTable) MarkFailed(address netip.AddrPort) {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+
+	for _, bucket := range table.buckets {
+		for _, node := range bucket {
+			if node.Address == address {
+				node.failedQueries++
+			}
+		}
+	}
+}
+
+func (table *RoutingTable) Closest(target NodeID, count int) []Node {
+	table.mutex.RLock()
+	defer table.mutex.RUnlock()
+
+	nodes := make([]Node, 0)
+	for _, bucket := range table.buckets {
+		for _, node := range bucket {
+			if !node.isBad() {
+				nodes = append(nodes, *node)
+			}
+		}
+	}
+
+	slices.SortFunc(nodes, func(a, b Node) int {
+		return a.ID.Distance(target).Compare(b.ID.Distance(target))
+	})
+
+	return nodes[:min(count, len(nodes))]
+}
+
+func (table *RoutingTable) Length() int {
+	table.mutex.RLock()
+	defer table.mutex.RUnlock()
+
+	length := 0
+	for _, bucket := range table.buckets {
+		length += len(bucket)
+	}
+
+	return length
+}
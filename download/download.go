@@ -2,30 +2,42 @@ package download
 
 import (
 	"bytes"
+	"cmp"
 	"context"
 	"fmt"
 	"log"
-	"math/rand/v2"
 	"net"
 	"net/netip"
+	"net/url"
 	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/mertwole/bittorrent-cli/download/bitfield"
+	"github.com/mertwole/bittorrent-cli/download/choker"
+	"github.com/mertwole/bittorrent-cli/download/connection_manager"
 	"github.com/mertwole/bittorrent-cli/download/downloaded_files"
-	"github.com/mertwole/bittorrent-cli/download/lsd"
 	"github.com/mertwole/bittorrent-cli/download/magnet_link"
 	"github.com/mertwole/bittorrent-cli/download/peer"
+	"github.com/mertwole/bittorrent-cli/download/peer/constants"
+	"github.com/mertwole/bittorrent-cli/download/piece_picker"
 	"github.com/mertwole/bittorrent-cli/download/pieces"
+	"github.com/mertwole/bittorrent-cli/download/rate_limiter"
+	"github.com/mertwole/bittorrent-cli/download/smart_ban"
 	"github.com/mertwole/bittorrent-cli/download/torrent_info"
 	"github.com/mertwole/bittorrent-cli/download/tracker"
-	"github.com/mertwole/bittorrent-cli/global_params"
 )
 
 const discoveredPeersQueueSize = 16
 const connectedPeersQueueSize = 16
 const setPausedChannelSize = 8
-const listenRetries = 16
+const stoppedAnnounceTimeout = time.Second * 5
+const scrapeInterval = time.Minute * 30
+const resumeDataSaveInterval = time.Second * 30
+const connectInterval = time.Second
 
 type Status uint8
 
@@ -39,16 +51,38 @@ const (
 
 type Download struct {
 	Pieces           *pieces.Pieces
+	piecePicker      *piece_picker.PiecePicker
+	choker           *choker.Choker
+	smartBan         *smart_ban.SmartBan
 	downloadedPieces *downloaded_files.DownloadedFiles
 	torrentInfo      *torrent_info.TorrentInfo
+	session          *Session
+
+	discoveredPeers   chan tracker.PeerInfo
+	connectedPeers    chan connectedPeer
+	connectionManager *connection_manager.Manager
+
+	trackerTiers    []*tracker.Tier
+	runningTrackers sync.WaitGroup
+
+	// Bytes transferred by the peers that are already disconnected.
+	downloadedBytes atomic.Uint64
+	uploadedBytes   atomic.Uint64
+
+	// Applied to the peers of this download along with the session limiters.
+	downloadLimiter *rate_limiter.Limiter
+	uploadLimiter   *rate_limiter.Limiter
 
 	paused    bool
 	setPaused chan bool
 
+	activePeers      map[*peer.Peer]struct{}
+	activePeersMutex sync.Mutex
+
 	cancelCallback context.CancelFunc
 }
 
-func New(fileName string, downloadFolderName string) (*Download, error) {
+func New(session *Session, fileName string, downloadFolderName string) (*Download, error) {
 	torrentFile, err := os.Open(fileName)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open torrent file: %w", err)
@@ -59,24 +93,16 @@ func New(fileName string, downloadFolderName string) (*Download, error) {
 		return nil, fmt.Errorf("failed to decode torrent file: %w", err)
 	}
 
-	pieces := pieces.New(len(torrentInfo.Pieces))
-	downloadedPieces := downloaded_files.New(torrentInfo, downloadFolderName)
-
-	return &Download{
-		Pieces:           pieces,
-		downloadedPieces: downloadedPieces,
-		torrentInfo:      torrentInfo,
-		setPaused:        make(chan bool, setPausedChannelSize),
-	}, nil
+	return newDownload(session, torrentInfo, downloadFolderName), nil
 }
 
-func LoadFromMagnetLink(link string, downloadFolderName string) (*Download, error) {
+func LoadFromMagnetLink(session *Session, link string, downloadFolderName string) (*Download, error) {
 	parsed, err := magnet_link.Decode(link)
 	if err != nil {
 		return nil, fmt.Errorf("failed to decode magnet link: %w", err)
 	}
 
-	metadata, err := loadMetadataFromMagnetLink(parsed)
+	metadata, err := loadMetadataFromMagnetLink(session, parsed)
 	if err != nil {
 		return nil, fmt.Errorf("failed to load metadata from the magnet link: %w", err)
 	}
@@ -89,7 +115,7 @@ func LoadFromMagnetLink(link string, downloadFolderName string) (*Download, erro
 	}
 
 	torrentInfo := torrent_info.TorrentInfo{
-		Trackers:    parsed.Trackers,
+		Trackers:    magnetLinkTrackerTiers(parsed),
 		Pieces:      decodedMetadata.Pieces,
 		PieceLength: decodedMetadata.PieceLength,
 		TotalLength: decodedMetadata.TotalLength,
@@ -98,37 +124,74 @@ func LoadFromMagnetLink(link string, downloadFolderName string) (*Download, erro
 		InfoHash:    decodedMetadata.InfoHash,
 	}
 
-	pieces := pieces.New(len(decodedMetadata.Pieces))
-	downloadedPieces := downloaded_files.New(&torrentInfo, downloadFolderName)
+	return newDownload(session, &torrentInfo, downloadFolderName), nil
+}
 
-	return &Download{
+func newDownload(session *Session, torrentInfo *torrent_info.TorrentInfo, downloadFolderName string) *Download {
+	pieces := pieces.New(len(torrentInfo.Pieces))
+	downloadedPieces := downloaded_files.New(torrentInfo, downloadFolderName)
+
+	download := &Download{
 		Pieces:           pieces,
+		piecePicker:      piece_picker.New(pieces),
+		choker:           choker.New(downloadedPieces),
+		smartBan:         smart_ban.New(session.banIP),
 		downloadedPieces: downloadedPieces,
-		torrentInfo:      &torrentInfo,
-		setPaused:        make(chan bool, setPausedChannelSize),
-	}, nil
+		torrentInfo:      torrentInfo,
+		session:          session,
+		discoveredPeers:  make(chan tracker.PeerInfo, discoveredPeersQueueSize),
+		connectedPeers:   make(chan connectedPeer, connectedPeersQueueSize),
+		connectionManager: connection_manager.New(
+			session.connectionPool,
+			session.maxConnectionsPerTorrent,
+			session.localAddress,
+		),
+		downloadLimiter: rate_limiter.New(0),
+		uploadLimiter:   rate_limiter.New(0),
+		setPaused:       make(chan bool, setPausedChannelSize),
+		activePeers:     make(map[*peer.Peer]struct{}),
+	}
+
+	peerID := session.GetPeerID()
+
+	for _, tierURLs := range torrentInfo.Trackers {
+		tier := tracker.NewTier(tierURLs,
+			torrentInfo.InfoHash,
+			download.GetStats,
+			peerID,
+		)
+		download.trackerTiers = append(download.trackerTiers, tier)
+	}
+
+	return download
 }
 
-func loadMetadataFromMagnetLink(link *magnet_link.Data) ([]byte, error) {
-	peerID := [20]byte{0, 2, 2, 3, 4, 5, 6, 7, 8, 9, 0, 1, 2, 3, 4, 5, 6, 7, 8, 9}
+func loadMetadataFromMagnetLink(session *Session, link *magnet_link.Data) ([]byte, error) {
+	peerID := session.GetPeerID()
 	ctx, cancelTrackerListening := context.WithCancel(context.Background())
 	discoveredPeers := make(chan tracker.PeerInfo, discoveredPeersQueueSize)
 	// TODO: Accept incoming connections as well
-	var listenPort uint16 = 60000
+	listenPort := session.GetListenPort()
 
-	for _, trackerURL := range link.Trackers {
-		tracker := tracker.NewTracker(trackerURL,
+	for _, tierURLs := range magnetLinkTrackerTiers(link) {
+		tier := tracker.NewTier(tierURLs,
 			link.InfoHash,
-			0,
+			func() tracker.Stats { return tracker.Stats{} },
 			peerID,
 		)
-		go tracker.ListenForPeers(ctx, listenPort, discoveredPeers)
+		go tier.ListenForPeers(ctx, listenPort, discoveredPeers)
 	}
 
+	session.listenForDHTPeers(ctx, link.InfoHash, discoveredPeers)
+
 	knownPeers := make([]tracker.PeerInfo, 0)
 	for {
 		peerInfo := <-discoveredPeers
 
+		if session.isBlocked(peerInfo.IP) {
+			continue
+		}
+
 		alreadyKnown := false
 		for _, peer := range knownPeers {
 			if peer.IP.Equal(peerInfo.IP) {
@@ -146,7 +209,7 @@ func loadMetadataFromMagnetLink(link *magnet_link.Data) ([]byte, error) {
 		log.Printf("connecting to the peer %+v", peerInfo)
 
 		peer := peer.Peer{}
-		err := peer.Connect(&peerInfo, nil)
+		err := peer.Connect(&peerInfo, nil, session.GetUTPSocket())
 		if err != nil {
 			log.Printf("failed to connect to the peer: %v", err)
 			continue
@@ -154,27 +217,45 @@ func loadMetadataFromMagnetLink(link *magnet_link.Data) ([]byte, error) {
 
 		log.Printf("connected to the peer %+v", peerInfo)
 
-		err = peer.Handshake(link.InfoHash)
+		err = peer.EstablishEncryption(link.InfoHash, session.GetEncryptionPolicy())
+		if err != nil {
+			log.Printf("failed to establish encryption with the peer: %v", err)
+			peer.Close()
+			continue
+		}
+
+		err = peer.Handshake(link.InfoHash, peerID)
 		if err != nil {
 			log.Printf("failed to handshake with the peer: %v", err)
+			peer.Close()
 			continue
 		}
 
 		log.Printf("handshaked with the peer %+v", peerInfo)
 
 		metadata, err := peer.RequestMetadata()
+		peer.Close()
 		if err != nil {
-			log.Printf("failed to download data from peer: %v. reconnecting", err)
+			log.Printf("failed to download metadata from the peer: %v. trying the next one", err)
+			continue
 		}
 
-		peer.Close()
-
 		cancelTrackerListening()
 
 		return metadata, nil
 	}
 }
 
+// Magnet links have no tiers, so every tracker is announced to.
+func magnetLinkTrackerTiers(link *magnet_link.Data) [][]*url.URL {
+	tiers := make([][]*url.URL, 0, len(link.Trackers))
+	for _, trackerURL := range link.Trackers {
+		tiers = append(tiers, []*url.URL{trackerURL})
+	}
+
+	return tiers
+}
+
 func (download *Download) Start() {
 	err := download.downloadedPieces.Prepare(download.Pieces)
 	if err != nil {
@@ -185,43 +266,20 @@ func (download *Download) Start() {
 	downloadedCount := (&piecesBitfield).SetPiecesCount()
 	log.Printf("Discovered %d already downloaded pieces", downloadedCount)
 
-	peerID := [20]byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 0, 1, 2, 3, 4, 5, 6, 7, 8, 9}
-
-	discoveredPeers := make(chan tracker.PeerInfo, discoveredPeersQueueSize)
-
 	ctx, cancel := context.WithCancel(context.Background())
 	download.cancelCallback = cancel
 
-	connectedPeers := make(chan connectedPeer, connectedPeersQueueSize)
-	listener, listenPort, err := createTCPListener()
-	if err != nil {
-		log.Printf("failed to create TCP listener: %v", err)
-	} else {
-		go download.acceptConnectionRequests(ctx, listener, connectedPeers)
-	}
+	download.session.addDownload(download)
+	defer download.session.removeDownload(download)
 
-	for _, trackerURL := range download.torrentInfo.Trackers {
-		tracker := tracker.NewTracker(trackerURL,
-			download.torrentInfo.InfoHash,
-			download.torrentInfo.TotalLength,
-			peerID,
-		)
-		go tracker.ListenForPeers(ctx, listenPort, discoveredPeers)
-	}
+	download.session.listenForDHTPeers(ctx, download.torrentInfo.InfoHash, download.discoveredPeers)
 
-	// TODO: It should be shared across all the downloads.
-	lsdErrors := make(chan error)
-	go lsd.StartDiscovery(download.torrentInfo.InfoHash, discoveredPeers, listenPort, lsdErrors)
+	go download.choker.Run(ctx)
+	go download.saveResumeDataPeriodically(ctx)
+	go download.scrapeTrackers(ctx)
+	go download.downloadFromAllPeers(ctx, download.discoveredPeers, download.connectedPeers)
 
-	go download.downloadFromAllPeers(discoveredPeers, connectedPeers)
-
-	// TODO: Process errors.
-	err = <-lsdErrors
-	log.Printf("error in lsd: %v", err)
-
-	for {
-		time.Sleep(time.Millisecond * 100)
-	}
+	<-ctx.Done()
 }
 
 func (download *Download) Stop() {
@@ -230,6 +288,51 @@ func (download *Download) Stop() {
 	if download.cancelCallback != nil {
 		download.cancelCallback()
 	}
+
+	err := download.SaveResumeData()
+	if err != nil {
+		log.Printf("failed to save resume data: %v", err)
+	}
+
+	trackersStopped := make(chan struct{})
+	go func() {
+		download.runningTrackers.Wait()
+		close(trackersStopped)
+	}()
+
+	select {
+	case <-trackersStopped:
+	case <-time.After(stoppedAnnounceTimeout):
+		log.Printf("timed out waiting for trackers to receive stopped event")
+	}
+}
+
+func (download *Download) GetStats() tracker.Stats {
+	stats := tracker.Stats{
+		Downloaded: download.downloadedBytes.Load(),
+		Uploaded:   download.uploadedBytes.Load(),
+	}
+
+	download.activePeersMutex.Lock()
+	for activePeer := range download.activePeers {
+		stats.Downloaded += activePeer.GetDownloadedBytes()
+		stats.Uploaded += activePeer.GetUploadedBytes()
+	}
+	download.activePeersMutex.Unlock()
+
+	wanted := download.Pieces.GetWantedBitfield()
+	for piece := range download.Pieces.Length() {
+		if wanted.ContainsPiece(piece) && download.Pieces.GetState(piece) != pieces.Downloaded {
+			pieceOffset := uint64(piece) * download.torrentInfo.PieceLength
+			stats.Left += min(download.torrentInfo.PieceLength, download.torrentInfo.TotalLength-pieceOffset)
+		}
+	}
+
+	return stats
+}
+
+func (download *Download) SaveResumeData() error {
+	return download.downloadedPieces.SaveResumeData()
 }
 
 func (download *Download) TogglePause() {
@@ -237,6 +340,15 @@ func (download *Download) TogglePause() {
 	download.setPaused <- download.paused
 }
 
+func (download *Download) GetRateLimits() RateLimits {
+	return RateLimits{Download: download.downloadLimiter.GetLimit(), Upload: download.uploadLimiter.GetLimit()}
+}
+
+func (download *Download) SetRateLimits(limits RateLimits) {
+	download.downloadLimiter.SetLimit(limits.Download)
+	download.uploadLimiter.SetLimit(limits.Upload)
+}
+
 func (download *Download) GetTorrentName() string {
 	return download.torrentInfo.Name
 }
@@ -266,158 +378,353 @@ func (download *Download) GetProgress() bitfield.Bitfield {
 	return download.downloadedPieces.GetStatus().Progress
 }
 
+func (download *Download) GetWanted() bitfield.Bitfield {
+	return download.Pieces.GetWantedBitfield()
+}
+
+func (download *Download) GetFiles() []downloaded_files.FileStatus {
+	return download.downloadedPieces.GetFiles()
+}
+
+func (download *Download) SetFilePriority(file int, priority pieces.Priority) error {
+	return download.downloadedPieces.SetFilePriority(file, priority, download.Pieces)
+}
+
+func (download *Download) SetFilePriorities(priorities []pieces.Priority) error {
+	for file, priority := range priorities {
+		err := download.SetFilePriority(file, priority)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (download *Download) GetConnectionCount() int {
+	return download.connectionManager.ConnectionCount()
+}
+
+type PeerStatus struct {
+	Address      string
+	ClientName   string
+	Downloaded   uint64
+	Uploaded     uint64
+	HashFailures uint64
+	Banned       bool
+}
+
+// Returns the connected peers followed by the peers banned for sending corrupted data.
+func (download *Download) GetPeers() []PeerStatus {
+	statuses := make([]PeerStatus, 0)
+
+	download.activePeersMutex.Lock()
+	for activePeer := range download.activePeers {
+		info := activePeer.GetInfo()
+		statuses = append(statuses, PeerStatus{
+			Address:      net.JoinHostPort(info.IP.String(), strconv.Itoa(int(info.Port))),
+			ClientName:   activePeer.GetClientName(),
+			Downloaded:   activePeer.GetDownloadedBytes(),
+			Uploaded:     activePeer.GetUploadedBytes(),
+			HashFailures: activePeer.GetHashFailures(),
+		})
+	}
+	download.activePeersMutex.Unlock()
+
+	slices.SortFunc(statuses, func(a, b PeerStatus) int {
+		return cmp.Compare(b.Downloaded, a.Downloaded)
+	})
+
+	banned := download.smartBan.GetBanned()
+	slices.SortFunc(banned, func(a, b netip.Addr) int { return a.Compare(b) })
+	for _, address := range banned {
+		statuses = append(statuses, PeerStatus{
+			Address:      address.String(),
+			HashFailures: uint64(download.smartBan.GetHashFailures(address)),
+			Banned:       true,
+		})
+	}
+
+	return statuses
+}
+
+func (download *Download) GetTrackerStatuses() []tracker.Status {
+	statuses := make([]tracker.Status, 0)
+	for _, tier := range download.trackerTiers {
+		statuses = append(statuses, tier.GetStatuses()...)
+	}
+
+	return statuses
+}
+
+// Returns the biggest swarm reported by the trackers.
+func (download *Download) GetScrapeResult() (tracker.ScrapeResult, bool) {
+	result := tracker.ScrapeResult{}
+	anyKnown := false
+	for _, tier := range download.trackerTiers {
+		trackerResult, ok := tier.GetScrapeResult()
+		if !ok {
+			continue
+		}
+
+		anyKnown = true
+		result.Seeders = max(result.Seeders, trackerResult.Seeders)
+		result.Completed = max(result.Completed, trackerResult.Completed)
+		result.Leechers = max(result.Leechers, trackerResult.Leechers)
+	}
+
+	return result, anyKnown
+}
+
+func (download *Download) scrapeTrackers(ctx context.Context) {
+	for {
+		for _, tier := range download.trackerTiers {
+			_, err := tier.Scrape(ctx)
+			if err != nil {
+				log.Printf("failed to scrape tracker: %v", err)
+			}
+		}
+
+		select {
+		case <-time.After(scrapeInterval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (download *Download) saveResumeDataPeriodically(ctx context.Context) {
+	ticker := time.NewTicker(resumeDataSaveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			err := download.SaveResumeData()
+			if err != nil {
+				log.Printf("failed to save resume data: %v", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Runs until the download is stopped. Peers and trackers are stopped on pause as well.
 func (download *Download) downloadFromAllPeers(
-	discoveredPeers <-chan tracker.PeerInfo,
+	downloadCtx context.Context,
+	discoveredPeers chan tracker.PeerInfo,
 	connectedPeers <-chan connectedPeer,
 ) {
-	ctx, cancel := context.WithCancel(context.Background())
+	ctx, cancel := context.WithCancel(downloadCtx)
+	download.startTrackers(ctx)
+	paused := false
+
+	pexTicker := time.NewTicker(constants.UtPexInterval)
+	defer pexTicker.Stop()
+
+	connectTicker := time.NewTicker(connectInterval)
+	defer connectTicker.Stop()
 
-	knownPeers := make([]tracker.PeerInfo, 0)
 	for {
 		select {
+		case <-downloadCtx.Done():
+			cancel()
+			return
+		case <-pexTicker.C:
+			// Sent in background, so slow peers don't hold up discovered peers.
+			go download.sendPex()
+		case <-connectTicker.C:
+			if !paused {
+				download.connectToCandidates(ctx, discoveredPeers)
+			}
+		case <-download.downloadedPieces.Completed():
+			for _, tier := range download.trackerTiers {
+				tier.SendEvent(tracker.Completed)
+			}
 		// TODO: aggregate state changes.
 		case pauseState := <-download.setPaused:
+			paused = pauseState
 			if pauseState {
 				cancel()
 			} else {
-				ctx, cancel = context.WithCancel(context.Background())
+				ctx, cancel = context.WithCancel(downloadCtx)
+				download.startTrackers(ctx)
 
-				for _, knownPeer := range knownPeers {
-					go download.downloadFromPeer(ctx, &knownPeer, nil)
-				}
+				download.connectionManager.ResetBackoff()
+				download.connectToCandidates(ctx, discoveredPeers)
 			}
 		case newPeer := <-discoveredPeers:
-			alreadyKnown := false
-			for _, peer := range knownPeers {
-				if peer.IP.Equal(newPeer.IP) {
-					alreadyKnown = true
-					break
-				}
+			if download.session.isBlocked(newPeer.IP) {
+				continue
 			}
 
-			if !alreadyKnown {
-				knownPeers = append(knownPeers, newPeer)
-				go download.downloadFromPeer(ctx, &newPeer, nil)
+			download.connectionManager.AddCandidate(newPeer)
+			if !paused {
+				download.connectToCandidates(ctx, discoveredPeers)
 			}
 		case newPeer := <-connectedPeers:
-			alreadyKnown := false
-			for _, peer := range knownPeers {
-				if peer.IP.Equal(newPeer.info.IP) {
-					alreadyKnown = true
-					break
-				}
+			if paused || download.session.isBlocked(newPeer.info.IP) || !download.connectionManager.Accept(newPeer.info) {
+				log.Printf("rejecting connection from the peer %+v", newPeer.info)
+				(*newPeer.connection).Close()
+				continue
 			}
 
-			if !alreadyKnown {
-				knownPeers = append(knownPeers, newPeer.info)
-				go download.downloadFromPeer(ctx, &newPeer.info, newPeer.connection)
-			}
+			go download.downloadFromPeer(ctx, &newPeer.info, &newPeer, discoveredPeers)
 		}
 	}
 }
 
+func (download *Download) connectToCandidates(ctx context.Context, discoveredPeers chan<- tracker.PeerInfo) {
+	for _, candidate := range download.connectionManager.NextCandidates(time.Now()) {
+		go download.downloadFromPeer(ctx, &candidate, nil, discoveredPeers)
+	}
+}
+
+// Trackers are notified with stopped event when ctx is cancelled.
+func (download *Download) startTrackers(ctx context.Context) {
+	listenPort := download.session.GetListenPort()
+
+	for _, tier := range download.trackerTiers {
+		download.runningTrackers.Add(1)
+		go func() {
+			defer download.runningTrackers.Done()
+			tier.ListenForPeers(ctx, listenPort, download.discoveredPeers)
+		}()
+	}
+}
+
+// Connection slot should be already reserved in the connection manager, it's released when the peer disconnects.
 func (download *Download) downloadFromPeer(
 	ctx context.Context,
 	peerInfo *tracker.PeerInfo,
-	connection *net.Conn,
+	incoming *connectedPeer,
+	discoveredPeers chan<- tracker.PeerInfo,
 ) {
-	for {
-		// TODO: Make cancellable.
-		peer := peer.Peer{}
-		err := peer.Connect(peerInfo, connection)
-		if err != nil {
-			log.Printf("failed to connect to the peer: %v", err)
-			return
-		}
-
-		// TODO: Make cancellable.
-		err = peer.Handshake(download.torrentInfo.InfoHash)
-		if err != nil {
-			log.Printf("failed to handshake with the peer: %v", err)
-			return
-		}
+	failed := true
+	defer func() {
+		download.connectionManager.Disconnected(*peerInfo, failed)
+	}()
 
-		log.Printf("handshaked with the peer %+v", peerInfo)
+	var connection *net.Conn
+	if incoming != nil {
+		connection = incoming.connection
+	}
 
-		err = peer.StartExchange(ctx, download.torrentInfo, download.Pieces, download.downloadedPieces)
-		if err != nil {
-			log.Printf("failed to download data from peer: %v. reconnecting", err)
-		}
+	// TODO: Make cancellable.
+	peer := peer.Peer{}
+	err := peer.Connect(peerInfo, connection, download.session.GetUTPSocket())
+	if err != nil {
+		log.Printf("failed to connect to the peer: %v", err)
+		return
+	}
 
-		select {
-		case <-ctx.Done():
-			return
-		default:
-			continue
+	// TODO: Make cancellable.
+	if incoming != nil {
+		err = peer.AcceptHandshake(incoming.handshake, download.session.GetPeerID())
+	} else {
+		err = peer.EstablishEncryption(download.torrentInfo.InfoHash, download.session.GetEncryptionPolicy())
+		if err == nil {
+			err = peer.Handshake(download.torrentInfo.InfoHash, download.session.GetPeerID())
 		}
 	}
-}
 
-type connectedPeer struct {
-	info       tracker.PeerInfo
-	connection *net.Conn
-}
+	if err != nil {
+		log.Printf("failed to handshake with the peer: %v", err)
+		peer.Close()
+		return
+	}
 
-func createTCPListener() (listener net.Listener, listenPort uint16, err error) {
-	for i := range listenRetries {
-		listenPort = uint16(
-			rand.Int()%
-				(global_params.ConnectionListenPortMax-global_params.ConnectionListenPortMin+1) +
-				global_params.ConnectionListenPortMin)
+	log.Printf("handshaked with the peer %+v", peerInfo)
+	failed = false
 
-		newListener, err := net.Listen("tcp", fmt.Sprintf(":%d", listenPort))
-		if err != nil {
-			if i+1 == listenRetries {
-				return nil, 0, fmt.Errorf("failed to create TCP listener: %w", err)
-			}
+	// Same peer might be discovered under different addresses, e.g. both IPv4 and IPv6 ones.
+	if incoming == nil && !download.connectionManager.Connected(peer.GetInfo()) {
+		log.Printf("dropping duplicate connection to the peer %+v", peerInfo)
+		peer.Close()
+		return
+	}
 
-			log.Printf("failed to create TCP listener on the port %d; %v", listenPort, err)
-		}
+	peer.LimitRate(
+		[]*rate_limiter.Limiter{download.downloadLimiter, download.session.downloadLimiter},
+		[]*rate_limiter.Limiter{download.uploadLimiter, download.session.uploadLimiter},
+	)
+
+	download.activePeersMutex.Lock()
+	download.activePeers[&peer] = struct{}{}
+	download.activePeersMutex.Unlock()
+	download.choker.AddPeer(&peer)
+
+	err = peer.StartExchange(
+		ctx,
+		download.torrentInfo,
+		download.Pieces,
+		download.piecePicker,
+		download.downloadedPieces,
+		download.smartBan,
+		download.session.isBlocked,
+		discoveredPeers,
+	)
+
+	download.choker.RemovePeer(&peer)
+	download.activePeersMutex.Lock()
+	delete(download.activePeers, &peer)
+	download.downloadedBytes.Add(peer.GetDownloadedBytes())
+	download.uploadedBytes.Add(peer.GetUploadedBytes())
+	download.activePeersMutex.Unlock()
 
-		listener = newListener
+	if err != nil {
+		log.Printf("failed to download data from peer: %v", err)
 	}
+}
 
-	return listener, listenPort, nil
+// Disconnects the peers with the address and prevents reconnecting to them.
+func (download *Download) dropPeers(address netip.Addr) {
+	download.dropPeersMatching(func(peerAddress netip.Addr) bool { return peerAddress == address.Unmap() })
 }
 
-func (download *Download) acceptConnectionRequests(
-	ctx context.Context,
-	listener net.Listener,
-	connectedPeers chan<- connectedPeer,
-) {
-	go func() {
-		<-ctx.Done()
-		listener.Close()
-	}()
+func (download *Download) dropPeersMatching(match func(netip.Addr) bool) {
+	download.connectionManager.ForgetMatching(match)
 
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		default:
-		}
+	download.activePeersMutex.Lock()
+	defer download.activePeersMutex.Unlock()
 
-		conn, err := listener.Accept()
-		if err != nil {
-			log.Printf("failed to accept TCP connection: %v", err)
-			continue
+	for activePeer := range download.activePeers {
+		peerAddress, ok := netip.AddrFromSlice(activePeer.GetInfo().IP)
+		if ok && match(peerAddress.Unmap()) {
+			activePeer.Close()
 		}
+	}
+}
 
-		remoteAddress := conn.RemoteAddr().String()
-		remoteAddrPort, err := netip.ParseAddrPort(remoteAddress)
-		if err != nil {
-			log.Panicf("unable to parse address and port: %v", err)
-		}
-		remoteIP := remoteAddrPort.Addr().As4()
+// Messages are sent without the lock held, as writes might be delayed by the rate limiter.
+func (download *Download) sendPex() {
+	download.activePeersMutex.Lock()
+	activePeers := make([]*peer.Peer, 0, len(download.activePeers))
+	for activePeer := range download.activePeers {
+		activePeers = append(activePeers, activePeer)
+	}
+	download.activePeersMutex.Unlock()
 
-		peerInfo := tracker.PeerInfo{IP: remoteIP[:], Port: remoteAddrPort.Port()}
+	listenInfos := make([]tracker.PeerInfo, len(activePeers))
+	for i, activePeer := range activePeers {
+		listenInfos[i] = activePeer.GetListenInfo()
+	}
 
-		log.Printf("accepted TCP connection from %+v", peerInfo)
+	for i, activePeer := range activePeers {
+		connectedPeers := make([]tracker.PeerInfo, 0, len(activePeers)-1)
+		connectedPeers = append(connectedPeers, listenInfos[:i]...)
+		connectedPeers = append(connectedPeers, listenInfos[i+1:]...)
 
-		select {
-		case connectedPeers <- connectedPeer{info: peerInfo, connection: &conn}:
-		case <-ctx.Done():
-			return
+		err := activePeer.SendPex(connectedPeers)
+		if err != nil {
+			log.Printf("failed to send ut_pex message: %v", err)
 		}
 	}
 }
+
+type connectedPeer struct {
+	info       tracker.PeerInfo
+	connection *net.Conn
+	handshake  *peer.Handshake
+}
@@ -3,9 +3,12 @@ package downloaded_files
 import (
 	"crypto/sha1"
 	"fmt"
+	"log"
 	"os"
 	"path/filepath"
+	"strconv"
 	"sync"
+	"sync/atomic"
 
 	"github.com/mertwole/bittorrent-cli/download/bitfield"
 	"github.com/mertwole/bittorrent-cli/download/pieces"
@@ -19,23 +22,41 @@ type DownloadedPiece struct {
 }
 
 type DownloadedFiles struct {
-	files       []downloadedFile
-	pieceLength uint64
-	pieceHashes [][sha1.Size]byte
-	status      Status
-	mutex       sync.RWMutex
+	files          []downloadedFile
+	partsPath      string
+	resumePath     string
+	infoHash       [sha1.Size]byte
+	pieceLength    uint64
+	totalLength    uint64
+	pieceHashes    [][sha1.Size]byte
+	prepared       bool
+	resumeOutdated atomic.Bool
+	completed      chan struct{}
+	status         Status
+	wanted         bitfield.Bitfield
+	statusMutex    sync.RWMutex
+	mutex          sync.RWMutex
 }
 
 type downloadedFile struct {
-	path   string
-	length uint64
-	handle *os.File
+	name     string
+	path     string
+	offset   uint64
+	length   uint64
+	priority pieces.Priority
+	handle   *os.File
+}
+
+type FileStatus struct {
+	Name     string
+	Path     string
+	Length   uint64
+	Priority pieces.Priority
 }
 
 type Status struct {
 	State    State
 	Progress bitfield.Bitfield
-	mutex    sync.RWMutex
 }
 
 type State uint8
@@ -47,6 +68,14 @@ const (
 	Ready          State = 3
 )
 
+// Part of the piece that is stored in the file.
+type segment struct {
+	file       int
+	fileOffset uint64
+	dataOffset uint64
+	length     uint64
+}
+
 func New(
 	torrent *torrent_info.TorrentInfo,
 	targetFolder string,
@@ -57,163 +86,500 @@ func New(
 	}
 
 	downloadedFiles := DownloadedFiles{
+		partsPath:   filepath.Join(targetFolder, "."+torrent.Name+".parts"),
+		resumePath:  filepath.Join(targetFolder, "."+torrent.Name+".resume"),
+		infoHash:    torrent.InfoHash,
 		pieceLength: torrent.PieceLength,
+		totalLength: torrent.TotalLength,
 		pieceHashes: torrent.Pieces,
 		status: Status{
 			State:    PreparingFiles,
 			Progress: bitfield.NewEmptyBitfield(totalFileCount),
 		},
+		wanted:    bitfield.NewEmptyBitfield(len(torrent.Pieces)),
+		completed: make(chan struct{}, 1),
 	}
 
 	if len(torrent.Files) == 0 {
 		path := filepath.Join(targetFolder, torrent.Name)
-		downloadedFiles.files = []downloadedFile{{path: path, length: torrent.TotalLength}}
+		downloadedFiles.files = []downloadedFile{
+			{name: torrent.Name, path: path, length: torrent.TotalLength, priority: pieces.Normal},
+		}
 
 		return &downloadedFiles
 	}
 
 	downloadFolderPath := filepath.Join(targetFolder, torrent.Name)
 	downloadedFiles.files = make([]downloadedFile, len(torrent.Files))
+	offset := uint64(0)
 	for i, fileInfo := range torrent.Files {
 		relativePath := filepath.Join(fileInfo.Path...)
 		path := filepath.Join(downloadFolderPath, relativePath)
 
-		downloadedFiles.files[i] = downloadedFile{path: path, length: fileInfo.Length}
+		downloadedFiles.files[i] = downloadedFile{
+			name:     relativePath,
+			path:     path,
+			offset:   offset,
+			length:   fileInfo.Length,
+			priority: pieces.Normal,
+		}
+
+		offset += fileInfo.Length
 	}
 
 	return &downloadedFiles
 }
 
-func (download *DownloadedFiles) Prepare(pieces *pieces.Pieces) error {
-	anyOpened := false
+func (download *DownloadedFiles) Prepare(pcs *pieces.Pieces) error {
+	download.mutex.Lock()
+
+	anyOpened := download.hasParts()
 	for i, file := range download.files {
-		fileHandle, fileAction, err := createOrOpenFile(file.path, file.length)
-		if err != nil {
-			return err
-		}
+		if file.priority != pieces.Skip {
+			fileHandle, fileAction, err := createOrOpenFile(file.path, file.length)
+			if err != nil {
+				download.mutex.Unlock()
+				return err
+			}
 
-		download.files[i].handle = fileHandle
+			download.files[i].handle = fileHandle
 
-		if fileAction == opened {
-			anyOpened = true
+			if fileAction == opened {
+				anyOpened = true
+			}
 		}
 
-		download.status.mutex.Lock()
+		download.statusMutex.Lock()
 		download.status.Progress.AddPiece(uint64(i))
-		download.status.mutex.Unlock()
+		download.statusMutex.Unlock()
 	}
 
-	download.status.mutex.Lock()
-	download.status.Progress = bitfield.NewEmptyBitfield(pieces.Length())
-	download.status.mutex.Unlock()
+	download.updatePiecePriorities(pcs)
+	download.prepared = true
+
+	download.mutex.Unlock()
+
+	download.statusMutex.Lock()
+	download.status.Progress = bitfield.NewEmptyBitfield(pcs.Length())
+	download.statusMutex.Unlock()
 
 	if anyOpened {
-		download.status.mutex.Lock()
+		download.statusMutex.Lock()
 		download.status.State = CheckingHashes
-		download.status.mutex.Unlock()
+		download.statusMutex.Unlock()
 
-		err := download.scanDonePieces(pieces)
-		if err != nil {
-			return fmt.Errorf("failed to scan downloaded files for already downloaded pieces: %w", err)
+		download.mutex.RLock()
+		err := download.loadResumeData(pcs)
+		download.mutex.RUnlock()
+
+		if err == nil {
+			log.Printf("loaded resume data for %s, skipping hash check", download.resumePath)
+		} else {
+			log.Printf("unable to use resume data, checking hashes: %v", err)
+
+			err = download.scanDonePieces(pcs)
+			if err != nil {
+				return fmt.Errorf("failed to scan downloaded files for already downloaded pieces: %w", err)
+			}
 		}
 	}
 
-	download.status.mutex.Lock()
+	download.statusMutex.Lock()
 	download.status.State = Downloading
-	download.status.Progress = pieces.GetBitfield()
-	download.status.mutex.Unlock()
+	download.status.Progress = pcs.GetBitfield()
+	download.updateState()
+	download.statusMutex.Unlock()
+
+	download.resumeOutdated.Store(true)
 
 	return nil
 }
 
 func (download *DownloadedFiles) GetStatus() Status {
-	download.status.mutex.RLock()
-	defer download.status.mutex.RUnlock()
+	download.statusMutex.RLock()
+	defer download.statusMutex.RUnlock()
 
 	return download.status
 }
 
+func (download *DownloadedFiles) GetFiles() []FileStatus {
+	download.mutex.RLock()
+	defer download.mutex.RUnlock()
+
+	files := make([]FileStatus, len(download.files))
+	for i, file := range download.files {
+		files[i] = FileStatus{Name: file.name, Path: file.path, Length: file.length, Priority: file.priority}
+	}
+
+	return files
+}
+
+func (download *DownloadedFiles) SetFilePriority(file int, priority pieces.Priority, pcs *pieces.Pieces) error {
+	if file < 0 || file >= len(download.files) {
+		return fmt.Errorf("invalid file index %d, torrent has %d files", file, len(download.files))
+	}
+
+	download.mutex.Lock()
+	defer download.mutex.Unlock()
+
+	previousPriority := download.files[file].priority
+	download.files[file].priority = priority
+
+	if download.prepared {
+		var err error
+		if previousPriority == pieces.Skip && priority != pieces.Skip {
+			err = download.openSkippedFile(file, pcs)
+		} else if previousPriority != pieces.Skip && priority == pieces.Skip {
+			err = download.closeSkippedFile(file, pcs)
+		}
+
+		if err != nil {
+			download.files[file].priority = previousPriority
+			return err
+		}
+	}
+
+	download.updatePiecePriorities(pcs)
+
+	download.statusMutex.Lock()
+	download.updateState()
+	download.resumeOutdated.Store(true)
+	download.statusMutex.Unlock()
+
+	return nil
+}
+
 func (download *DownloadedFiles) ReadPiece(piece int) (*[]byte, error) {
-	offset := uint64(piece) * uint64(download.pieceLength)
+	download.mutex.RLock()
+	defer download.mutex.RUnlock()
 
-	currentOffset := uint64(0)
-	bytesRead := uint64(0)
-	readData := make([]byte, 0)
+	return download.readPiece(piece)
+}
+
+func (download *DownloadedFiles) WritePiece(piece DownloadedPiece) error {
+	download.mutex.Lock()
+	err := download.writePiece(piece)
+	download.mutex.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	download.statusMutex.Lock()
+	previousState := download.status.State
+	download.status.Progress.AddPiece(piece.Index)
+	download.updateState()
+	// Marked outdated only after the progress is updated, otherwise the resume data
+	// might be saved without the piece and never saved again.
+	download.resumeOutdated.Store(true)
+	completed := previousState != Ready && download.status.State == Ready
+	download.statusMutex.Unlock()
+
+	if completed {
+		select {
+		case download.completed <- struct{}{}:
+		default:
+		}
+	}
+
+	return nil
+}
+
+// Notifies when the last wanted piece is written. Completion at startup isn't reported.
+func (download *DownloadedFiles) Completed() <-chan struct{} {
+	return download.completed
+}
+
+func (download *DownloadedFiles) Finalize() {
+	download.mutex.Lock()
+	defer download.mutex.Unlock()
 
 	for _, file := range download.files {
-		if file.length+currentOffset > offset {
-			bytesToRead := min(uint64(download.pieceLength)-bytesRead, file.length+currentOffset-offset, file.length)
-			readBytes := make([]byte, bytesToRead)
+		if file.handle != nil {
+			file.handle.Close()
+		}
+	}
+}
 
-			readOffset := max(0, int64(offset)-int64(currentOffset))
+// Should be called with statusMutex locked.
+func (download *DownloadedFiles) updateState() {
+	if download.status.State != Downloading && download.status.State != Ready {
+		return
+	}
 
-			download.mutex.RLock()
-			_, err := file.handle.ReadAt(readBytes, readOffset)
-			download.mutex.RUnlock()
+	for piece := range download.wanted.PieceCount() {
+		if download.wanted.ContainsPiece(piece) && !download.status.Progress.ContainsPiece(piece) {
+			download.status.State = Downloading
+			return
+		}
+	}
 
-			if err != nil {
-				return nil, fmt.Errorf("failed to read from file %s: %w", file.path, err)
-			}
-			readData = append(readData, readBytes...)
+	download.status.State = Ready
+}
 
-			bytesRead += bytesToRead
-			if bytesRead >= download.pieceLength {
-				break
-			}
+func (download *DownloadedFiles) updatePiecePriorities(pcs *pieces.Pieces) {
+	priorities := make([]pieces.Priority, len(download.pieceHashes))
+	for _, file := range download.files {
+		if file.length == 0 {
+			continue
+		}
+
+		firstPiece := file.offset / download.pieceLength
+		lastPiece := (file.offset + file.length - 1) / download.pieceLength
+		for piece := firstPiece; piece <= lastPiece; piece++ {
+			priorities[piece] = max(priorities[piece], file.priority)
+		}
+	}
+
+	wanted := bitfield.NewEmptyBitfield(len(priorities))
+	for piece, priority := range priorities {
+		pcs.SetPriority(piece, priority)
+
+		if priority != pieces.Skip {
+			wanted.AddPiece(uint64(piece))
+		}
+	}
+
+	download.statusMutex.Lock()
+	download.wanted = wanted
+	download.statusMutex.Unlock()
+}
+
+func (download *DownloadedFiles) pieceSegments(piece int) []segment {
+	pieceOffset := uint64(piece) * download.pieceLength
+	pieceLength := min(download.pieceLength, download.totalLength-pieceOffset)
+
+	segments := make([]segment, 0)
+	for i, file := range download.files {
+		start := max(pieceOffset, file.offset)
+		end := min(pieceOffset+pieceLength, file.offset+file.length)
+		if start >= end {
+			continue
 		}
 
-		currentOffset += file.length
+		segments = append(segments, segment{
+			file:       i,
+			fileOffset: start - file.offset,
+			dataOffset: start - pieceOffset,
+			length:     end - start,
+		})
+	}
+
+	return segments
+}
+
+func (download *DownloadedFiles) overlapsSkippedFile(piece int) bool {
+	for _, segment := range download.pieceSegments(piece) {
+		if download.files[segment.file].handle == nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (download *DownloadedFiles) readPiece(piece int) (*[]byte, error) {
+	if download.overlapsSkippedFile(piece) {
+		data, err := download.readPart(piece)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read piece #%d from the parts storage: %w", piece, err)
+		}
+
+		return &data, nil
+	}
+
+	segments := download.pieceSegments(piece)
+
+	readData := make([]byte, 0)
+	for _, segment := range segments {
+		file := download.files[segment.file]
+
+		readBytes := make([]byte, segment.length)
+		_, err := file.handle.ReadAt(readBytes, int64(segment.fileOffset))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read from file %s: %w", file.path, err)
+		}
+
+		readData = append(readData, readBytes...)
 	}
 
 	return &readData, nil
 }
 
-func (download *DownloadedFiles) WritePiece(piece DownloadedPiece) error {
-	currentOffset := uint64(0)
-	bytesWritten := int64(0)
-	for _, file := range download.files {
-		if file.length+currentOffset > piece.Offset {
-			bytesToWrite := min(int64(len(piece.Data))-bytesWritten, int64(file.length+currentOffset-piece.Offset))
-			writeOffset := max(0, int64(piece.Offset)-int64(currentOffset))
+func (download *DownloadedFiles) writePiece(piece DownloadedPiece) error {
+	writeToParts := false
+	for _, segment := range download.pieceSegments(int(piece.Index)) {
+		file := download.files[segment.file]
+		if file.handle == nil {
+			writeToParts = true
+			continue
+		}
 
-			download.mutex.Lock()
-			_, err := file.handle.WriteAt((piece.Data)[bytesWritten:bytesWritten+bytesToWrite], writeOffset)
-			download.mutex.Unlock()
+		err := download.writeSegment(file, segment, piece.Data)
+		if err != nil {
+			return err
+		}
+	}
 
+	if writeToParts {
+		err := download.writePart(int(piece.Index), piece.Data)
+		if err != nil {
+			return fmt.Errorf("failed to write piece #%d to the parts storage: %w", piece.Index, err)
+		}
+	}
+
+	return nil
+}
+
+func (download *DownloadedFiles) writeSegment(file downloadedFile, segment segment, pieceData []byte) error {
+	data := pieceData[segment.dataOffset : segment.dataOffset+segment.length]
+	_, err := file.handle.WriteAt(data, int64(segment.fileOffset))
+	if err != nil {
+		return fmt.Errorf("failed to write to file %s: %w", file.path, err)
+	}
+
+	err = file.handle.Sync()
+	if err != nil {
+		return fmt.Errorf("failed to sync file %s to the disk: %w", file.path, err)
+	}
+
+	return nil
+}
+
+func (download *DownloadedFiles) filePieces(file int) (first int, last int) {
+	fileInfo := download.files[file]
+	if fileInfo.length == 0 {
+		return 0, -1
+	}
+
+	first = int(fileInfo.offset / download.pieceLength)
+	last = int((fileInfo.offset + fileInfo.length - 1) / download.pieceLength)
+
+	return first, last
+}
+
+func (download *DownloadedFiles) openSkippedFile(file int, pcs *pieces.Pieces) error {
+	fileHandle, _, err := createOrOpenFile(download.files[file].path, download.files[file].length)
+	if err != nil {
+		return err
+	}
+
+	download.files[file].handle = fileHandle
+
+	first, last := download.filePieces(file)
+	for piece := first; piece <= last; piece++ {
+		if download.hasPart(piece) {
+			data, err := download.readPart(piece)
 			if err != nil {
-				return fmt.Errorf("failed to write to file %s: %w", file.path, err)
+				return fmt.Errorf("failed to read piece #%d from the parts storage: %w", piece, err)
 			}
 
-			download.mutex.Lock()
-			err = file.handle.Sync()
-			download.mutex.Unlock()
+			for _, segment := range download.pieceSegments(piece) {
+				if segment.file == file {
+					err = download.writeSegment(download.files[file], segment, data)
+					if err != nil {
+						return err
+					}
+				}
+			}
 
-			if err != nil {
-				return fmt.Errorf("failed to sync file %s to the disk: %w", file.path, err)
+			if !download.overlapsSkippedFile(piece) {
+				download.removePart(piece)
 			}
 
-			bytesWritten += bytesToWrite
-			if bytesWritten >= int64(len(piece.Data)) {
-				break
+			continue
+		}
+
+		// The file might be already present on the disk.
+		if pcs.GetState(piece) == pieces.NotDownloaded && !download.overlapsSkippedFile(piece) {
+			err := download.checkPiece(piece, pcs)
+			if err != nil {
+				return err
 			}
 		}
+	}
+
+	return nil
+}
+
+func (download *DownloadedFiles) closeSkippedFile(file int, pcs *pieces.Pieces) error {
+	first, last := download.filePieces(file)
+	for piece := first; piece <= last; piece++ {
+		if pcs.GetState(piece) != pieces.Downloaded || download.overlapsSkippedFile(piece) {
+			continue
+		}
+
+		data, err := download.readPiece(piece)
+		if err != nil {
+			return err
+		}
 
-		currentOffset += file.length
+		err = download.writePart(piece, *data)
+		if err != nil {
+			return fmt.Errorf("failed to write piece #%d to the parts storage: %w", piece, err)
+		}
 	}
 
-	download.status.mutex.Lock()
-	download.status.Progress.AddPiece(piece.Index)
-	if download.status.Progress.SetPiecesCount() == download.status.Progress.PieceCount() {
-		download.status.State = Ready
+	download.files[file].handle.Close()
+	download.files[file].handle = nil
+
+	return nil
+}
+
+func (download *DownloadedFiles) checkPiece(piece int, pcs *pieces.Pieces) error {
+	data, err := download.readPiece(piece)
+	if err != nil {
+		return fmt.Errorf("failed to read piece #%d: %w", piece, err)
+	}
+
+	if sha1.Sum(*data) != download.pieceHashes[piece] {
+		return nil
+	}
+
+	if pcs.CheckStateAndChange(piece, pieces.NotDownloaded, pieces.Downloaded) {
+		download.statusMutex.Lock()
+		download.status.Progress.AddPiece(uint64(piece))
+		download.statusMutex.Unlock()
 	}
-	download.status.mutex.Unlock()
 
 	return nil
 }
 
-func (download *DownloadedFiles) Finalize() {
-	for _, file := range download.files {
-		file.handle.Close()
+func (download *DownloadedFiles) partPath(piece int) string {
+	return filepath.Join(download.partsPath, strconv.Itoa(piece))
+}
+
+func (download *DownloadedFiles) hasParts() bool {
+	entries, err := os.ReadDir(download.partsPath)
+	return err == nil && len(entries) != 0
+}
+
+func (download *DownloadedFiles) hasPart(piece int) bool {
+	_, err := os.Stat(download.partPath(piece))
+	return err == nil
+}
+
+func (download *DownloadedFiles) readPart(piece int) ([]byte, error) {
+	return os.ReadFile(download.partPath(piece))
+}
+
+func (download *DownloadedFiles) writePart(piece int, data []byte) error {
+	err := os.MkdirAll(download.partsPath, 0770)
+	if err != nil {
+		return fmt.Errorf("failed to create parts directory %s: %w", download.partsPath, err)
+	}
+
+	return os.WriteFile(download.partPath(piece), data, 0644)
+}
+
+func (download *DownloadedFiles) removePart(piece int) {
+	err := os.Remove(download.partPath(piece))
+	if err != nil {
+		return
+	}
+
+	if !download.hasParts() {
+		os.Remove(download.partsPath)
 	}
 }
 
@@ -262,20 +628,21 @@ func createOrOpenFile(path string, expectedLength uint64) (*os.File, createOrOpe
 }
 
 func (download *DownloadedFiles) scanDonePieces(pcs *pieces.Pieces) error {
-	for i, pieceHash := range download.pieceHashes {
-		piece, err := download.ReadPiece(i)
-		if err != nil {
-			return fmt.Errorf("failed to read piece #%d: %w", i, err)
+	for i := range download.pieceHashes {
+		download.mutex.RLock()
+		var err error
+		if !download.overlapsSkippedFile(i) || download.hasPart(i) {
+			err = download.checkPiece(i, pcs)
 		}
-		readPieceHash := sha1.Sum(*piece)
+		download.mutex.RUnlock()
 
-		if readPieceHash == pieceHash {
-			pcs.CheckStateAndChange(i, pieces.NotDownloaded, pieces.Downloaded)
+		if err != nil {
+			return err
 		}
 
-		download.status.mutex.Lock()
+		download.statusMutex.Lock()
 		download.status.Progress.AddPiece(uint64(i))
-		download.status.mutex.Unlock()
+		download.statusMutex.Unlock()
 	}
 
 	return nil
@@ -0,0 +1,200 @@
+package downloaded_files
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mertwole/bittorrent-cli/download/pieces"
+	"github.com/mertwole/bittorrent-cli/download/torrent_info"
+)
+
+func TestSkippedFileWithStraddlingPieces(t *testing.T) {
+	data := []byte("abcdefghijkl")
+	torrent := testTorrent(data, 4, []uint64{3, 5, 4})
+	targetFolder := t.TempDir()
+
+	downloadedFiles := New(torrent, targetFolder)
+	pcs := pieces.New(len(torrent.Pieces))
+
+	err := downloadedFiles.SetFilePriority(1, pieces.Skip, pcs)
+	if err != nil {
+		t.Fatalf("failed to set file priority: %v", err)
+	}
+
+	expectedPriorities := []pieces.Priority{pieces.Normal, pieces.Skip, pieces.Normal}
+	for piece, expected := range expectedPriorities {
+		if pcs.GetPriority(piece) != expected {
+			t.Errorf("unexpected priority of piece #%d: expected %v, got %v", piece, expected, pcs.GetPriority(piece))
+		}
+	}
+
+	err = downloadedFiles.Prepare(pcs)
+	if err != nil {
+		t.Fatalf("failed to prepare files: %v", err)
+	}
+	defer downloadedFiles.Finalize()
+
+	skippedPath := filepath.Join(targetFolder, torrent.Name, "1")
+	if _, err := os.Stat(skippedPath); err == nil {
+		t.Errorf("skipped file is created")
+	}
+
+	writePiece(downloadedFiles, pcs, data, 0, 4, t)
+	writePiece(downloadedFiles, pcs, data, 2, 4, t)
+
+	readData, err := downloadedFiles.ReadPiece(0)
+	if err != nil {
+		t.Fatalf("failed to read straddling piece: %v", err)
+	}
+	if !bytes.Equal(*readData, data[:4]) {
+		t.Errorf("unexpected straddling piece data: expected %s, got %s", data[:4], *readData)
+	}
+
+	if downloadedFiles.GetStatus().State != Ready {
+		t.Errorf("download is not ready when all the wanted pieces are present")
+	}
+
+	err = downloadedFiles.SetFilePriority(1, pieces.Normal, pcs)
+	if err != nil {
+		t.Fatalf("failed to set file priority: %v", err)
+	}
+
+	if downloadedFiles.GetStatus().State != Downloading {
+		t.Errorf("download is ready after the skipped file became wanted")
+	}
+
+	restored, err := os.ReadFile(skippedPath)
+	if err != nil {
+		t.Fatalf("failed to read previously skipped file: %v", err)
+	}
+	if restored[0] != data[3] {
+		t.Errorf("straddling piece data is not restored: expected %c, got %c", data[3], restored[0])
+	}
+
+	if _, err := os.Stat(downloadedFiles.partsPath); err == nil {
+		t.Errorf("parts storage is not cleaned up")
+	}
+}
+
+func testTorrent(data []byte, pieceLength uint64, fileLengths []uint64) *torrent_info.TorrentInfo {
+	pieceHashes := make([][sha1.Size]byte, 0)
+	for offset := uint64(0); offset < uint64(len(data)); offset += pieceLength {
+		end := min(offset+pieceLength, uint64(len(data)))
+		pieceHashes = append(pieceHashes, sha1.Sum(data[offset:end]))
+	}
+
+	files := make([]torrent_info.FileInfo, 0)
+	for i, length := range fileLengths {
+		files = append(files, torrent_info.FileInfo{Path: []string{string(rune('0' + i))}, Length: length})
+	}
+
+	return &torrent_info.TorrentInfo{
+		Pieces:      pieceHashes,
+		PieceLength: pieceLength,
+		TotalLength: uint64(len(data)),
+		Name:        "test",
+		Files:       files,
+	}
+}
+
+func writePiece(
+	downloadedFiles *DownloadedFiles,
+	pcs *pieces.Pieces,
+	data []byte,
+	piece int,
+	pieceLength int,
+	t *testing.T,
+) {
+	offset := piece * pieceLength
+	end := min(offset+pieceLength, len(data))
+
+	err := downloadedFiles.WritePiece(DownloadedPiece{
+		Index:  uint64(piece),
+		Offset: uint64(offset),
+		Data:   data[offset:end],
+	})
+	if err != nil {
+		t.Fatalf("failed to write piece #%d: %v", piece, err)
+	}
+
+	pcs.CheckStateAndChange(piece, pieces.NotDownloaded, pieces.Downloaded)
+}
+
+func TestResumeData(t *testing.T) {
+	data := []byte("abcdefghijkl")
+	torrent := testTorrent(data, 4, []uint64{6, 6})
+	targetFolder := t.TempDir()
+
+	downloadedFiles := New(torrent, targetFolder)
+	pcs := pieces.New(len(torrent.Pieces))
+
+	err := downloadedFiles.Prepare(pcs)
+	if err != nil {
+		t.Fatalf("failed to prepare files: %v", err)
+	}
+
+	writePiece(downloadedFiles, pcs, data, 0, 4, t)
+	writePiece(downloadedFiles, pcs, data, 2, 4, t)
+
+	err = downloadedFiles.SaveResumeData()
+	if err != nil {
+		t.Fatalf("failed to save resume data: %v", err)
+	}
+
+	downloadedFiles.Finalize()
+
+	// Resume data is trusted while files are unchanged, so corrupted data shouldn't be noticed.
+	lastFilePath := filepath.Join(targetFolder, torrent.Name, "1")
+	lastFileInfo, err := os.Stat(lastFilePath)
+	if err != nil {
+		t.Fatalf("failed to stat file: %v", err)
+	}
+
+	err = os.WriteFile(lastFilePath, []byte("zzzzzz"), 0644)
+	if err != nil {
+		t.Fatalf("failed to corrupt file: %v", err)
+	}
+
+	err = os.Chtimes(lastFilePath, lastFileInfo.ModTime(), lastFileInfo.ModTime())
+	if err != nil {
+		t.Fatalf("failed to restore modification time: %v", err)
+	}
+
+	expectedStates := []pieces.PieceState{pieces.Downloaded, pieces.NotDownloaded, pieces.Downloaded}
+	assertPreparedPieces(torrent, targetFolder, expectedStates, t)
+
+	// Resume data isn't trusted anymore after the file is modified.
+	err = os.Chtimes(lastFilePath, lastFileInfo.ModTime(), lastFileInfo.ModTime().Add(time.Second))
+	if err != nil {
+		t.Fatalf("failed to change modification time: %v", err)
+	}
+
+	expectedStates = []pieces.PieceState{pieces.Downloaded, pieces.NotDownloaded, pieces.NotDownloaded}
+	assertPreparedPieces(torrent, targetFolder, expectedStates, t)
+}
+
+func assertPreparedPieces(
+	torrent *torrent_info.TorrentInfo,
+	targetFolder string,
+	expected []pieces.PieceState,
+	t *testing.T,
+) {
+	downloadedFiles := New(torrent, targetFolder)
+	pcs := pieces.New(len(torrent.Pieces))
+
+	err := downloadedFiles.Prepare(pcs)
+	if err != nil {
+		t.Fatalf("failed to prepare files: %v", err)
+	}
+	defer downloadedFiles.Finalize()
+
+	for piece, expectedState := range expected {
+		if pcs.GetState(piece) != expectedState {
+			t.Errorf("unexpected state of piece #%d: expected %v, got %v", piece, expectedState, pcs.GetState(piece))
+		}
+	}
+}
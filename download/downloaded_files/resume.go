@@ -0,0 +1,159 @@
+package downloaded_files
+
+import (
+	"fmt"
+	"os"
+	"slices"
+
+	"github.com/mertwole/bittorrent-cli/download/bencode"
+	"github.com/mertwole/bittorrent-cli/download/bitfield"
+	"github.com/mertwole/bittorrent-cli/download/pieces"
+)
+
+const resumeDataVersion = 1
+
+type resumeData struct {
+	Version  int          `bencode:"version"`
+	InfoHash string       `bencode:"info hash"`
+	Pieces   string       `bencode:"pieces"`
+	Files    []resumeFile `bencode:"files"`
+}
+
+// Skipped files are stored with zero length and modification time.
+type resumeFile struct {
+	Length           int64 `bencode:"length"`
+	ModificationTime int64 `bencode:"mtime"`
+}
+
+func (download *DownloadedFiles) SaveResumeData() error {
+	if !download.resumeOutdated.Swap(false) {
+		return nil
+	}
+
+	err := download.saveResumeData()
+	if err != nil {
+		download.resumeOutdated.Store(true)
+		return err
+	}
+
+	return nil
+}
+
+func (download *DownloadedFiles) saveResumeData() error {
+	download.mutex.RLock()
+	defer download.mutex.RUnlock()
+
+	download.statusMutex.RLock()
+	state := download.status.State
+	progress := slices.Clone(download.status.Progress.ToBytes())
+	download.statusMutex.RUnlock()
+
+	// Until the files are checked progress contains hash check status.
+	if state != Downloading && state != Ready {
+		return nil
+	}
+
+	data := resumeData{
+		Version:  resumeDataVersion,
+		InfoHash: string(download.infoHash[:]),
+		Pieces:   string(progress),
+		Files:    make([]resumeFile, len(download.files)),
+	}
+
+	for i, file := range download.files {
+		if file.handle == nil {
+			continue
+		}
+
+		fileInfo, err := file.handle.Stat()
+		if err != nil {
+			return fmt.Errorf("failed to get info of the file %s: %w", file.path, err)
+		}
+
+		data.Files[i] = resumeFile{Length: fileInfo.Size(), ModificationTime: fileInfo.ModTime().UnixNano()}
+	}
+
+	// Write to the temporary file first so a crash in the middle doesn't leave broken resume data.
+	temporaryPath := download.resumePath + ".tmp"
+	resumeFile, err := os.Create(temporaryPath)
+	if err != nil {
+		return fmt.Errorf("failed to create resume file %s: %w", temporaryPath, err)
+	}
+
+	err = bencode.Serialize(resumeFile, data)
+	if err != nil {
+		resumeFile.Close()
+		return fmt.Errorf("failed to encode resume data: %w", err)
+	}
+
+	err = resumeFile.Close()
+	if err != nil {
+		return fmt.Errorf("failed to write resume file %s: %w", temporaryPath, err)
+	}
+
+	err = os.Rename(temporaryPath, download.resumePath)
+	if err != nil {
+		return fmt.Errorf("failed to replace resume file %s: %w", download.resumePath, err)
+	}
+
+	return nil
+}
+
+// Marks pieces from the resume data as downloaded if files are unchanged since it was saved.
+// Should be called with mutex locked.
+func (download *DownloadedFiles) loadResumeData(pcs *pieces.Pieces) error {
+	resumeFile, err := os.Open(download.resumePath)
+	if err != nil {
+		return fmt.Errorf("failed to open resume file %s: %w", download.resumePath, err)
+	}
+	defer resumeFile.Close()
+
+	var data resumeData
+	err = bencode.Deserialize(resumeFile, &data)
+	if err != nil {
+		return fmt.Errorf("failed to decode resume data: %w", err)
+	}
+
+	if data.Version != resumeDataVersion {
+		return fmt.Errorf("unsupported resume data version %d", data.Version)
+	}
+
+	if data.InfoHash != string(download.infoHash[:]) {
+		return fmt.Errorf("resume data belongs to another torrent")
+	}
+
+	if len(data.Files) != len(download.files) || len(data.Pieces) != (pcs.Length()+7)/8 {
+		return fmt.Errorf("resume data doesn't match the torrent layout")
+	}
+
+	for i, file := range download.files {
+		if file.handle == nil {
+			continue
+		}
+
+		fileInfo, err := file.handle.Stat()
+		if err != nil {
+			return fmt.Errorf("failed to get info of the file %s: %w", file.path, err)
+		}
+
+		saved := data.Files[i]
+		if fileInfo.Size() != saved.Length || fileInfo.ModTime().UnixNano() != saved.ModificationTime {
+			return fmt.Errorf("file %s is modified since resume data was saved", file.path)
+		}
+	}
+
+	progress := bitfield.NewBitfield([]byte(data.Pieces), pcs.Length())
+	for piece := range pcs.Length() {
+		if !progress.ContainsPiece(piece) {
+			continue
+		}
+
+		if download.overlapsSkippedFile(piece) && !download.hasPart(piece) {
+			continue
+		}
+
+		pcs.CheckStateAndChange(piece, pieces.NotDownloaded, pieces.Downloaded)
+	}
+
+	return nil
+}
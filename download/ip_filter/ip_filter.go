@@ -0,0 +1,268 @@
+package ip_filter
+
+import (
+	"bufio"
+	"cmp"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// Ranges of eMule ipfilter.dat with access level above this one are allowed.
+const maxBlockedAccessLevel = 127
+
+type ipRange struct {
+	first netip.Addr
+	last  netip.Addr
+}
+
+// Filter blocks the addresses listed in the filter files. Supported formats, detected per line:
+//
+//	eMule ipfilter.dat:   001.002.003.000 - 001.002.003.255 , 000 , Description
+//	PeerGuardian P2P:     Description:1.2.3.0-1.2.3.255
+//	CIDR or single IP:    1.2.3.0/24, 2001:db8::/32, 1.2.3.4
+//
+// Lines starting with # or // are comments. Nil filter blocks nothing.
+type Filter struct {
+	paths []string
+	// Sorted by the first address and not overlapping, so lookups are binary searches.
+	// Replaced as a whole on reload.
+	ranges atomic.Pointer[[]ipRange]
+}
+
+func New(paths []string) (*Filter, error) {
+	filter := &Filter{paths: paths}
+
+	err := filter.Reload()
+	if err != nil {
+		return nil, err
+	}
+
+	return filter, nil
+}
+
+// Rereads the filter files. Previously loaded ranges stay in effect if any of the files fails to load.
+func (filter *Filter) Reload() error {
+	ranges := make([]ipRange, 0)
+	for _, path := range filter.paths {
+		file, err := os.Open(path)
+		if err != nil {
+			return fmt.Errorf("failed to open IP filter file %s: %w", path, err)
+		}
+
+		loaded, skipped, err := parse(file)
+		file.Close()
+		if err != nil {
+			return fmt.Errorf("failed to read IP filter file %s: %w", path, err)
+		}
+
+		if skipped != 0 {
+			log.Printf("skipped %d invalid lines of IP filter file %s", skipped, path)
+		}
+
+		ranges = append(ranges, loaded...)
+	}
+
+	merged := mergeRanges(ranges)
+	filter.ranges.Store(&merged)
+
+	log.Printf("loaded %d blocked IP ranges", len(merged))
+
+	return nil
+}
+
+func (filter *Filter) IsBlocked(ip net.IP) bool {
+	if filter == nil {
+		return false
+	}
+
+	address, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return false
+	}
+
+	return filter.isBlocked(address.Unmap())
+}
+
+func (filter *Filter) isBlocked(address netip.Addr) bool {
+	ranges := *filter.ranges.Load()
+
+	idx, _ := slices.BinarySearchFunc(ranges, address, func(r ipRange, address netip.Addr) int {
+		return r.last.Compare(address)
+	})
+
+	return idx < len(ranges) && ranges[idx].first.Compare(address) <= 0
+}
+
+func (filter *Filter) RangeCount() int {
+	if filter == nil {
+		return 0
+	}
+
+	return len(*filter.ranges.Load())
+}
+
+func parse(reader io.Reader) (ranges []ipRange, skipped int, err error) {
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "//") {
+			continue
+		}
+
+		parsed, blocked, err := parseLine(line)
+		if err != nil {
+			skipped++
+			continue
+		}
+
+		if blocked {
+			ranges = append(ranges, parsed)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	return ranges, skipped, nil
+}
+
+func parseLine(line string) (parsed ipRange, blocked bool, err error) {
+	// eMule: range , access level , description
+	if rangeString, rest, ok := strings.Cut(line, ","); ok {
+		levelString, _, _ := strings.Cut(rest, ",")
+		level, err := strconv.Atoi(strings.TrimSpace(levelString))
+		if err != nil {
+			return ipRange{}, false, fmt.Errorf("invalid access level %s: %w", levelString, err)
+		}
+
+		parsed, err := parseRange(rangeString)
+		return parsed, level <= maxBlockedAccessLevel, err
+	}
+
+	if strings.Contains(line, "/") {
+		prefix, err := netip.ParsePrefix(line)
+		if err != nil {
+			return ipRange{}, false, fmt.Errorf("invalid CIDR %s: %w", line, err)
+		}
+
+		return prefixRange(prefix.Masked()), true, nil
+	}
+
+	// P2P: description may contain colons, so the range follows the last one.
+	if separator := strings.LastIndex(line, ":"); separator != -1 && strings.Contains(line[separator:], "-") {
+		if parsed, err := parseRange(line[separator+1:]); err == nil {
+			return parsed, true, nil
+		}
+	}
+
+	if strings.Contains(line, "-") {
+		parsed, err := parseRange(line)
+		return parsed, true, err
+	}
+
+	address, err := parseAddr(line)
+	if err != nil {
+		return ipRange{}, false, err
+	}
+
+	return ipRange{first: address, last: address}, true, nil
+}
+
+func parseRange(rangeString string) (ipRange, error) {
+	firstString, lastString, ok := strings.Cut(rangeString, "-")
+	if !ok {
+		return ipRange{}, fmt.Errorf("invalid range %s", rangeString)
+	}
+
+	first, err := parseAddr(firstString)
+	if err != nil {
+		return ipRange{}, err
+	}
+
+	last, err := parseAddr(lastString)
+	if err != nil {
+		return ipRange{}, err
+	}
+
+	if first.BitLen() != last.BitLen() || first.Compare(last) > 0 {
+		return ipRange{}, fmt.Errorf("invalid range %s", rangeString)
+	}
+
+	return ipRange{first: first, last: last}, nil
+}
+
+// ipfilter.dat pads IPv4 octets with zeros, which netip doesn't accept.
+func parseAddr(addressString string) (netip.Addr, error) {
+	addressString = strings.TrimSpace(addressString)
+
+	address, err := netip.ParseAddr(addressString)
+	if err == nil {
+		return address.Unmap(), nil
+	}
+
+	octets := strings.Split(addressString, ".")
+	if len(octets) != net.IPv4len {
+		return netip.Addr{}, fmt.Errorf("invalid IP address %s: %w", addressString, err)
+	}
+
+	var bytes [net.IPv4len]byte
+	for i, octet := range octets {
+		value, err := strconv.ParseUint(octet, 10, 8)
+		if err != nil {
+			return netip.Addr{}, fmt.Errorf("invalid IP address %s: %w", addressString, err)
+		}
+
+		bytes[i] = byte(value)
+	}
+
+	return netip.AddrFrom4(bytes), nil
+}
+
+func prefixRange(prefix netip.Prefix) ipRange {
+	first := prefix.Addr().Unmap()
+	last := first.AsSlice()
+	for bit := prefix.Bits(); bit < len(last)*8; bit++ {
+		last[bit/8] |= 1 << (7 - bit%8)
+	}
+
+	lastAddress, _ := netip.AddrFromSlice(last)
+
+	return ipRange{first: first, last: lastAddress}
+}
+
+func mergeRanges(ranges []ipRange) []ipRange {
+	slices.SortFunc(ranges, func(a, b ipRange) int {
+		return cmp.Or(a.first.Compare(b.first), a.last.Compare(b.last))
+	})
+
+	merged := make([]ipRange, 0, len(ranges))
+	for _, current := range ranges {
+		if len(merged) != 0 {
+			previous := &merged[len(merged)-1]
+			next := previous.last.Next()
+
+			// Next is invalid when the previous range ends with the last address of the family.
+			if previous.last.BitLen() == current.first.BitLen() &&
+				(!next.IsValid() || current.first.Compare(next) <= 0) {
+				if current.last.Compare(previous.last) > 0 {
+					previous.last = current.last
+				}
+
+				continue
+			}
+		}
+
+		merged = append(merged, current)
+	}
+
+	return merged
+}
@@ -0,0 +1,126 @@
+package ip_filter
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFormats(t *testing.T) {
+	path := writeFilter(t, `# comment
+// another comment
+
+001.002.003.000 - 001.002.003.255 , 000 , eMule blocked
+005.005.005.000 - 005.005.005.255 , 200 , eMule allowed
+Some: organisation:10.0.0.0-10.0.0.15
+192.168.0.0/16
+2001:db8::/32
+8.8.8.8
+not an address
+`)
+
+	filter, err := New([]string{path})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		ip      string
+		blocked bool
+	}{
+		{ip: "1.2.3.0", blocked: true},
+		{ip: "1.2.3.255", blocked: true},
+		{ip: "1.2.4.0", blocked: false},
+		{ip: "5.5.5.5", blocked: false},
+		{ip: "10.0.0.15", blocked: true},
+		{ip: "10.0.0.16", blocked: false},
+		{ip: "192.168.100.1", blocked: true},
+		{ip: "::ffff:192.168.100.1", blocked: true},
+		{ip: "2001:db8:ffff::1", blocked: true},
+		{ip: "2001:db9::1", blocked: false},
+		{ip: "8.8.8.8", blocked: true},
+		{ip: "8.8.8.9", blocked: false},
+	}
+
+	for _, test := range tests {
+		if filter.IsBlocked(net.ParseIP(test.ip)) != test.blocked {
+			t.Errorf("expected blocked state of %s to be %v", test.ip, test.blocked)
+		}
+	}
+}
+
+func TestRangesAreMerged(t *testing.T) {
+	path := writeFilter(t, `1.0.0.0-1.0.0.10
+1.0.0.5-1.0.0.20
+1.0.0.21-1.0.0.30
+1.0.0.40-1.0.0.50
+255.255.255.0/24
+255.255.255.255
+::/0
+`)
+
+	filter, err := New([]string{path})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if filter.RangeCount() != 4 {
+		t.Errorf("expected 4 ranges after merging, got %d", filter.RangeCount())
+	}
+
+	if !filter.IsBlocked(net.ParseIP("1.0.0.25")) || filter.IsBlocked(net.ParseIP("1.0.0.35")) {
+		t.Errorf("merged ranges are incorrect")
+	}
+}
+
+func TestReload(t *testing.T) {
+	path := writeFilter(t, "1.1.1.1\n")
+
+	filter, err := New([]string{path})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.WriteFile(path, []byte("2.2.2.2\n"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = filter.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if filter.IsBlocked(net.ParseIP("1.1.1.1")) || !filter.IsBlocked(net.ParseIP("2.2.2.2")) {
+		t.Errorf("filter is not reloaded")
+	}
+
+	os.Remove(path)
+
+	if filter.Reload() == nil {
+		t.Errorf("expected an error when the file is missing")
+	}
+
+	if !filter.IsBlocked(net.ParseIP("2.2.2.2")) {
+		t.Errorf("ranges are dropped after the failed reload")
+	}
+}
+
+func TestNilFilter(t *testing.T) {
+	var filter *Filter
+	if filter.IsBlocked(net.ParseIP("1.1.1.1")) {
+		t.Errorf("nil filter blocks addresses")
+	}
+}
+
+func writeFilter(t *testing.T, contents string) string {
+	path := filepath.Join(t.TempDir(), "filter.txt")
+
+	err := os.WriteFile(path, []byte(contents), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
@@ -1,6 +1,7 @@
 package lsd
 
 import (
+	"context"
 	"crypto/sha1"
 	"encoding/hex"
 	"fmt"
@@ -10,10 +11,12 @@ import (
 	"net/netip"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/mertwole/bittorrent-cli/download/tracker"
 	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
 )
 
 // TODO: Set a bigger time as specified in the BEP14.
@@ -25,7 +28,6 @@ func multicastAddressIpv4() netip.AddrPort {
 	return netip.AddrPortFrom(netip.AddrFrom4([4]byte{239, 192, 152, 143}), multicastPort)
 }
 
-// TODO: Use.
 func multicastAddressIpv6() netip.AddrPort {
 	return netip.AddrPortFrom(netip.AddrFrom16(
 		[16]byte{0xFF, 0x15, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xEF, 0xC0, 0x98, 0x8F}),
@@ -33,21 +35,51 @@ func multicastAddressIpv6() netip.AddrPort {
 	)
 }
 
-// TODO: Accept multiple info hashes.
-func StartDiscovery(
-	infoHash [sha1.Size]byte,
-	discoveredPeers chan<- tracker.PeerInfo,
-	listeningPort uint16,
-	errors chan<- error,
-) {
-	udpAddr := net.UDPAddrFromAddrPort(multicastAddressIpv4())
+// Announcements should fit into a single UDP packet.
+const maxInfoHashesPerAnnouncement = 20
+
+type Discovery struct {
+	listeningPort uint16
+	cookie        string
+	// Announcements from the blocked addresses are ignored.
+	isBlocked func(net.IP) bool
+
+	torrents map[[sha1.Size]byte]chan<- tracker.PeerInfo
+	mutex    sync.RWMutex
+}
 
-	cookie := strconv.FormatInt(rand.Int64(), 36)
+func New(listeningPort uint16, isBlocked func(net.IP) bool) *Discovery {
+	return &Discovery{
+		listeningPort: listeningPort,
+		cookie:        strconv.FormatInt(rand.Int64(), 36),
+		isBlocked:     isBlocked,
+		torrents:      make(map[[sha1.Size]byte]chan<- tracker.PeerInfo),
+	}
+}
+
+func (discovery *Discovery) AddTorrent(infoHash [sha1.Size]byte, discoveredPeers chan<- tracker.PeerInfo) {
+	discovery.mutex.Lock()
+	defer discovery.mutex.Unlock()
+
+	discovery.torrents[infoHash] = discoveredPeers
+}
+
+func (discovery *Discovery) RemoveTorrent(infoHash [sha1.Size]byte) {
+	discovery.mutex.Lock()
+	defer discovery.mutex.Unlock()
+
+	delete(discovery.torrents, infoHash)
+}
+
+func (discovery *Discovery) Start(ctx context.Context) error {
+	udpAddrs := []*net.UDPAddr{
+		net.UDPAddrFromAddrPort(multicastAddressIpv4()),
+		net.UDPAddrFromAddrPort(multicastAddressIpv6()),
+	}
 
 	interfaces, err := net.Interfaces()
 	if err != nil {
-		errors <- fmt.Errorf("failed to get network interfaces: %w", err)
-		return
+		return fmt.Errorf("failed to get network interfaces: %w", err)
 	}
 
 	listeningOnAny := false
@@ -57,47 +89,90 @@ func StartDiscovery(
 		}
 
 		listeningOnAny = true
-		go listenAnnouncements(*udpAddr, infoHash, cookie, listenInterface, discoveredPeers)
+		for _, udpAddr := range udpAddrs {
+			go discovery.listenAnnouncements(ctx, *udpAddr, listenInterface)
+		}
 	}
 
 	if !listeningOnAny {
 		log.Printf("no interfaces supporting multicast are found. cannot start LSD")
-		return
+		return nil
 	}
 
-	infoHashes := [1][sha1.Size]byte{infoHash}
-	message := btSearchMessage{
-		host:       udpAddr.String(),
-		port:       listeningPort,
-		infoHashes: infoHashes[:],
-		cookie:     cookie,
+	// TODO: Announce on all interfaces?
+	conns := make([]*net.UDPConn, 0, len(udpAddrs))
+	for _, udpAddr := range udpAddrs {
+		conn, err := net.DialUDP("udp", nil, udpAddr)
+		if err != nil {
+			// Host might not have IPv4 or IPv6 connectivity.
+			log.Printf("UDP dial to %s failed: %v", udpAddr.String(), err)
+			continue
+		}
+		defer conn.Close()
+
+		conns = append(conns, conn)
 	}
-	request := formatMessage(message)
 
-	// TODO: Announce on all interfaces?
-	conn, err := net.DialUDP("udp", nil, udpAddr)
-	if err != nil {
-		errors <- fmt.Errorf("UDP dial failed: %w", err)
-		return
+	if len(conns) == 0 {
+		return fmt.Errorf("UDP dial failed for all multicast addresses")
 	}
 
 	for {
-		time.Sleep(announceInterval)
+		select {
+		case <-time.After(announceInterval):
+		case <-ctx.Done():
+			return nil
+		}
+
+		for _, conn := range conns {
+			err = discovery.announce(conn)
+			if err != nil {
+				log.Printf("failed to send LSD announcement: %v", err)
+			}
+		}
+	}
+}
+
+func (discovery *Discovery) announce(conn *net.UDPConn) error {
+	infoHashes := discovery.getInfoHashes()
+	for len(infoHashes) > 0 {
+		announcedCount := min(len(infoHashes), maxInfoHashesPerAnnouncement)
 
-		_, err = conn.Write([]byte(request))
+		message := btSearchMessage{
+			host:       conn.RemoteAddr().String(),
+			port:       discovery.listeningPort,
+			infoHashes: infoHashes[:announcedCount],
+			cookie:     discovery.cookie,
+		}
+		request := formatMessage(message)
+
+		_, err := conn.Write([]byte(request))
 		if err != nil {
-			errors <- fmt.Errorf("failed to send request: %w", err)
-			return
+			return fmt.Errorf("failed to send request to %s: %w", conn.RemoteAddr().String(), err)
 		}
+
+		infoHashes = infoHashes[announcedCount:]
 	}
+
+	return nil
 }
 
-func listenAnnouncements(
+func (discovery *Discovery) getInfoHashes() [][sha1.Size]byte {
+	discovery.mutex.RLock()
+	defer discovery.mutex.RUnlock()
+
+	infoHashes := make([][sha1.Size]byte, 0, len(discovery.torrents))
+	for infoHash := range discovery.torrents {
+		infoHashes = append(infoHashes, infoHash)
+	}
+
+	return infoHashes
+}
+
+func (discovery *Discovery) listenAnnouncements(
+	ctx context.Context,
 	address net.UDPAddr,
-	requiredInfoHash [sha1.Size]byte,
-	cookie string,
 	listenInterface net.Interface,
-	discoveredPeers chan<- tracker.PeerInfo,
 ) {
 	conn, err := net.ListenPacket("udp", address.String())
 	if err != nil {
@@ -105,63 +180,101 @@ func listenAnnouncements(
 		return
 	}
 
-	packetConn := ipv4.NewPacketConn(conn)
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
 
-	err = packetConn.JoinGroup(&listenInterface, &address)
+	err = joinMulticastGroup(conn, &address, &listenInterface)
 	if err != nil {
 		log.Printf("failed to join multicast group on interface %s: %v", listenInterface.Name, err)
 		return
 	}
 
-	err = packetConn.SetControlMessage(ipv4.FlagDst, true)
-	if err != nil {
-		log.Printf("failed to set control message on interface %s: %v", listenInterface.Name, err)
-	}
-
-	log.Printf("listening for LSD announcements on interface %s", listenInterface.Name)
+	log.Printf("listening for LSD announcements to %s on interface %s", address.String(), listenInterface.Name)
 
 	for {
 		buffer := make([]byte, readMessageBufferSize)
-		messageLen, _, source, err := packetConn.ReadFrom(buffer)
+		messageLen, source, err := conn.ReadFrom(buffer)
 
 		if err != nil {
-			log.Printf("failed to read UDP message: %v", err)
+			if ctx.Err() == nil {
+				log.Printf("failed to read UDP message: %v", err)
+			}
 			return
 		}
 
 		message, err := parseMessage(string(buffer[:messageLen]))
 		if err != nil {
-			fmt.Printf("failed to read btsearch response: %v", err)
+			log.Printf("failed to read btsearch response: %v", err)
 			continue
 		}
 
-		if message.cookie == cookie {
+		if message.cookie == discovery.cookie {
 			continue
 		}
 
-		infoHashFound := false
-		for _, infoHash := range message.infoHashes {
-			if infoHash == requiredInfoHash {
-				infoHashFound = true
-				break
-			}
+		// TODO: Validate message.host?
+
+		sourceAddress := source.String()
+		sourceAddrPort, err := netip.ParseAddrPort(sourceAddress)
+		if err != nil {
+			log.Panicf("unable to parse address and port: %v", err)
 		}
+		peerInfo := tracker.PeerInfo{IP: sourceAddrPort.Addr().Unmap().AsSlice(), Port: message.port}
 
-		if !infoHashFound {
+		if discovery.isBlocked(peerInfo.IP) {
 			continue
 		}
 
-		// TODO: Validate message.host?
+		for _, infoHash := range message.infoHashes {
+			discovery.mutex.RLock()
+			discoveredPeers, ok := discovery.torrents[infoHash]
+			discovery.mutex.RUnlock()
 
-		sourceAddress := source.String()
-		sourceAddrPort, err := netip.ParseAddrPort(sourceAddress)
+			if !ok {
+				continue
+			}
+
+			select {
+			case discoveredPeers <- peerInfo:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+func joinMulticastGroup(conn net.PacketConn, address *net.UDPAddr, listenInterface *net.Interface) error {
+	if address.IP.To4() != nil {
+		packetConn := ipv4.NewPacketConn(conn)
+
+		err := packetConn.JoinGroup(listenInterface, address)
 		if err != nil {
-			log.Panicf("unable to parse address and port: %v", err)
+			return err
+		}
+
+		err = packetConn.SetControlMessage(ipv4.FlagDst, true)
+		if err != nil {
+			log.Printf("failed to set control message on interface %s: %v", listenInterface.Name, err)
 		}
-		sourceIP := sourceAddrPort.Addr().As4()
 
-		discoveredPeers <- tracker.PeerInfo{IP: sourceIP[:], Port: message.port}
+		return nil
+	}
+
+	packetConn := ipv6.NewPacketConn(conn)
+
+	err := packetConn.JoinGroup(listenInterface, address)
+	if err != nil {
+		return err
+	}
+
+	err = packetConn.SetControlMessage(ipv6.FlagDst, true)
+	if err != nil {
+		log.Printf("failed to set control message on interface %s: %v", listenInterface.Name, err)
 	}
+
+	return nil
 }
 
 type btSearchMessage struct {
@@ -0,0 +1,29 @@
+package lsd
+
+import (
+	"crypto/sha1"
+	"slices"
+	"testing"
+)
+
+func TestFormatParseMultipleInfoHashes(t *testing.T) {
+	message := btSearchMessage{
+		host:       "239.192.152.143:6771",
+		port:       51413,
+		infoHashes: [][sha1.Size]byte{sha1.Sum([]byte("a")), sha1.Sum([]byte("b")), sha1.Sum([]byte("c"))},
+		cookie:     "cookie",
+	}
+
+	parsed, err := parseMessage(formatMessage(message))
+	if err != nil {
+		t.Fatalf("failed to parse message: %v", err)
+	}
+
+	if parsed.host != message.host || parsed.port != message.port || parsed.cookie != message.cookie {
+		t.Errorf("unexpected parsed message: expected %+v, got %+v", message, parsed)
+	}
+
+	if !slices.Equal(parsed.infoHashes, message.infoHashes) {
+		t.Errorf("unexpected info hashes: expected %x, got %x", message.infoHashes, parsed.infoHashes)
+	}
+}
@@ -0,0 +1,425 @@
+package mse
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/rc4"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	mathRand "math/rand/v2"
+	"net"
+	"sync"
+)
+
+const keyLength = 96
+const privateKeyBits = 160
+const maxPaddingLength = 512
+const verificationConstantLength = 8
+
+// First bytes of the RC4 keystream are discarded as they're known to leak information about the key.
+const discardedKeystreamLength = 1024
+
+const (
+	cryptoPlaintext uint32 = 0x01
+	cryptoRC4       uint32 = 0x02
+)
+
+const plaintextHeader = "\x13BitTorrent protocol"
+
+var prime, _ = new(big.Int).SetString(
+	"FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74"+
+		"020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F1437"+
+		"4FE1356D6D51C245E485B576625E7EC6F44C42E9A63A36210000000000090563",
+	16,
+)
+var generator = big.NewInt(2)
+
+type Policy int
+
+const (
+	Disabled Policy = iota
+	Prefer
+	Require
+)
+
+func (policy Policy) String() string {
+	switch policy {
+	case Disabled:
+		return "disabled"
+	case Prefer:
+		return "prefer"
+	case Require:
+		return "require"
+	default:
+		return "unknown"
+	}
+}
+
+func ParsePolicy(policy string) (Policy, bool) {
+	for _, candidate := range []Policy{Disabled, Prefer, Require} {
+		if candidate.String() == policy {
+			return candidate, true
+		}
+	}
+
+	return Disabled, false
+}
+
+func (policy Policy) cryptoProvide() uint32 {
+	if policy == Require {
+		return cryptoRC4
+	}
+
+	return cryptoRC4 | cryptoPlaintext
+}
+
+// Connection that is read and written through the negotiated crypto method.
+// When plaintext is selected ciphers are nil and only the handshake is obfuscated.
+type encryptedConn struct {
+	net.Conn
+
+	reader *bufio.Reader
+	// Payload received during the handshake, it's already decrypted.
+	initialPayload []byte
+	decrypt        *rc4.Cipher
+
+	encrypt    *rc4.Cipher
+	writeMutex sync.Mutex
+}
+
+func (conn *encryptedConn) Read(buffer []byte) (int, error) {
+	if len(conn.initialPayload) != 0 {
+		read := copy(buffer, conn.initialPayload)
+		conn.initialPayload = conn.initialPayload[read:]
+		return read, nil
+	}
+
+	read, err := conn.reader.Read(buffer)
+	if conn.decrypt != nil {
+		conn.decrypt.XORKeyStream(buffer[:read], buffer[:read])
+	}
+
+	return read, err
+}
+
+func (conn *encryptedConn) Write(data []byte) (int, error) {
+	if conn.encrypt == nil {
+		return conn.Conn.Write(data)
+	}
+
+	// Keystream position should match the order in which data is written.
+	conn.writeMutex.Lock()
+	defer conn.writeMutex.Unlock()
+
+	encrypted := make([]byte, len(data))
+	conn.encrypt.XORKeyStream(encrypted, data)
+
+	return conn.Conn.Write(encrypted)
+}
+
+// Performs the handshake on the outgoing connection. Data written to the returned
+// connection is encrypted with RC4 or sent in plaintext, depending on what the peer selects.
+// Deadlines should be set by the caller.
+func Initiate(conn net.Conn, infoHash [sha1.Size]byte, policy Policy) (net.Conn, error) {
+	if policy == Disabled {
+		return conn, nil
+	}
+
+	privateKey, publicKey, err := generateKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	// 1 A->B: Diffie Hellman Ya, PadA
+	err = writeWithPadding(conn, publicKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send public key: %w", err)
+	}
+
+	// 2 B->A: Diffie Hellman Yb, PadB
+	reader := bufio.NewReader(conn)
+	secret, err := readSecret(reader, privateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	// 3 A->B: HASH('req1', S), HASH('req2', SKEY) xor HASH('req3', S), ENCRYPT(VC, crypto_provide, len(PadC), PadC, len(IA)), ENCRYPT(IA)
+	encrypt := newCipher("keyA", secret, infoHash)
+	decrypt := newCipher("keyB", secret, infoHash)
+
+	request := hash("req1", secret)
+	request = append(request, xor(hash("req2", infoHash[:]), hash("req3", secret))...)
+
+	encrypted := make([]byte, verificationConstantLength)
+	encrypted = binary.BigEndian.AppendUint32(encrypted, policy.cryptoProvide())
+	encrypted = binary.BigEndian.AppendUint16(encrypted, 0)
+	encrypted = binary.BigEndian.AppendUint16(encrypted, 0)
+	encrypt.XORKeyStream(encrypted, encrypted)
+
+	_, err = conn.Write(append(request, encrypted...))
+	if err != nil {
+		return nil, fmt.Errorf("failed to send crypto provide: %w", err)
+	}
+
+	// 4 B->A: ENCRYPT(VC, crypto_select, len(padD), padD), ENCRYPT2(Payload Stream)
+	verificationConstant := make([]byte, verificationConstantLength)
+	decrypt.XORKeyStream(verificationConstant, verificationConstant)
+
+	err = synchronize(reader, verificationConstant, maxPaddingLength)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find verification constant: %w", err)
+	}
+
+	response := make([]byte, 4+2)
+	_, err = io.ReadFull(reader, response)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read crypto select: %w", err)
+	}
+	decrypt.XORKeyStream(response, response)
+
+	cryptoSelect := binary.BigEndian.Uint32(response[:4])
+	paddingLength := binary.BigEndian.Uint16(response[4:6])
+	if paddingLength > maxPaddingLength {
+		return nil, fmt.Errorf("invalid padding length %d", paddingLength)
+	}
+
+	padding := make([]byte, paddingLength)
+	_, err = io.ReadFull(reader, padding)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read padding: %w", err)
+	}
+	decrypt.XORKeyStream(padding, padding)
+
+	switch cryptoSelect & policy.cryptoProvide() {
+	case cryptoRC4:
+		return &encryptedConn{Conn: conn, reader: reader, decrypt: decrypt, encrypt: encrypt}, nil
+	case cryptoPlaintext:
+		return &encryptedConn{Conn: conn, reader: reader}, nil
+	default:
+		return nil, fmt.Errorf("peer selected unsupported crypto method %d", cryptoSelect)
+	}
+}
+
+// Performs the handshake on the incoming connection if it's encrypted. Plaintext
+// connections are passed through unless encryption is required.
+// Info hashes are the ones of the torrents the connection might belong to.
+func Accept(conn net.Conn, infoHashes [][sha1.Size]byte, policy Policy) (net.Conn, error) {
+	reader := bufio.NewReader(conn)
+
+	header, err := reader.Peek(len(plaintextHeader))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read handshake: %w", err)
+	}
+
+	if string(header) == plaintextHeader {
+		if policy == Require {
+			return nil, fmt.Errorf("plaintext connections are not allowed")
+		}
+
+		return &encryptedConn{Conn: conn, reader: reader}, nil
+	}
+
+	if policy == Disabled {
+		return nil, fmt.Errorf("encrypted connections are not allowed")
+	}
+
+	privateKey, publicKey, err := generateKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	// 1 A->B: Diffie Hellman Ya, PadA
+	secret, err := readSecret(reader, privateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	// 2 B->A: Diffie Hellman Yb, PadB
+	err = writeWithPadding(conn, publicKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send public key: %w", err)
+	}
+
+	// 3 A->B: HASH('req1', S), HASH('req2', SKEY) xor HASH('req3', S), ENCRYPT(VC, crypto_provide, len(PadC), PadC, len(IA)), ENCRYPT(IA)
+	err = synchronize(reader, hash("req1", secret), maxPaddingLength)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find synchronization hash: %w", err)
+	}
+
+	obfuscatedInfoHash := make([]byte, sha1.Size)
+	_, err = io.ReadFull(reader, obfuscatedInfoHash)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read info hash: %w", err)
+	}
+
+	infoHash, ok := findInfoHash(xor(obfuscatedInfoHash, hash("req3", secret)), infoHashes)
+	if !ok {
+		return nil, fmt.Errorf("peer requested unknown torrent")
+	}
+
+	encrypt := newCipher("keyB", secret, infoHash)
+	decrypt := newCipher("keyA", secret, infoHash)
+
+	request := make([]byte, verificationConstantLength+4+2)
+	_, err = io.ReadFull(reader, request)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read crypto provide: %w", err)
+	}
+	decrypt.XORKeyStream(request, request)
+
+	if !bytes.Equal(request[:verificationConstantLength], make([]byte, verificationConstantLength)) {
+		return nil, fmt.Errorf("invalid verification constant")
+	}
+
+	cryptoProvide := binary.BigEndian.Uint32(request[verificationConstantLength : verificationConstantLength+4])
+	paddingLength := binary.BigEndian.Uint16(request[verificationConstantLength+4:])
+	if paddingLength > maxPaddingLength {
+		return nil, fmt.Errorf("invalid padding length %d", paddingLength)
+	}
+
+	// PadC is followed by len(IA).
+	padding := make([]byte, paddingLength+2)
+	_, err = io.ReadFull(reader, padding)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read padding: %w", err)
+	}
+	decrypt.XORKeyStream(padding, padding)
+
+	initialPayload := make([]byte, binary.BigEndian.Uint16(padding[paddingLength:]))
+	_, err = io.ReadFull(reader, initialPayload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read initial payload: %w", err)
+	}
+	decrypt.XORKeyStream(initialPayload, initialPayload)
+
+	var cryptoSelect uint32
+	switch {
+	case cryptoProvide&cryptoRC4 != 0:
+		cryptoSelect = cryptoRC4
+	case cryptoProvide&policy.cryptoProvide()&cryptoPlaintext != 0:
+		cryptoSelect = cryptoPlaintext
+	default:
+		return nil, fmt.Errorf("peer provided unsupported crypto methods %d", cryptoProvide)
+	}
+
+	// 4 B->A: ENCRYPT(VC, crypto_select, len(padD), padD), ENCRYPT2(Payload Stream)
+	response := make([]byte, verificationConstantLength)
+	response = binary.BigEndian.AppendUint32(response, cryptoSelect)
+	response = binary.BigEndian.AppendUint16(response, 0)
+	encrypt.XORKeyStream(response, response)
+
+	_, err = conn.Write(response)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send crypto select: %w", err)
+	}
+
+	encrypted := encryptedConn{Conn: conn, reader: reader, initialPayload: initialPayload}
+	if cryptoSelect == cryptoRC4 {
+		encrypted.decrypt = decrypt
+		encrypted.encrypt = encrypt
+	}
+
+	return &encrypted, nil
+}
+
+func generateKeys() (privateKey *big.Int, publicKey []byte, err error) {
+	privateKey, err = rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), privateKeyBits))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate private key: %w", err)
+	}
+
+	publicKey = new(big.Int).Exp(generator, privateKey, prime).FillBytes(make([]byte, keyLength))
+
+	return privateKey, publicKey, nil
+}
+
+func readSecret(reader io.Reader, privateKey *big.Int) ([]byte, error) {
+	encodedPublicKey := make([]byte, keyLength)
+	_, err := io.ReadFull(reader, encodedPublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read public key: %w", err)
+	}
+
+	publicKey := new(big.Int).SetBytes(encodedPublicKey)
+	maxPublicKey := new(big.Int).Sub(prime, big.NewInt(1))
+	if publicKey.Cmp(big.NewInt(1)) <= 0 || publicKey.Cmp(maxPublicKey) >= 0 {
+		return nil, fmt.Errorf("invalid public key")
+	}
+
+	return new(big.Int).Exp(publicKey, privateKey, prime).FillBytes(make([]byte, keyLength)), nil
+}
+
+func writeWithPadding(writer io.Writer, data []byte) error {
+	padding := make([]byte, mathRand.IntN(maxPaddingLength+1))
+	_, err := rand.Read(padding)
+	if err != nil {
+		return fmt.Errorf("failed to generate padding: %w", err)
+	}
+
+	_, err = writer.Write(append(data, padding...))
+	return err
+}
+
+// Skips the padding of unknown length until the marker is found.
+func synchronize(reader *bufio.Reader, marker []byte, maxSkipped int) error {
+	window := make([]byte, 0, len(marker)+maxSkipped)
+	for len(window) < cap(window) {
+		nextByte, err := reader.ReadByte()
+		if err != nil {
+			return err
+		}
+
+		window = append(window, nextByte)
+		if bytes.HasSuffix(window, marker) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("marker is not found in %d bytes", maxSkipped)
+}
+
+func findInfoHash(obfuscated []byte, infoHashes [][sha1.Size]byte) ([sha1.Size]byte, bool) {
+	for _, infoHash := range infoHashes {
+		if bytes.Equal(hash("req2", infoHash[:]), obfuscated) {
+			return infoHash, true
+		}
+	}
+
+	return [sha1.Size]byte{}, false
+}
+
+func newCipher(keyName string, secret []byte, infoHash [sha1.Size]byte) *rc4.Cipher {
+	cipher, err := rc4.NewCipher(hash(keyName, secret, infoHash[:]))
+	if err != nil {
+		log.Panicf("failed to create RC4 cipher: %v", err)
+	}
+
+	discarded := make([]byte, discardedKeystreamLength)
+	cipher.XORKeyStream(discarded, discarded)
+
+	return cipher
+}
+
+func hash(prefix string, data ...[]byte) []byte {
+	hasher := sha1.New()
+	hasher.Write([]byte(prefix))
+	for _, chunk := range data {
+		hasher.Write(chunk)
+	}
+
+	return hasher.Sum(nil)
+}
+
+func xor(lhs []byte, rhs []byte) []byte {
+	result := make([]byte, len(lhs))
+	for i := range lhs {
+		result[i] = lhs[i] ^ rhs[i]
+	}
+
+	return result
+}
@@ -0,0 +1,141 @@
+package mse
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestEncryptedConnection(t *testing.T) {
+	tests := []struct {
+		name            string
+		initiatorPolicy Policy
+		acceptorPolicy  Policy
+		encrypted       bool
+		fails           bool
+	}{
+		{name: "prefer", initiatorPolicy: Prefer, acceptorPolicy: Prefer, encrypted: true},
+		{name: "initiator requires", initiatorPolicy: Require, acceptorPolicy: Prefer, encrypted: true},
+		{name: "acceptor requires", initiatorPolicy: Prefer, acceptorPolicy: Require, encrypted: true},
+		{name: "plaintext", initiatorPolicy: Disabled, acceptorPolicy: Prefer, encrypted: false},
+		{name: "plaintext rejected", initiatorPolicy: Disabled, acceptorPolicy: Require, fails: true},
+		{name: "encryption rejected", initiatorPolicy: Prefer, acceptorPolicy: Disabled, fails: true},
+	}
+
+	infoHash := sha1.Sum([]byte("torrent"))
+	infoHashes := [][sha1.Size]byte{sha1.Sum([]byte("other")), infoHash}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			initiatorConn, acceptorConn := connectedPair(t)
+			defer initiatorConn.Close()
+			defer acceptorConn.Close()
+
+			type acceptResult struct {
+				conn net.Conn
+				err  error
+			}
+			accepted := make(chan acceptResult)
+			go func() {
+				conn, err := Accept(acceptorConn, infoHashes, test.acceptorPolicy)
+				if err != nil {
+					acceptorConn.Close()
+				}
+
+				accepted <- acceptResult{conn: conn, err: err}
+			}()
+
+			initiated, err := Initiate(initiatorConn, infoHash, test.initiatorPolicy)
+			if err == nil {
+				_, err = initiated.Write([]byte(plaintextHeader + "payload"))
+			}
+
+			result := <-accepted
+			if test.fails {
+				if result.err == nil {
+					t.Fatalf("connection is accepted")
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("failed to initiate connection: %v", err)
+			}
+			if result.err != nil {
+				t.Fatalf("failed to accept connection: %v", result.err)
+			}
+
+			assertReceived(result.conn, []byte(plaintextHeader+"payload"), t)
+
+			_, err = result.conn.Write([]byte("response"))
+			if err != nil {
+				t.Fatalf("failed to send response: %v", err)
+			}
+
+			assertReceived(initiated, []byte("response"), t)
+
+			encrypted, ok := result.conn.(*encryptedConn)
+			if !ok || (encrypted.encrypt != nil) != test.encrypted {
+				t.Errorf("unexpected crypto method selected: encryption expected to be %t", test.encrypted)
+			}
+		})
+	}
+}
+
+func TestUnknownInfoHash(t *testing.T) {
+	initiatorConn, acceptorConn := connectedPair(t)
+	defer initiatorConn.Close()
+	defer acceptorConn.Close()
+
+	accepted := make(chan error)
+	go func() {
+		_, err := Accept(acceptorConn, [][sha1.Size]byte{sha1.Sum([]byte("other"))}, Prefer)
+		acceptorConn.Close()
+
+		accepted <- err
+	}()
+
+	_, err := Initiate(initiatorConn, sha1.Sum([]byte("torrent")), Prefer)
+	if err == nil {
+		t.Errorf("connection for unknown torrent is initiated")
+	}
+
+	if <-accepted == nil {
+		t.Errorf("connection for unknown torrent is accepted")
+	}
+}
+
+func connectedPair(t *testing.T) (net.Conn, net.Conn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to create listener: %v", err)
+	}
+	defer listener.Close()
+
+	initiator, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+
+	acceptor, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("failed to accept connection: %v", err)
+	}
+
+	return initiator, acceptor
+}
+
+func assertReceived(conn net.Conn, expected []byte, t *testing.T) {
+	received := make([]byte, len(expected))
+	_, err := io.ReadFull(conn, received)
+	if err != nil {
+		t.Fatalf("failed to receive data: %v", err)
+	}
+
+	if !bytes.Equal(received, expected) {
+		t.Errorf("unexpected data received: expected %q, got %q", expected, received)
+	}
+}
@@ -0,0 +1,39 @@
+package peer
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"net"
+	"slices"
+)
+
+// Computes the allowed fast set as specified in the BEP6. It's only defined
+// for IPv4 peers, so an empty set is returned for the others.
+func allowedFastSet(ip net.IP, infoHash [sha1.Size]byte, pieceCount int, size int) []int {
+	ipv4 := ip.To4()
+	if ipv4 == nil {
+		return nil
+	}
+
+	size = min(size, pieceCount)
+	allowed := make([]int, 0, size)
+
+	// Peers in the same /24 network get the same set.
+	hash := make([]byte, 0, net.IPv4len+sha1.Size)
+	hash = append(hash, ipv4.Mask(net.CIDRMask(24, 32))...)
+	hash = append(hash, infoHash[:]...)
+
+	for len(allowed) < size {
+		digest := sha1.Sum(hash)
+		hash = digest[:]
+
+		for i := 0; i < sha1.Size/4 && len(allowed) < size; i++ {
+			piece := int(binary.BigEndian.Uint32(hash[i*4:i*4+4]) % uint32(pieceCount))
+			if !slices.Contains(allowed, piece) {
+				allowed = append(allowed, piece)
+			}
+		}
+	}
+
+	return allowed
+}
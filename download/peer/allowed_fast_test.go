@@ -0,0 +1,39 @@
+package peer
+
+import (
+	"crypto/sha1"
+	"net"
+	"slices"
+	"testing"
+)
+
+func TestAllowedFastSet(t *testing.T) {
+	var infoHash [sha1.Size]byte
+	for i := range infoHash {
+		infoHash[i] = 0xAA
+	}
+
+	// Test vectors from the BEP6.
+	ip := net.IPv4(80, 4, 4, 200)
+
+	allowed := allowedFastSet(ip, infoHash, 1313, 7)
+	expected := []int{1059, 431, 808, 1217, 287, 376, 1188}
+	if !slices.Equal(allowed, expected) {
+		t.Errorf("unexpected allowed fast set: expected %v, got %v", expected, allowed)
+	}
+
+	allowed = allowedFastSet(ip, infoHash, 1313, 9)
+	expected = append(expected, 353, 508)
+	if !slices.Equal(allowed, expected) {
+		t.Errorf("unexpected allowed fast set: expected %v, got %v", expected, allowed)
+	}
+
+	allowed = allowedFastSet(net.IPv4(80, 4, 4, 1), infoHash, 3, 10)
+	if len(allowed) != 3 {
+		t.Errorf("allowed fast set should contain all the pieces: got %v", allowed)
+	}
+
+	if allowedFastSet(net.ParseIP("2001:db8::1"), infoHash, 1313, 10) != nil {
+		t.Errorf("allowed fast set is computed for IPv6 peer")
+	}
+}
@@ -8,6 +8,7 @@ import (
 )
 
 const ConnectionTimeout = time.Second * 120
+const UTPConnectionTimeout = time.Second * 5
 const KeepAliveInterval = time.Second * 120
 const RequestedPiecesPopInterval = time.Millisecond * 100
 const NotifyPresentPiecesInterval = time.Millisecond * 100
@@ -16,13 +17,17 @@ const CancelMessagesSendInterval = time.Millisecond * 100
 const BlockSize = 1 << 14
 const PendingPiecesQueueLength = 5
 const UtMetadataBlockLength = 16384
+const UtPexInterval = time.Minute
+const UtPexMaxPeersPerMessage = 50
+const AllowedFastSetSize = 10
 
 const (
 	UtMetadataExtensionName = "ut_metadata"
+	UtPexExtensionName      = "ut_pex"
 )
 
 func SupportedExtensions() extensions.Extensions {
-	supported := []string{UtMetadataExtensionName}
+	supported := []string{UtMetadataExtensionName, UtPexExtensionName}
 
 	extensions, err := extensions.New(supported)
 	if err != nil {
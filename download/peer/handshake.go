@@ -7,29 +7,74 @@ import (
 )
 
 type Handshake struct {
+	Reserved [8]byte
 	InfoHash [sha1.Size]byte
 	PeerID   [20]byte
 }
 
+// Protocol extensions advertised in the reserved bytes of the handshake.
+type Capabilities struct {
+	// BEP10 - Extension Protocol
+	ExtensionProtocol bool
+	// BEP6 - Fast Extension
+	FastExtension bool
+	// BEP5 - DHT Protocol
+	DHT bool
+}
+
+// Reserved bytes are indexed from the start of the field, bits from the least significant one.
+const (
+	extensionProtocolByte = 5
+	extensionProtocolBit  = 0x10
+	fastExtensionByte     = 7
+	fastExtensionBit      = 0x04
+	dhtByte               = 7
+	dhtBit                = 0x01
+)
+
+// DHT isn't advertised as the PORT message isn't supported.
+var localCapabilities = Capabilities{ExtensionProtocol: true, FastExtension: true}
+
 const handshakeLength = 1 + 19 + 8 + sha1.Size + 20
 const protocolIdentifier = "BitTorrent protocol"
 
+func (capabilities Capabilities) reserved() [8]byte {
+	var reserved [8]byte
+
+	if capabilities.ExtensionProtocol {
+		reserved[extensionProtocolByte] |= extensionProtocolBit
+	}
+	if capabilities.FastExtension {
+		reserved[fastExtensionByte] |= fastExtensionBit
+	}
+	if capabilities.DHT {
+		reserved[dhtByte] |= dhtBit
+	}
+
+	return reserved
+}
+
+func (handshake *Handshake) Capabilities() Capabilities {
+	return Capabilities{
+		ExtensionProtocol: handshake.Reserved[extensionProtocolByte]&extensionProtocolBit != 0,
+		FastExtension:     handshake.Reserved[fastExtensionByte]&fastExtensionBit != 0,
+		DHT:               handshake.Reserved[dhtByte]&dhtBit != 0,
+	}
+}
+
 func (handshake *Handshake) serialize() []byte {
 	serialized := make([]byte, handshakeLength)
 
-	// BEP10 extension available
-	supportedExtensions := []byte{0, 0, 0, 0, 0, 0x10, 0, 0}
-
 	serialized[0] = 0x13
 	copy(serialized[1:20], protocolIdentifier)
-	copy(serialized[20:28], supportedExtensions)
+	copy(serialized[20:28], handshake.Reserved[:])
 	copy(serialized[28:28+sha1.Size], handshake.InfoHash[:])
 	copy(serialized[28+sha1.Size:], handshake.PeerID[:])
 
 	return serialized
 }
 
-func deserializeHandshake(data io.Reader) (*Handshake, error) {
+func DeserializeHandshake(data io.Reader) (*Handshake, error) {
 	protocolNameLength := make([]byte, 1)
 	_, err := io.ReadFull(data, protocolNameLength)
 	if err != nil {
@@ -68,6 +113,7 @@ func deserializeHandshake(data io.Reader) (*Handshake, error) {
 	}
 
 	return &Handshake{
+		Reserved: reserved,
 		InfoHash: infoHash,
 		PeerID:   peerID,
 	}, nil
@@ -0,0 +1,101 @@
+package peer
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"testing"
+)
+
+func TestHandshakeSerializeDeserialize(t *testing.T) {
+	tests := []struct {
+		name         string
+		reserved     [8]byte
+		capabilities Capabilities
+		unknownBits  bool
+	}{
+		{
+			name:         "no extensions",
+			reserved:     [8]byte{},
+			capabilities: Capabilities{},
+		},
+		{
+			name:         "extension protocol",
+			reserved:     [8]byte{0, 0, 0, 0, 0, 0x10, 0, 0},
+			capabilities: Capabilities{ExtensionProtocol: true},
+		},
+		{
+			name:         "fast extension and DHT",
+			reserved:     [8]byte{0, 0, 0, 0, 0, 0, 0, 0x05},
+			capabilities: Capabilities{FastExtension: true, DHT: true},
+		},
+		{
+			name:         "unknown bits",
+			reserved:     [8]byte{0x80, 0, 0, 0, 0, 0x10, 0x01, 0x04},
+			capabilities: Capabilities{ExtensionProtocol: true, FastExtension: true},
+			unknownBits:  true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			original := Handshake{
+				Reserved: test.reserved,
+				InfoHash: sha1.Sum([]byte("torrent")),
+				PeerID:   [20]byte{1, 2, 3},
+			}
+
+			serialized := original.serialize()
+			if len(serialized) != handshakeLength {
+				t.Fatalf("unexpected handshake length: expected %d, got %d", handshakeLength, len(serialized))
+			}
+
+			decoded, err := DeserializeHandshake(bytes.NewReader(serialized))
+			if err != nil {
+				t.Fatalf("failed to deserialize handshake: %v", err)
+			}
+
+			if *decoded != original {
+				t.Errorf("values don't match: expected %v, got %v", original, *decoded)
+			}
+
+			if decoded.Capabilities() != test.capabilities {
+				t.Errorf("unexpected capabilities: expected %+v, got %+v", test.capabilities, decoded.Capabilities())
+			}
+
+			if !test.unknownBits && test.capabilities.reserved() != test.reserved {
+				t.Errorf("capabilities are encoded as %v, expected %v", test.capabilities.reserved(), test.reserved)
+			}
+		})
+	}
+}
+
+func TestHandshakeDeserializeInvalid(t *testing.T) {
+	valid := (&Handshake{InfoHash: sha1.Sum([]byte("torrent"))}).serialize()
+
+	invalidLength := bytes.Clone(valid)
+	invalidLength[0] = 18
+
+	invalidProtocol := bytes.Clone(valid)
+	copy(invalidProtocol[1:20], "BitTorrent protocoL")
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{name: "empty", data: []byte{}},
+		{name: "invalid protocol name length", data: invalidLength},
+		{name: "invalid protocol identifier", data: invalidProtocol},
+		{name: "truncated reserved bytes", data: valid[:24]},
+		{name: "truncated info hash", data: valid[:40]},
+		{name: "truncated peer ID", data: valid[:handshakeLength-1]},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := DeserializeHandshake(bytes.NewReader(test.data))
+			if err == nil {
+				t.Errorf("invalid handshake is deserialized")
+			}
+		})
+	}
+}
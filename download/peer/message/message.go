@@ -10,6 +10,7 @@ import (
 	"github.com/mertwole/bittorrent-cli/download/bencode"
 	"github.com/mertwole/bittorrent-cli/download/peer/constants"
 	"github.com/mertwole/bittorrent-cli/download/peer/extensions"
+	"github.com/mertwole/bittorrent-cli/download/tracker"
 )
 
 const maxPayloadLength = 100_000_000
@@ -26,6 +27,12 @@ const (
 	requestMsgID       messageID = 6
 	pieceMsgID         messageID = 7
 	cancelMsgID        messageID = 8
+	// BEP6 - Fast Extension
+	suggestPieceMsgID  messageID = 13
+	haveAllMsgID       messageID = 14
+	haveNoneMsgID      messageID = 15
+	rejectRequestMsgID messageID = 16
+	allowedFastMsgID   messageID = 17
 	extendedMsgID      messageID = 20
 )
 
@@ -33,6 +40,36 @@ const (
 	extendedHandshakeMsgID messageID = 0
 )
 
+// Payload lengths of the messages that have a fixed size.
+var fixedPayloadLengths = map[messageID]int{
+	chokeMsgID:         0,
+	unchokeMsgID:       0,
+	interestedMsgID:    0,
+	notInterestedMsgID: 0,
+	haveMsgID:          4,
+	requestMsgID:       12,
+	cancelMsgID:        12,
+	suggestPieceMsgID:  4,
+	haveAllMsgID:       0,
+	haveNoneMsgID:      0,
+	rejectRequestMsgID: 12,
+	allowedFastMsgID:   4,
+}
+
+// Minimum payload lengths of the messages that have a variable size.
+var minPayloadLengths = map[messageID]int{
+	pieceMsgID:    8,
+	extendedMsgID: 1,
+}
+
+const (
+	UtPexPrefersEncryption byte = 0x01
+	UtPexSeedOnly          byte = 0x02
+	UtPexSupportsUtp       byte = 0x04
+	UtPexSupportsHolepunch byte = 0x08
+	UtPexReachable         byte = 0x10
+)
+
 const (
 	utMetadataRequest int = 0
 	utMetadataData    int = 1
@@ -65,6 +102,19 @@ type Cancel struct {
 	Length int
 }
 type KeepAlive struct{}
+type SuggestPiece struct {
+	Piece int
+}
+type HaveAll struct{}
+type HaveNone struct{}
+type RejectRequest struct {
+	Piece  int
+	Offset int
+	Length int
+}
+type AllowedFast struct {
+	Piece int
+}
 
 type extended struct {
 	extendedMessageID messageID
@@ -75,9 +125,10 @@ type extended struct {
 type ExtendedHandshake struct {
 	SupportedExtensions map[string]int `bencode:"m"`
 	ClientName          string         `bencode:"v"`
-	//TcpListenPort       *int 			`bencode:"p"`
+	TcpListenPort       *int           `bencode:"p"`
 	//ReceiverIPAddress   *net.IP 		`bencode:"yourip"`
-	//IPv6                *net.IP 		`bencode:"ipv6"`
+	// Compact representation of the sender's IPv6 address.
+	IPv6 *string `bencode:"ipv6"`
 	//IPv4                *net.IP 		`bencode:"ipv4"`
 	//RequestQueueLength  *int 			`bencode:"reqq"`
 	// BEP9 - Extension for Peers to Send Metadata Files (Magnet Links)
@@ -113,6 +164,26 @@ type UtMetadataReject struct {
 }
 type UtMetadataUnknown struct{}
 
+type utPex struct {
+	Added       string  `bencode:"added"`
+	AddedFlags  *string `bencode:"added.f"`
+	Dropped     string  `bencode:"dropped"`
+	Added6      *string `bencode:"added6"`
+	Added6Flags *string `bencode:"added6.f"`
+	Dropped6    *string `bencode:"dropped6"`
+
+	extensions *extensions.Extensions
+}
+
+// Contains both IPv4 and IPv6 peers, they're split into separate lists only on the wire.
+type UtPex struct {
+	Added      []tracker.PeerInfo
+	AddedFlags []byte
+	Dropped    []tracker.PeerInfo
+
+	Extensions *extensions.Extensions
+}
+
 type Message interface {
 	Encode() []byte
 }
@@ -175,6 +246,35 @@ func (msg *Cancel) Encode() []byte {
 	return (&message{ID: cancelMsgID, Payload: payload}).encode()
 }
 
+func (msg *SuggestPiece) Encode() []byte {
+	payload := make([]byte, 0)
+	payload = binary.BigEndian.AppendUint32(payload, uint32(msg.Piece))
+	return (&message{ID: suggestPieceMsgID, Payload: payload}).encode()
+}
+
+func (msg *HaveAll) Encode() []byte {
+	return (&message{ID: haveAllMsgID, Payload: make([]byte, 0)}).encode()
+}
+
+func (msg *HaveNone) Encode() []byte {
+	return (&message{ID: haveNoneMsgID, Payload: make([]byte, 0)}).encode()
+}
+
+func (msg *RejectRequest) Encode() []byte {
+	payload := make([]byte, 0)
+	payload = binary.BigEndian.AppendUint32(payload, uint32(msg.Piece))
+	payload = binary.BigEndian.AppendUint32(payload, uint32(msg.Offset))
+	payload = binary.BigEndian.AppendUint32(payload, uint32(msg.Length))
+
+	return (&message{ID: rejectRequestMsgID, Payload: payload}).encode()
+}
+
+func (msg *AllowedFast) Encode() []byte {
+	payload := make([]byte, 0)
+	payload = binary.BigEndian.AppendUint32(payload, uint32(msg.Piece))
+	return (&message{ID: allowedFastMsgID, Payload: payload}).encode()
+}
+
 func (msg *extended) Encode() []byte {
 	payload := []byte{byte(msg.extendedMessageID)}
 	payload = append(payload, msg.payload...)
@@ -247,6 +347,70 @@ func (msg *UtMetadataUnknown) Encode() []byte {
 	return nil
 }
 
+func (msg *utPex) Encode() []byte {
+	var encodedDictionary bytes.Buffer
+	err := bencode.Serialize(&encodedDictionary, *msg)
+	if err != nil {
+		log.Panicf("cannot encode ut_pex message: %v", err)
+	}
+
+	msgID, ok := msg.extensions.GetID(constants.UtPexExtensionName)
+	if !ok {
+		log.Panicf("failed to get extension ID by name: %s", constants.UtPexExtensionName)
+	}
+
+	extendedMessage := extended{extendedMessageID: messageID(msgID), payload: encodedDictionary.Bytes()}
+	return extendedMessage.Encode()
+}
+
+func (msg *UtPex) Encode() []byte {
+	added, added6 := make([]byte, 0), make([]byte, 0)
+	addedFlags, added6Flags := make([]byte, 0), make([]byte, 0)
+	for i, peer := range msg.Added {
+		var flags byte
+		if i < len(msg.AddedFlags) {
+			flags = msg.AddedFlags[i]
+		}
+
+		if peer.IsIPv4() {
+			added = append(added, peer.EncodeCompact()...)
+			addedFlags = append(addedFlags, flags)
+		} else {
+			added6 = append(added6, peer.EncodeCompact()...)
+			added6Flags = append(added6Flags, flags)
+		}
+	}
+
+	dropped, dropped6 := make([]byte, 0), make([]byte, 0)
+	for _, peer := range msg.Dropped {
+		if peer.IsIPv4() {
+			dropped = append(dropped, peer.EncodeCompact()...)
+		} else {
+			dropped6 = append(dropped6, peer.EncodeCompact()...)
+		}
+	}
+
+	addedFlagsString := string(addedFlags)
+	encoded := utPex{
+		Added:      string(added),
+		AddedFlags: &addedFlagsString,
+		Dropped:    string(dropped),
+		extensions: msg.Extensions,
+	}
+
+	if len(added6) != 0 {
+		added6String, added6FlagsString := string(added6), string(added6Flags)
+		encoded.Added6 = &added6String
+		encoded.Added6Flags = &added6FlagsString
+	}
+	if len(dropped6) != 0 {
+		dropped6String := string(dropped6)
+		encoded.Dropped6 = &dropped6String
+	}
+
+	return encoded.Encode()
+}
+
 func (msg *KeepAlive) Encode() []byte {
 	return make([]byte, 0)
 }
@@ -299,7 +463,14 @@ func Decode(reader io.Reader) (Message, error) {
 		return nil, fmt.Errorf("failed to read message payload: %w", err)
 	}
 
-	// TODO: Assert message lengths.
+	if expected, ok := fixedPayloadLengths[id]; ok && len(payload) != expected {
+		return nil, fmt.Errorf("invalid payload length of message %d: expected %d, got %d", id, expected, len(payload))
+	}
+
+	if expected, ok := minPayloadLengths[id]; ok && len(payload) < expected {
+		return nil, fmt.Errorf("invalid payload length of message %d: expected at least %d, got %d", id, expected, len(payload))
+	}
+
 	switch id {
 	case chokeMsgID:
 		return &Choke{}, nil
@@ -329,6 +500,21 @@ func Decode(reader io.Reader) (Message, error) {
 		offset := binary.BigEndian.Uint32(payload[4:8])
 		length := binary.BigEndian.Uint32(payload[8:12])
 		return &Cancel{Piece: int(piece), Offset: int(offset), Length: int(length)}, nil
+	case suggestPieceMsgID:
+		piece := binary.BigEndian.Uint32(payload[:4])
+		return &SuggestPiece{Piece: int(piece)}, nil
+	case haveAllMsgID:
+		return &HaveAll{}, nil
+	case haveNoneMsgID:
+		return &HaveNone{}, nil
+	case rejectRequestMsgID:
+		piece := binary.BigEndian.Uint32(payload[:4])
+		offset := binary.BigEndian.Uint32(payload[4:8])
+		length := binary.BigEndian.Uint32(payload[8:12])
+		return &RejectRequest{Piece: int(piece), Offset: int(offset), Length: int(length)}, nil
+	case allowedFastMsgID:
+		piece := binary.BigEndian.Uint32(payload[:4])
+		return &AllowedFast{Piece: int(piece)}, nil
 	case extendedMsgID:
 		extendedMessageID := messageID(payload[0])
 		payload := payload[1:]
@@ -390,8 +576,64 @@ func (extended *extended) decode() (Message, error) {
 			log.Printf("unknown ut_metadata message type: %d", decoded.MessageType)
 			return &UtMetadataUnknown{}, nil
 		}
+	case constants.UtPexExtensionName:
+		decoded := utPex{}
+		err := bencode.Deserialize(buffer, &decoded)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ut_pex message: %w", err)
+		}
+
+		added, err := tracker.DecodeCompactPeerInfo([]byte(decoded.Added))
+		if err != nil {
+			return nil, fmt.Errorf("invalid ut_pex added peers: %w", err)
+		}
+
+		dropped, err := tracker.DecodeCompactPeerInfo([]byte(decoded.Dropped))
+		if err != nil {
+			return nil, fmt.Errorf("invalid ut_pex dropped peers: %w", err)
+		}
+
+		addedFlags := make([]byte, 0)
+		if decoded.AddedFlags != nil {
+			addedFlags = []byte(*decoded.AddedFlags)
+		}
+
+		if decoded.Added6 != nil {
+			added6, err := tracker.DecodeCompactPeerInfo6([]byte(*decoded.Added6))
+			if err != nil {
+				return nil, fmt.Errorf("invalid ut_pex added IPv6 peers: %w", err)
+			}
+
+			added6Flags := make([]byte, 0)
+			if decoded.Added6Flags != nil {
+				added6Flags = []byte(*decoded.Added6Flags)
+			}
+
+			// Flags of IPv6 peers should stay aligned with them after concatenation.
+			addedFlags = append(resizeFlags(addedFlags, len(added)), resizeFlags(added6Flags, len(added6))...)
+
+			added = append(added, added6...)
+		}
+
+		if decoded.Dropped6 != nil {
+			dropped6, err := tracker.DecodeCompactPeerInfo6([]byte(*decoded.Dropped6))
+			if err != nil {
+				return nil, fmt.Errorf("invalid ut_pex dropped IPv6 peers: %w", err)
+			}
+
+			dropped = append(dropped, dropped6...)
+		}
+
+		return &UtPex{Added: added, AddedFlags: addedFlags, Dropped: dropped}, nil
 	default:
 		log.Panicf("unknown extended message: %s", name)
 		return nil, nil
 	}
 }
+
+func resizeFlags(flags []byte, length int) []byte {
+	resized := make([]byte, length)
+	copy(resized, flags)
+
+	return resized
+}
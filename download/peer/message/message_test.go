@@ -0,0 +1,84 @@
+package message
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/mertwole/bittorrent-cli/download/peer/constants"
+	"github.com/mertwole/bittorrent-cli/download/tracker"
+)
+
+func TestUtPexEncodeDecode(t *testing.T) {
+	extensions := constants.SupportedExtensions()
+
+	original := UtPex{
+		Added: []tracker.PeerInfo{
+			{IP: net.IPv4(10, 0, 0, 1).To4(), Port: 6881},
+			{IP: net.IPv4(192, 168, 1, 2).To4(), Port: 51413},
+			{IP: net.ParseIP("2001:db8::1"), Port: 6882},
+		},
+		AddedFlags: []byte{UtPexReachable, UtPexSeedOnly | UtPexSupportsUtp, UtPexPrefersEncryption},
+		Dropped: []tracker.PeerInfo{
+			{IP: net.IPv4(172, 16, 0, 3).To4(), Port: 1},
+			{IP: net.ParseIP("2001:db8::2"), Port: 2},
+		},
+		Extensions: &extensions,
+	}
+
+	decoded, err := Decode(bytes.NewReader(original.Encode()))
+	if err != nil {
+		t.Fatalf("failed to decode ut_pex message: %v", err)
+	}
+
+	decodedPex, ok := decoded.(*UtPex)
+	if !ok {
+		t.Fatalf("unexpected message type decoded: %T", decoded)
+	}
+
+	original.Extensions = nil
+	if !reflect.DeepEqual(*decodedPex, original) {
+		t.Errorf("values don't match: expected %v, got %v", original, *decodedPex)
+	}
+}
+
+func TestFastExtensionEncodeDecode(t *testing.T) {
+	messages := []Message{
+		&SuggestPiece{Piece: 12},
+		&HaveAll{},
+		&HaveNone{},
+		&RejectRequest{Piece: 3, Offset: 16384, Length: 16384},
+		&AllowedFast{Piece: 1059},
+	}
+
+	for _, original := range messages {
+		decoded, err := Decode(bytes.NewReader(original.Encode()))
+		if err != nil {
+			t.Fatalf("failed to decode %T message: %v", original, err)
+		}
+
+		if !reflect.DeepEqual(decoded, original) {
+			t.Errorf("values don't match: expected %v, got %v", original, decoded)
+		}
+	}
+}
+
+func TestInvalidPayloadLength(t *testing.T) {
+	encoded := [][]byte{
+		{0, 0, 0, 2, byte(haveMsgID), 1},
+		{0, 0, 0, 2, byte(suggestPieceMsgID), 1},
+		{0, 0, 0, 2, byte(haveAllMsgID), 1},
+		{0, 0, 0, 2, byte(rejectRequestMsgID), 1},
+		{0, 0, 0, 2, byte(allowedFastMsgID), 1},
+		{0, 0, 0, 5, byte(pieceMsgID), 0, 0, 0, 1},
+		{0, 0, 0, 1, byte(extendedMsgID)},
+	}
+
+	for _, message := range encoded {
+		_, err := Decode(bytes.NewReader(message))
+		if err == nil {
+			t.Errorf("message %d with payload of length %d is decoded", message[4], len(message)-5)
+		}
+	}
+}
@@ -6,81 +6,175 @@ import (
 	"encoding/hex"
 	"fmt"
 	"log"
+	"math"
 	"net"
+	"net/netip"
+	"slices"
 	"strconv"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/mertwole/bittorrent-cli/download/bitfield"
 	"github.com/mertwole/bittorrent-cli/download/downloaded_files"
+	"github.com/mertwole/bittorrent-cli/download/mse"
 	"github.com/mertwole/bittorrent-cli/download/peer/constants"
 	"github.com/mertwole/bittorrent-cli/download/peer/extensions"
 	"github.com/mertwole/bittorrent-cli/download/peer/message"
 	"github.com/mertwole/bittorrent-cli/download/peer/pending_pieces"
 	"github.com/mertwole/bittorrent-cli/download/peer/requested_pieces"
+	"github.com/mertwole/bittorrent-cli/download/piece_picker"
 	"github.com/mertwole/bittorrent-cli/download/pieces"
+	"github.com/mertwole/bittorrent-cli/download/rate_limiter"
+	"github.com/mertwole/bittorrent-cli/download/smart_ban"
 	"github.com/mertwole/bittorrent-cli/download/torrent_info"
 	"github.com/mertwole/bittorrent-cli/download/tracker"
+	"github.com/mertwole/bittorrent-cli/download/utp"
 )
 
 type Peer struct {
 	info       tracker.PeerInfo
-	clientName string
+	clientName atomic.Pointer[string]
+	// Listen port and extensions are updated by extended handshakes, while PEX is sent from the download goroutine.
+	listenPort             *uint16
+	availableExtensions    extensions.Extensions
+	extendedHandshakeMutex sync.RWMutex
 
 	connection net.Conn
+	// Outgoing connections are tried over uTP first when it's set.
+	utpSocket *utp.Socket
 
-	chocked             bool
-	availablePieces     *bitfield.ConcurrentBitfield
-	availableExtensions extensions.Extensions
+	chocked         bool
+	amChoking       atomic.Bool
+	interested      atomic.Bool
+	availablePieces *bitfield.ConcurrentBitfield
+	// Capabilities supported by both sides of the connection.
+	capabilities Capabilities
+
+	// Pieces the peer allows us to request while we're choked.
+	allowedFastPieces *bitfield.ConcurrentBitfield
+	// Pieces we allow the peer to request while it's choked.
+	grantedFastPieces []int
 
 	pendingPieces   pending_pieces.PendingPieces
 	requestedPieces requested_pieces.RequestedPieces
 
-	pieces *pieces.Pieces
+	pieces      *pieces.Pieces
+	piecePicker *piece_picker.PiecePicker
+	smartBan    *smart_ban.SmartBan
+	// Peers received via PEX are dropped if blocked.
+	isBlocked func(net.IP) bool
+
+	discoveredPeers chan<- tracker.PeerInfo
+	pexSentPeers    map[string]tracker.PeerInfo
+	pexMutex        sync.Mutex
 
 	endgameMode atomic.Bool
+
+	downloadedBytes atomic.Uint64
+	uploadedBytes   atomic.Uint64
+	// Pieces received from the peer that failed the hash check.
+	hashFailures atomic.Uint64
 }
 
 func (peer *Peer) GetInfo() tracker.PeerInfo {
 	return peer.info
 }
 
-func (peer *Peer) Connect(info *tracker.PeerInfo, existingConnection *net.Conn) error {
+func (peer *Peer) GetListenInfo() tracker.PeerInfo {
+	info := peer.info
+	if listenPort := peer.getListenPort(); listenPort != nil {
+		info.Port = *listenPort
+	}
+
+	return info
+}
+
+func (peer *Peer) Connect(info *tracker.PeerInfo, existingConnection *net.Conn, utpSocket *utp.Socket) error {
 	peer.info = *info
+	peer.utpSocket = utpSocket
 	peer.chocked = true
+	peer.amChoking.Store(true)
 	peer.availableExtensions = extensions.Empty()
 
 	if existingConnection == nil {
-		conn, err := net.DialTimeout(
-			"tcp",
-			info.IP.String()+":"+strconv.Itoa(int(info.Port)),
-			constants.ConnectionTimeout,
-		)
-		if err != nil {
-			return fmt.Errorf("failed to establish connection with peer %s: %w", info.IP.String(), err)
+		return peer.dial()
+	}
+
+	peer.connection = *existingConnection
+
+	return nil
+}
+
+func (peer *Peer) dial() error {
+	address := net.JoinHostPort(peer.info.IP.String(), strconv.Itoa(int(peer.info.Port)))
+
+	if peer.utpSocket != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), constants.UTPConnectionTimeout)
+		conn, err := peer.utpSocket.Dial(ctx, address)
+		cancel()
+
+		if err == nil {
+			peer.connection = conn
+			return nil
 		}
 
-		peer.connection = conn
-	} else {
-		peer.connection = *existingConnection
+		log.Printf("failed to establish uTP connection with peer %s, falling back to TCP: %v", peer.info.IP.String(), err)
 	}
 
+	conn, err := net.DialTimeout("tcp", address, constants.ConnectionTimeout)
+	if err != nil {
+		return fmt.Errorf("failed to establish connection with peer %s: %w", peer.info.IP.String(), err)
+	}
+
+	peer.connection = conn
+
 	return nil
 }
 
-func (peer *Peer) Handshake(infoHash [sha1.Size]byte) error {
-	handshake := Handshake{
-		PeerID:   [20]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 0},
-		InfoHash: infoHash,
+// Wraps the outgoing connection into Message Stream Encryption. Peers that don't support
+// it usually drop the connection, so it's reestablished in plaintext unless encryption is required.
+func (peer *Peer) EstablishEncryption(infoHash [sha1.Size]byte, policy mse.Policy) error {
+	if policy == mse.Disabled {
+		return nil
 	}
-	serializedHandshake := handshake.serialize()
 
-	_, err := peer.connection.Write(serializedHandshake)
+	peer.connection.SetDeadline(time.Now().Add(constants.ConnectionTimeout))
+	encrypted, err := mse.Initiate(peer.connection, infoHash, policy)
+	peer.connection.SetDeadline(time.Time{})
+
+	if err == nil {
+		peer.connection = encrypted
+		return nil
+	}
+
+	peer.connection.Close()
+
+	if policy == mse.Require {
+		return fmt.Errorf("failed to establish encrypted connection with peer %s: %w", peer.info.IP.String(), err)
+	}
+
+	log.Printf(
+		"failed to establish encrypted connection with peer %s, falling back to plaintext: %v",
+		peer.info.IP.String(),
+		err,
+	)
+
+	return peer.dial()
+}
+
+// Throttles all the subsequent reads and writes. Should be called before the exchange is started.
+func (peer *Peer) LimitRate(downloadLimiters []*rate_limiter.Limiter, uploadLimiters []*rate_limiter.Limiter) {
+	peer.connection = rate_limiter.NewConn(peer.connection, downloadLimiters, uploadLimiters)
+}
+
+func (peer *Peer) Handshake(infoHash [sha1.Size]byte, localPeerID [20]byte) error {
+	err := peer.sendHandshake(infoHash, localPeerID)
 	if err != nil {
-		return fmt.Errorf("failed to send request to the peer %s: %w", peer.info.IP.String(), err)
+		return err
 	}
 
-	responseHandshake, err := deserializeHandshake(peer.connection)
+	responseHandshake, err := DeserializeHandshake(peer.connection)
 	if err != nil {
 		return fmt.Errorf("failed to decode handshake from peer %s: %w", peer.info.IP.String(), err)
 	}
@@ -94,12 +188,74 @@ func (peer *Peer) Handshake(infoHash [sha1.Size]byte) error {
 		)
 	}
 
-	// TODO: Check if extension protocol(BEP10) is supported.
+	if responseHandshake.PeerID == localPeerID {
+		return fmt.Errorf("connected to ourselves via %s", peer.info.IP.String())
+	}
+
+	if peer.info.PeerID != nil && responseHandshake.PeerID != *peer.info.PeerID {
+		return fmt.Errorf(
+			"invalid peer ID received from the peer %s: expected %x, got %x",
+			peer.info.IP.String(),
+			*peer.info.PeerID,
+			responseHandshake.PeerID,
+		)
+	}
+	peer.info.PeerID = &responseHandshake.PeerID
+	peer.setCapabilities(responseHandshake.Capabilities())
+
+	return peer.sendExtendedHandshake()
+}
+
+// Responds to the handshake that is already received from the peer.
+func (peer *Peer) AcceptHandshake(remoteHandshake *Handshake, localPeerID [20]byte) error {
+	peer.info.PeerID = &remoteHandshake.PeerID
+	peer.setCapabilities(remoteHandshake.Capabilities())
+
+	err := peer.sendHandshake(remoteHandshake.InfoHash, localPeerID)
+	if err != nil {
+		return err
+	}
+
+	return peer.sendExtendedHandshake()
+}
+
+func (peer *Peer) sendHandshake(infoHash [sha1.Size]byte, localPeerID [20]byte) error {
+	handshake := Handshake{
+		Reserved: localCapabilities.reserved(),
+		PeerID:   localPeerID,
+		InfoHash: infoHash,
+	}
+	serializedHandshake := handshake.serialize()
+
+	_, err := peer.connection.Write(serializedHandshake)
+	if err != nil {
+		return fmt.Errorf("failed to send request to the peer %s: %w", peer.info.IP.String(), err)
+	}
+
+	return nil
+}
+
+func (peer *Peer) setCapabilities(remote Capabilities) {
+	peer.capabilities = Capabilities{
+		ExtensionProtocol: localCapabilities.ExtensionProtocol && remote.ExtensionProtocol,
+		FastExtension:     localCapabilities.FastExtension && remote.FastExtension,
+		DHT:               localCapabilities.DHT && remote.DHT,
+	}
+}
+
+func (peer *Peer) sendExtendedHandshake() error {
+	if !peer.capabilities.ExtensionProtocol {
+		return nil
+	}
 
 	supportedExtensions := constants.SupportedExtensions()
 	extendedHandshake := message.ExtendedHandshake{SupportedExtensions: supportedExtensions.GetMapping()}
+	if ipv6 := globalIPv6Address(); ipv6 != nil {
+		encoded := string(ipv6)
+		extendedHandshake.IPv6 = &encoded
+	}
 
-	_, err = peer.connection.Write(extendedHandshake.Encode())
+	_, err := peer.connection.Write(extendedHandshake.Encode())
 	if err != nil {
 		return fmt.Errorf("failed to send extended handshake to the peer %s: %w", peer.info.IP.String(), err)
 	}
@@ -107,8 +263,31 @@ func (peer *Peer) Handshake(infoHash [sha1.Size]byte) error {
 	return nil
 }
 
+// Lets peers connected over IPv4 know they can reach us over IPv6 as well.
+func globalIPv6Address() net.IP {
+	addresses, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil
+	}
+
+	for _, address := range addresses {
+		ipNet, ok := address.(*net.IPNet)
+		if !ok || ipNet.IP.To4() != nil || !ipNet.IP.IsGlobalUnicast() || ipNet.IP.IsPrivate() {
+			continue
+		}
+
+		return ipNet.IP.To16()
+	}
+
+	return nil
+}
+
 // TODO: Make cancellable and get rid of Peer.Close()
 func (peer *Peer) RequestMetadata() ([]byte, error) {
+	if !peer.capabilities.ExtensionProtocol {
+		return nil, fmt.Errorf("peer %s doesn't support extension protocol", peer.info.IP.String())
+	}
+
 Outer:
 	for {
 		receivedMessage, err := message.Decode(peer.connection)
@@ -118,17 +297,23 @@ Outer:
 
 		switch msg := receivedMessage.(type) {
 		case *message.ExtendedHandshake:
-			peer.availableExtensions, err = extensions.FromMap(msg.SupportedExtensions)
+			err = peer.setExtensions(msg.SupportedExtensions)
 			if err != nil {
-				return nil, fmt.Errorf("failed to decode extensions: %w", err)
+				return nil, err
 			}
 
-			peer.clientName = msg.ClientName
+			peer.clientName.Store(&msg.ClientName)
+			peer.setListenPort(msg.TcpListenPort)
 
 			break Outer
 		}
 	}
 
+	availableExtensions := peer.getExtensions()
+	if _, ok := availableExtensions.GetID(constants.UtMetadataExtensionName); !ok {
+		return nil, fmt.Errorf("peer %s doesn't support %s", peer.info.IP.String(), constants.UtMetadataExtensionName)
+	}
+
 	data, totalSize, err := peer.requestMetadataPiece(0)
 	if err != nil {
 		return nil, err
@@ -156,7 +341,8 @@ func (peer *Peer) Close() {
 }
 
 func (peer *Peer) requestMetadataPiece(piece int) (data []byte, totalSize int, errr error) {
-	request := message.UtMetadataRequest{Piece: piece, Extensions: &peer.availableExtensions}
+	availableExtensions := peer.getExtensions()
+	request := message.UtMetadataRequest{Piece: piece, Extensions: &availableExtensions}
 	_, err := peer.connection.Write(request.Encode())
 	if err != nil {
 		return nil, 0, fmt.Errorf("failed to send metadata request: %w", err)
@@ -185,13 +371,36 @@ func (peer *Peer) StartExchange(
 	ctx context.Context,
 	torrent *torrent_info.TorrentInfo,
 	pieces *pieces.Pieces,
+	piecePicker *piece_picker.PiecePicker,
 	downloadedPieces *downloaded_files.DownloadedFiles,
+	smartBan *smart_ban.SmartBan,
+	isBlocked func(net.IP) bool,
+	discoveredPeers chan<- tracker.PeerInfo,
 ) error {
 	// TODO: Cancel goroutines when error occured and cleanup the pendingPieces.
 
 	peer.pieces = pieces
+	peer.piecePicker = piecePicker
+	peer.smartBan = smartBan
+	peer.isBlocked = isBlocked
+	peer.discoveredPeers = discoveredPeers
+	peer.pexSentPeers = make(map[string]tracker.PeerInfo)
 	peer.pendingPieces = pending_pieces.NewPendingPieces()
 	peer.availablePieces = bitfield.NewEmptyConcurrentBitfield(len(torrent.Pieces))
+	peer.allowedFastPieces = bitfield.NewEmptyConcurrentBitfield(len(torrent.Pieces))
+	if peer.capabilities.FastExtension {
+		peer.grantedFastPieces = allowedFastSet(
+			peer.info.IP,
+			torrent.InfoHash,
+			len(torrent.Pieces),
+			constants.AllowedFastSetSize,
+		)
+	}
+
+	defer func() {
+		available := peer.availablePieces.GetBitfield()
+		peer.piecePicker.RemoveAvailableBitfield(&available)
+	}()
 
 	err := peer.sendInitialMessages()
 	if err != nil {
@@ -254,6 +463,15 @@ func (peer *Peer) listen(
 			continue
 		}
 
+		// BEP 6 requires closing the connection when these are sent without the fast extension negotiated.
+		switch receivedMessage.(type) {
+		case *message.SuggestPiece, *message.HaveAll, *message.HaveNone, *message.RejectRequest, *message.AllowedFast:
+			if !peer.capabilities.FastExtension {
+				errors <- fmt.Errorf("received %T message without the fast extension negotiated", receivedMessage)
+				return
+			}
+		}
+
 		switch msg := receivedMessage.(type) {
 		case *message.KeepAlive:
 			continue
@@ -262,20 +480,46 @@ func (peer *Peer) listen(
 		case *message.Unchoke:
 			peer.chocked = false
 		case *message.Interested:
-			// TODO
+			peer.interested.Store(true)
 		case *message.NotInterested:
-			// TODO
+			peer.interested.Store(false)
 		case *message.Have:
-			peer.availablePieces.AddPiece(uint64(msg.Piece))
+			if msg.Piece < 0 || msg.Piece >= len(torrent.Pieces) {
+				errors <- fmt.Errorf("received have message with invalid piece index %d", msg.Piece)
+				return
+			}
+
+			if !peer.availablePieces.ContainsPiece(msg.Piece) {
+				peer.availablePieces.AddPiece(uint64(msg.Piece))
+				peer.piecePicker.AddAvailablePiece(msg.Piece)
+			}
 		case *message.Bitfield:
-			peer.availablePieces = bitfield.NewConcurrentBitfield(
-				msg.Bitfield,
-				len(torrent.Pieces),
-			)
+			if len(msg.Bitfield) != (len(torrent.Pieces)+7)/8 {
+				errors <- fmt.Errorf("received bitfield of invalid length %d", len(msg.Bitfield))
+				return
+			}
+
+			peer.setAvailablePieces(bitfield.NewBitfield(msg.Bitfield, len(torrent.Pieces)))
+		case *message.HaveAll:
+			peer.setAvailablePieces(bitfield.NewFullBitfield(len(torrent.Pieces)))
+		case *message.HaveNone:
+			peer.setAvailablePieces(bitfield.NewEmptyBitfield(len(torrent.Pieces)))
 		case *message.Request:
 			request := requested_pieces.PieceRequest{Piece: msg.Piece, Offset: msg.Offset, Length: msg.Length}
+			if !peer.canServeRequest(torrent, request) {
+				err := peer.rejectRequests([]requested_pieces.PieceRequest{request})
+				if err != nil {
+					errors <- err
+					return
+				}
+
+				continue
+			}
+
 			peer.requestedPieces.AddRequest(request)
 		case *message.Piece:
+			peer.downloadedBytes.Add(uint64(len(msg.Data)))
+
 			donePiece, err := peer.pendingPieces.InsertData(msg.Piece, msg.Offset, msg.Data)
 			if err != nil {
 				log.Printf("failed to insert data to the pending piece: %v", err)
@@ -293,8 +537,13 @@ func (peer *Peer) listen(
 						hex.EncodeToString(sha1[:]),
 					)
 
+					peer.hashFailures.Add(1)
+					peer.reportHashFailure(msg.Piece, donePiece.Data)
+
 					newState = pieces.NotDownloaded
 				} else {
+					peer.smartBan.PiecePassed(msg.Piece, donePiece.Data)
+
 					globalOffset := uint64(msg.Piece) * torrent.PieceLength
 					downloadedPieces.WritePiece(
 						downloaded_files.DownloadedPiece{
@@ -321,13 +570,45 @@ func (peer *Peer) listen(
 			}
 		case *message.Cancel:
 			request := requested_pieces.PieceRequest{Piece: msg.Piece, Offset: msg.Offset, Length: msg.Length}
-			peer.requestedPieces.CancelRequest(request)
+			// With the fast extension every request should be answered with either piece or reject.
+			if peer.requestedPieces.CancelRequest(request) {
+				err := peer.rejectRequests([]requested_pieces.PieceRequest{request})
+				if err != nil {
+					errors <- err
+					return
+				}
+			}
+		case *message.RejectRequest:
+			peer.releaseRejectedPiece(msg.Piece, msg.Offset, msg.Length)
+		case *message.AllowedFast:
+			if msg.Piece >= 0 && msg.Piece < len(torrent.Pieces) {
+				peer.allowedFastPieces.AddPiece(uint64(msg.Piece))
+			}
+		case *message.SuggestPiece:
+			// Suggestions are advisory, the piece picker keeps picking rarest pieces first.
+			continue
 		case *message.ExtendedHandshake:
-			peer.availableExtensions, err = extensions.FromMap(msg.SupportedExtensions)
+			err = peer.setExtensions(msg.SupportedExtensions)
 			if err != nil {
-				errors <- fmt.Errorf("failed to decode extensions: %w", err)
+				errors <- err
+			}
+			peer.clientName.Store(&msg.ClientName)
+			peer.setListenPort(msg.TcpListenPort)
+
+			// Peer might be reachable over IPv6 as well, so it's treated as a separate peer.
+			listenPort := peer.getListenPort()
+			if msg.IPv6 != nil && len(*msg.IPv6) == net.IPv6len && peer.info.IsIPv4() && listenPort != nil &&
+				!peer.isBlocked(net.IP(*msg.IPv6)) {
+				peer.discoveredPeers <- tracker.PeerInfo{IP: net.IP(*msg.IPv6), Port: *listenPort}
+			}
+		case *message.UtPex:
+			log.Printf("received %d peers via ut_pex", len(msg.Added))
+
+			for _, added := range msg.Added {
+				if !peer.isBlocked(added.IP) {
+					peer.discoveredPeers <- added
+				}
 			}
-			peer.clientName = msg.ClientName
 		case *message.UtMetadataRequest,
 			*message.UtMetadataData,
 			*message.UtMetadataReject,
@@ -337,79 +618,283 @@ func (peer *Peer) listen(
 	}
 }
 
+// Blocks of the pending piece are always received from the same peer.
+func (peer *Peer) reportHashFailure(piece int, data []byte) {
+	address, ok := netip.AddrFromSlice(peer.info.IP)
+	if !ok {
+		log.Printf("failed to attribute hash failure of piece #%d: invalid peer IP %s", piece, peer.info.IP.String())
+		return
+	}
+
+	peer.smartBan.PieceFailed(piece, smart_ban.BlocksFrom(data, address))
+}
+
+func (peer *Peer) setAvailablePieces(available bitfield.Bitfield) {
+	previous := peer.availablePieces.GetBitfield()
+	peer.piecePicker.RemoveAvailableBitfield(&previous)
+
+	peer.availablePieces.SetBitfield(available)
+	peer.piecePicker.AddAvailableBitfield(&available)
+}
+
+func (peer *Peer) canServeRequest(torrent *torrent_info.TorrentInfo, request requested_pieces.PieceRequest) bool {
+	if request.Piece < 0 || request.Piece >= peer.pieces.Length() {
+		return false
+	}
+
+	if request.Offset < 0 || request.Length <= 0 || request.Length > constants.BlockSize ||
+		request.Offset+request.Length > pieceLength(torrent, request.Piece) {
+		return false
+	}
+
+	if peer.amChoking.Load() && !slices.Contains(peer.grantedFastPieces, request.Piece) {
+		return false
+	}
+
+	return peer.pieces.GetState(request.Piece) == pieces.Downloaded
+}
+
+// The last piece might be shorter than the others.
+func pieceLength(torrent *torrent_info.TorrentInfo, piece int) int {
+	return int(min(torrent.PieceLength, torrent.TotalLength-uint64(piece)*torrent.PieceLength))
+}
+
+// Lets the peer know that requests are dropped, so it doesn't wait for them to time out.
+// Peers not supporting the fast extension will find it out when being choked.
+func (peer *Peer) rejectRequests(requests []requested_pieces.PieceRequest) error {
+	if !peer.capabilities.FastExtension {
+		return nil
+	}
+
+	for _, request := range requests {
+		message := message.RejectRequest{Piece: request.Piece, Offset: request.Offset, Length: request.Length}
+		_, err := peer.connection.Write(message.Encode())
+		if err != nil {
+			return fmt.Errorf("error sending reject request message: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// The piece can't be completed by this peer anymore, so it's made available to be picked again.
+func (peer *Peer) releaseRejectedPiece(piece int, offset int, length int) {
+	pendingBlocks := peer.pendingPieces.GetPendingBlocksForPiece(piece)
+	rejected := slices.ContainsFunc(pendingBlocks, func(block pending_pieces.PendingBlock) bool {
+		return block.Offset == offset && block.Length == length
+	})
+	if !rejected {
+		return
+	}
+
+	peer.pendingPieces.Remove(piece)
+	peer.pieces.CheckStateAndChange(piece, pieces.Pending, pieces.NotDownloaded)
+
+	log.Printf("request for piece #%d is rejected", piece)
+}
+
+func (peer *Peer) setListenPort(port *int) {
+	if port == nil || *port <= 0 || *port > math.MaxUint16 {
+		return
+	}
+
+	listenPort := uint16(*port)
+
+	peer.extendedHandshakeMutex.Lock()
+	defer peer.extendedHandshakeMutex.Unlock()
+
+	peer.listenPort = &listenPort
+}
+
+func (peer *Peer) getListenPort() *uint16 {
+	peer.extendedHandshakeMutex.RLock()
+	defer peer.extendedHandshakeMutex.RUnlock()
+
+	return peer.listenPort
+}
+
+func (peer *Peer) setExtensions(supportedExtensions map[string]int) error {
+	decoded, err := extensions.FromMap(supportedExtensions)
+	if err != nil {
+		return fmt.Errorf("failed to decode extensions: %w", err)
+	}
+
+	peer.extendedHandshakeMutex.Lock()
+	defer peer.extendedHandshakeMutex.Unlock()
+
+	peer.availableExtensions = decoded
+
+	return nil
+}
+
+func (peer *Peer) getExtensions() extensions.Extensions {
+	peer.extendedHandshakeMutex.RLock()
+	defer peer.extendedHandshakeMutex.RUnlock()
+
+	return peer.availableExtensions
+}
+
+func (peer *Peer) SendPex(connectedPeers []tracker.PeerInfo) error {
+	availableExtensions := peer.getExtensions()
+	if _, ok := availableExtensions.GetID(constants.UtPexExtensionName); !ok {
+		return nil
+	}
+
+	peer.pexMutex.Lock()
+	defer peer.pexMutex.Unlock()
+
+	current := make(map[string]tracker.PeerInfo)
+	for _, connected := range connectedPeers {
+		current[string(connected.EncodeCompact())] = connected
+	}
+
+	added := make([]tracker.PeerInfo, 0)
+	for key, connected := range current {
+		if _, ok := peer.pexSentPeers[key]; !ok && len(added) < constants.UtPexMaxPeersPerMessage {
+			added = append(added, connected)
+			peer.pexSentPeers[key] = connected
+		}
+	}
+
+	dropped := make([]tracker.PeerInfo, 0)
+	for key, sent := range peer.pexSentPeers {
+		if _, ok := current[key]; !ok && len(dropped) < constants.UtPexMaxPeersPerMessage {
+			dropped = append(dropped, sent)
+			delete(peer.pexSentPeers, key)
+		}
+	}
+
+	if len(added) == 0 && len(dropped) == 0 {
+		return nil
+	}
+
+	message := message.UtPex{
+		Added:      added,
+		AddedFlags: make([]byte, len(added)),
+		Dropped:    dropped,
+		Extensions: &availableExtensions,
+	}
+	_, err := peer.connection.Write(message.Encode())
+	if err != nil {
+		return fmt.Errorf("error sending ut_pex message: %w", err)
+	}
+
+	log.Printf("sent ut_pex message: %d added, %d dropped", len(added), len(dropped))
+
+	return nil
+}
+
 func (peer *Peer) requestBlocks(
 	torrent *torrent_info.TorrentInfo,
 	errors chan<- error,
 ) {
-Outer:
 	for {
+		available := peer.availablePieces
 		if peer.chocked {
+			// Allowed fast pieces can be requested while choked.
+			available = peer.allowedFastAvailablePieces()
+			if available.IsEmpty() {
+				time.Sleep(time.Millisecond * 100)
+				continue
+			}
+		}
+
+		for peer.pendingPieces.Length() >= constants.PendingPiecesQueueLength {
+			time.Sleep(time.Millisecond * 100)
+		}
+
+		pieceIdx, ok := peer.piecePicker.Pick(available)
+		if !ok && peer.chocked {
 			time.Sleep(time.Millisecond * 100)
 			continue
 		}
 
-		setEndgameMode := true
-		for pieceIdx := range len(torrent.Pieces) {
-			if peer.availablePieces == nil || !peer.availablePieces.ContainsPiece(pieceIdx) {
-				continue
-			}
+		setEndgameMode := !ok
+		if !ok {
+			pieceIdx, ok = peer.pickEndgamePiece()
+		}
 
-			for peer.pendingPieces.Length() >= constants.PendingPiecesQueueLength {
-				time.Sleep(time.Millisecond * 100)
-			}
+		if !peer.endgameMode.Load() && setEndgameMode {
+			log.Printf("entered endgame mode")
+		} else if peer.endgameMode.Load() && !setEndgameMode {
+			log.Printf("exited endgame mode")
+		}
 
-			if peer.pieces.CheckStateAndChange(pieceIdx, pieces.NotDownloaded, pieces.Pending) {
-				setEndgameMode = false
-			} else {
-				if peer.endgameMode.Load() {
-					if peer.pieces.GetState(pieceIdx) != pieces.Pending {
-						continue
-					}
+		peer.endgameMode.Store(setEndgameMode)
 
-					if peer.pendingPieces.ContainsPiece(pieceIdx) {
-						continue
-					}
-				} else {
-					continue
-				}
-			}
+		if !ok {
+			time.Sleep(time.Millisecond * 100)
+			continue
+		}
 
-			log.Printf("requesting piece #%d", pieceIdx)
+		log.Printf("requesting piece #%d", pieceIdx)
 
-			pieceLength := min(torrent.PieceLength, torrent.TotalLength-uint64(pieceIdx)*torrent.PieceLength)
-			peer.pendingPieces.Insert(pieceIdx, int(pieceLength))
+		peer.pendingPieces.Insert(pieceIdx, pieceLength(torrent, pieceIdx))
 
-			for _, block := range peer.pendingPieces.GetPendingBlocksForPiece(pieceIdx) {
-				message := message.Request{
-					Piece:  pieceIdx,
-					Offset: block.Offset,
-					Length: block.Length,
-				}
-				request := (&message).Encode()
-				_, err := peer.connection.Write(request)
-				if err != nil {
-					peer.pendingPieces.Remove(pieceIdx)
-					errors <- fmt.Errorf("error sending piece request: %w", err)
-					break Outer
-				}
+		for _, block := range peer.pendingPieces.GetPendingBlocksForPiece(pieceIdx) {
+			message := message.Request{
+				Piece:  pieceIdx,
+				Offset: block.Offset,
+				Length: block.Length,
+			}
+			request := (&message).Encode()
+			_, err := peer.connection.Write(request)
+			if err != nil {
+				peer.pendingPieces.Remove(pieceIdx)
+				errors <- fmt.Errorf("error sending piece request: %w", err)
+				return
 			}
 		}
+	}
+}
 
-		if !peer.endgameMode.Load() && setEndgameMode {
-			log.Printf("entered endgame mode")
-		} else if peer.endgameMode.Load() && !setEndgameMode {
-			log.Printf("exited endgame mode")
+func (peer *Peer) allowedFastAvailablePieces() *bitfield.ConcurrentBitfield {
+	allowed := peer.allowedFastPieces.GetBitfield()
+	result := bitfield.NewEmptyConcurrentBitfield(allowed.PieceCount())
+	for piece := range allowed.PieceCount() {
+		if allowed.ContainsPiece(piece) && peer.availablePieces.ContainsPiece(piece) {
+			result.AddPiece(uint64(piece))
 		}
+	}
 
-		peer.endgameMode.Store(setEndgameMode)
+	return result
+}
+
+func (peer *Peer) pickEndgamePiece() (int, bool) {
+	for pieceIdx := range peer.pieces.Length() {
+		if !peer.availablePieces.ContainsPiece(pieceIdx) {
+			continue
+		}
+
+		if peer.pieces.GetState(pieceIdx) != pieces.Pending {
+			continue
+		}
+
+		if peer.pendingPieces.ContainsPiece(pieceIdx) {
+			continue
+		}
+
+		return pieceIdx, true
 	}
+
+	return 0, false
 }
 
 func (peer *Peer) sendInitialMessages() error {
 	present := peer.pieces.GetBitfield()
-	if !present.IsEmpty() {
-		request := (&message.Bitfield{Bitfield: present.ToBytes()}).Encode()
-		_, err := peer.connection.Write(request)
+
+	var availability message.Message
+	switch {
+	case peer.capabilities.FastExtension && present.IsEmpty():
+		availability = &message.HaveNone{}
+	case peer.capabilities.FastExtension && present.SetPiecesCount() == present.PieceCount():
+		availability = &message.HaveAll{}
+	case !present.IsEmpty():
+		availability = &message.Bitfield{Bitfield: present.ToBytes()}
+	}
+
+	if availability != nil {
+		_, err := peer.connection.Write(availability.Encode())
 		if err != nil {
 			return fmt.Errorf("error sending bitfield: %w", err)
 		}
@@ -417,6 +902,13 @@ func (peer *Peer) sendInitialMessages() error {
 		log.Printf("sent bitfield message")
 	}
 
+	for _, piece := range peer.grantedFastPieces {
+		_, err := peer.connection.Write((&message.AllowedFast{Piece: piece}).Encode())
+		if err != nil {
+			return fmt.Errorf("error sending allowed fast message: %w", err)
+		}
+	}
+
 	request := (&message.Interested{}).Encode()
 	_, err := peer.connection.Write(request)
 	if err != nil {
@@ -425,13 +917,66 @@ func (peer *Peer) sendInitialMessages() error {
 
 	log.Printf("sent interested message")
 
-	request = (&message.Unchoke{}).Encode()
-	_, err = peer.connection.Write(request)
+	return nil
+}
+
+func (peer *Peer) IsInterested() bool {
+	return peer.interested.Load()
+}
+
+func (peer *Peer) IsChoking() bool {
+	return peer.amChoking.Load()
+}
+
+func (peer *Peer) GetDownloadedBytes() uint64 {
+	return peer.downloadedBytes.Load()
+}
+
+func (peer *Peer) GetHashFailures() uint64 {
+	return peer.hashFailures.Load()
+}
+
+func (peer *Peer) GetClientName() string {
+	clientName := peer.clientName.Load()
+	if clientName == nil {
+		return ""
+	}
+
+	return *clientName
+}
+
+func (peer *Peer) GetUploadedBytes() uint64 {
+	return peer.uploadedBytes.Load()
+}
+
+func (peer *Peer) SetChoking(choking bool) error {
+	if peer.amChoking.Swap(choking) == choking {
+		return nil
+	}
+
+	var request []byte
+	var dropped []requested_pieces.PieceRequest
+	if choking {
+		// Requests for the allowed fast pieces are still served while choked.
+		dropped = peer.requestedPieces.RemoveFunc(func(request requested_pieces.PieceRequest) bool {
+			return !slices.Contains(peer.grantedFastPieces, request.Piece)
+		})
+		request = (&message.Choke{}).Encode()
+	} else {
+		request = (&message.Unchoke{}).Encode()
+	}
+
+	_, err := peer.connection.Write(request)
+	if err != nil {
+		return fmt.Errorf("error sending choke state: %w", err)
+	}
+
+	err = peer.rejectRequests(dropped)
 	if err != nil {
-		return fmt.Errorf("error sending unchoke message: %w", err)
+		return err
 	}
 
-	log.Printf("sent unchoke message")
+	log.Printf("set choking state of peer %s to %t", peer.info.IP.String(), choking)
 
 	return nil
 }
@@ -474,6 +1019,7 @@ func (peer *Peer) uploadPieces(downloadedPieces *downloaded_files.DownloadedFile
 		pieceData, err := downloadedPieces.ReadPiece(requestedPiece.Piece)
 		if err != nil {
 			errors <- fmt.Errorf("failed to read piece #%d: %w", requestedPiece.Piece, err)
+			break
 		}
 
 		// TODO: Add method to partially read piece.
@@ -486,6 +1032,8 @@ func (peer *Peer) uploadPieces(downloadedPieces *downloaded_files.DownloadedFile
 			break
 		}
 
+		peer.uploadedBytes.Add(uint64(len(block)))
+
 		log.Printf("sent piece #%d", requestedPiece.Piece)
 	}
 }
@@ -0,0 +1,77 @@
+package peer
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mertwole/bittorrent-cli/download/peer/constants"
+	"github.com/mertwole/bittorrent-cli/download/peer/message"
+	"github.com/mertwole/bittorrent-cli/download/peer/requested_pieces"
+	"github.com/mertwole/bittorrent-cli/download/pieces"
+	"github.com/mertwole/bittorrent-cli/download/torrent_info"
+)
+
+func TestCanServeRequest(t *testing.T) {
+	torrent := &torrent_info.TorrentInfo{
+		PieceLength: constants.BlockSize * 2,
+		TotalLength: constants.BlockSize*2 + 100,
+	}
+
+	peer := Peer{pieces: pieces.New(2)}
+	for piece := range 2 {
+		peer.pieces.CheckStateAndChange(piece, pieces.NotDownloaded, pieces.Downloaded)
+	}
+
+	tests := []struct {
+		request requested_pieces.PieceRequest
+		valid   bool
+	}{
+		{request: requested_pieces.PieceRequest{Piece: 0, Offset: constants.BlockSize, Length: constants.BlockSize}, valid: true},
+		{request: requested_pieces.PieceRequest{Piece: 1, Offset: 0, Length: 100}, valid: true},
+		{request: requested_pieces.PieceRequest{Piece: 2, Offset: 0, Length: 100}, valid: false},
+		{request: requested_pieces.PieceRequest{Piece: 1, Offset: 50, Length: 100}, valid: false},
+		{request: requested_pieces.PieceRequest{Piece: 0, Offset: -1, Length: 100}, valid: false},
+		{request: requested_pieces.PieceRequest{Piece: 0, Offset: 0, Length: 0}, valid: false},
+		{request: requested_pieces.PieceRequest{Piece: 0, Offset: 0, Length: constants.BlockSize * 2}, valid: false},
+	}
+
+	for _, test := range tests {
+		if peer.canServeRequest(torrent, test.request) != test.valid {
+			t.Errorf("expected request %+v to be valid: %v", test.request, test.valid)
+		}
+	}
+}
+
+func TestFastMessagesWithoutFastExtension(t *testing.T) {
+	messages := []message.Message{
+		&message.SuggestPiece{Piece: 0},
+		&message.HaveAll{},
+		&message.HaveNone{},
+		&message.RejectRequest{Piece: 0, Offset: 0, Length: constants.BlockSize},
+		&message.AllowedFast{Piece: 0},
+	}
+
+	for _, sent := range messages {
+		local, remote := net.Pipe()
+
+		peer := Peer{connection: local}
+		errors := make(chan error, 1)
+		go peer.listen(&torrent_info.TorrentInfo{}, nil, errors)
+
+		go remote.Write(sent.Encode())
+
+		select {
+		case err := <-errors:
+			if !strings.Contains(err.Error(), "fast extension") {
+				t.Errorf("unexpected error on %T message: %v", sent, err)
+			}
+		case <-time.After(time.Second * 5):
+			t.Errorf("%T message is accepted without the fast extension negotiated", sent)
+		}
+
+		local.Close()
+		remote.Close()
+	}
+}
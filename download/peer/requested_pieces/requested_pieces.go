@@ -28,14 +28,38 @@ func (requestedPieces *RequestedPieces) AddRequest(request PieceRequest) {
 	requestedPieces.pieces = append(requestedPieces.pieces, request)
 }
 
-func (requestedPieces *RequestedPieces) CancelRequest(request PieceRequest) {
+func (requestedPieces *RequestedPieces) CancelRequest(request PieceRequest) bool {
 	requestedPieces.mutex.Lock()
 	defer requestedPieces.mutex.Unlock()
 
 	idx := slices.Index(requestedPieces.pieces, request)
-	if idx != -1 {
-		requestedPieces.pieces = slices.Delete(requestedPieces.pieces, idx, idx+1)
+	if idx == -1 {
+		return false
 	}
+
+	requestedPieces.pieces = slices.Delete(requestedPieces.pieces, idx, idx+1)
+
+	return true
+}
+
+// Removes the requests matching the predicate and returns them.
+func (requestedPieces *RequestedPieces) RemoveFunc(remove func(PieceRequest) bool) []PieceRequest {
+	requestedPieces.mutex.Lock()
+	defer requestedPieces.mutex.Unlock()
+
+	removed := make([]PieceRequest, 0)
+	kept := make([]PieceRequest, 0, len(requestedPieces.pieces))
+	for _, request := range requestedPieces.pieces {
+		if remove(request) {
+			removed = append(removed, request)
+		} else {
+			kept = append(kept, request)
+		}
+	}
+
+	requestedPieces.pieces = kept
+
+	return removed
 }
 
 func (requestedPieces *RequestedPieces) PopRequest() *PieceRequest {
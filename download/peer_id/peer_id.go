@@ -0,0 +1,26 @@
+package peer_id
+
+import (
+	"crypto/rand"
+)
+
+// Azureus-style client identifier: client code "BC" and version 0.0.0.1.
+const clientPrefix = "-BC0001-"
+const peerIDLength = 20
+
+// Random part is alphanumeric, so peer IDs stay readable in tracker logs.
+const randomAlphabet = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+
+func Generate() [peerIDLength]byte {
+	var peerID [peerIDLength]byte
+	copy(peerID[:], clientPrefix)
+
+	random := make([]byte, peerIDLength-len(clientPrefix))
+	rand.Read(random)
+
+	for i, value := range random {
+		peerID[len(clientPrefix)+i] = randomAlphabet[int(value)%len(randomAlphabet)]
+	}
+
+	return peerID
+}
@@ -0,0 +1,25 @@
+package peer_id
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGenerate(t *testing.T) {
+	first := Generate()
+	second := Generate()
+
+	if !strings.HasPrefix(string(first[:]), clientPrefix) {
+		t.Errorf("peer ID doesn't start with the client prefix: %s", first)
+	}
+
+	for _, char := range first[len(clientPrefix):] {
+		if !strings.ContainsRune(randomAlphabet, rune(char)) {
+			t.Errorf("peer ID contains unexpected character: %q", char)
+		}
+	}
+
+	if first == second {
+		t.Errorf("generated peer IDs collide: %s", first)
+	}
+}
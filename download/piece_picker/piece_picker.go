@@ -0,0 +1,117 @@
+package piece_picker
+
+import (
+	"math/rand/v2"
+	"sync"
+
+	"github.com/mertwole/bittorrent-cli/download/bitfield"
+	"github.com/mertwole/bittorrent-cli/download/pieces"
+)
+
+const randomFirstPiecesCount = 4
+
+type PiecePicker struct {
+	pieces       *pieces.Pieces
+	availability []int
+	mutex        sync.Mutex
+}
+
+func New(pieces *pieces.Pieces) *PiecePicker {
+	return &PiecePicker{
+		pieces:       pieces,
+		availability: make([]int, pieces.Length()),
+	}
+}
+
+func (picker *PiecePicker) AddAvailablePiece(piece int) {
+	picker.mutex.Lock()
+	defer picker.mutex.Unlock()
+
+	picker.availability[piece]++
+}
+
+func (picker *PiecePicker) AddAvailableBitfield(available *bitfield.Bitfield) {
+	picker.mutex.Lock()
+	defer picker.mutex.Unlock()
+
+	for piece := range picker.availability {
+		if available.ContainsPiece(piece) {
+			picker.availability[piece]++
+		}
+	}
+}
+
+func (picker *PiecePicker) RemoveAvailableBitfield(available *bitfield.Bitfield) {
+	picker.mutex.Lock()
+	defer picker.mutex.Unlock()
+
+	for piece := range picker.availability {
+		if available.ContainsPiece(piece) {
+			picker.availability[piece] = max(0, picker.availability[piece]-1)
+		}
+	}
+}
+
+func (picker *PiecePicker) GetAvailability(piece int) int {
+	picker.mutex.Lock()
+	defer picker.mutex.Unlock()
+
+	return picker.availability[piece]
+}
+
+// Until the first few pieces are downloaded pieces are picked at random,
+// so we get something to share as soon as possible.
+func (picker *PiecePicker) Pick(peerPieces *bitfield.ConcurrentBitfield) (int, bool) {
+	picker.mutex.Lock()
+	defer picker.mutex.Unlock()
+
+	available := peerPieces.GetBitfield()
+	present := picker.pieces.GetBitfield()
+	pickRandom := present.SetPiecesCount() < randomFirstPiecesCount
+
+	for {
+		picked := -1
+		pickedPriority := pieces.Skip
+		pickedAvailability := 0
+		candidatesCount := 0
+
+		for piece := range picker.availability {
+			if !available.ContainsPiece(piece) || picker.pieces.GetState(piece) != pieces.NotDownloaded {
+				continue
+			}
+
+			priority := picker.pieces.GetPriority(piece)
+			if priority == pieces.Skip {
+				continue
+			}
+
+			availability := picker.availability[piece]
+			if pickRandom {
+				availability = 0
+			}
+
+			switch {
+			case picked == -1 ||
+				priority > pickedPriority ||
+				(priority == pickedPriority && availability < pickedAvailability):
+				picked = piece
+				pickedPriority = priority
+				pickedAvailability = availability
+				candidatesCount = 1
+			case priority == pickedPriority && availability == pickedAvailability:
+				candidatesCount++
+				if rand.IntN(candidatesCount) == 0 {
+					picked = piece
+				}
+			}
+		}
+
+		if picked == -1 {
+			return 0, false
+		}
+
+		if picker.pieces.CheckStateAndChange(picked, pieces.NotDownloaded, pieces.Pending) {
+			return picked, true
+		}
+	}
+}
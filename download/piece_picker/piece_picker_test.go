@@ -0,0 +1,99 @@
+package piece_picker
+
+import (
+	"testing"
+
+	"github.com/mertwole/bittorrent-cli/download/bitfield"
+	"github.com/mertwole/bittorrent-cli/download/pieces"
+)
+
+func TestPickRarestFirst(t *testing.T) {
+	pcs := pieces.New(8)
+	for piece := range randomFirstPiecesCount {
+		pcs.CheckStateAndChange(piece, pieces.NotDownloaded, pieces.Downloaded)
+	}
+
+	picker := New(pcs)
+
+	common := bitfield.NewBitfield([]byte{0b1111_1110}, 8)
+	picker.AddAvailableBitfield(&common)
+	picker.AddAvailableBitfield(&common)
+
+	rare := bitfield.NewBitfield([]byte{0b0000_0101}, 8)
+	picker.AddAvailableBitfield(&rare)
+
+	peerPieces := bitfield.NewConcurrentBitfield([]byte{0b1111_1111}, 8)
+
+	assertPicked(picker, peerPieces, []int{7}, t)
+	assertPicked(picker, peerPieces, []int{4, 6}, t)
+	assertPicked(picker, peerPieces, []int{4, 6}, t)
+	assertPicked(picker, peerPieces, []int{5}, t)
+
+	piece, ok := picker.Pick(peerPieces)
+	if ok {
+		t.Errorf("expected nothing to pick, got piece #%d", piece)
+	}
+}
+
+func TestPickOnlyAvailable(t *testing.T) {
+	pcs := pieces.New(8)
+	picker := New(pcs)
+
+	peerPieces := bitfield.NewConcurrentBitfield([]byte{0b0010_0100}, 8)
+	available := peerPieces.GetBitfield()
+	picker.AddAvailableBitfield(&available)
+
+	assertPicked(picker, peerPieces, []int{2, 5}, t)
+	assertPicked(picker, peerPieces, []int{2, 5}, t)
+
+	piece, ok := picker.Pick(peerPieces)
+	if ok {
+		t.Errorf("expected nothing to pick, got piece #%d", piece)
+	}
+}
+
+func TestPickByPriority(t *testing.T) {
+	pcs := pieces.New(4)
+	pcs.SetPriority(0, pieces.Skip)
+	pcs.SetPriority(1, pieces.Low)
+	pcs.SetPriority(3, pieces.High)
+
+	picker := New(pcs)
+
+	peerPieces := bitfield.NewConcurrentBitfield([]byte{0b1111_0000}, 4)
+	available := peerPieces.GetBitfield()
+	picker.AddAvailableBitfield(&available)
+
+	assertPicked(picker, peerPieces, []int{3}, t)
+	assertPicked(picker, peerPieces, []int{2}, t)
+	assertPicked(picker, peerPieces, []int{1}, t)
+
+	piece, ok := picker.Pick(peerPieces)
+	if ok {
+		t.Errorf("expected skipped piece not to be picked, got piece #%d", piece)
+	}
+}
+
+func assertPicked(
+	picker *PiecePicker,
+	peerPieces *bitfield.ConcurrentBitfield,
+	expectedOneOf []int,
+	t *testing.T,
+) {
+	piece, ok := picker.Pick(peerPieces)
+	if !ok {
+		t.Fatalf("failed to pick a piece, expected one of %v", expectedOneOf)
+	}
+
+	if picker.pieces.GetState(piece) != pieces.Pending {
+		t.Errorf("picked piece #%d is not marked as pending", piece)
+	}
+
+	for _, expected := range expectedOneOf {
+		if piece == expected {
+			return
+		}
+	}
+
+	t.Errorf("unexpected piece picked: expected one of %v, got %d", expectedOneOf, piece)
+}
@@ -7,8 +7,9 @@ import (
 )
 
 type Pieces struct {
-	mutex  sync.RWMutex
-	pieces []PieceState
+	mutex      sync.RWMutex
+	pieces     []PieceState
+	priorities []Priority
 }
 
 type PieceState uint8
@@ -19,13 +20,49 @@ const (
 	Downloaded    PieceState = 2
 )
 
+type Priority uint8
+
+const (
+	Skip   Priority = 0
+	Low    Priority = 1
+	Normal Priority = 2
+	High   Priority = 3
+)
+
+func (priority Priority) String() string {
+	switch priority {
+	case Skip:
+		return "skip"
+	case Low:
+		return "low"
+	case Normal:
+		return "normal"
+	case High:
+		return "high"
+	default:
+		return "unknown"
+	}
+}
+
+func ParsePriority(priority string) (Priority, bool) {
+	for _, parsed := range []Priority{Skip, Low, Normal, High} {
+		if parsed.String() == priority {
+			return parsed, true
+		}
+	}
+
+	return 0, false
+}
+
 func New(count int) *Pieces {
 	pieces := make([]PieceState, count)
+	priorities := make([]Priority, count)
 	for i := range count {
 		pieces[i] = NotDownloaded
+		priorities[i] = Normal
 	}
 
-	return &Pieces{pieces: pieces}
+	return &Pieces{pieces: pieces, priorities: priorities}
 }
 
 func (pieces *Pieces) Length() int {
@@ -42,6 +79,34 @@ func (pieces *Pieces) GetState(index int) PieceState {
 	return pieces.pieces[index]
 }
 
+func (pieces *Pieces) GetPriority(index int) Priority {
+	pieces.mutex.RLock()
+	defer pieces.mutex.RUnlock()
+
+	return pieces.priorities[index]
+}
+
+func (pieces *Pieces) SetPriority(index int, priority Priority) {
+	pieces.mutex.Lock()
+	defer pieces.mutex.Unlock()
+
+	pieces.priorities[index] = priority
+}
+
+func (pieces *Pieces) GetWantedBitfield() bitfield.Bitfield {
+	pieces.mutex.RLock()
+	defer pieces.mutex.RUnlock()
+
+	bitfield := bitfield.NewEmptyBitfield(len(pieces.pieces))
+	for i, priority := range pieces.priorities {
+		if priority != Skip {
+			bitfield.AddPiece(uint64(i))
+		}
+	}
+
+	return bitfield
+}
+
 func (pieces *Pieces) GetBitfield() bitfield.Bitfield {
 	pieces.mutex.RLock()
 	defer pieces.mutex.RUnlock()
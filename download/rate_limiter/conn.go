@@ -0,0 +1,52 @@
+package rate_limiter
+
+import (
+	"net"
+	"sync"
+)
+
+// Wraps the connection, so reads and writes are throttled by the given limiters.
+// Each write is passed to the underlying connection as a whole, so concurrent writers don't interleave.
+type conn struct {
+	net.Conn
+
+	downloadLimiters []*Limiter
+	uploadLimiters   []*Limiter
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func NewConn(connection net.Conn, downloadLimiters []*Limiter, uploadLimiters []*Limiter) net.Conn {
+	return &conn{
+		Conn:             connection,
+		downloadLimiters: downloadLimiters,
+		uploadLimiters:   uploadLimiters,
+		closed:           make(chan struct{}),
+	}
+}
+
+func (conn *conn) Read(buffer []byte) (int, error) {
+	read, err := conn.Conn.Read(buffer)
+	if read != 0 && !Wait(read, conn.closed, conn.downloadLimiters...) {
+		return read, net.ErrClosed
+	}
+
+	return read, err
+}
+
+func (conn *conn) Write(data []byte) (int, error) {
+	if !Wait(len(data), conn.closed, conn.uploadLimiters...) {
+		return 0, net.ErrClosed
+	}
+
+	return conn.Conn.Write(data)
+}
+
+func (conn *conn) Close() error {
+	conn.closeOnce.Do(func() {
+		close(conn.closed)
+	})
+
+	return conn.Conn.Close()
+}
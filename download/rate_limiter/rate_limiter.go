@@ -0,0 +1,97 @@
+package rate_limiter
+
+import (
+	"sync"
+	"time"
+)
+
+// Waiters re-check the limiter at least this often, so limit changes are applied quickly.
+const maxWaitStep = time.Millisecond * 100
+
+// Token bucket that holds up to one second worth of traffic.
+type Limiter struct {
+	mutex sync.Mutex
+	// Bytes per second, 0 means unlimited.
+	limit     int
+	tokens    float64
+	updatedAt time.Time
+}
+
+func New(limit int) *Limiter {
+	return &Limiter{limit: limit, tokens: float64(limit), updatedAt: time.Now()}
+}
+
+func (limiter *Limiter) GetLimit() int {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	return limiter.limit
+}
+
+func (limiter *Limiter) SetLimit(limit int) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	limiter.refillLocked(time.Now())
+	limiter.limit = limit
+	// Debt accumulated under the previous limit shouldn't stall transfers for long.
+	limiter.tokens = min(max(limiter.tokens, 0), float64(limit))
+}
+
+// Blocks until every limiter has tokens available and takes size tokens from each.
+// Bucket can go into debt, so messages bigger than the limit are not split.
+func Wait(size int, cancel <-chan struct{}, limiters ...*Limiter) bool {
+	for _, limiter := range limiters {
+		if !limiter.wait(size, cancel) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (limiter *Limiter) wait(size int, cancel <-chan struct{}) bool {
+	for {
+		delay, ok := limiter.take(size)
+		if ok {
+			return true
+		}
+
+		select {
+		case <-time.After(min(delay, maxWaitStep)):
+		case <-cancel:
+			return false
+		}
+	}
+}
+
+func (limiter *Limiter) take(size int) (time.Duration, bool) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	if limiter.limit == 0 {
+		return 0, true
+	}
+
+	limiter.refillLocked(time.Now())
+
+	if limiter.tokens < 0 {
+		return time.Duration(-limiter.tokens / float64(limiter.limit) * float64(time.Second)), false
+	}
+
+	limiter.tokens -= float64(size)
+
+	return 0, true
+}
+
+func (limiter *Limiter) refillLocked(now time.Time) {
+	elapsed := now.Sub(limiter.updatedAt)
+	limiter.updatedAt = now
+
+	if limiter.limit == 0 {
+		return
+	}
+
+	limiter.tokens += elapsed.Seconds() * float64(limiter.limit)
+	limiter.tokens = min(limiter.tokens, float64(limiter.limit))
+}
@@ -0,0 +1,128 @@
+package rate_limiter
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestLimiterThroughput(t *testing.T) {
+	limiter := New(10000)
+
+	start := time.Now()
+	// First second worth of traffic is taken from the full bucket.
+	for range 15 {
+		Wait(1000, nil, limiter)
+	}
+	elapsed := time.Since(start)
+
+	if elapsed < time.Millisecond*350 || elapsed > time.Second {
+		t.Errorf("unexpected time to transfer 15000 bytes at 10000 bytes per second: %v", elapsed)
+	}
+}
+
+func TestLimiterUnlimited(t *testing.T) {
+	limiter := New(0)
+
+	start := time.Now()
+	for range 1000 {
+		Wait(1<<20, nil, limiter)
+	}
+
+	if elapsed := time.Since(start); elapsed > time.Millisecond*100 {
+		t.Errorf("unlimited limiter delayed transfer for %v", elapsed)
+	}
+}
+
+func TestLimiterRaisedAtRuntime(t *testing.T) {
+	limiter := New(100)
+	Wait(10000, nil, limiter)
+
+	done := make(chan struct{})
+	go func() {
+		Wait(1, nil, limiter)
+		close(done)
+	}()
+
+	limiter.SetLimit(0)
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Errorf("waiter is not released after the limit is removed")
+	}
+}
+
+func TestLimiterWaitCancelled(t *testing.T) {
+	limiter := New(100)
+	Wait(10000, nil, limiter)
+
+	cancel := make(chan struct{})
+	close(cancel)
+
+	if Wait(1, cancel, limiter) {
+		t.Errorf("cancelled wait succeeded")
+	}
+}
+
+func TestConnLimitsUpload(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+
+	limited := NewConn(local, nil, []*Limiter{New(0), New(20000)})
+	defer limited.Close()
+
+	go io.Copy(io.Discard, remote)
+
+	start := time.Now()
+	for range 3 {
+		_, err := limited.Write(make([]byte, 20000))
+		if err != nil {
+			t.Fatalf("failed to write: %v", err)
+		}
+	}
+
+	// Third write waits for the debt of the second one to be paid off.
+	if elapsed := time.Since(start); elapsed < time.Millisecond*800 {
+		t.Errorf("upload is not limited: 60000 bytes are sent in %v", elapsed)
+	}
+}
+
+func TestSchedule(t *testing.T) {
+	tests := []struct {
+		spec     string
+		moment   string
+		contains bool
+	}{
+		{spec: "09:00-17:00", moment: "12:30", contains: true},
+		{spec: "09:00-17:00", moment: "17:00", contains: false},
+		{spec: "09:00-17:00", moment: "08:59", contains: false},
+		{spec: "22:00-07:00", moment: "23:15", contains: true},
+		{spec: "22:00-07:00", moment: "06:59", contains: true},
+		{spec: "22:00-07:00", moment: "12:00", contains: false},
+	}
+
+	for _, test := range tests {
+		schedule, err := ParseSchedule(test.spec)
+		if err != nil {
+			t.Fatalf("failed to parse schedule %s: %v", test.spec, err)
+		}
+
+		moment, err := time.Parse("15:04", test.moment)
+		if err != nil {
+			t.Fatalf("failed to parse time: %v", err)
+		}
+
+		if schedule.Contains(moment) != test.contains {
+			t.Errorf("schedule %s: expected Contains(%s) to be %t", test.spec, test.moment, test.contains)
+		}
+	}
+
+	for _, invalid := range []string{"", "09:00", "9-17", "25:00-07:00"} {
+		_, err := ParseSchedule(invalid)
+		if err == nil {
+			t.Errorf("invalid schedule %q is parsed", invalid)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package rate_limiter
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Time of day interval, e.g. 22:00-07:00. Intervals that end before they start span midnight.
+type Schedule struct {
+	start time.Duration
+	end   time.Duration
+}
+
+func ParseSchedule(spec string) (*Schedule, error) {
+	startString, endString, ok := strings.Cut(spec, "-")
+	if !ok {
+		return nil, fmt.Errorf("invalid schedule %s: expected format is HH:MM-HH:MM", spec)
+	}
+
+	start, err := parseTimeOfDay(startString)
+	if err != nil {
+		return nil, fmt.Errorf("invalid schedule start: %w", err)
+	}
+
+	end, err := parseTimeOfDay(endString)
+	if err != nil {
+		return nil, fmt.Errorf("invalid schedule end: %w", err)
+	}
+
+	return &Schedule{start: start, end: end}, nil
+}
+
+func parseTimeOfDay(value string) (time.Duration, error) {
+	parsed, err := time.Parse("15:04", strings.TrimSpace(value))
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse time of day %s: %w", value, err)
+	}
+
+	return time.Duration(parsed.Hour())*time.Hour + time.Duration(parsed.Minute())*time.Minute, nil
+}
+
+func (schedule *Schedule) Contains(moment time.Time) bool {
+	timeOfDay := time.Duration(moment.Hour())*time.Hour +
+		time.Duration(moment.Minute())*time.Minute +
+		time.Duration(moment.Second())*time.Second
+
+	if schedule.start <= schedule.end {
+		return timeOfDay >= schedule.start && timeOfDay < schedule.end
+	}
+
+	return timeOfDay >= schedule.start || timeOfDay < schedule.end
+}
@@ -0,0 +1,525 @@
+package download
+
+import (
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/mertwole/bittorrent-cli/download/connection_manager"
+	"github.com/mertwole/bittorrent-cli/download/dht"
+	"github.com/mertwole/bittorrent-cli/download/ip_filter"
+	"github.com/mertwole/bittorrent-cli/download/lsd"
+	"github.com/mertwole/bittorrent-cli/download/mse"
+	"github.com/mertwole/bittorrent-cli/download/peer"
+	"github.com/mertwole/bittorrent-cli/download/peer/constants"
+	"github.com/mertwole/bittorrent-cli/download/peer_id"
+	"github.com/mertwole/bittorrent-cli/download/rate_limiter"
+	"github.com/mertwole/bittorrent-cli/download/tracker"
+	"github.com/mertwole/bittorrent-cli/download/utp"
+	"github.com/mertwole/bittorrent-cli/global_params"
+)
+
+const listenRetries = 16
+const altSpeedScheduleCheckInterval = time.Minute
+
+// Used only to find out the address of the default route interface, nothing is sent there.
+const localAddressProbe = "203.0.113.1:80"
+
+// Session owns the resources shared by all the downloads: listening port, LSD and DHT.
+type Session struct {
+	listener   net.Listener
+	listenPort uint16
+	// Accepts and dials uTP connections on the listen port, nil when UDP port is unavailable.
+	utpSocket *utp.Socket
+	// Identifies us to trackers and peers, the same for every download.
+	peerID [20]byte
+
+	encryptionPolicy mse.Policy
+
+	connectionPool           *connection_manager.Pool
+	maxConnectionsPerTorrent int
+	// Used to compute canonical peer priority.
+	localAddress netip.AddrPort
+
+	// Shared by all the downloads, so the limits are global.
+	downloadLimiter  *rate_limiter.Limiter
+	uploadLimiter    *rate_limiter.Limiter
+	rateLimits       RateLimits
+	altRateLimits    RateLimits
+	altSpeedEnabled  bool
+	altSpeedSchedule *rate_limiter.Schedule
+	rateLimitsMutex  sync.Mutex
+
+	lsd *lsd.Discovery
+	dht *dht.DHT
+
+	downloads      map[[sha1.Size]byte]*Download
+	downloadsMutex sync.RWMutex
+
+	// Peers that sent corrupted data, banned until the session is closed.
+	bannedIPs      map[netip.Addr]struct{}
+	bannedIPsMutex sync.RWMutex
+	// Nil when no filter is configured.
+	ipFilter *ip_filter.Filter
+
+	cancelCallback context.CancelFunc
+}
+
+type SessionOptions struct {
+	// Whether peer connections are obfuscated with Message Stream Encryption.
+	EncryptionPolicy mse.Policy
+
+	RateLimits RateLimits
+	// Used instead of RateLimits while the alternative speed is enabled.
+	AltRateLimits RateLimits
+	// Alternative speed is enabled automatically within the schedule when it's set.
+	AltSpeedSchedule *rate_limiter.Schedule
+
+	// Connection limits, 0 means unlimited.
+	MaxConnections           int
+	MaxHalfOpenConnections   int
+	MaxConnectionsPerTorrent int
+
+	// Peers from the blocked ranges are never connected to or accepted.
+	IPFilter *ip_filter.Filter
+}
+
+// Bytes per second, 0 means unlimited.
+type RateLimits struct {
+	Download int
+	Upload   int
+}
+
+func NewSession(options SessionOptions) (*Session, error) {
+	listener, listenPort, err := createTCPListener()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	session := Session{
+		listener:         listener,
+		listenPort:       listenPort,
+		peerID:           peer_id.Generate(),
+		encryptionPolicy: options.EncryptionPolicy,
+		connectionPool: connection_manager.NewPool(
+			options.MaxConnections,
+			options.MaxHalfOpenConnections,
+		),
+		maxConnectionsPerTorrent: options.MaxConnectionsPerTorrent,
+		localAddress:             detectLocalAddress(listenPort),
+		downloadLimiter:          rate_limiter.New(0),
+		uploadLimiter:            rate_limiter.New(0),
+		rateLimits:               options.RateLimits,
+		altRateLimits:            options.AltRateLimits,
+		altSpeedSchedule:         options.AltSpeedSchedule,
+		lsd:                      lsd.New(listenPort, options.IPFilter.IsBlocked),
+		downloads:                make(map[[sha1.Size]byte]*Download),
+		bannedIPs:                make(map[netip.Addr]struct{}),
+		ipFilter:                 options.IPFilter,
+		cancelCallback:           cancel,
+	}
+
+	session.applyRateLimits()
+	if session.altSpeedSchedule != nil {
+		go session.followAltSpeedSchedule(ctx)
+	}
+
+	utpSocket, err := utp.Listen(fmt.Sprintf(":%d", listenPort))
+	if err != nil {
+		log.Printf("failed to start uTP listener: %v", err)
+	} else {
+		session.utpSocket = utpSocket
+	}
+
+	var dhtNode *dht.DHT
+	if session.utpSocket != nil {
+		// DHT shares the UDP port with uTP.
+		dhtNode = dht.NewWithConn(session.utpSocket.SharedConn(), dht.DefaultBootstrapNodes())
+	} else {
+		dhtNode, err = dht.New(listenPort, dht.DefaultBootstrapNodes())
+	}
+	if err != nil {
+		log.Printf("failed to start DHT node: %v", err)
+	} else {
+		session.dht = dhtNode
+		go dhtNode.Serve(ctx)
+	}
+
+	go func() {
+		err := session.lsd.Start(ctx)
+		if err != nil {
+			log.Printf("error in lsd: %v", err)
+		}
+	}()
+
+	go session.acceptConnectionRequests(ctx, session.listener)
+	if session.utpSocket != nil {
+		go session.acceptConnectionRequests(ctx, session.utpSocket)
+	}
+
+	return &session, nil
+}
+
+func (session *Session) GetListenPort() uint16 {
+	return session.listenPort
+}
+
+func (session *Session) GetPeerID() [20]byte {
+	return session.peerID
+}
+
+func (session *Session) GetEncryptionPolicy() mse.Policy {
+	return session.encryptionPolicy
+}
+
+func (session *Session) GetUTPSocket() *utp.Socket {
+	return session.utpSocket
+}
+
+// Returns the limits that are currently in effect, either normal or alternative ones.
+func (session *Session) GetRateLimits() RateLimits {
+	session.rateLimitsMutex.Lock()
+	defer session.rateLimitsMutex.Unlock()
+
+	return session.activeRateLimitsLocked()
+}
+
+// Changes the limits that are currently in effect, either normal or alternative ones.
+func (session *Session) SetRateLimits(limits RateLimits) {
+	session.rateLimitsMutex.Lock()
+	defer session.rateLimitsMutex.Unlock()
+
+	if session.altSpeedEnabled {
+		session.altRateLimits = limits
+	} else {
+		session.rateLimits = limits
+	}
+
+	session.applyRateLimitsLocked()
+}
+
+func (session *Session) IsAltSpeedEnabled() bool {
+	session.rateLimitsMutex.Lock()
+	defer session.rateLimitsMutex.Unlock()
+
+	return session.altSpeedEnabled
+}
+
+func (session *Session) SetAltSpeedEnabled(enabled bool) {
+	session.rateLimitsMutex.Lock()
+	defer session.rateLimitsMutex.Unlock()
+
+	session.altSpeedEnabled = enabled
+	session.applyRateLimitsLocked()
+}
+
+func (session *Session) applyRateLimits() {
+	session.rateLimitsMutex.Lock()
+	defer session.rateLimitsMutex.Unlock()
+
+	session.applyRateLimitsLocked()
+}
+
+func (session *Session) applyRateLimitsLocked() {
+	limits := session.activeRateLimitsLocked()
+	session.downloadLimiter.SetLimit(limits.Download)
+	session.uploadLimiter.SetLimit(limits.Upload)
+}
+
+func (session *Session) activeRateLimitsLocked() RateLimits {
+	if session.altSpeedEnabled {
+		return session.altRateLimits
+	}
+
+	return session.rateLimits
+}
+
+// Alternative speed is switched only when the schedule boundary is crossed,
+// so the manual switch stays in effect until then.
+func (session *Session) followAltSpeedSchedule(ctx context.Context) {
+	ticker := time.NewTicker(altSpeedScheduleCheckInterval)
+	defer ticker.Stop()
+
+	inSchedule := session.altSpeedSchedule.Contains(time.Now())
+	session.SetAltSpeedEnabled(inSchedule)
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		nowInSchedule := session.altSpeedSchedule.Contains(time.Now())
+		if nowInSchedule != inSchedule {
+			inSchedule = nowInSchedule
+			session.SetAltSpeedEnabled(inSchedule)
+		}
+	}
+}
+
+func (session *Session) Close() {
+	session.cancelCallback()
+}
+
+func (session *Session) addDownload(download *Download) {
+	infoHash := download.torrentInfo.InfoHash
+
+	session.downloadsMutex.Lock()
+	session.downloads[infoHash] = download
+	session.downloadsMutex.Unlock()
+
+	session.lsd.AddTorrent(infoHash, download.discoveredPeers)
+}
+
+func (session *Session) removeDownload(download *Download) {
+	infoHash := download.torrentInfo.InfoHash
+
+	session.lsd.RemoveTorrent(infoHash)
+
+	session.downloadsMutex.Lock()
+	if session.downloads[infoHash] == download {
+		delete(session.downloads, infoHash)
+	}
+	session.downloadsMutex.Unlock()
+}
+
+func (session *Session) getInfoHashes() [][sha1.Size]byte {
+	session.downloadsMutex.RLock()
+	defer session.downloadsMutex.RUnlock()
+
+	infoHashes := make([][sha1.Size]byte, 0, len(session.downloads))
+	for infoHash := range session.downloads {
+		infoHashes = append(infoHashes, infoHash)
+	}
+
+	return infoHashes
+}
+
+func (session *Session) IsBanned(ip net.IP) bool {
+	address, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return false
+	}
+
+	session.bannedIPsMutex.RLock()
+	defer session.bannedIPsMutex.RUnlock()
+
+	_, banned := session.bannedIPs[address.Unmap()]
+	return banned
+}
+
+func (session *Session) GetBannedCount() int {
+	session.bannedIPsMutex.RLock()
+	defer session.bannedIPsMutex.RUnlock()
+
+	return len(session.bannedIPs)
+}
+
+// Returns the number of blocked IP ranges, 0 when no filter is configured.
+func (session *Session) GetIPFilterRangeCount() int {
+	return session.ipFilter.RangeCount()
+}
+
+// Rereads the IP filter files and disconnects the peers that became blocked.
+func (session *Session) ReloadIPFilter() error {
+	if session.ipFilter == nil {
+		return fmt.Errorf("IP filter is not configured")
+	}
+
+	err := session.ipFilter.Reload()
+	if err != nil {
+		return err
+	}
+
+	for _, download := range session.getDownloads() {
+		download.dropPeersMatching(func(address netip.Addr) bool {
+			return session.ipFilter.IsBlocked(address.AsSlice())
+		})
+	}
+
+	return nil
+}
+
+// Peer is blocked either by the IP filter or because it's banned.
+func (session *Session) isBlocked(ip net.IP) bool {
+	return session.ipFilter.IsBlocked(ip) || session.IsBanned(ip)
+}
+
+// Disconnects the peer from all the downloads.
+func (session *Session) banIP(address netip.Addr) {
+	log.Printf("banning peer %s", address.String())
+
+	session.bannedIPsMutex.Lock()
+	session.bannedIPs[address.Unmap()] = struct{}{}
+	session.bannedIPsMutex.Unlock()
+
+	for _, download := range session.getDownloads() {
+		download.dropPeers(address)
+	}
+}
+
+func (session *Session) getDownloads() []*Download {
+	session.downloadsMutex.RLock()
+	defer session.downloadsMutex.RUnlock()
+
+	downloads := make([]*Download, 0, len(session.downloads))
+	for _, download := range session.downloads {
+		downloads = append(downloads, download)
+	}
+
+	return downloads
+}
+
+func (session *Session) listenForDHTPeers(
+	ctx context.Context,
+	infoHash [sha1.Size]byte,
+	discoveredPeers chan<- tracker.PeerInfo,
+) {
+	if session.dht == nil {
+		return
+	}
+
+	go session.dht.ListenForPeers(ctx, infoHash, session.listenPort, discoveredPeers)
+}
+
+// Canonical peer priority should be computed from the external address, but it's unknown,
+// so the address of the default route interface is used instead.
+func detectLocalAddress(listenPort uint16) netip.AddrPort {
+	conn, err := net.Dial("udp", localAddressProbe)
+	if err != nil {
+		log.Printf("failed to detect local address: %v", err)
+		return netip.AddrPortFrom(netip.IPv4Unspecified(), listenPort)
+	}
+	defer conn.Close()
+
+	address, err := netip.ParseAddrPort(conn.LocalAddr().String())
+	if err != nil {
+		log.Printf("failed to parse local address: %v", err)
+		return netip.AddrPortFrom(netip.IPv4Unspecified(), listenPort)
+	}
+
+	return netip.AddrPortFrom(address.Addr().Unmap(), listenPort)
+}
+
+func createTCPListener() (listener net.Listener, listenPort uint16, err error) {
+	for i := range listenRetries {
+		listenPort = uint16(
+			rand.Int()%
+				(global_params.ConnectionListenPortMax-global_params.ConnectionListenPortMin+1) +
+				global_params.ConnectionListenPortMin)
+
+		listener, err = net.Listen("tcp", fmt.Sprintf(":%d", listenPort))
+		if err == nil {
+			return listener, listenPort, nil
+		}
+
+		if i+1 == listenRetries {
+			return nil, 0, fmt.Errorf("failed to create TCP listener: %w", err)
+		}
+
+		log.Printf("failed to create TCP listener on the port %d; %v", listenPort, err)
+	}
+
+	return nil, 0, fmt.Errorf("failed to create TCP listener")
+}
+
+func (session *Session) acceptConnectionRequests(ctx context.Context, listener net.Listener) {
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+
+			log.Printf("failed to accept %s connection: %v", listener.Addr().Network(), err)
+			continue
+		}
+
+		remoteAddress, err := netip.ParseAddrPort(conn.RemoteAddr().String())
+		if err == nil && session.ipFilter.IsBlocked(remoteAddress.Addr().AsSlice()) {
+			log.Printf("dropping connection from %s: blocked by IP filter", remoteAddress.Addr().String())
+			conn.Close()
+			continue
+		}
+
+		go session.routeConnection(conn)
+	}
+}
+
+// Reads the handshake to find out which download the connection belongs to.
+func (session *Session) routeConnection(conn net.Conn) {
+	remoteAddrPort, err := netip.ParseAddrPort(conn.RemoteAddr().String())
+	if err != nil {
+		log.Printf("failed to parse address of the incoming connection: %v", err)
+		conn.Close()
+		return
+	}
+
+	peerInfo := tracker.PeerInfo{IP: remoteAddrPort.Addr().Unmap().AsSlice(), Port: remoteAddrPort.Port()}
+
+	log.Printf("accepted %s connection from %+v", conn.RemoteAddr().Network(), peerInfo)
+
+	if session.IsBanned(peerInfo.IP) {
+		log.Printf("dropping connection from banned peer %s", peerInfo.IP.String())
+		conn.Close()
+		return
+	}
+
+	conn.SetDeadline(time.Now().Add(constants.ConnectionTimeout))
+
+	// Encrypted connections are told apart from the plaintext ones by the first bytes.
+	encrypted, err := mse.Accept(conn, session.getInfoHashes(), session.encryptionPolicy)
+	if err != nil {
+		log.Printf("failed to establish encrypted connection with peer %s: %v", peerInfo.IP.String(), err)
+		conn.Close()
+		return
+	}
+	conn = encrypted
+
+	handshake, err := peer.DeserializeHandshake(conn)
+	conn.SetDeadline(time.Time{})
+
+	if err != nil {
+		log.Printf("failed to decode handshake from peer %s: %v", peerInfo.IP.String(), err)
+		conn.Close()
+		return
+	}
+
+	if handshake.PeerID == session.peerID {
+		log.Printf("dropping connection from %s: connected to ourselves", peerInfo.IP.String())
+		conn.Close()
+		return
+	}
+	peerInfo.PeerID = &handshake.PeerID
+
+	session.downloadsMutex.RLock()
+	download, ok := session.downloads[handshake.InfoHash]
+	session.downloadsMutex.RUnlock()
+
+	if !ok {
+		log.Printf("peer %s requested unknown torrent %x", peerInfo.IP.String(), handshake.InfoHash)
+		conn.Close()
+		return
+	}
+
+	select {
+	case download.connectedPeers <- connectedPeer{info: peerInfo, connection: &conn, handshake: handshake}:
+	default:
+		log.Printf("dropping connection from %s: too many pending connections", peerInfo.IP.String())
+		conn.Close()
+	}
+}
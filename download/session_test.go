@@ -0,0 +1,280 @@
+package download
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mertwole/bittorrent-cli/download/ip_filter"
+	"github.com/mertwole/bittorrent-cli/download/mse"
+	"github.com/mertwole/bittorrent-cli/download/torrent_info"
+	"github.com/mertwole/bittorrent-cli/download/tracker"
+)
+
+func TestSessionRoutesIncomingConnections(t *testing.T) {
+	session, err := NewSession(SessionOptions{})
+	if err != nil {
+		t.Fatalf("failed to create session: %v", err)
+	}
+	defer session.Close()
+
+	downloads := make([]*Download, 3)
+	for i := range downloads {
+		downloads[i] = &Download{
+			torrentInfo:     &torrent_info.TorrentInfo{InfoHash: sha1.Sum([]byte{byte(i)})},
+			discoveredPeers: make(chan tracker.PeerInfo, discoveredPeersQueueSize),
+			connectedPeers:  make(chan connectedPeer, connectedPeersQueueSize),
+		}
+		session.addDownload(downloads[i])
+	}
+
+	for i := len(downloads) - 1; i >= 0; i-- {
+		infoHash := downloads[i].torrentInfo.InfoHash
+		conn := dialWithHandshake(session, infoHash, [20]byte{}, t)
+		defer conn.Close()
+
+		select {
+		case incoming := <-downloads[i].connectedPeers:
+			if incoming.handshake.InfoHash != infoHash {
+				t.Errorf("routed handshake has invalid info hash")
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatalf("connection is not routed to the download #%d", i)
+		}
+	}
+
+	conn := dialWithHandshake(session, sha1.Sum([]byte("unknown")), [20]byte{}, t)
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	_, err = conn.Read(make([]byte, 1))
+	if err == nil {
+		t.Errorf("connection for unknown torrent is not closed")
+	}
+}
+
+func TestSessionDropsSelfConnections(t *testing.T) {
+	session, err := NewSession(SessionOptions{})
+	if err != nil {
+		t.Fatalf("failed to create session: %v", err)
+	}
+	defer session.Close()
+
+	download := &Download{
+		torrentInfo:     &torrent_info.TorrentInfo{InfoHash: sha1.Sum([]byte("torrent"))},
+		discoveredPeers: make(chan tracker.PeerInfo, discoveredPeersQueueSize),
+		connectedPeers:  make(chan connectedPeer, connectedPeersQueueSize),
+	}
+	session.addDownload(download)
+
+	conn := dialWithHandshake(session, download.torrentInfo.InfoHash, session.GetPeerID(), t)
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	_, err = conn.Read(make([]byte, 1))
+	if err == nil {
+		t.Errorf("connection to ourselves is not closed")
+	}
+
+	select {
+	case <-download.connectedPeers:
+		t.Errorf("connection to ourselves is routed to the download")
+	default:
+	}
+}
+
+func TestSessionRoutesEncryptedConnections(t *testing.T) {
+	session, err := NewSession(SessionOptions{EncryptionPolicy: mse.Require})
+	if err != nil {
+		t.Fatalf("failed to create session: %v", err)
+	}
+	defer session.Close()
+
+	download := &Download{
+		torrentInfo:     &torrent_info.TorrentInfo{InfoHash: sha1.Sum([]byte("torrent"))},
+		discoveredPeers: make(chan tracker.PeerInfo, discoveredPeersQueueSize),
+		connectedPeers:  make(chan connectedPeer, connectedPeersQueueSize),
+	}
+	session.addDownload(download)
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", session.GetListenPort()))
+	if err != nil {
+		t.Fatalf("failed to connect to the session: %v", err)
+	}
+	defer conn.Close()
+
+	encrypted, err := mse.Initiate(conn, download.torrentInfo.InfoHash, mse.Require)
+	if err != nil {
+		t.Fatalf("failed to establish encrypted connection: %v", err)
+	}
+
+	_, err = encrypted.Write(encodeHandshake(download.torrentInfo.InfoHash, [20]byte{}))
+	if err != nil {
+		t.Fatalf("failed to send handshake: %v", err)
+	}
+
+	select {
+	case incoming := <-download.connectedPeers:
+		if incoming.handshake.InfoHash != download.torrentInfo.InfoHash {
+			t.Errorf("routed handshake has invalid info hash")
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatalf("encrypted connection is not routed to the download")
+	}
+
+	plaintext := dialWithHandshake(session, download.torrentInfo.InfoHash, [20]byte{}, t)
+	defer plaintext.Close()
+
+	plaintext.SetReadDeadline(time.Now().Add(time.Second * 5))
+	_, err = plaintext.Read(make([]byte, 1))
+	if err == nil {
+		t.Errorf("plaintext connection is not closed when encryption is required")
+	}
+}
+
+func dialWithHandshake(session *Session, infoHash [sha1.Size]byte, peerID [20]byte, t *testing.T) net.Conn {
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", session.GetListenPort()))
+	if err != nil {
+		t.Fatalf("failed to connect to the session: %v", err)
+	}
+
+	_, err = conn.Write(encodeHandshake(infoHash, peerID))
+	if err != nil {
+		t.Fatalf("failed to send handshake: %v", err)
+	}
+
+	return conn
+}
+
+func encodeHandshake(infoHash [sha1.Size]byte, peerID [20]byte) []byte {
+	handshake := []byte{19}
+	handshake = append(handshake, "BitTorrent protocol"...)
+	handshake = append(handshake, make([]byte, 8)...)
+	handshake = append(handshake, infoHash[:]...)
+	handshake = append(handshake, peerID[:]...)
+
+	return handshake
+}
+
+func TestSessionAltSpeedLimits(t *testing.T) {
+	session, err := NewSession(SessionOptions{
+		RateLimits:    RateLimits{Download: 1000, Upload: 2000},
+		AltRateLimits: RateLimits{Download: 100, Upload: 200},
+	})
+	if err != nil {
+		t.Fatalf("failed to create session: %v", err)
+	}
+	defer session.Close()
+
+	if session.downloadLimiter.GetLimit() != 1000 || session.uploadLimiter.GetLimit() != 2000 {
+		t.Errorf("normal rate limits are not applied")
+	}
+
+	session.SetAltSpeedEnabled(true)
+	session.SetRateLimits(RateLimits{Download: 300, Upload: 400})
+
+	if session.downloadLimiter.GetLimit() != 300 || session.uploadLimiter.GetLimit() != 400 {
+		t.Errorf("alternative rate limits are not applied")
+	}
+
+	session.SetAltSpeedEnabled(false)
+
+	if limits := session.GetRateLimits(); limits != (RateLimits{Download: 1000, Upload: 2000}) {
+		t.Errorf("normal rate limits are changed while alternative speed is enabled: %+v", limits)
+	}
+	if session.downloadLimiter.GetLimit() != 1000 || session.uploadLimiter.GetLimit() != 2000 {
+		t.Errorf("normal rate limits are not restored")
+	}
+}
+
+func TestSessionDropsBannedPeers(t *testing.T) {
+	session, err := NewSession(SessionOptions{})
+	if err != nil {
+		t.Fatalf("failed to create session: %v", err)
+	}
+	defer session.Close()
+
+	session.banIP(netip.MustParseAddr("127.0.0.1"))
+
+	download := &Download{
+		torrentInfo:     &torrent_info.TorrentInfo{InfoHash: sha1.Sum([]byte("torrent"))},
+		discoveredPeers: make(chan tracker.PeerInfo, discoveredPeersQueueSize),
+		connectedPeers:  make(chan connectedPeer, connectedPeersQueueSize),
+	}
+	session.addDownload(download)
+
+	conn := dialWithHandshake(session, download.torrentInfo.InfoHash, [20]byte{}, t)
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	_, err = conn.Read(make([]byte, 1))
+	if err == nil {
+		t.Errorf("connection from banned peer is not closed")
+	}
+
+	select {
+	case <-download.connectedPeers:
+		t.Errorf("connection from banned peer is routed to the download")
+	default:
+	}
+}
+
+func TestSessionFiltersBlockedPeers(t *testing.T) {
+	filterPath := filepath.Join(t.TempDir(), "ipfilter.dat")
+	err := os.WriteFile(filterPath, []byte("# nothing is blocked yet\n"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	filter, err := ip_filter.New([]string{filterPath})
+	if err != nil {
+		t.Fatalf("failed to load IP filter: %v", err)
+	}
+
+	session, err := NewSession(SessionOptions{IPFilter: filter})
+	if err != nil {
+		t.Fatalf("failed to create session: %v", err)
+	}
+	defer session.Close()
+
+	if session.isBlocked(net.ParseIP("127.0.0.1")) {
+		t.Fatalf("peer is blocked by the empty filter")
+	}
+
+	err = os.WriteFile(filterPath, []byte("127.000.000.000 - 127.255.255.255 , 000 , loopback\n"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = session.ReloadIPFilter()
+	if err != nil {
+		t.Fatalf("failed to reload IP filter: %v", err)
+	}
+
+	download := &Download{
+		torrentInfo:     &torrent_info.TorrentInfo{InfoHash: sha1.Sum([]byte("torrent"))},
+		discoveredPeers: make(chan tracker.PeerInfo, discoveredPeersQueueSize),
+		connectedPeers:  make(chan connectedPeer, connectedPeersQueueSize),
+	}
+	session.addDownload(download)
+
+	conn := dialWithHandshake(session, download.torrentInfo.InfoHash, [20]byte{}, t)
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	_, err = conn.Read(make([]byte, 1))
+	if err == nil {
+		t.Errorf("connection from blocked peer is not closed")
+	}
+
+	select {
+	case <-download.connectedPeers:
+		t.Errorf("connection from blocked peer is routed to the download")
+	default:
+	}
+}
@@ -0,0 +1,163 @@
+package smart_ban
+
+import (
+	"crypto/sha1"
+	"net/netip"
+	"sync"
+
+	"github.com/mertwole/bittorrent-cli/download/peer/constants"
+)
+
+// Peer is banned after this many failed pieces even if its blocks can't be compared with the valid ones.
+const maxHashFailures = 5
+
+// Block of the piece that failed the hash check, received from a single peer.
+type Block struct {
+	Offset int
+	Data   []byte
+	Peer   netip.Addr
+}
+
+// Block hashes of the failed pieces are kept until the piece is downloaded successfully.
+// Peers that sent blocks different from the valid ones are banned.
+type SmartBan struct {
+	// Piece -> block offset -> peer -> hash of the block received from the peer.
+	failedBlocks map[int]map[int]map[netip.Addr][sha1.Size]byte
+	hashFailures map[netip.Addr]int
+	banned       map[netip.Addr]struct{}
+	mutex        sync.Mutex
+
+	onBan func(netip.Addr)
+}
+
+// onBan is called without the lock held, so it can disconnect the banned peers.
+func New(onBan func(netip.Addr)) *SmartBan {
+	return &SmartBan{
+		failedBlocks: make(map[int]map[int]map[netip.Addr][sha1.Size]byte),
+		hashFailures: make(map[netip.Addr]int),
+		banned:       make(map[netip.Addr]struct{}),
+		onBan:        onBan,
+	}
+}
+
+// Splits the data into blocks of the standard size supplied by the same peer.
+func BlocksFrom(data []byte, peer netip.Addr) []Block {
+	blocks := make([]Block, 0, (len(data)+constants.BlockSize-1)/constants.BlockSize)
+	for offset := 0; offset < len(data); offset += constants.BlockSize {
+		end := min(offset+constants.BlockSize, len(data))
+		blocks = append(blocks, Block{Offset: offset, Data: data[offset:end], Peer: peer.Unmap()})
+	}
+
+	return blocks
+}
+
+func (smartBan *SmartBan) PieceFailed(piece int, blocks []Block) {
+	smartBan.mutex.Lock()
+
+	pieceBlocks, ok := smartBan.failedBlocks[piece]
+	if !ok {
+		pieceBlocks = make(map[int]map[netip.Addr][sha1.Size]byte)
+		smartBan.failedBlocks[piece] = pieceBlocks
+	}
+
+	suppliers := make(map[netip.Addr]struct{})
+	for _, block := range blocks {
+		if pieceBlocks[block.Offset] == nil {
+			pieceBlocks[block.Offset] = make(map[netip.Addr][sha1.Size]byte)
+		}
+
+		supplier := block.Peer.Unmap()
+		pieceBlocks[block.Offset][supplier] = sha1.Sum(block.Data)
+		suppliers[supplier] = struct{}{}
+	}
+
+	toBan := make([]netip.Addr, 0)
+	for supplier := range suppliers {
+		smartBan.hashFailures[supplier]++
+		if smartBan.hashFailures[supplier] >= maxHashFailures && smartBan.banLocked(supplier) {
+			toBan = append(toBan, supplier)
+		}
+	}
+
+	smartBan.mutex.Unlock()
+
+	smartBan.notify(toBan)
+}
+
+// Compares the blocks of the piece that passed the hash check with the ones that failed it.
+func (smartBan *SmartBan) PiecePassed(piece int, data []byte) {
+	smartBan.mutex.Lock()
+
+	pieceBlocks, ok := smartBan.failedBlocks[piece]
+	if !ok {
+		smartBan.mutex.Unlock()
+		return
+	}
+	delete(smartBan.failedBlocks, piece)
+
+	toBan := make([]netip.Addr, 0)
+	for offset, received := range pieceBlocks {
+		if offset >= len(data) {
+			continue
+		}
+
+		validHash := sha1.Sum(data[offset:min(offset+constants.BlockSize, len(data))])
+		for peer, hash := range received {
+			if hash != validHash && smartBan.banLocked(peer) {
+				toBan = append(toBan, peer)
+			}
+		}
+	}
+
+	smartBan.mutex.Unlock()
+
+	smartBan.notify(toBan)
+}
+
+func (smartBan *SmartBan) IsBanned(peer netip.Addr) bool {
+	smartBan.mutex.Lock()
+	defer smartBan.mutex.Unlock()
+
+	_, banned := smartBan.banned[peer.Unmap()]
+	return banned
+}
+
+func (smartBan *SmartBan) GetHashFailures(peer netip.Addr) int {
+	smartBan.mutex.Lock()
+	defer smartBan.mutex.Unlock()
+
+	return smartBan.hashFailures[peer.Unmap()]
+}
+
+func (smartBan *SmartBan) GetBanned() []netip.Addr {
+	smartBan.mutex.Lock()
+	defer smartBan.mutex.Unlock()
+
+	banned := make([]netip.Addr, 0, len(smartBan.banned))
+	for peer := range smartBan.banned {
+		banned = append(banned, peer)
+	}
+
+	return banned
+}
+
+// Returns false if the peer is already banned.
+func (smartBan *SmartBan) banLocked(peer netip.Addr) bool {
+	if _, ok := smartBan.banned[peer]; ok {
+		return false
+	}
+
+	smartBan.banned[peer] = struct{}{}
+
+	return true
+}
+
+func (smartBan *SmartBan) notify(banned []netip.Addr) {
+	if smartBan.onBan == nil {
+		return
+	}
+
+	for _, peer := range banned {
+		smartBan.onBan(peer)
+	}
+}
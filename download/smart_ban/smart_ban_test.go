@@ -0,0 +1,84 @@
+package smart_ban
+
+import (
+	"bytes"
+	"net/netip"
+	"slices"
+	"testing"
+
+	"github.com/mertwole/bittorrent-cli/download/peer/constants"
+)
+
+func TestPoisonerIsBanned(t *testing.T) {
+	honest := netip.MustParseAddr("1.1.1.1")
+	poisoner := netip.MustParseAddr("2.2.2.2")
+
+	banned := make([]netip.Addr, 0)
+	smartBan := New(func(peer netip.Addr) { banned = append(banned, peer) })
+
+	valid := bytes.Repeat([]byte{1}, constants.BlockSize*3)
+
+	poisoned := slices.Clone(valid)
+	poisoned[constants.BlockSize*2] = 0
+
+	// Honest peer supplied the first blocks, while the poisoner sent the last one.
+	blocks := BlocksFrom(poisoned, honest)
+	blocks[2].Peer = poisoner
+	smartBan.PieceFailed(7, blocks)
+
+	if len(banned) != 0 {
+		t.Fatalf("peers are banned before the valid piece is received: %v", banned)
+	}
+
+	if smartBan.GetHashFailures(honest) != 1 || smartBan.GetHashFailures(poisoner) != 1 {
+		t.Errorf("hash failures are not counted for the suppliers of the piece")
+	}
+
+	smartBan.PiecePassed(7, valid)
+
+	if !slices.Equal(banned, []netip.Addr{poisoner}) {
+		t.Errorf("expected only the poisoner to be banned, got %v", banned)
+	}
+
+	if !smartBan.IsBanned(poisoner) || smartBan.IsBanned(honest) {
+		t.Errorf("unexpected ban state")
+	}
+
+	// Records are removed once the piece is verified.
+	smartBan.PiecePassed(7, valid)
+	if len(banned) != 1 {
+		t.Errorf("peer is banned twice")
+	}
+}
+
+func TestRepeatedFailuresBan(t *testing.T) {
+	peer := netip.MustParseAddr("::ffff:3.3.3.3")
+
+	banned := make([]netip.Addr, 0)
+	smartBan := New(func(peer netip.Addr) { banned = append(banned, peer) })
+
+	for piece := range maxHashFailures {
+		smartBan.PieceFailed(piece, BlocksFrom([]byte("corrupted"), peer))
+	}
+
+	if !slices.Equal(banned, []netip.Addr{peer.Unmap()}) {
+		t.Errorf("peer is not banned after %d failed pieces: %v", maxHashFailures, banned)
+	}
+
+	if !smartBan.IsBanned(peer) {
+		t.Errorf("IPv4-mapped address is not recognised as banned")
+	}
+}
+
+func TestBlocksFrom(t *testing.T) {
+	data := make([]byte, constants.BlockSize*2+10)
+	blocks := BlocksFrom(data, netip.MustParseAddr("1.1.1.1"))
+
+	if len(blocks) != 3 {
+		t.Fatalf("expected 3 blocks, got %d", len(blocks))
+	}
+
+	if blocks[2].Offset != constants.BlockSize*2 || len(blocks[2].Data) != 10 {
+		t.Errorf("last block is split incorrectly: offset %d, length %d", blocks[2].Offset, len(blocks[2].Data))
+	}
+}
@@ -13,7 +13,8 @@ import (
 
 // TODO: Nest Metadata here.
 type TorrentInfo struct {
-	Trackers    []*url.URL
+	// Grouped in tiers as specified in BEP12.
+	Trackers    [][]*url.URL
 	Pieces      [][sha1.Size]byte
 	PieceLength uint64
 	TotalLength uint64
@@ -64,27 +65,9 @@ func Decode(reader io.Reader) (*TorrentInfo, error) {
 		return nil, err
 	}
 
-	trackers := make([]*url.URL, 0)
-
-	tracker, err := url.Parse(bencodeTorrent.Announce)
+	trackers, err := decodeTrackers(bencodeTorrent.Announce, bencodeTorrent.AnnounceList)
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse announce URL %s: %w", bencodeTorrent.Announce, err)
-	}
-	trackers = append(trackers, tracker)
-
-	for _, list := range bencodeTorrent.AnnounceList {
-		for _, tracker := range list {
-			trackerURL, err := url.Parse(tracker)
-			if err != nil {
-				return nil, fmt.Errorf(
-					"failed to parse announce-list URL %s: %w",
-					bencodeTorrent.Announce,
-					err,
-				)
-			}
-
-			trackers = append(trackers, trackerURL)
-		}
+		return nil, err
 	}
 
 	var pieces [][sha1.Size]byte
@@ -129,6 +112,44 @@ func Decode(reader io.Reader) (*TorrentInfo, error) {
 	}, nil
 }
 
+// Announce URL is ignored when announce-list is present, as specified in the BEP12.
+func decodeTrackers(announce string, announceList [][]string) ([][]*url.URL, error) {
+	tiers := make([][]*url.URL, 0)
+	known := make(map[string]bool)
+
+	for _, list := range announceList {
+		tier := make([]*url.URL, 0)
+		for _, tracker := range list {
+			if tracker == "" || known[tracker] {
+				continue
+			}
+
+			trackerURL, err := url.Parse(tracker)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse announce-list URL %s: %w", tracker, err)
+			}
+
+			known[tracker] = true
+			tier = append(tier, trackerURL)
+		}
+
+		if len(tier) != 0 {
+			tiers = append(tiers, tier)
+		}
+	}
+
+	if announce != "" && len(tiers) == 0 {
+		trackerURL, err := url.Parse(announce)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse announce URL %s: %w", announce, err)
+		}
+
+		tiers = append(tiers, []*url.URL{trackerURL})
+	}
+
+	return tiers, nil
+}
+
 func DecodeMetadata(reader io.Reader) (*Metadata, error) {
 	bencodeMetadata := bencodeInfo{}
 	err := bencode.Deserialize(reader, &bencodeMetadata)
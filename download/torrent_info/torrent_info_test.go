@@ -0,0 +1,76 @@
+package torrent_info
+
+import (
+	"net/url"
+	"slices"
+	"testing"
+)
+
+func TestDecodeTrackers(t *testing.T) {
+	testCases := []struct {
+		name         string
+		announce     string
+		announceList [][]string
+		expected     [][]string
+	}{
+		{
+			name:     "announce only",
+			announce: "http://a/announce",
+			expected: [][]string{{"http://a/announce"}},
+		},
+		{
+			name:         "announce repeated in the list",
+			announce:     "http://b/announce",
+			announceList: [][]string{{"http://a/announce", "http://b/announce"}, {"udp://c:80"}},
+			expected:     [][]string{{"http://a/announce", "http://b/announce"}, {"udp://c:80"}},
+		},
+		{
+			name:         "announce ignored when the list is present",
+			announce:     "http://a/announce",
+			announceList: [][]string{{"http://b/announce"}},
+			expected:     [][]string{{"http://b/announce"}},
+		},
+		{
+			name:         "announce used when the list is empty",
+			announce:     "http://a/announce",
+			announceList: [][]string{{""}},
+			expected:     [][]string{{"http://a/announce"}},
+		},
+		{
+			name:         "duplicates across tiers",
+			announceList: [][]string{{"http://a/announce", "http://a/announce"}, {"http://a/announce"}, {"", "udp://c:80"}},
+			expected:     [][]string{{"http://a/announce"}, {"udp://c:80"}},
+		},
+		{
+			name:     "trackerless",
+			expected: [][]string{},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			tiers, err := decodeTrackers(testCase.announce, testCase.announceList)
+			if err != nil {
+				t.Fatalf("failed to decode trackers: %v", err)
+			}
+
+			decoded := make([][]string, 0)
+			for _, tier := range tiers {
+				decoded = append(decoded, urlStrings(tier))
+			}
+
+			if !slices.EqualFunc(decoded, testCase.expected, slices.Equal) {
+				t.Errorf("unexpected tiers: expected %v, got %v", testCase.expected, decoded)
+			}
+		})
+	}
+}
+
+func urlStrings(urls []*url.URL) []string {
+	strings := make([]string, 0, len(urls))
+	for _, url := range urls {
+		strings = append(strings, url.String())
+	}
+
+	return strings
+}
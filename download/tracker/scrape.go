@@ -0,0 +1,232 @@
+package tracker
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/mertwole/bittorrent-cli/download/bencode"
+)
+
+// Limited by the UDP packet size as specified in BEP15.
+const maxUDPScrapeInfoHashes = 74
+
+type ScrapeResult struct {
+	Seeders   int
+	Completed int
+	Leechers  int
+}
+
+type scrapeResponseBencode struct {
+	Files         map[string]scrapeFileBencode `bencode:"files"`
+	FailureReason *string                      `bencode:"failure reason"`
+}
+
+type scrapeFileBencode struct {
+	Complete   int `bencode:"complete"`
+	Downloaded int `bencode:"downloaded"`
+	Incomplete int `bencode:"incomplete"`
+}
+
+func Scrape(
+	ctx context.Context,
+	address *url.URL,
+	infoHashes [][sha1.Size]byte,
+) (map[[sha1.Size]byte]ScrapeResult, error) {
+	switch address.Scheme {
+	case "http", "https":
+		return sendHTTPScrapeRequest(ctx, address, infoHashes)
+	case "udp":
+		results := make(map[[sha1.Size]byte]ScrapeResult)
+		for chunk := range slices.Chunk(infoHashes, maxUDPScrapeInfoHashes) {
+			err := sendUDPScrapeRequest(ctx, address, chunk, results)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		return results, nil
+	default:
+		return nil, fmt.Errorf("unsupported tracker scheme: %s", address.Scheme)
+	}
+}
+
+func (tracker *Tracker) Scrape(ctx context.Context) (ScrapeResult, error) {
+	results, err := Scrape(ctx, tracker.url, [][sha1.Size]byte{tracker.infoHash})
+	if err != nil {
+		return ScrapeResult{}, err
+	}
+
+	result, ok := results[tracker.infoHash]
+	if !ok {
+		return ScrapeResult{}, fmt.Errorf("tracker %s has no info about the torrent", tracker.url)
+	}
+
+	tracker.mutex.Lock()
+	tracker.scrapeResult = &result
+	tracker.mutex.Unlock()
+
+	return result, nil
+}
+
+// Returns the latest swarm info received either in scrape or announce response.
+func (tracker *Tracker) GetScrapeResult() (ScrapeResult, bool) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	if tracker.scrapeResult == nil {
+		return ScrapeResult{}, false
+	}
+
+	return *tracker.scrapeResult, true
+}
+
+func (tracker *Tracker) updateScrapeResult(response *TrackerResponse) {
+	if response.Seeders == nil || response.Leechers == nil {
+		return
+	}
+
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	result := ScrapeResult{Seeders: *response.Seeders, Leechers: *response.Leechers}
+	if tracker.scrapeResult != nil {
+		result.Completed = tracker.scrapeResult.Completed
+	}
+
+	tracker.scrapeResult = &result
+}
+
+// Scrape URL is derived from the announce URL by replacing "announce" in the last path segment with "scrape".
+func scrapeURL(announceURL *url.URL) (*url.URL, error) {
+	directory, lastSegment := path.Split(announceURL.Path)
+	if !strings.HasPrefix(lastSegment, "announce") {
+		return nil, fmt.Errorf("tracker %s doesn't support scrape", announceURL)
+	}
+
+	address := *announceURL
+	address.Path = directory + "scrape" + strings.TrimPrefix(lastSegment, "announce")
+
+	return &address, nil
+}
+
+func sendHTTPScrapeRequest(
+	ctx context.Context,
+	address *url.URL,
+	infoHashes [][sha1.Size]byte,
+) (map[[sha1.Size]byte]ScrapeResult, error) {
+	address, err := scrapeURL(address)
+	if err != nil {
+		return nil, err
+	}
+
+	query := address.Query()
+	for _, infoHash := range infoHashes {
+		query.Add("info_hash", string(infoHash[:]))
+	}
+	address.RawQuery = query.Encode()
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, address.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create scrape request: %w", err)
+	}
+
+	response, err := httpClient.Do(request)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send scrape request to a tracker: %w", err)
+	}
+
+	defer response.Body.Close()
+
+	decodedResponse := scrapeResponseBencode{}
+	err = bencode.Deserialize(response.Body, &decodedResponse)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode scrape response: %w", err)
+	}
+
+	if decodedResponse.FailureReason != nil {
+		return nil, fmt.Errorf("tracker returned failure: %s", *decodedResponse.FailureReason)
+	}
+
+	results := make(map[[sha1.Size]byte]ScrapeResult)
+	for infoHash, file := range decodedResponse.Files {
+		if len(infoHash) != sha1.Size {
+			return nil, fmt.Errorf("invalid info hash length in scrape response: %d", len(infoHash))
+		}
+
+		results[[sha1.Size]byte([]byte(infoHash))] = ScrapeResult{
+			Seeders:   file.Complete,
+			Completed: file.Downloaded,
+			Leechers:  file.Incomplete,
+		}
+	}
+
+	return results, nil
+}
+
+func sendUDPScrapeRequest(
+	ctx context.Context,
+	address *url.URL,
+	infoHashes [][sha1.Size]byte,
+	results map[[sha1.Size]byte]ScrapeResult,
+) error {
+	conn, err := dialUDPTracker(address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// Unblocks pending reads when ctx is cancelled.
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	// Offset          Size            Name            Value
+	// 0               64-bit integer  connection_id
+	// 8               32-bit integer  action          2 // scrape
+	// 12              32-bit integer  transaction_id
+	// 16 + 20 * n     20-byte string  info_hash
+	// 16 + 20 * N
+	//
+	// Header up to transaction_id is added when sending.
+
+	request := make([]byte, 0, sha1.Size*len(infoHashes))
+	for _, infoHash := range infoHashes {
+		request = append(request, infoHash[:]...)
+	}
+
+	response, err := conn.send(udpActionScrape, request)
+	if err != nil {
+		return fmt.Errorf("failed to send scrape request to the UDP tracker %s: %w", address.String(), err)
+	}
+
+	// Offset      Size            Name            Value
+	// 0           32-bit integer  action          2 // scrape
+	// 4           32-bit integer  transaction_id
+	// 8 + 12 * n  32-bit integer  seeders
+	// 12 + 12 * n 32-bit integer  completed
+	// 16 + 12 * n 32-bit integer  leechers
+	// 8 + 12 * N
+	//
+	// Action and transaction ID are already stripped from the response.
+
+	if len(response) != 12*len(infoHashes) {
+		return fmt.Errorf("received scrape response of unexpected length: %d", len(response)+8)
+	}
+
+	for i, infoHash := range infoHashes {
+		offset := 12 * i
+		results[infoHash] = ScrapeResult{
+			Seeders:   int(binary.BigEndian.Uint32(response[offset : offset+4])),
+			Completed: int(binary.BigEndian.Uint32(response[offset+4 : offset+8])),
+			Leechers:  int(binary.BigEndian.Uint32(response[offset+8 : offset+12])),
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,201 @@
+package tracker
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestScrapeURL(t *testing.T) {
+	testCases := []struct {
+		announce string
+		scrape   string
+	}{
+		{"http://example.com/announce", "http://example.com/scrape"},
+		{"http://example.com/x/announce", "http://example.com/x/scrape"},
+		{"http://example.com/announce.php", "http://example.com/scrape.php"},
+		{"http://example.com/announce?passkey=abc", "http://example.com/scrape?passkey=abc"},
+		{"http://example.com/a", ""},
+		{"http://example.com/announce/x", ""},
+	}
+
+	for _, testCase := range testCases {
+		announceURL, err := url.Parse(testCase.announce)
+		if err != nil {
+			t.Fatalf("failed to parse URL %s: %v", testCase.announce, err)
+		}
+
+		scrape, err := scrapeURL(announceURL)
+		if testCase.scrape == "" {
+			if err == nil {
+				t.Errorf("expected %s to not support scrape, got %s", testCase.announce, scrape)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("failed to derive scrape URL from %s: %v", testCase.announce, err)
+			continue
+		}
+
+		if scrape.String() != testCase.scrape {
+			t.Errorf("unexpected scrape URL for %s: expected %s, got %s", testCase.announce, testCase.scrape, scrape)
+		}
+	}
+}
+
+func TestHTTPScrape(t *testing.T) {
+	first := sha1.Sum([]byte("first"))
+	second := sha1.Sum([]byte("second"))
+
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if request.URL.Path != "/scrape" {
+			http.NotFound(writer, request)
+			return
+		}
+
+		infoHashes := request.URL.Query()["info_hash"]
+		if len(infoHashes) != 2 || infoHashes[0] != string(first[:]) || infoHashes[1] != string(second[:]) {
+			t.Errorf("unexpected info hashes in scrape request: %x", infoHashes)
+		}
+
+		writer.Write([]byte("d5:filesd" +
+			"20:" + string(first[:]) + "d8:completei5e10:downloadedi50e10:incompletei10ee" +
+			"20:" + string(second[:]) + "d8:completei1e10:downloadedi2e10:incompletei3e4:name1:xe" +
+			"ee"))
+	}))
+	defer server.Close()
+
+	announceURL, err := url.Parse(server.URL + "/announce")
+	if err != nil {
+		t.Fatalf("failed to parse tracker URL: %v", err)
+	}
+
+	results, err := Scrape(context.Background(), announceURL, [][sha1.Size]byte{first, second})
+	if err != nil {
+		t.Fatalf("failed to scrape: %v", err)
+	}
+
+	assertScrapeResult(results, first, ScrapeResult{Seeders: 5, Completed: 50, Leechers: 10}, t)
+	assertScrapeResult(results, second, ScrapeResult{Seeders: 1, Completed: 2, Leechers: 3}, t)
+}
+
+func TestScrapeCancelled(t *testing.T) {
+	unblock := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		<-unblock
+	}))
+	defer server.Close()
+	defer close(unblock)
+
+	announceURL, err := url.Parse(server.URL + "/announce")
+	if err != nil {
+		t.Fatalf("failed to parse tracker URL: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+
+	_, err = Scrape(ctx, announceURL, [][sha1.Size]byte{sha1.Sum([]byte("torrent"))})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected scrape to be cancelled, got %v", err)
+	}
+}
+
+func TestUDPScrape(t *testing.T) {
+	infoHashes := make([][sha1.Size]byte, maxUDPScrapeInfoHashes+1)
+	for i := range infoHashes {
+		infoHashes[i] = sha1.Sum([]byte{byte(i)})
+	}
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("failed to create UDP tracker: %v", err)
+	}
+	defer conn.Close()
+
+	go serveUDPScrape(conn, t)
+
+	trackerURL, err := url.Parse("udp://" + conn.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("failed to parse tracker URL: %v", err)
+	}
+
+	results, err := Scrape(context.Background(), trackerURL, infoHashes)
+	if err != nil {
+		t.Fatalf("failed to scrape: %v", err)
+	}
+
+	for i, infoHash := range infoHashes {
+		expected := ScrapeResult{Seeders: int(infoHash[0]), Completed: i % maxUDPScrapeInfoHashes, Leechers: 1}
+		assertScrapeResult(results, infoHash, expected, t)
+	}
+}
+
+// Responds with the first byte of info hash as seeders and its position in the request as completed.
+func serveUDPScrape(conn *net.UDPConn, t *testing.T) {
+	const connectionID = 0x1234
+
+	buffer := make([]byte, 2048)
+	for {
+		length, address, err := conn.ReadFromUDP(buffer)
+		if err != nil {
+			return
+		}
+
+		request := buffer[:length]
+		action := binary.BigEndian.Uint32(request[8:12])
+		transactionID := request[12:16]
+
+		response := make([]byte, 8)
+		binary.BigEndian.PutUint32(response[:4], action)
+		copy(response[4:8], transactionID)
+
+		switch action {
+		case 0:
+			response = binary.BigEndian.AppendUint64(response, connectionID)
+		case 2:
+			if binary.BigEndian.Uint64(request[:8]) != connectionID {
+				t.Errorf("unexpected connection ID in scrape request")
+			}
+
+			infoHashes := request[16:]
+			if len(infoHashes)/sha1.Size > maxUDPScrapeInfoHashes {
+				t.Errorf("too many info hashes in scrape request: %d", len(infoHashes)/sha1.Size)
+			}
+
+			for i := range len(infoHashes) / sha1.Size {
+				response = binary.BigEndian.AppendUint32(response, uint32(infoHashes[i*sha1.Size]))
+				response = binary.BigEndian.AppendUint32(response, uint32(i))
+				response = binary.BigEndian.AppendUint32(response, 1)
+			}
+		}
+
+		conn.WriteToUDP(response, address)
+	}
+}
+
+func assertScrapeResult(
+	results map[[sha1.Size]byte]ScrapeResult,
+	infoHash [sha1.Size]byte,
+	expected ScrapeResult,
+	t *testing.T,
+) {
+	result, ok := results[infoHash]
+	if !ok {
+		t.Errorf("no scrape result for %x", infoHash)
+		return
+	}
+
+	if result != expected {
+		t.Errorf("unexpected scrape result for %x: expected %+v, got %+v", infoHash, expected, result)
+	}
+}
@@ -0,0 +1,567 @@
+package tracker
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/netip"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mertwole/bittorrent-cli/download/bencode"
+)
+
+const defaultNumWant = 50
+const maxNumWant = 200
+
+// Peer is forgotten if it doesn't announce for this many announce intervals.
+const peerTimeoutIntervals = 3
+
+// Clients are allowed to use connection ID for a minute, so the server keeps it for two.
+const udpServerConnectionIDLifetime = udpConnectionIDLifetime * 2
+
+var errNotWhitelisted = errors.New("torrent is not allowed on this tracker")
+
+// Server is a BitTorrent tracker serving announce and scrape requests over HTTP and UDP.
+type Server struct {
+	interval time.Duration
+	// Every torrent is allowed if whitelist is nil.
+	whitelist map[[sha1.Size]byte]struct{}
+
+	swarms map[[sha1.Size]byte]*swarm
+	mutex  sync.Mutex
+
+	udpConnectionIDs map[uint64]udpServerConnectionID
+	udpMutex         sync.Mutex
+}
+
+type swarm struct {
+	peers     map[[20]byte]*swarmPeer
+	completed int
+}
+
+type swarmPeer struct {
+	info     PeerInfo
+	seeding  bool
+	lastSeen time.Time
+}
+
+// Connection ID is bound to the IP only, since clients might send requests from different ports.
+type udpServerConnectionID struct {
+	ip        string
+	expiresAt time.Time
+}
+
+type announceResult struct {
+	peers    []PeerInfo
+	seeders  int
+	leechers int
+}
+
+type peerBencode struct {
+	IP     string  `bencode:"ip"`
+	PeerID *string `bencode:"peer id"`
+	Port   int     `bencode:"port"`
+}
+
+func NewServer(interval time.Duration, whitelist [][sha1.Size]byte) *Server {
+	server := Server{
+		interval:         interval,
+		swarms:           make(map[[sha1.Size]byte]*swarm),
+		udpConnectionIDs: make(map[uint64]udpServerConnectionID),
+	}
+
+	if whitelist != nil {
+		server.whitelist = make(map[[sha1.Size]byte]struct{})
+		for _, infoHash := range whitelist {
+			server.whitelist[infoHash] = struct{}{}
+		}
+	}
+
+	return &server
+}
+
+func (server *Server) isAllowed(infoHash [sha1.Size]byte) bool {
+	if server.whitelist == nil {
+		return true
+	}
+
+	_, ok := server.whitelist[infoHash]
+	return ok
+}
+
+func (server *Server) announce(request *announceRequest, ip net.IP) (*announceResult, error) {
+	if !server.isAllowed(request.infoHash) {
+		return nil, errNotWhitelisted
+	}
+
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	torrentSwarm, ok := server.swarms[request.infoHash]
+	if !ok {
+		torrentSwarm = &swarm{peers: make(map[[20]byte]*swarmPeer)}
+		server.swarms[request.infoHash] = torrentSwarm
+	}
+
+	now := time.Now()
+	for peerID, peer := range torrentSwarm.peers {
+		if now.Sub(peer.lastSeen) > server.interval*peerTimeoutIntervals {
+			delete(torrentSwarm.peers, peerID)
+		}
+	}
+
+	if request.event == Stopped {
+		delete(torrentSwarm.peers, request.peerID)
+	} else {
+		if request.event == Completed {
+			torrentSwarm.completed++
+		}
+
+		peerID := request.peerID
+		torrentSwarm.peers[request.peerID] = &swarmPeer{
+			info:     PeerInfo{IP: ip, Port: request.port, PeerID: &peerID},
+			seeding:  request.left == 0,
+			lastSeen: now,
+		}
+	}
+
+	numWant := int(request.numWant)
+	if numWant < 0 {
+		numWant = defaultNumWant
+	}
+	numWant = min(numWant, maxNumWant)
+
+	result := announceResult{peers: make([]PeerInfo, 0)}
+	for peerID, peer := range torrentSwarm.peers {
+		if peer.seeding {
+			result.seeders++
+		} else {
+			result.leechers++
+		}
+
+		// Seeders don't need other seeders.
+		if peerID == request.peerID || (request.left == 0 && peer.seeding) || len(result.peers) >= numWant {
+			continue
+		}
+
+		result.peers = append(result.peers, peer.info)
+	}
+
+	rand.Shuffle(len(result.peers), func(i, j int) {
+		result.peers[i], result.peers[j] = result.peers[j], result.peers[i]
+	})
+
+	return &result, nil
+}
+
+// Returns info about every known torrent if infoHashes are empty.
+func (server *Server) scrape(infoHashes [][sha1.Size]byte) map[[sha1.Size]byte]ScrapeResult {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	if len(infoHashes) == 0 {
+		for infoHash := range server.swarms {
+			infoHashes = append(infoHashes, infoHash)
+		}
+	}
+
+	results := make(map[[sha1.Size]byte]ScrapeResult)
+	for _, infoHash := range infoHashes {
+		if !server.isAllowed(infoHash) {
+			continue
+		}
+
+		result := ScrapeResult{}
+		if torrentSwarm, ok := server.swarms[infoHash]; ok {
+			result.Completed = torrentSwarm.completed
+			for _, peer := range torrentSwarm.peers {
+				if peer.seeding {
+					result.Seeders++
+				} else {
+					result.Leechers++
+				}
+			}
+		}
+
+		results[infoHash] = result
+	}
+
+	return results
+}
+
+// Handles announce and scrape requests, the kind of request is determined by the last path segment.
+func (server *Server) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	lastSegment := path.Base(request.URL.Path)
+
+	var response any
+	switch {
+	case strings.HasPrefix(lastSegment, "announce"):
+		response = server.serveHTTPAnnounce(request)
+	case strings.HasPrefix(lastSegment, "scrape"):
+		response = server.serveHTTPScrape(request)
+	default:
+		http.NotFound(writer, request)
+		return
+	}
+
+	var encoded bytes.Buffer
+	err := bencode.Serialize(&encoded, response)
+	if err != nil {
+		log.Panicf("cannot encode tracker response: %v", err)
+	}
+
+	writer.Header().Set("Content-Type", "text/plain")
+	writer.Write(encoded.Bytes())
+}
+
+func (server *Server) serveHTTPAnnounce(request *http.Request) any {
+	announceRequest, err := parseHTTPAnnounceRequest(request)
+	if err != nil {
+		return httpFailure(err)
+	}
+
+	remoteAddrPort, err := netip.ParseAddrPort(request.RemoteAddr)
+	if err != nil {
+		return httpFailure(fmt.Errorf("unable to parse remote address: %w", err))
+	}
+
+	result, err := server.announce(announceRequest, remoteAddrPort.Addr().Unmap().AsSlice())
+	if err != nil {
+		return httpFailure(err)
+	}
+
+	seeders, leechers := result.seeders, result.leechers
+	response := trackerResponseBencode{
+		Interval:   int(server.interval.Seconds()),
+		Complete:   &seeders,
+		Incomplete: &leechers,
+	}
+
+	if request.URL.Query().Get("compact") == "0" {
+		noPeerID := request.URL.Query().Get("no_peer_id") == "1"
+
+		peers := make([]peerBencode, 0, len(result.peers))
+		for _, peer := range result.peers {
+			encoded := peerBencode{IP: peer.IP.String(), Port: int(peer.Port)}
+			if !noPeerID {
+				peerID := string(peer.PeerID[:])
+				encoded.PeerID = &peerID
+			}
+
+			peers = append(peers, encoded)
+		}
+
+		response.Peers = peers
+
+		return response
+	}
+
+	// BEP7: IPv6 peers are sent separately.
+	peers, peers6 := make([]byte, 0), make([]byte, 0)
+	for _, peer := range result.peers {
+		if peer.IsIPv4() {
+			peers = append(peers, peer.EncodeCompact()...)
+		} else {
+			peers6 = append(peers6, peer.EncodeCompact()...)
+		}
+	}
+
+	response.Peers = string(peers)
+	if len(peers6) != 0 {
+		peers6String := string(peers6)
+		response.Peers6 = &peers6String
+	}
+
+	return response
+}
+
+func parseHTTPAnnounceRequest(request *http.Request) (*announceRequest, error) {
+	query := request.URL.Query()
+
+	infoHash := query.Get("info_hash")
+	if len(infoHash) != sha1.Size {
+		return nil, fmt.Errorf("invalid info_hash")
+	}
+
+	peerID := query.Get("peer_id")
+	if len(peerID) != 20 {
+		return nil, fmt.Errorf("invalid peer_id")
+	}
+
+	port, err := strconv.ParseUint(query.Get("port"), 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port")
+	}
+
+	parsed := announceRequest{
+		infoHash: [sha1.Size]byte([]byte(infoHash)),
+		peerID:   [20]byte([]byte(peerID)),
+		port:     uint16(port),
+		numWant:  -1,
+	}
+
+	counters := []struct {
+		name  string
+		value *uint64
+	}{
+		{"downloaded", &parsed.downloaded},
+		{"uploaded", &parsed.uploaded},
+		{"left", &parsed.left},
+	}
+	for _, counter := range counters {
+		if !query.Has(counter.name) {
+			continue
+		}
+
+		*counter.value, err = strconv.ParseUint(query.Get(counter.name), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s", counter.name)
+		}
+	}
+
+	if query.Has("numwant") {
+		numWant, err := strconv.ParseInt(query.Get("numwant"), 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid numwant")
+		}
+
+		parsed.numWant = int32(numWant)
+	}
+
+	switch query.Get("event") {
+	case "", "empty":
+		parsed.event = None
+	case Started.String():
+		parsed.event = Started
+	case Completed.String():
+		parsed.event = Completed
+	case Stopped.String():
+		parsed.event = Stopped
+	default:
+		return nil, fmt.Errorf("invalid event")
+	}
+
+	return &parsed, nil
+}
+
+func (server *Server) serveHTTPScrape(request *http.Request) any {
+	infoHashes := make([][sha1.Size]byte, 0)
+	for _, infoHash := range request.URL.Query()["info_hash"] {
+		if len(infoHash) != sha1.Size {
+			return httpFailure(fmt.Errorf("invalid info_hash"))
+		}
+
+		infoHashes = append(infoHashes, [sha1.Size]byte([]byte(infoHash)))
+	}
+
+	response := scrapeResponseBencode{Files: make(map[string]scrapeFileBencode)}
+	for infoHash, result := range server.scrape(infoHashes) {
+		response.Files[string(infoHash[:])] = scrapeFileBencode{
+			Complete:   result.Seeders,
+			Downloaded: result.Completed,
+			Incomplete: result.Leechers,
+		}
+	}
+
+	return response
+}
+
+func httpFailure(err error) any {
+	reason := err.Error()
+	return struct {
+		FailureReason *string `bencode:"failure reason"`
+	}{FailureReason: &reason}
+}
+
+// Serves UDP tracker protocol as specified in BEP15 until ctx is cancelled.
+func (server *Server) ServeUDP(ctx context.Context, conn net.PacketConn) error {
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	buffer := make([]byte, udpMaxPacketLength)
+	for {
+		length, address, err := conn.ReadFrom(buffer)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+
+			return fmt.Errorf("failed to read UDP request: %w", err)
+		}
+
+		response := server.handleUDPRequest(buffer[:length], address)
+		if response == nil {
+			continue
+		}
+
+		_, err = conn.WriteTo(response, address)
+		if err != nil {
+			log.Printf("failed to send UDP tracker response to %s: %v", address, err)
+		}
+	}
+}
+
+// Returns nil if the request should be ignored.
+func (server *Server) handleUDPRequest(request []byte, address net.Addr) []byte {
+	if len(request) < 16 {
+		return nil
+	}
+
+	connectionID := binary.BigEndian.Uint64(request[:8])
+	action := binary.BigEndian.Uint32(request[8:12])
+	transactionID := binary.BigEndian.Uint32(request[12:16])
+	payload := request[16:]
+
+	response := binary.BigEndian.AppendUint32(nil, action)
+	response = binary.BigEndian.AppendUint32(response, transactionID)
+
+	if action == udpActionConnect {
+		if connectionID != udpProtocolID {
+			return nil
+		}
+
+		return binary.BigEndian.AppendUint64(response, server.newUDPConnectionID(address))
+	}
+
+	if !server.isValidUDPConnectionID(connectionID, address) {
+		return udpFailure(transactionID, fmt.Errorf("invalid connection ID"))
+	}
+
+	var err error
+	switch action {
+	case udpActionAnnounce:
+		response, err = server.handleUDPAnnounce(response, payload, address)
+	case udpActionScrape:
+		response, err = server.handleUDPScrape(response, payload)
+	default:
+		err = fmt.Errorf("unknown action %d", action)
+	}
+
+	if err != nil {
+		return udpFailure(transactionID, err)
+	}
+
+	return response
+}
+
+func (server *Server) handleUDPAnnounce(response []byte, payload []byte, address net.Addr) ([]byte, error) {
+	// See sendUDPAnnounceRequest for the request layout, payload starts with info_hash.
+	if len(payload) < 82 {
+		return nil, fmt.Errorf("invalid announce request length")
+	}
+
+	request := announceRequest{
+		infoHash:   [sha1.Size]byte(payload[:20]),
+		peerID:     [20]byte(payload[20:40]),
+		downloaded: binary.BigEndian.Uint64(payload[40:48]),
+		left:       binary.BigEndian.Uint64(payload[48:56]),
+		uploaded:   binary.BigEndian.Uint64(payload[56:64]),
+		event:      Event(binary.BigEndian.Uint32(payload[64:68])),
+		key:        binary.BigEndian.Uint32(payload[72:76]),
+		numWant:    int32(binary.BigEndian.Uint32(payload[76:80])),
+		port:       binary.BigEndian.Uint16(payload[80:82]),
+	}
+
+	addrPort, err := netip.ParseAddrPort(address.String())
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse remote address: %w", err)
+	}
+	ip := addrPort.Addr().Unmap()
+
+	result, err := server.announce(&request, ip.AsSlice())
+	if err != nil {
+		return nil, err
+	}
+
+	response = binary.BigEndian.AppendUint32(response, uint32(server.interval.Seconds()))
+	response = binary.BigEndian.AppendUint32(response, uint32(result.leechers))
+	response = binary.BigEndian.AppendUint32(response, uint32(result.seeders))
+
+	// Peers are returned in the address family of the request.
+	for _, peer := range result.peers {
+		if peer.IsIPv4() == ip.Is4() {
+			response = append(response, peer.EncodeCompact()...)
+		}
+	}
+
+	return response, nil
+}
+
+func (server *Server) handleUDPScrape(response []byte, payload []byte) ([]byte, error) {
+	if len(payload)%sha1.Size != 0 || len(payload)/sha1.Size > maxUDPScrapeInfoHashes {
+		return nil, fmt.Errorf("invalid scrape request length")
+	}
+
+	infoHashes := make([][sha1.Size]byte, 0, len(payload)/sha1.Size)
+	for i := 0; i < len(payload); i += sha1.Size {
+		infoHashes = append(infoHashes, [sha1.Size]byte(payload[i:i+sha1.Size]))
+	}
+
+	results := server.scrape(infoHashes)
+	for _, infoHash := range infoHashes {
+		result := results[infoHash]
+		response = binary.BigEndian.AppendUint32(response, uint32(result.Seeders))
+		response = binary.BigEndian.AppendUint32(response, uint32(result.Completed))
+		response = binary.BigEndian.AppendUint32(response, uint32(result.Leechers))
+	}
+
+	return response, nil
+}
+
+func (server *Server) newUDPConnectionID(address net.Addr) uint64 {
+	server.udpMutex.Lock()
+	defer server.udpMutex.Unlock()
+
+	now := time.Now()
+	for connectionID, entry := range server.udpConnectionIDs {
+		if now.After(entry.expiresAt) {
+			delete(server.udpConnectionIDs, connectionID)
+		}
+	}
+
+	connectionID := rand.Uint64()
+	server.udpConnectionIDs[connectionID] = udpServerConnectionID{
+		ip:        udpAddressIP(address),
+		expiresAt: now.Add(udpServerConnectionIDLifetime),
+	}
+
+	return connectionID
+}
+
+func (server *Server) isValidUDPConnectionID(connectionID uint64, address net.Addr) bool {
+	server.udpMutex.Lock()
+	defer server.udpMutex.Unlock()
+
+	entry, ok := server.udpConnectionIDs[connectionID]
+
+	return ok && entry.ip == udpAddressIP(address) && time.Now().Before(entry.expiresAt)
+}
+
+func udpAddressIP(address net.Addr) string {
+	udpAddr, ok := address.(*net.UDPAddr)
+	if !ok {
+		return address.String()
+	}
+
+	return udpAddr.IP.String()
+}
+
+func udpFailure(transactionID uint32, err error) []byte {
+	response := binary.BigEndian.AppendUint32(nil, udpActionError)
+	response = binary.BigEndian.AppendUint32(response, transactionID)
+
+	return append(response, err.Error()...)
+}
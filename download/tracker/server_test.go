@@ -0,0 +1,174 @@
+package tracker
+
+import (
+	"context"
+	"crypto/sha1"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/mertwole/bittorrent-cli/download/bencode"
+)
+
+func TestServerHTTP(t *testing.T) {
+	infoHash := sha1.Sum([]byte("torrent"))
+	server := NewServer(time.Minute, [][sha1.Size]byte{infoHash})
+
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+
+	trackerURL, err := url.Parse(httpServer.URL + "/announce")
+	if err != nil {
+		t.Fatalf("failed to parse tracker URL: %v", err)
+	}
+
+	_, err = sendHTTPRequest(context.Background(), trackerURL, testAnnounceRequest(infoHash, 1, 6881, 0, Started))
+	if err != nil {
+		t.Fatalf("failed to announce: %v", err)
+	}
+
+	response, err := sendHTTPRequest(context.Background(), trackerURL, testAnnounceRequest(infoHash, 2, 6882, 100, Started))
+	if err != nil {
+		t.Fatalf("failed to announce: %v", err)
+	}
+
+	if len(response.Peers) != 1 || response.Peers[0].Port != 6881 || !response.Peers[0].IP.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Errorf("unexpected peers in response: %+v", response.Peers)
+	}
+
+	if response.Interval != 60 || *response.Seeders != 1 || *response.Leechers != 1 {
+		t.Errorf("unexpected announce response: %+v", response)
+	}
+
+	results, err := Scrape(context.Background(), trackerURL, [][sha1.Size]byte{infoHash})
+	if err != nil {
+		t.Fatalf("failed to scrape: %v", err)
+	}
+
+	assertScrapeResult(results, infoHash, ScrapeResult{Seeders: 1, Leechers: 1}, t)
+
+	otherInfoHash := sha1.Sum([]byte("other"))
+	_, err = sendHTTPRequest(context.Background(), trackerURL, testAnnounceRequest(otherInfoHash, 3, 6883, 0, Started))
+	if err == nil {
+		t.Errorf("announce of a torrent that isn't whitelisted succeeded")
+	}
+}
+
+func TestServerHTTPPeerFormats(t *testing.T) {
+	infoHash := sha1.Sum([]byte("torrent"))
+	server := NewServer(time.Minute, nil)
+	server.announce(testAnnounceRequest(infoHash, 1, 6881, 100, Started), net.IPv4(10, 0, 0, 1).To4())
+	server.announce(testAnnounceRequest(infoHash, 2, 6882, 100, Started), net.ParseIP("2001:db8::1"))
+
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+
+	for _, compact := range []string{"0", "1"} {
+		query := url.Values{}
+		query.Set("info_hash", string(infoHash[:]))
+		query.Set("peer_id", string(make([]byte, 20)))
+		query.Set("port", "6883")
+		query.Set("left", "100")
+		query.Set("compact", compact)
+
+		response, err := http.Get(httpServer.URL + "/announce?" + query.Encode())
+		if err != nil {
+			t.Fatalf("failed to announce: %v", err)
+		}
+
+		decoded := trackerResponseBencode{}
+		err = bencode.Deserialize(response.Body, &decoded)
+		response.Body.Close()
+		if err != nil {
+			t.Fatalf("failed to decode announce response: %v", err)
+		}
+
+		peers, err := decodePeers(context.Background(), decoded.Peers)
+		if err != nil {
+			t.Fatalf("failed to decode peers: %v", err)
+		}
+
+		if compact == "1" {
+			if decoded.Peers6 == nil {
+				t.Fatalf("IPv6 peers are not returned in peers6")
+			}
+
+			peers6, err := DecodeCompactPeerInfo6([]byte(*decoded.Peers6))
+			if err != nil {
+				t.Fatalf("failed to decode IPv6 peers: %v", err)
+			}
+
+			peers = append(peers, peers6...)
+		}
+
+		if len(peers) != 2 {
+			t.Errorf("unexpected peers in response with compact=%s: %+v", compact, peers)
+		}
+
+		for _, peer := range peers {
+			if (peer.PeerID != nil) != (compact == "0") {
+				t.Errorf("unexpected peer ID with compact=%s: %+v", compact, peer)
+			}
+		}
+	}
+}
+
+func TestServerUDP(t *testing.T) {
+	infoHash := sha1.Sum([]byte("torrent"))
+	server := NewServer(time.Minute, nil)
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("failed to create UDP tracker: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go server.ServeUDP(ctx, conn)
+
+	trackerURL, err := url.Parse("udp://" + conn.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("failed to parse tracker URL: %v", err)
+	}
+
+	_, err = sendUDPRequest(context.Background(), trackerURL, testAnnounceRequest(infoHash, 1, 6881, 0, Started))
+	if err != nil {
+		t.Fatalf("failed to announce: %v", err)
+	}
+
+	response, err := sendUDPRequest(context.Background(), trackerURL, testAnnounceRequest(infoHash, 2, 6882, 100, Completed))
+	if err != nil {
+		t.Fatalf("failed to announce: %v", err)
+	}
+
+	if len(response.Peers) != 1 || response.Peers[0].Port != 6881 {
+		t.Errorf("unexpected peers in response: %+v", response.Peers)
+	}
+
+	results, err := Scrape(context.Background(), trackerURL, [][sha1.Size]byte{infoHash})
+	if err != nil {
+		t.Fatalf("failed to scrape: %v", err)
+	}
+
+	assertScrapeResult(results, infoHash, ScrapeResult{Seeders: 1, Leechers: 1, Completed: 1}, t)
+}
+
+func testAnnounceRequest(
+	infoHash [sha1.Size]byte,
+	peerID byte,
+	port uint16,
+	left uint64,
+	event Event,
+) *announceRequest {
+	return &announceRequest{
+		infoHash: infoHash,
+		peerID:   [20]byte{peerID},
+		port:     port,
+		left:     left,
+		event:    event,
+		numWant:  -1,
+	}
+}
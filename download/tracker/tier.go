@@ -0,0 +1,201 @@
+package tracker
+
+import (
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net/url"
+	"slices"
+	"sync"
+	"time"
+)
+
+const eventsQueueSize = 4
+const failedAnnounceInterval = time.Second * 60
+const stoppedAnnounceTimeout = time.Second * 10
+
+// Tier announces to a single tracker at a time, falling back to the next one on failure as specified in BEP12.
+type Tier struct {
+	trackers []*Tracker
+	mutex    sync.Mutex
+
+	events chan Event
+}
+
+func NewTier(urls []*url.URL, infoHash [sha1.Size]byte, getStats func() Stats, peerID [20]byte) *Tier {
+	trackers := make([]*Tracker, 0, len(urls))
+	for _, url := range urls {
+		trackers = append(trackers, NewTracker(url, infoHash, getStats, peerID))
+	}
+
+	rand.Shuffle(len(trackers), func(i, j int) {
+		trackers[i], trackers[j] = trackers[j], trackers[i]
+	})
+
+	return &Tier{
+		trackers: trackers,
+		events:   make(chan Event, eventsQueueSize),
+	}
+}
+
+// Makes the running ListenForPeers announce the event immediately.
+func (tier *Tier) SendEvent(event Event) {
+	select {
+	case tier.events <- event:
+	default:
+		log.Printf("dropping %s event: too many pending events", event)
+	}
+}
+
+// Announces started event first and stopped event when ctx is cancelled.
+func (tier *Tier) ListenForPeers(ctx context.Context, listeningPort uint16, peers chan<- PeerInfo) {
+	interval := time.Duration(0)
+	event := None
+
+	for {
+		select {
+		case <-time.After(interval):
+		case event = <-tier.events:
+		case <-ctx.Done():
+			tier.stop(listeningPort)
+			return
+		}
+
+		response, err := tier.announce(ctx, listeningPort, event)
+		if err != nil {
+			log.Printf("error sending request to the tracker: %v", err)
+
+			if interval == 0 {
+				interval = failedAnnounceInterval
+			}
+
+			continue
+		}
+
+		event = None
+
+		log.Printf("Discovered %d peers", len(response.Peers))
+
+		interval = time.Second * time.Duration(response.Interval)
+		if response.MinInterval != nil {
+			interval = max(interval, time.Second*time.Duration(*response.MinInterval))
+		}
+		interval = max(interval, minRequestInterval)
+
+		if response.WarningMessage != nil {
+			log.Printf("tracker warning: %s", *response.WarningMessage)
+		}
+		for _, peer := range response.Peers {
+			select {
+			case peers <- peer:
+			case <-ctx.Done():
+				tier.stop(listeningPort)
+				return
+			}
+		}
+	}
+}
+
+// Returns swarm info from the tracker that is currently used.
+func (tier *Tier) GetScrapeResult() (ScrapeResult, bool) {
+	current, ok := tier.current()
+	if !ok {
+		return ScrapeResult{}, false
+	}
+
+	return current.GetScrapeResult()
+}
+
+func (tier *Tier) GetStatuses() []Status {
+	tier.mutex.Lock()
+	defer tier.mutex.Unlock()
+
+	statuses := make([]Status, 0, len(tier.trackers))
+	for _, tracker := range tier.trackers {
+		statuses = append(statuses, tracker.GetStatus())
+	}
+
+	return statuses
+}
+
+func (tier *Tier) Scrape(ctx context.Context) (ScrapeResult, error) {
+	current, ok := tier.current()
+	if !ok {
+		return ScrapeResult{}, fmt.Errorf("tier has no trackers")
+	}
+
+	return current.Scrape(ctx)
+}
+
+func (tier *Tier) current() (*Tracker, bool) {
+	tier.mutex.Lock()
+	defer tier.mutex.Unlock()
+
+	if len(tier.trackers) == 0 {
+		return nil, false
+	}
+
+	return tier.trackers[0], true
+}
+
+func (tier *Tier) announce(ctx context.Context, listeningPort uint16, event Event) (*TrackerResponse, error) {
+	tier.mutex.Lock()
+	trackers := slices.Clone(tier.trackers)
+	tier.mutex.Unlock()
+
+	for _, tracker := range trackers {
+		trackerEvent := event
+		// Tracker should learn about us first.
+		if !tracker.announced.Load() {
+			trackerEvent = Started
+		}
+
+		response, err := tracker.announce(ctx, listeningPort, trackerEvent)
+		if err != nil {
+			log.Printf("failed to announce to the tracker %s, trying the next one in the tier: %v", tracker.url, err)
+			continue
+		}
+
+		tier.promote(tracker)
+
+		return response, nil
+	}
+
+	return nil, fmt.Errorf("all %d trackers in the tier failed", len(trackers))
+}
+
+func (tier *Tier) promote(tracker *Tracker) {
+	tier.mutex.Lock()
+	defer tier.mutex.Unlock()
+
+	index := slices.Index(tier.trackers, tracker)
+	if index <= 0 {
+		return
+	}
+
+	tier.trackers = slices.Delete(tier.trackers, index, index+1)
+	tier.trackers = slices.Insert(tier.trackers, 0, tracker)
+}
+
+// Announce context is already cancelled at this point, so stopped event is sent with its own timeout.
+func (tier *Tier) stop(listeningPort uint16) {
+	ctx, cancel := context.WithTimeout(context.Background(), stoppedAnnounceTimeout)
+	defer cancel()
+
+	tier.mutex.Lock()
+	trackers := slices.Clone(tier.trackers)
+	tier.mutex.Unlock()
+
+	for _, tracker := range trackers {
+		if !tracker.announced.Load() {
+			continue
+		}
+
+		_, err := tracker.announce(ctx, listeningPort, Stopped)
+		if err != nil {
+			log.Printf("error sending stopped event to the tracker %s: %v", tracker.url, err)
+		}
+	}
+}
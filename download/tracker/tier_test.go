@@ -0,0 +1,63 @@
+package tracker
+
+import (
+	"context"
+	"crypto/sha1"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestTierFailover(t *testing.T) {
+	working := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Write([]byte("d8:intervali60e5:peers6:\x7f\x00\x00\x01\x1a\xe1e"))
+	}))
+	defer working.Close()
+
+	failing := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		http.Error(writer, "error", http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+
+	urls := make([]*url.URL, 0)
+	for _, address := range []string{failing.URL, working.URL, failing.URL + "/other"} {
+		trackerURL, err := url.Parse(address + "/announce")
+		if err != nil {
+			t.Fatalf("failed to parse tracker URL: %v", err)
+		}
+
+		urls = append(urls, trackerURL)
+	}
+
+	tier := NewTier(urls, sha1.Sum([]byte("torrent")), func() Stats { return Stats{} }, [20]byte{})
+
+	for range 2 {
+		response, err := tier.announce(context.Background(), 6881, None)
+		if err != nil {
+			t.Fatalf("failed to announce: %v", err)
+		}
+
+		if len(response.Peers) != 1 || response.Peers[0].Port != 6881 {
+			t.Errorf("unexpected peers received: %+v", response.Peers)
+		}
+
+		if tier.trackers[0].url != urls[1] {
+			t.Errorf("working tracker is not promoted to the front of the tier")
+		}
+	}
+
+	for _, tracker := range tier.trackers {
+		if tracker.announced.Load() != (tracker.url == urls[1]) {
+			t.Errorf("unexpected announce state of the tracker %s", tracker.url)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	tier.ListenForPeers(ctx, 6881, make(chan PeerInfo))
+
+	if tier.trackers[0].announced.Load() {
+		t.Errorf("stopped event is not sent to the tracker")
+	}
+}
@@ -6,37 +6,104 @@ import (
 	"encoding/binary"
 	"fmt"
 	"log"
+	"math"
 	"math/rand/v2"
 	"net"
 	"net/http"
 	"net/url"
 	"slices"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/mertwole/bittorrent-cli/download/bencode"
 )
 
-const maxAnnounceResponseLength = 1024
-const udpReadTimeout = time.Second * 20
 const minRequestInterval = time.Second * 10
+const compactPeerInfoLength = 6
+const compactPeerInfo6Length = 18
+const httpRequestTimeout = time.Second * 20
+const numWant = 50
+
+// Limits the time spent resolving DNS names of the peers returned by a tracker.
+const maxResolvedHostnames = 8
+const hostnameResolveTimeout = time.Second * 5
 
 const URLDataOption = 0x2
 const EndOfOptions = 0x0
 
+type Event uint32
+
+const (
+	None      Event = 0
+	Completed Event = 1
+	Started   Event = 2
+	Stopped   Event = 3
+)
+
+func (event Event) String() string {
+	switch event {
+	case Completed:
+		return "completed"
+	case Started:
+		return "started"
+	case Stopped:
+		return "stopped"
+	default:
+		return ""
+	}
+}
+
+type Stats struct {
+	Downloaded uint64
+	Uploaded   uint64
+	Left       uint64
+}
+
 type TrackerResponse struct {
-	Interval int
-	Peers    []PeerInfo
+	Interval       int
+	MinInterval    *int
+	TrackerID      *string
+	WarningMessage *string
+	Peers          []PeerInfo
+	Seeders        *int
+	Leechers       *int
+}
+
+type Status struct {
+	URL     string
+	Working bool
+	Error   string
+	Warning string
 }
 
 type PeerInfo struct {
 	IP   net.IP
 	Port uint16
+	// Peer ID is known only when the tracker returns peers in non-compact form.
+	PeerID *[20]byte
 }
 
 type trackerResponseBencode struct {
-	Interval int    `bencode:"interval"`
-	Peers    string `bencode:"peers"`
+	FailureReason  *string `bencode:"failure reason"`
+	WarningMessage *string `bencode:"warning message"`
+	Interval       int     `bencode:"interval"`
+	MinInterval    *int    `bencode:"min interval"`
+	TrackerID      *string `bencode:"tracker id"`
+	Complete       *int    `bencode:"complete"`
+	Incomplete     *int    `bencode:"incomplete"`
+	// Either a compact string or a list of dictionaries.
+	Peers  any     `bencode:"peers"`
+	Peers6 *string `bencode:"peers6"`
+}
+
+type FailureError struct {
+	Reason string
+}
+
+func (err *FailureError) Error() string {
+	return fmt.Sprintf("tracker returned failure: %s", err.Reason)
 }
 
 type announceRequest struct {
@@ -45,103 +112,167 @@ type announceRequest struct {
 	downloaded uint64
 	left       uint64
 	uploaded   uint64
+	event      Event
 	port       uint16
+	trackerID  *string
+	key        uint32
+	numWant    int32
 }
 
 type Tracker struct {
 	url      *url.URL
 	infoHash [sha1.Size]byte
-	length   uint64
 	peerID   [20]byte
-	interval time.Duration
+	getStats func() Stats
+	// Lets the tracker identify us if our IP address changes.
+	key uint32
+
+	// Whether the started event is sent and the tracker wasn't stopped since.
+	announced atomic.Bool
+
+	scrapeResult *ScrapeResult
+	trackerID    *string
+	status       Status
+	mutex        sync.Mutex
 }
 
-func NewTracker(url *url.URL, infoHash [sha1.Size]byte, length uint64, peerID [20]byte) *Tracker {
+const maxHTTPRedirects = 10
+
+var httpClient = &http.Client{
+	Timeout:       httpRequestTimeout,
+	Transport:     http.DefaultTransport.(*http.Transport).Clone(),
+	CheckRedirect: checkRedirect,
+}
+
+// Requests contain info hashes, so they shouldn't be redirected from HTTPS to plain HTTP.
+func checkRedirect(request *http.Request, via []*http.Request) error {
+	if len(via) >= maxHTTPRedirects {
+		return fmt.Errorf("stopped after %d redirects", maxHTTPRedirects)
+	}
+
+	if via[0].URL.Scheme == "https" && request.URL.Scheme != "https" {
+		return fmt.Errorf("refusing to redirect from HTTPS to %s", request.URL.Scheme)
+	}
+
+	return nil
+}
+
+func NewTracker(url *url.URL, infoHash [sha1.Size]byte, getStats func() Stats, peerID [20]byte) *Tracker {
 	return &Tracker{
 		url:      url,
 		infoHash: infoHash,
-		length:   length,
 		peerID:   peerID,
-		interval: time.Second * 0,
+		getStats: getStats,
+		key:      rand.Uint32(),
+		status:   Status{URL: url.String()},
 	}
 }
 
-func (tracker *Tracker) ListenForPeers(ctx context.Context, listeningPort uint16, peers chan<- PeerInfo) {
-	for {
-		select {
-		case <-time.After(tracker.interval):
-		case <-ctx.Done():
-			return
+func (tracker *Tracker) announce(ctx context.Context, listenPort uint16, event Event) (*TrackerResponse, error) {
+	response, err := tracker.sendRequest(ctx, listenPort, event)
+
+	tracker.mutex.Lock()
+	if err != nil {
+		tracker.status.Working = false
+		tracker.status.Error = err.Error()
+	} else {
+		tracker.status.Working = true
+		tracker.status.Error = ""
+		tracker.status.Warning = ""
+		if response.WarningMessage != nil {
+			tracker.status.Warning = *response.WarningMessage
 		}
 
-		// TODO: Make cancellable.
-		response, err := tracker.sendRequest(listeningPort)
-		if err != nil {
-			log.Printf("error sending request to the tracker: %v", err)
+		// Tracker ID should be kept if the tracker doesn't send it again.
+		if response.TrackerID != nil {
+			tracker.trackerID = response.TrackerID
+		}
+	}
+	tracker.mutex.Unlock()
 
-			if tracker.interval == 0 {
-				tracker.interval = time.Second * 60
-			}
+	if err != nil {
+		return nil, err
+	}
 
-			continue
-		}
+	tracker.announced.Store(event != Stopped)
+	tracker.updateScrapeResult(response)
 
-		log.Printf("Discovered %d peers", len(response.Peers))
+	return response, nil
+}
 
-		tracker.interval = time.Second * time.Duration(response.Interval)
-		tracker.interval = max(tracker.interval, minRequestInterval)
-		for _, peer := range response.Peers {
-			select {
-			case peers <- peer:
-			case <-ctx.Done():
-				return
-			}
-		}
-	}
+func (tracker *Tracker) GetStatus() Status {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	return tracker.status
 }
 
-func (tracker *Tracker) sendRequest(listenPort uint16) (*TrackerResponse, error) {
-	peerID := [20]byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 0, 1, 2, 3, 4, 5, 6, 7, 8, 9}
+func (tracker *Tracker) sendRequest(ctx context.Context, listenPort uint16, event Event) (*TrackerResponse, error) {
+	stats := tracker.getStats()
+
+	tracker.mutex.Lock()
+	trackerID := tracker.trackerID
+	tracker.mutex.Unlock()
 
 	announceRequest := announceRequest{
 		infoHash:   tracker.infoHash,
-		peerID:     peerID,
-		downloaded: 0,
-		uploaded:   0,
-		left:       uint64(tracker.length),
+		peerID:     tracker.peerID,
+		downloaded: stats.Downloaded,
+		uploaded:   stats.Uploaded,
+		left:       stats.Left,
+		event:      event,
 		port:       listenPort,
+		trackerID:  trackerID,
+		key:        tracker.key,
+		numWant:    numWant,
+	}
+	// We're leaving the swarm, so there's no need in peers.
+	if event == Stopped {
+		announceRequest.numWant = 0
 	}
 
 	switch tracker.url.Scheme {
-	case "http":
-		return sendHTTPRequest(tracker.url, &announceRequest)
-	case "https":
+	case "http", "https":
 		url := *tracker.url
-		url.Scheme = "http"
 
-		return sendHTTPRequest(&url, &announceRequest)
+		return sendHTTPRequest(ctx, &url, &announceRequest)
 	case "udp":
-		return sendUDPRequest(tracker.url, &announceRequest)
+		return sendUDPRequest(ctx, tracker.url, &announceRequest)
 	default:
 		return nil, fmt.Errorf("unsupported tracker scheme: %s", tracker.url.Scheme)
 	}
 }
 
 func sendHTTPRequest(
+	ctx context.Context,
 	address *url.URL,
 	announceRequest *announceRequest,
 ) (*TrackerResponse, error) {
-	address.RawQuery = url.Values{
-		"info_hash":  []string{string(announceRequest.infoHash[:])},
-		"peer_id":    []string{string(announceRequest.peerID[:])},
-		"port":       []string{strconv.Itoa(int(announceRequest.port))},
-		"uploaded":   []string{strconv.FormatUint(announceRequest.uploaded, 10)},
-		"downloaded": []string{strconv.FormatUint(announceRequest.downloaded, 10)},
-		"compact":    []string{"1"},
-		"left":       []string{strconv.FormatUint(announceRequest.left, 10)},
-	}.Encode()
-
-	response, err := http.Get(address.String())
+	// Announce URL might contain parameters such as passkey.
+	query := address.Query()
+	query.Set("info_hash", string(announceRequest.infoHash[:]))
+	query.Set("peer_id", string(announceRequest.peerID[:]))
+	query.Set("port", strconv.Itoa(int(announceRequest.port)))
+	query.Set("uploaded", strconv.FormatUint(announceRequest.uploaded, 10))
+	query.Set("downloaded", strconv.FormatUint(announceRequest.downloaded, 10))
+	query.Set("compact", "1")
+	query.Set("left", strconv.FormatUint(announceRequest.left, 10))
+	query.Set("key", strconv.FormatUint(uint64(announceRequest.key), 16))
+	query.Set("numwant", strconv.Itoa(int(announceRequest.numWant)))
+	if announceRequest.event != None {
+		query.Set("event", announceRequest.event.String())
+	}
+	if announceRequest.trackerID != nil {
+		query.Set("trackerid", *announceRequest.trackerID)
+	}
+	address.RawQuery = query.Encode()
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, address.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create tracker request: %w", err)
+	}
+
+	response, err := httpClient.Do(request)
 	if err != nil {
 		return nil, fmt.Errorf("failed to send get request to a tracker: %w", err)
 	}
@@ -154,24 +285,122 @@ func sendHTTPRequest(
 		return nil, fmt.Errorf("failed to decode tracker response: %w", err)
 	}
 
-	peers, err := decodePeerInfo(&decodedResponse.Peers)
+	if decodedResponse.FailureReason != nil {
+		return nil, &FailureError{Reason: *decodedResponse.FailureReason}
+	}
+
+	peers, err := decodePeers(ctx, decodedResponse.Peers)
 	if err != nil {
 		return nil, fmt.Errorf("failed to decode peer info: %w", err)
 	}
 
+	if decodedResponse.Peers6 != nil {
+		peers6, err := DecodeCompactPeerInfo6([]byte(*decodedResponse.Peers6))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode IPv6 peer info: %w", err)
+		}
+
+		peers = append(peers, peers6...)
+	}
+
 	return &TrackerResponse{
-		Interval: decodedResponse.Interval,
-		Peers:    peers,
+		Interval:       decodedResponse.Interval,
+		MinInterval:    decodedResponse.MinInterval,
+		TrackerID:      decodedResponse.TrackerID,
+		WarningMessage: decodedResponse.WarningMessage,
+		Peers:          peers,
+		Seeders:        decodedResponse.Complete,
+		Leechers:       decodedResponse.Incomplete,
 	}, nil
 }
 
-func decodePeerInfo(peers *string) ([]PeerInfo, error) {
-	if len(*peers)%6 != 0 {
+func decodePeers(ctx context.Context, peers any) ([]PeerInfo, error) {
+	switch peers := peers.(type) {
+	case nil:
+		return make([]PeerInfo, 0), nil
+	case string:
+		return DecodeCompactPeerInfo([]byte(peers))
+	case []any:
+		peerInfos := make([]PeerInfo, 0, len(peers))
+		resolved := 0
+		for _, peer := range peers {
+			peerDictionary, ok := peer.(map[string]any)
+			if !ok {
+				return nil, fmt.Errorf("invalid peer list format: expected dictionary, got %T", peer)
+			}
+
+			// DNS names are resolved one by one, so only a few of them are accepted.
+			if host, ok := peerDictionary["ip"].(string); ok && net.ParseIP(host) == nil {
+				if resolved >= maxResolvedHostnames {
+					log.Printf("skipping peer returned by the tracker: too many DNS names to resolve")
+					continue
+				}
+
+				resolved++
+			}
+
+			peerInfo, err := decodePeerDictionary(ctx, peerDictionary)
+			if err != nil {
+				log.Printf("skipping peer returned by the tracker: %v", err)
+				continue
+			}
+
+			peerInfos = append(peerInfos, *peerInfo)
+		}
+
+		return peerInfos, nil
+	default:
+		return nil, fmt.Errorf("invalid peer list format: expected string or list, got %T", peers)
+	}
+}
+
+func decodePeerDictionary(ctx context.Context, peer map[string]any) (*PeerInfo, error) {
+	host, ok := peer["ip"].(string)
+	if !ok {
+		return nil, fmt.Errorf("peer IP is missing or invalid")
+	}
+
+	port, ok := peer["port"].(int64)
+	if !ok || port < 0 || port > math.MaxUint16 {
+		return nil, fmt.Errorf("peer port is missing or invalid")
+	}
+
+	// IP can be either IPv4, IPv6 or a DNS name.
+	ip := net.ParseIP(host)
+	if ip == nil {
+		resolveCtx, cancel := context.WithTimeout(ctx, hostnameResolveTimeout)
+		addresses, err := net.DefaultResolver.LookupIPAddr(resolveCtx, host)
+		cancel()
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve peer address %s: %w", host, err)
+		}
+
+		if len(addresses) == 0 {
+			return nil, fmt.Errorf("no addresses found for peer %s", host)
+		}
+
+		ip = addresses[0].IP
+	}
+	if ipv4 := ip.To4(); ipv4 != nil {
+		ip = ipv4
+	}
+
+	peerInfo := PeerInfo{IP: ip, Port: uint16(port)}
+
+	if peerID, ok := peer["peer id"].(string); ok && len(peerID) == 20 {
+		peerInfo.PeerID = (*[20]byte)([]byte(peerID))
+	}
+
+	return &peerInfo, nil
+}
+
+func DecodeCompactPeerInfo(peers []byte) ([]PeerInfo, error) {
+	if len(peers)%compactPeerInfoLength != 0 {
 		return nil, fmt.Errorf("invalid peer list format")
 	}
 
 	peerInfos := make([]PeerInfo, 0)
-	for info := range slices.Chunk([]byte(*peers), 6) {
+	for info := range slices.Chunk(peers, compactPeerInfoLength) {
 		peerInfos = append(peerInfos, PeerInfo{
 			IP:   net.IP(info[:4]),
 			Port: binary.BigEndian.Uint16(info[4:]),
@@ -181,34 +410,54 @@ func decodePeerInfo(peers *string) ([]PeerInfo, error) {
 	return peerInfos, nil
 }
 
-func sendUDPRequest(
-	address *url.URL,
-	announceRequest *announceRequest,
-) (*TrackerResponse, error) {
-	udpAddr, err := net.ResolveUDPAddr("udp", address.Host)
-	if err != nil {
-		return nil, fmt.Errorf("failed to resolve UDP tracker address %s: %w", address.String(), err)
+func DecodeCompactPeerInfo6(peers []byte) ([]PeerInfo, error) {
+	if len(peers)%compactPeerInfo6Length != 0 {
+		return nil, fmt.Errorf("invalid IPv6 peer list format")
 	}
 
-	conn, err := net.DialUDP("udp", nil, udpAddr)
-	if err != nil {
-		return nil, fmt.Errorf("failed to connect to the UDP tracker %s: %w", address.String(), err)
+	peerInfos := make([]PeerInfo, 0)
+	for info := range slices.Chunk(peers, compactPeerInfo6Length) {
+		peerInfos = append(peerInfos, PeerInfo{
+			IP:   net.IP(info[:16]),
+			Port: binary.BigEndian.Uint16(info[16:]),
+		})
 	}
 
-	err = conn.SetReadDeadline(time.Now().Add(udpReadTimeout))
-	if err != nil {
-		return nil, fmt.Errorf("failed to set UDP read timeout: %w", err)
+	return peerInfos, nil
+}
+
+func (peerInfo *PeerInfo) IsIPv4() bool {
+	return peerInfo.IP.To4() != nil
+}
+
+// Encodes peer info in 6-byte form for IPv4 peers and in 18-byte form for IPv6 ones.
+func (peerInfo *PeerInfo) EncodeCompact() []byte {
+	ip := peerInfo.IP.To4()
+	if ip == nil {
+		ip = peerInfo.IP.To16()
 	}
 
-	transcactionID := rand.Uint32()
-	connectionID, err := sendUDPConnectionRequest(conn, transcactionID)
+	encoded := make([]byte, 0, len(ip)+2)
+	encoded = append(encoded, ip...)
+	encoded = binary.BigEndian.AppendUint16(encoded, peerInfo.Port)
+
+	return encoded
+}
+
+func sendUDPRequest(
+	ctx context.Context,
+	address *url.URL,
+	announceRequest *announceRequest,
+) (*TrackerResponse, error) {
+	conn, err := dialUDPTracker(address)
 	if err != nil {
-		return nil, fmt.Errorf(
-			"failed to send connection request to the UDP tracker %s: %w",
-			address.String(),
-			err,
-		)
+		return nil, err
 	}
+	defer conn.Close()
+
+	// Unblocks pending reads when ctx is cancelled.
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
 
 	leadingSlash := ""
 	if len(address.Path) != 0 && address.Path[0] != '/' {
@@ -216,13 +465,7 @@ func sendUDPRequest(
 	}
 	urlData := leadingSlash + address.Path + address.Query().Encode()
 
-	trackerResponse, err := sendUDPAnnounceRequest(
-		conn,
-		transcactionID,
-		connectionID,
-		announceRequest,
-		urlData,
-	)
+	trackerResponse, err := sendUDPAnnounceRequest(conn, announceRequest, urlData)
 	if err != nil {
 		return nil, fmt.Errorf(
 			"failed to send announce request to the UDP tracker %s: %w",
@@ -234,56 +477,11 @@ func sendUDPRequest(
 	return trackerResponse, nil
 }
 
-type connectionID = uint64
-
-func sendUDPConnectionRequest(connection *net.UDPConn, transactionID uint32) (connectionID, error) {
-	connectionRequest := make([]byte, 16)
-	binary.BigEndian.PutUint64(connectionRequest[:8], 0x41727101980)
-	binary.BigEndian.PutUint32(connectionRequest[8:12], 0) // action: connect
-	binary.BigEndian.PutUint32(connectionRequest[12:], transactionID)
-
-	_, err := connection.Write(connectionRequest)
-	if err != nil {
-		return 0, fmt.Errorf("failed to send request: %w", err)
-	}
-
-	response := make([]byte, 16)
-
-	responseBytes, err := connection.Read(response)
-	if err != nil {
-		return 0, fmt.Errorf("failed to receive response: %w", err)
-	}
-
-	if responseBytes < len(response) {
-		return 0, fmt.Errorf("invalid response length: length is %d", responseBytes)
-	}
-
-	responseAction := binary.BigEndian.Uint32(response[:4])
-	if responseAction != 0 {
-		return 0, fmt.Errorf("invalid action received: %d, expected 0", responseAction)
-	}
-
-	responseTransactionID := binary.BigEndian.Uint32(response[4:8])
-	if responseTransactionID != transactionID {
-		return 0, fmt.Errorf(
-			"invalid transaction ID received: %x, expected %x",
-			responseTransactionID,
-			transactionID,
-		)
-	}
-
-	return binary.BigEndian.Uint64(response[8:16]), nil
-}
-
 func sendUDPAnnounceRequest(
-	connection *net.UDPConn,
-	transactionID uint32,
-	connectionID uint64,
+	conn *udpTrackerConn,
 	announceRequest *announceRequest,
 	urlData string,
 ) (*TrackerResponse, error) {
-	var key uint32 = 0xAABBCCDD
-
 	// Offset  Size    			Name    		Value
 	// 0       64-bit integer  	connection_id
 	// 8       32-bit integer  	action          1 // announce
@@ -293,35 +491,34 @@ func sendUDPAnnounceRequest(
 	// 56      64-bit integer  	downloaded
 	// 64      64-bit integer  	left
 	// 72      64-bit integer  	uploaded
-	// 80      32-bit integer  	event           0 // 0: none; 1: completed; 2: started; 3: stopped
+	// 80      32-bit integer  	event           // 0: none; 1: completed; 2: started; 3: stopped
 	// 84      32-bit integer  	IP address      0 // default
 	// 88      32-bit integer  	key
 	// 92      32-bit integer  	num_want        -1 // default
 	// 96      16-bit integer  	port
 	// 98	   Variable			extensions
+	//
+	// Header up to transaction_id is added when sending.
+
+	request := make([]byte, 82)
 
-	request := make([]byte, 98)
-
-	binary.BigEndian.PutUint64(request[:8], connectionID)
-	binary.BigEndian.PutUint32(request[8:12], 1) // action: announce
-	binary.BigEndian.PutUint32(request[12:16], transactionID)
-	copy(request[16:36], announceRequest.infoHash[:])
-	copy(request[36:56], announceRequest.peerID[:])
-	binary.BigEndian.PutUint64(request[56:64], announceRequest.downloaded)
-	binary.BigEndian.PutUint64(request[64:72], announceRequest.left)
-	binary.BigEndian.PutUint64(request[72:80], announceRequest.uploaded)
-	binary.BigEndian.PutUint32(request[80:84], 0) // event: none
+	copy(request[:20], announceRequest.infoHash[:])
+	copy(request[20:40], announceRequest.peerID[:])
+	binary.BigEndian.PutUint64(request[40:48], announceRequest.downloaded)
+	binary.BigEndian.PutUint64(request[48:56], announceRequest.left)
+	binary.BigEndian.PutUint64(request[56:64], announceRequest.uploaded)
+	binary.BigEndian.PutUint32(request[64:68], uint32(announceRequest.event))
 	// TODO: IP address
-	binary.BigEndian.PutUint32(request[88:92], key)
-	copy(request[92:96], []byte{0xFF, 0xFF, 0xFF, 0xFF}) // num_want: default: -1
-	binary.BigEndian.PutUint16(request[96:98], announceRequest.port)
+	binary.BigEndian.PutUint32(request[72:76], announceRequest.key)
+	binary.BigEndian.PutUint32(request[76:80], uint32(announceRequest.numWant))
+	binary.BigEndian.PutUint16(request[80:82], announceRequest.port)
 
 	encodedURLData := encodeURLData(urlData)
 	request = append(request, encodedURLData...)
 
-	_, err := connection.Write(request)
+	response, err := conn.send(udpActionAnnounce, request)
 	if err != nil {
-		return nil, fmt.Errorf("failed to send request: %w", err)
+		return nil, err
 	}
 
 	// Offset      Size            Name            Value
@@ -333,46 +530,37 @@ func sendUDPAnnounceRequest(
 	// 20 + 6 * n  32-bit integer  IP address
 	// 24 + 6 * n  16-bit integer  TCP port
 	// 20 + 6 * N
+	//
+	// For IPv6 trackers IP addresses are 128-bit, so each peer takes 18 bytes.
+	// Action and transaction ID are already stripped from the response.
 
-	response := make([]byte, maxAnnounceResponseLength)
-	responseLength, err := connection.Read(response)
-	if err != nil {
-		return nil, fmt.Errorf("failed to receive response: %w", err)
+	peerInfoLength := compactPeerInfoLength
+	if conn.isIPv6() {
+		peerInfoLength = compactPeerInfo6Length
 	}
 
-	if responseLength < 20 || (responseLength-20)%6 != 0 {
-		return nil, fmt.Errorf("received response of unexpected length: %d", responseLength)
+	if len(response) < 12 || (len(response)-12)%peerInfoLength != 0 {
+		return nil, fmt.Errorf("received response of unexpected length: %d", len(response)+8)
 	}
 
-	responseAction := binary.BigEndian.Uint32(response[:4])
-	if responseAction != 1 {
-		return nil, fmt.Errorf("unexpected action in response: %d, expected 1", responseAction)
-	}
-
-	responseTransactionID := binary.BigEndian.Uint32(response[4:8])
-	if responseTransactionID != transactionID {
-		return nil, fmt.Errorf(
-			"invalid transaction id is received in response: %x, expected %x",
-			responseTransactionID,
-			transactionID,
-		)
-	}
-
-	responseInterval := binary.BigEndian.Uint32(response[8:12])
+	responseInterval := binary.BigEndian.Uint32(response[:4])
 
 	decodedResponse := &TrackerResponse{
 		Interval: int(responseInterval),
-		Peers:    make([]PeerInfo, 0),
 	}
 
-	responseLeechers := binary.BigEndian.Uint32(response[12:16])
-	_ = responseLeechers
-	responseSeeders := binary.BigEndian.Uint32(response[16:20])
-	_ = responseSeeders
+	responseLeechers := int(binary.BigEndian.Uint32(response[4:8]))
+	decodedResponse.Leechers = &responseLeechers
+	responseSeeders := int(binary.BigEndian.Uint32(response[8:12]))
+	decodedResponse.Seeders = &responseSeeders
 
-	for peer := range slices.Chunk(response[20:responseLength], 6) {
-		peerInfo := PeerInfo{IP: net.IP(peer[:4]), Port: binary.BigEndian.Uint16(peer[4:])}
-		decodedResponse.Peers = append(decodedResponse.Peers, peerInfo)
+	if conn.isIPv6() {
+		decodedResponse.Peers, err = DecodeCompactPeerInfo6(response[12:])
+	} else {
+		decodedResponse.Peers, err = DecodeCompactPeerInfo(response[12:])
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode peer info: %w", err)
 	}
 
 	return decodedResponse, nil
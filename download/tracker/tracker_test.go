@@ -0,0 +1,324 @@
+package tracker
+
+import (
+	"context"
+	"crypto/sha1"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestAnnounceEvents(t *testing.T) {
+	requests := make(chan url.Values, 8)
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		requests <- request.URL.Query()
+		writer.Write([]byte("d8:intervali60e5:peers0:e"))
+	}))
+	defer server.Close()
+
+	trackerURL, err := url.Parse(server.URL + "/announce")
+	if err != nil {
+		t.Fatalf("failed to parse tracker URL: %v", err)
+	}
+
+	stats := Stats{Downloaded: 100, Uploaded: 50, Left: 1000}
+	tier := NewTier([]*url.URL{trackerURL}, sha1.Sum([]byte("torrent")), func() Stats { return stats }, [20]byte{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		tier.ListenForPeers(ctx, 6881, make(chan PeerInfo))
+		close(stopped)
+	}()
+
+	assertAnnounce(requests, "started", "100", "50", "1000", t)
+
+	stats = Stats{Downloaded: 1000, Uploaded: 70, Left: 0}
+	tier.SendEvent(Completed)
+	assertAnnounce(requests, "completed", "1000", "70", "0", t)
+
+	cancel()
+	assertAnnounce(requests, "stopped", "1000", "70", "0", t)
+
+	<-stopped
+}
+
+func assertAnnounce(
+	requests <-chan url.Values,
+	event string,
+	downloaded string,
+	uploaded string,
+	left string,
+	t *testing.T,
+) {
+	select {
+	case query := <-requests:
+		if query.Get("event") != event {
+			t.Errorf("unexpected event: expected %s, got %s", event, query.Get("event"))
+		}
+
+		if query.Get("downloaded") != downloaded ||
+			query.Get("uploaded") != uploaded ||
+			query.Get("left") != left {
+			t.Errorf(
+				"unexpected stats: expected %s/%s/%s, got %s/%s/%s",
+				downloaded, uploaded, left,
+				query.Get("downloaded"), query.Get("uploaded"), query.Get("left"),
+			)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatalf("tracker didn't announce %s event", event)
+	}
+}
+
+func TestAnnounceResponse(t *testing.T) {
+	requests := make(chan url.Values, 8)
+	responses := make(chan string, 8)
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		requests <- request.URL.Query()
+		writer.Write([]byte(<-responses))
+	}))
+	defer server.Close()
+
+	trackerURL, err := url.Parse(server.URL + "/announce?passkey=secret")
+	if err != nil {
+		t.Fatalf("failed to parse tracker URL: %v", err)
+	}
+
+	tracker := NewTracker(trackerURL, sha1.Sum([]byte("torrent")), func() Stats { return Stats{} }, [20]byte{})
+
+	responses <- "d8:completei7e10:incompletei3e8:intervali1800e12:min intervali900e5:peers0:" +
+		"10:tracker id3:abc15:warning message7:warninge"
+	response, err := tracker.announce(context.Background(), 6881, Started)
+	if err != nil {
+		t.Fatalf("failed to announce: %v", err)
+	}
+
+	query := <-requests
+	if query.Get("passkey") != "secret" {
+		t.Errorf("announce URL parameters are not preserved")
+	}
+	if query.Has("trackerid") {
+		t.Errorf("tracker ID is sent before it's received")
+	}
+
+	if response.Interval != 1800 || response.MinInterval == nil || *response.MinInterval != 900 {
+		t.Errorf("unexpected intervals in response: %+v", response)
+	}
+
+	scrapeResult, ok := tracker.GetScrapeResult()
+	if !ok || scrapeResult.Seeders != 7 || scrapeResult.Leechers != 3 {
+		t.Errorf("unexpected swarm info: %+v", scrapeResult)
+	}
+
+	status := tracker.GetStatus()
+	if !status.Working || status.Warning != "warning" {
+		t.Errorf("unexpected tracker status: %+v", status)
+	}
+
+	responses <- "d14:failure reason6:bannede"
+	_, err = tracker.announce(context.Background(), 6881, None)
+
+	var failure *FailureError
+	if !errors.As(err, &failure) || failure.Reason != "banned" {
+		t.Errorf("expected failure reason to be returned, got %v", err)
+	}
+
+	query = <-requests
+	if query.Get("trackerid") != "abc" {
+		t.Errorf("tracker ID is not echoed: got %s", query.Get("trackerid"))
+	}
+
+	status = tracker.GetStatus()
+	if status.Working || err == nil || status.Error != err.Error() {
+		t.Errorf("unexpected tracker status: %+v", status)
+	}
+}
+
+func TestDecodePeers(t *testing.T) {
+	compact, err := decodePeers(context.Background(), "\x01\x02\x03\x04\x1a\xe1")
+	if err != nil {
+		t.Fatalf("failed to decode compact peers: %v", err)
+	}
+
+	if len(compact) != 1 ||
+		!compact[0].IP.Equal(net.IPv4(1, 2, 3, 4)) ||
+		compact[0].Port != 6881 ||
+		compact[0].PeerID != nil {
+		t.Errorf("unexpected compact peers: %+v", compact)
+	}
+
+	dictionary, err := decodePeers(context.Background(), []any{
+		map[string]any{"ip": "1.2.3.4", "port": int64(6881), "peer id": "-BC0001-0123456789ab"},
+		map[string]any{"ip": "::1", "port": int64(6882)},
+	})
+	if err != nil {
+		t.Fatalf("failed to decode dictionary peers: %v", err)
+	}
+
+	if len(dictionary) != 2 {
+		t.Fatalf("unexpected peer count: expected 2, got %d", len(dictionary))
+	}
+
+	if !dictionary[0].IP.Equal(net.IPv4(1, 2, 3, 4)) ||
+		dictionary[0].Port != 6881 ||
+		dictionary[0].PeerID == nil ||
+		string(dictionary[0].PeerID[:]) != "-BC0001-0123456789ab" {
+		t.Errorf("unexpected peer: %+v", dictionary[0])
+	}
+
+	if !dictionary[1].IP.Equal(net.IPv6loopback) || dictionary[1].Port != 6882 || dictionary[1].PeerID != nil {
+		t.Errorf("unexpected peer: %+v", dictionary[1])
+	}
+
+	_, err = decodePeers(context.Background(), int64(10))
+	if err == nil {
+		t.Errorf("expected error on invalid peer list")
+	}
+}
+
+func TestDecodePeersResolveCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	peers := []any{map[string]any{"ip": "1.2.3.4", "port": int64(6881)}}
+	for range maxResolvedHostnames * 2 {
+		peers = append(peers, map[string]any{"ip": "peer.invalid", "port": int64(6881)})
+	}
+
+	decoded, err := decodePeers(ctx, peers)
+	if err != nil {
+		t.Fatalf("failed to decode dictionary peers: %v", err)
+	}
+
+	if len(decoded) != 1 || !decoded[0].IP.Equal(net.IPv4(1, 2, 3, 4)) {
+		t.Errorf("unexpected peers: %+v", decoded)
+	}
+}
+
+func TestNonCompactAnnounceResponse(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Write([]byte("d8:intervali60e5:peersld2:ip7:1.2.3.47:peer id20:-BC0001-0123456789ab4:porti6881eeee"))
+	}))
+	defer server.Close()
+
+	trackerURL, err := url.Parse(server.URL + "/announce")
+	if err != nil {
+		t.Fatalf("failed to parse tracker URL: %v", err)
+	}
+
+	tracker := NewTracker(trackerURL, sha1.Sum([]byte("torrent")), func() Stats { return Stats{} }, [20]byte{})
+
+	response, err := tracker.announce(context.Background(), 6881, Started)
+	if err != nil {
+		t.Fatalf("failed to announce: %v", err)
+	}
+
+	if len(response.Peers) != 1 || response.Peers[0].Port != 6881 || response.Peers[0].PeerID == nil {
+		t.Errorf("unexpected peers in response: %+v", response.Peers)
+	}
+}
+
+func TestIPv6AnnounceResponse(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Write([]byte("d8:intervali60e5:peers6:\x01\x02\x03\x04\x1a\xe16:peers618:" +
+			"\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01\x1a\xe2e"))
+	}))
+	defer server.Close()
+
+	trackerURL, err := url.Parse(server.URL + "/announce")
+	if err != nil {
+		t.Fatalf("failed to parse tracker URL: %v", err)
+	}
+
+	tracker := NewTracker(trackerURL, sha1.Sum([]byte("torrent")), func() Stats { return Stats{} }, [20]byte{})
+
+	response, err := tracker.announce(context.Background(), 6881, Started)
+	if err != nil {
+		t.Fatalf("failed to announce: %v", err)
+	}
+
+	if len(response.Peers) != 2 {
+		t.Fatalf("unexpected peer count: expected 2, got %d", len(response.Peers))
+	}
+
+	if !response.Peers[1].IP.Equal(net.ParseIP("2001:db8::1")) || response.Peers[1].Port != 6882 {
+		t.Errorf("unexpected IPv6 peer: %+v", response.Peers[1])
+	}
+
+	encoded := response.Peers[1].EncodeCompact()
+	decoded, err := DecodeCompactPeerInfo6(encoded)
+	if err != nil || len(decoded) != 1 || !decoded[0].IP.Equal(response.Peers[1].IP) {
+		t.Errorf("IPv6 peer doesn't survive compact encoding: %v, %+v", err, decoded)
+	}
+}
+
+func TestHTTPSAnnounce(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if request.URL.Path == "/insecure" {
+			http.Redirect(writer, request, "http://example.com/announce", http.StatusFound)
+			return
+		}
+
+		writer.Write([]byte("d8:intervali60e5:peers6:\x01\x02\x03\x04\x1a\xe1e"))
+	}))
+	defer server.Close()
+
+	defaultTransport := httpClient.Transport
+	httpClient.Transport = server.Client().Transport
+	defer func() { httpClient.Transport = defaultTransport }()
+
+	trackerURL, err := url.Parse(server.URL + "/announce")
+	if err != nil {
+		t.Fatalf("failed to parse tracker URL: %v", err)
+	}
+
+	tracker := NewTracker(trackerURL, sha1.Sum([]byte("torrent")), func() Stats { return Stats{} }, [20]byte{})
+
+	response, err := tracker.announce(context.Background(), 6881, Started)
+	if err != nil {
+		t.Fatalf("failed to announce: %v", err)
+	}
+
+	if len(response.Peers) != 1 {
+		t.Errorf("unexpected peers in response: %+v", response.Peers)
+	}
+
+	insecureURL, err := url.Parse(server.URL + "/insecure")
+	if err != nil {
+		t.Fatalf("failed to parse tracker URL: %v", err)
+	}
+
+	tracker = NewTracker(insecureURL, sha1.Sum([]byte("torrent")), func() Stats { return Stats{} }, [20]byte{})
+
+	_, err = tracker.announce(context.Background(), 6881, Started)
+	if err == nil {
+		t.Errorf("redirect from HTTPS to HTTP is followed")
+	}
+}
+
+func TestAnnounceCancellation(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		<-request.Context().Done()
+	}))
+	defer server.Close()
+
+	trackerURL, err := url.Parse(server.URL + "/announce")
+	if err != nil {
+		t.Fatalf("failed to parse tracker URL: %v", err)
+	}
+
+	tracker := NewTracker(trackerURL, sha1.Sum([]byte("torrent")), func() Stats { return Stats{} }, [20]byte{})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+
+	_, err = tracker.announce(ctx, 6881, Started)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected announce to be cancelled, got %v", err)
+	}
+}
@@ -0,0 +1,213 @@
+package tracker
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+const udpProtocolID = 0x41727101980
+const udpConnectionIDLifetime = time.Minute
+
+// Largest payload of a UDP datagram.
+const udpMaxPacketLength = 65507
+
+// BEP15 allows up to 8 retransmissions, but the tier should fall back to the next tracker sooner.
+const udpMaxRetransmissions = 3
+
+// Timeout before the n-th retransmission is udpBaseTimeout * 2^n.
+var udpBaseTimeout = time.Second * 15
+
+const (
+	udpActionConnect  uint32 = 0
+	udpActionAnnounce uint32 = 1
+	udpActionScrape   uint32 = 2
+	udpActionError    uint32 = 3
+)
+
+type cachedConnectionID struct {
+	id        uint64
+	expiresAt time.Time
+}
+
+// Connection IDs are shared between announces and scrapes to the same tracker.
+type connectionIDCache struct {
+	entries map[string]cachedConnectionID
+	mutex   sync.Mutex
+}
+
+var udpConnectionIDs = connectionIDCache{entries: make(map[string]cachedConnectionID)}
+
+func (cache *connectionIDCache) get(address string) (uint64, bool) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	entry, ok := cache.entries[address]
+	if !ok || time.Now().After(entry.expiresAt) {
+		delete(cache.entries, address)
+		return 0, false
+	}
+
+	return entry.id, true
+}
+
+func (cache *connectionIDCache) put(address string, id uint64) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	cache.entries[address] = cachedConnectionID{id: id, expiresAt: time.Now().Add(udpConnectionIDLifetime)}
+}
+
+func (cache *connectionIDCache) remove(address string) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	delete(cache.entries, address)
+}
+
+type udpTrackerConn struct {
+	conn    *net.UDPConn
+	address *url.URL
+}
+
+func dialUDPTracker(address *url.URL) (*udpTrackerConn, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", address.Host)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve UDP tracker address %s: %w", address.String(), err)
+	}
+
+	conn, err := net.DialUDP("udp", nil, udpAddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to the UDP tracker %s: %w", address.String(), err)
+	}
+
+	return &udpTrackerConn{conn: conn, address: address}, nil
+}
+
+func (conn *udpTrackerConn) Close() error {
+	return conn.conn.Close()
+}
+
+// Trackers reached over IPv6 respond with IPv6 peers.
+func (conn *udpTrackerConn) isIPv6() bool {
+	return conn.conn.RemoteAddr().(*net.UDPAddr).IP.To4() == nil
+}
+
+// Sends the request, retransmitting it on timeout, and returns the response
+// payload that follows action and transaction ID.
+func (conn *udpTrackerConn) send(action uint32, payload []byte) ([]byte, error) {
+	transactionID := rand.Uint32()
+
+	for attempt := range udpMaxRetransmissions + 1 {
+		// Connection ID might expire between retransmissions, so the header is rebuilt every time.
+		header, err := conn.header(action, transactionID)
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = conn.conn.Write(append(header, payload...))
+		if err != nil {
+			return nil, fmt.Errorf("failed to send request: %w", err)
+		}
+
+		timeout := udpBaseTimeout * time.Duration(1<<attempt)
+		responseAction, response, err := conn.receive(transactionID, timeout)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to receive response: %w", err)
+		}
+
+		if responseAction == udpActionError {
+			// Tracker might have rejected the connection ID.
+			udpConnectionIDs.remove(conn.conn.RemoteAddr().String())
+
+			return nil, &FailureError{Reason: string(response)}
+		}
+
+		if responseAction != action {
+			return nil, fmt.Errorf("unexpected action in response: %d, expected %d", responseAction, action)
+		}
+
+		return response, nil
+	}
+
+	return nil, fmt.Errorf("no response after %d retransmissions", udpMaxRetransmissions)
+}
+
+// Offset  Size            Name            Value
+// 0       64-bit integer  connection_id   0x41727101980 for connect
+// 8       32-bit integer  action
+// 12      32-bit integer  transaction_id
+func (conn *udpTrackerConn) header(action uint32, transactionID uint32) ([]byte, error) {
+	var connectionID uint64 = udpProtocolID
+	if action != udpActionConnect {
+		var err error
+		connectionID, err = conn.connectionID()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	header := make([]byte, 16)
+	binary.BigEndian.PutUint64(header[:8], connectionID)
+	binary.BigEndian.PutUint32(header[8:12], action)
+	binary.BigEndian.PutUint32(header[12:16], transactionID)
+
+	return header, nil
+}
+
+func (conn *udpTrackerConn) connectionID() (uint64, error) {
+	address := conn.conn.RemoteAddr().String()
+
+	if connectionID, ok := udpConnectionIDs.get(address); ok {
+		return connectionID, nil
+	}
+
+	// Offset  Size            Name            Value
+	// 0       32-bit integer  action          0 // connect
+	// 4       32-bit integer  transaction_id
+	// 8       64-bit integer  connection_id
+	response, err := conn.send(udpActionConnect, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to send connection request to the UDP tracker %s: %w", conn.address, err)
+	}
+
+	if len(response) < 8 {
+		return 0, fmt.Errorf("invalid connection response length: length is %d", len(response)+8)
+	}
+
+	connectionID := binary.BigEndian.Uint64(response[:8])
+	udpConnectionIDs.put(address, connectionID)
+
+	return connectionID, nil
+}
+
+// Skips responses to other transactions, such as late responses to the previous requests.
+func (conn *udpTrackerConn) receive(transactionID uint32, timeout time.Duration) (uint32, []byte, error) {
+	err := conn.conn.SetReadDeadline(time.Now().Add(timeout))
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to set UDP read timeout: %w", err)
+	}
+
+	buffer := make([]byte, udpMaxPacketLength)
+	for {
+		length, err := conn.conn.Read(buffer)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		if length < 8 || binary.BigEndian.Uint32(buffer[4:8]) != transactionID {
+			continue
+		}
+
+		return binary.BigEndian.Uint32(buffer[:4]), buffer[8:length], nil
+	}
+}
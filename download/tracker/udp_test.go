@@ -0,0 +1,141 @@
+package tracker
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const testPeersCount = 300
+
+func TestUDPAnnounce(t *testing.T) {
+	udpBaseTimeout = time.Millisecond * 50
+	defer func() { udpBaseTimeout = time.Second * 15 }()
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("failed to create UDP tracker: %v", err)
+	}
+	defer conn.Close()
+
+	var connects, announces atomic.Int32
+	go serveUDPAnnounce(conn, &connects, &announces, t)
+
+	trackerURL, err := url.Parse("udp://" + conn.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("failed to parse tracker URL: %v", err)
+	}
+
+	tracker := NewTracker(trackerURL, sha1.Sum([]byte("torrent")), func() Stats { return Stats{} }, [20]byte{})
+
+	for range 2 {
+		response, err := tracker.announce(context.Background(), 6881, None)
+		if err != nil {
+			t.Fatalf("failed to announce: %v", err)
+		}
+
+		if len(response.Peers) != testPeersCount {
+			t.Errorf("unexpected peer count: expected %d, got %d", testPeersCount, len(response.Peers))
+		}
+	}
+
+	// First announce is dropped by the tracker and should be retransmitted.
+	if announces.Load() != 3 {
+		t.Errorf("unexpected announce request count: expected 3, got %d", announces.Load())
+	}
+
+	if connects.Load() != 1 {
+		t.Errorf("connection ID isn't reused: %d connect requests sent", connects.Load())
+	}
+}
+
+func TestUDPErrorResponse(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("failed to create UDP tracker: %v", err)
+	}
+	defer conn.Close()
+
+	go func() {
+		buffer := make([]byte, 2048)
+		for {
+			_, address, err := conn.ReadFromUDP(buffer)
+			if err != nil {
+				return
+			}
+
+			response := binary.BigEndian.AppendUint32(nil, udpActionError)
+			response = append(response, buffer[12:16]...)
+			response = append(response, "unknown torrent"...)
+
+			conn.WriteToUDP(response, address)
+		}
+	}()
+
+	trackerURL, err := url.Parse("udp://" + conn.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("failed to parse tracker URL: %v", err)
+	}
+
+	tracker := NewTracker(trackerURL, sha1.Sum([]byte("torrent")), func() Stats { return Stats{} }, [20]byte{})
+
+	_, err = tracker.announce(context.Background(), 6881, Started)
+
+	var failure *FailureError
+	if !errors.As(err, &failure) || failure.Reason != "unknown torrent" {
+		t.Errorf("expected error message to be returned, got %v", err)
+	}
+}
+
+// Drops the first announce request and responds with testPeersCount peers to the others.
+func serveUDPAnnounce(conn *net.UDPConn, connects *atomic.Int32, announces *atomic.Int32, t *testing.T) {
+	const connectionID = 0x5678
+
+	buffer := make([]byte, 2048)
+	for {
+		length, address, err := conn.ReadFromUDP(buffer)
+		if err != nil {
+			return
+		}
+
+		request := buffer[:length]
+		action := binary.BigEndian.Uint32(request[8:12])
+
+		response := binary.BigEndian.AppendUint32(nil, action)
+		response = append(response, request[12:16]...)
+
+		switch action {
+		case udpActionConnect:
+			connects.Add(1)
+			response = binary.BigEndian.AppendUint64(response, connectionID)
+		case udpActionAnnounce:
+			if binary.BigEndian.Uint64(request[:8]) != connectionID {
+				t.Errorf("unexpected connection ID in announce request")
+			}
+
+			if binary.BigEndian.Uint32(request[92:96]) != numWant {
+				t.Errorf("unexpected num_want in announce request")
+			}
+
+			if announces.Add(1) == 1 {
+				continue
+			}
+
+			response = binary.BigEndian.AppendUint32(response, 1800)
+			response = binary.BigEndian.AppendUint32(response, 1)
+			response = binary.BigEndian.AppendUint32(response, 2)
+			for i := range testPeersCount {
+				peer := PeerInfo{IP: net.IPv4(10, 0, byte(i>>8), byte(i)), Port: 6881}
+				response = append(response, peer.EncodeCompact()...)
+			}
+		}
+
+		conn.WriteToUDP(response, address)
+	}
+}
@@ -0,0 +1,732 @@
+package utp
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+const packetSize = 1400
+const maxPayloadLength = packetSize - headerLength
+const receiveWindow = 1 << 20
+
+// Packets received too far ahead of the last in-order one are dropped.
+const maxOutOfOrderPackets = 1024
+const maxSelectiveAckLength = 64
+
+// LEDBAT congestion control parameters.
+const targetDelay = time.Millisecond * 100
+const maxWindowIncreasePerRTT = 3000
+const minWindow = packetSize
+const initialWindow = packetSize * 2
+const baseDelayInterval = time.Minute
+
+const duplicateAcksBeforeResend = 3
+const tickInterval = time.Millisecond * 10
+const keepAliveInterval = time.Second * 29
+const idleTimeout = time.Minute * 2
+const maxTimeout = time.Minute
+
+// Connection fails after this many consecutive timeouts.
+const maxTimeouts = 6
+const maxSynTimeouts = 3
+
+var initialTimeout = time.Second
+var minTimeout = time.Millisecond * 500
+
+var errConnectionReset = errors.New("connection reset by peer")
+
+type outgoingPacket struct {
+	packet        *packet
+	sentAt        time.Time
+	transmissions int
+	inFlight      bool
+	needResend    bool
+	// Packet is resent at most once because of the packets acknowledged after it.
+	fastResent bool
+}
+
+// Conn is a reliable ordered stream on top of uTP.
+type Conn struct {
+	socket        *Socket
+	remoteAddress netip.AddrPort
+	recvID        uint16
+	sendID        uint16
+
+	mutex sync.Mutex
+	// Held for the whole write, so messages of concurrent writers aren't interleaved
+	// when the window is full. Taken before mutex.
+	writeMutex sync.Mutex
+	// Closed and replaced on every state change, so waiters can select on it along with deadlines.
+	changed chan struct{}
+	done    chan struct{}
+
+	connected bool
+	closed    bool
+	finished  bool
+	err       error
+
+	seqNr uint16
+	ackNr uint16
+
+	outgoing      []*outgoingPacket
+	bytesInFlight int
+	maxWindow     float64
+	peerWindow    uint32
+	lastAckNr     uint16
+	duplicateAcks int
+
+	incoming   map[uint16]*packet
+	readBuffer []byte
+	eof        bool
+
+	rtt         time.Duration
+	rttVariance time.Duration
+	timeout     time.Duration
+	timeouts    int
+
+	lastReceived time.Time
+	lastSent     time.Time
+	// Sent back to the peer, so it can measure the delay of its packets.
+	timestampDifference uint32
+
+	// Minimum delays over the current and the previous baseDelayInterval.
+	baseDelays         [2]uint32
+	baseDelayRotatedAt time.Time
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+func newConn(socket *Socket, remoteAddress netip.AddrPort, recvID uint16, sendID uint16) *Conn {
+	now := time.Now()
+
+	conn := &Conn{
+		socket:             socket,
+		remoteAddress:      remoteAddress,
+		recvID:             recvID,
+		sendID:             sendID,
+		changed:            make(chan struct{}),
+		done:               make(chan struct{}),
+		maxWindow:          initialWindow,
+		peerWindow:         receiveWindow,
+		incoming:           make(map[uint16]*packet),
+		timeout:            initialTimeout,
+		lastReceived:       now,
+		lastSent:           now,
+		baseDelays:         [2]uint32{math.MaxUint32, math.MaxUint32},
+		baseDelayRotatedAt: now,
+	}
+
+	go conn.run()
+
+	return conn
+}
+
+func (conn *Conn) connect(ctx context.Context) error {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	conn.seqNr = 1
+	conn.sendNewLocked(stSyn, nil)
+
+	for !conn.connected {
+		if conn.err != nil {
+			return conn.err
+		}
+
+		if conn.closed {
+			return net.ErrClosed
+		}
+
+		changed := conn.changed
+		conn.mutex.Unlock()
+		select {
+		case <-changed:
+		case <-ctx.Done():
+		}
+		conn.mutex.Lock()
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+
+	return nil
+}
+
+func (conn *Conn) Read(buffer []byte) (int, error) {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	for len(conn.readBuffer) == 0 {
+		switch {
+		case conn.eof:
+			return 0, io.EOF
+		case conn.err != nil:
+			return 0, conn.err
+		case conn.closed:
+			return 0, net.ErrClosed
+		}
+
+		err := conn.waitLocked(conn.readDeadline)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	previousLength := len(conn.readBuffer)
+	read := copy(buffer, conn.readBuffer)
+	conn.readBuffer = conn.readBuffer[read:]
+
+	// Sender might be stalled by the full receive window.
+	if previousLength > receiveWindow-packetSize {
+		conn.sendStateLocked()
+	}
+
+	return read, nil
+}
+
+func (conn *Conn) Write(data []byte) (int, error) {
+	conn.writeMutex.Lock()
+	defer conn.writeMutex.Unlock()
+
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	written := 0
+	for written < len(data) {
+		chunkLength := min(maxPayloadLength, len(data)-written)
+
+		for !conn.canSendLocked(chunkLength) {
+			switch {
+			case conn.err != nil:
+				return written, conn.err
+			case conn.closed:
+				return written, net.ErrClosed
+			}
+
+			err := conn.waitLocked(conn.writeDeadline)
+			if err != nil {
+				return written, err
+			}
+		}
+
+		switch {
+		case conn.err != nil:
+			return written, conn.err
+		case conn.closed:
+			return written, net.ErrClosed
+		}
+
+		conn.sendNewLocked(stData, append([]byte(nil), data[written:written+chunkLength]...))
+		written += chunkLength
+	}
+
+	return written, nil
+}
+
+// Sends FIN after the data that is already written. The connection is removed once FIN is acknowledged.
+func (conn *Conn) Close() error {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	if conn.closed {
+		return nil
+	}
+
+	conn.closed = true
+	conn.signalLocked()
+
+	if !conn.connected || conn.err != nil {
+		conn.finishLocked()
+		return nil
+	}
+
+	conn.sendNewLocked(stFin, nil)
+
+	return nil
+}
+
+func (conn *Conn) LocalAddr() net.Addr {
+	return conn.socket.Addr()
+}
+
+func (conn *Conn) RemoteAddr() net.Addr {
+	return net.UDPAddrFromAddrPort(conn.remoteAddress)
+}
+
+func (conn *Conn) SetDeadline(deadline time.Time) error {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	conn.readDeadline = deadline
+	conn.writeDeadline = deadline
+	conn.signalLocked()
+
+	return nil
+}
+
+func (conn *Conn) SetReadDeadline(deadline time.Time) error {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	conn.readDeadline = deadline
+	conn.signalLocked()
+
+	return nil
+}
+
+func (conn *Conn) SetWriteDeadline(deadline time.Time) error {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	conn.writeDeadline = deadline
+	conn.signalLocked()
+
+	return nil
+}
+
+func (conn *Conn) handlePacket(received *packet) {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	if conn.finished {
+		return
+	}
+
+	now := time.Now()
+	conn.lastReceived = now
+	conn.timestampDifference = microseconds(now) - received.timestamp
+	conn.peerWindow = received.windowSize
+
+	switch received.packetType {
+	case stReset:
+		conn.failLocked(errConnectionReset)
+		return
+	case stSyn:
+		if !conn.connected {
+			conn.connected = true
+			conn.ackNr = received.seqNr
+			conn.seqNr = uint16(rand.Uint32())
+			conn.signalLocked()
+		}
+
+		// SYN is resent when our response is lost.
+		conn.sendStateLocked()
+		return
+	}
+
+	if !conn.connected {
+		// Response to our SYN carries the sequence number of the first packet the peer will send.
+		if len(conn.outgoing) == 0 || conn.outgoing[0].packet.packetType != stSyn ||
+			conn.outgoing[0].packet.seqNr != received.ackNr {
+			return
+		}
+
+		conn.connected = true
+		conn.ackNr = received.seqNr - 1
+	}
+
+	conn.processAcksLocked(received)
+
+	if received.packetType == stData || received.packetType == stFin {
+		conn.receiveLocked(received)
+		conn.sendStateLocked()
+	}
+
+	conn.signalLocked()
+}
+
+func (conn *Conn) processAcksLocked(received *packet) {
+	now := time.Now()
+	ackedBytes := 0
+	acked := false
+
+	remaining := make([]*outgoingPacket, 0, len(conn.outgoing))
+	for _, sent := range conn.outgoing {
+		seqNr := sent.packet.seqNr
+		if seqLess(received.ackNr, seqNr) && !selectiveAckContains(received, seqNr) {
+			remaining = append(remaining, sent)
+			continue
+		}
+
+		acked = true
+		ackedBytes += len(sent.packet.payload)
+		if sent.inFlight {
+			conn.bytesInFlight -= len(sent.packet.payload)
+		}
+		if sent.transmissions == 1 {
+			conn.updateRTTLocked(now.Sub(sent.sentAt))
+		}
+	}
+	conn.outgoing = remaining
+
+	if acked {
+		conn.timeouts = 0
+		conn.timeout = max(conn.rtt+conn.rttVariance*4, minTimeout)
+	}
+
+	if received.ackNr != conn.lastAckNr {
+		conn.duplicateAcks = 0
+	} else if received.packetType == stState && len(conn.outgoing) != 0 {
+		conn.duplicateAcks++
+	}
+	conn.lastAckNr = received.ackNr
+
+	conn.fastResendLocked(received)
+
+	if ackedBytes != 0 && received.timestampDifference != 0 {
+		conn.updateWindowLocked(ackedBytes, received.timestampDifference)
+	}
+
+	conn.resendLocked()
+
+	if conn.closed && len(conn.outgoing) == 0 {
+		conn.finishLocked()
+	}
+}
+
+// Packet is considered lost when several packets sent after it are already received.
+func (conn *Conn) fastResendLocked(received *packet) {
+	if len(conn.outgoing) == 0 {
+		return
+	}
+
+	if conn.duplicateAcks >= duplicateAcksBeforeResend && !conn.outgoing[0].fastResent {
+		conn.outgoing[0].fastResent = true
+		conn.markForResendLocked(conn.outgoing[0])
+	}
+
+	selectivelyAcked := make([]uint16, 0)
+	for offset := range len(received.selectiveAck) * 8 {
+		if received.selectiveAck[offset/8]&(1<<(offset%8)) != 0 {
+			selectivelyAcked = append(selectivelyAcked, received.ackNr+2+uint16(offset))
+		}
+	}
+
+	// Both lists are ordered by sequence number.
+	ackedIdx := 0
+	for _, sent := range conn.outgoing {
+		for ackedIdx < len(selectivelyAcked) && !seqLess(sent.packet.seqNr, selectivelyAcked[ackedIdx]) {
+			ackedIdx++
+		}
+
+		if len(selectivelyAcked)-ackedIdx < duplicateAcksBeforeResend {
+			return
+		}
+
+		if !sent.fastResent {
+			sent.fastResent = true
+			conn.markForResendLocked(sent)
+		}
+	}
+}
+
+func selectiveAckContains(received *packet, seqNr uint16) bool {
+	offset := int(seqNr - (received.ackNr + 2))
+	if offset >= len(received.selectiveAck)*8 {
+		return false
+	}
+
+	return received.selectiveAck[offset/8]&(1<<(offset%8)) != 0
+}
+
+func (conn *Conn) receiveLocked(received *packet) {
+	if conn.eof {
+		return
+	}
+
+	if received.seqNr != conn.ackNr+1 {
+		if seqLess(conn.ackNr, received.seqNr) && received.seqNr-conn.ackNr < maxOutOfOrderPackets {
+			conn.incoming[received.seqNr] = received
+		}
+
+		return
+	}
+
+	for {
+		conn.ackNr++
+
+		if received.packetType == stFin {
+			conn.eof = true
+			clear(conn.incoming)
+			return
+		}
+
+		conn.readBuffer = append(conn.readBuffer, received.payload...)
+
+		next, ok := conn.incoming[conn.ackNr+1]
+		if !ok {
+			return
+		}
+
+		delete(conn.incoming, conn.ackNr+1)
+		received = next
+	}
+}
+
+// LEDBAT: window grows while the queuing delay is below the target and shrinks otherwise.
+func (conn *Conn) updateWindowLocked(ackedBytes int, delay uint32) {
+	now := time.Now()
+	if now.Sub(conn.baseDelayRotatedAt) > baseDelayInterval {
+		conn.baseDelays[1] = conn.baseDelays[0]
+		conn.baseDelays[0] = math.MaxUint32
+		conn.baseDelayRotatedAt = now
+	}
+	conn.baseDelays[0] = min(conn.baseDelays[0], delay)
+
+	baseDelay := min(conn.baseDelays[0], conn.baseDelays[1])
+	queuingDelay := time.Duration(delay-baseDelay) * time.Microsecond
+
+	offTarget := float64(targetDelay-queuingDelay) / float64(targetDelay)
+	windowFactor := float64(ackedBytes) / max(conn.maxWindow, float64(ackedBytes))
+
+	conn.maxWindow += maxWindowIncreasePerRTT * offTarget * windowFactor
+	conn.maxWindow = max(conn.maxWindow, minWindow)
+}
+
+func (conn *Conn) updateRTTLocked(sample time.Duration) {
+	if conn.rtt == 0 {
+		conn.rtt = sample
+		conn.rttVariance = sample / 2
+		return
+	}
+
+	delta := conn.rtt - sample
+	if delta < 0 {
+		delta = -delta
+	}
+
+	conn.rttVariance += (delta - conn.rttVariance) / 4
+	conn.rtt += (sample - conn.rtt) / 8
+}
+
+func (conn *Conn) canSendLocked(length int) bool {
+	if !conn.connected {
+		return false
+	}
+
+	// Single packet is always allowed, so the peer can report when its window opens again.
+	if conn.bytesInFlight == 0 {
+		return true
+	}
+
+	window := min(int(conn.maxWindow), int(conn.peerWindow))
+	return conn.bytesInFlight+length <= window
+}
+
+func (conn *Conn) sendNewLocked(packetType packetType, payload []byte) {
+	sent := &outgoingPacket{packet: &packet{packetType: packetType, seqNr: conn.seqNr, payload: payload}}
+	conn.seqNr++
+
+	conn.outgoing = append(conn.outgoing, sent)
+	conn.transmitLocked(sent)
+}
+
+func (conn *Conn) transmitLocked(sent *outgoingPacket) {
+	now := time.Now()
+
+	sent.sentAt = now
+	sent.transmissions++
+	sent.needResend = false
+	if !sent.inFlight {
+		sent.inFlight = true
+		conn.bytesInFlight += len(sent.packet.payload)
+	}
+
+	conn.fillHeaderLocked(sent.packet, now)
+	conn.socket.send(sent.packet, conn.remoteAddress)
+}
+
+func (conn *Conn) markForResendLocked(sent *outgoingPacket) {
+	sent.needResend = true
+	if sent.inFlight {
+		sent.inFlight = false
+		conn.bytesInFlight -= len(sent.packet.payload)
+	}
+}
+
+func (conn *Conn) resendLocked() {
+	for _, sent := range conn.outgoing {
+		if !sent.needResend {
+			continue
+		}
+
+		if !conn.canSendLocked(len(sent.packet.payload)) && sent.packet.packetType != stSyn {
+			return
+		}
+
+		conn.transmitLocked(sent)
+	}
+}
+
+func (conn *Conn) sendStateLocked() {
+	state := packet{packetType: stState, seqNr: conn.seqNr, selectiveAck: conn.selectiveAckLocked()}
+	conn.fillHeaderLocked(&state, time.Now())
+	conn.socket.send(&state, conn.remoteAddress)
+}
+
+func (conn *Conn) fillHeaderLocked(toSend *packet, now time.Time) {
+	toSend.connectionID = conn.sendID
+	// SYN carries the ID the peer should use for the responses.
+	if toSend.packetType == stSyn {
+		toSend.connectionID = conn.recvID
+	}
+	toSend.timestamp = microseconds(now)
+	toSend.timestampDifference = conn.timestampDifference
+	toSend.windowSize = uint32(max(receiveWindow-len(conn.readBuffer), 0))
+	toSend.ackNr = conn.ackNr
+
+	conn.lastSent = now
+}
+
+func (conn *Conn) selectiveAckLocked() []byte {
+	if len(conn.incoming) == 0 {
+		return nil
+	}
+
+	maxOffset := 0
+	for seqNr := range conn.incoming {
+		maxOffset = max(maxOffset, int(seqNr-(conn.ackNr+2)))
+	}
+
+	// Length should be a multiple of 4.
+	length := min((maxOffset/32+1)*4, maxSelectiveAckLength)
+	selectiveAck := make([]byte, length)
+	for seqNr := range conn.incoming {
+		offset := int(seqNr - (conn.ackNr + 2))
+		if offset < length*8 {
+			selectiveAck[offset/8] |= 1 << (offset % 8)
+		}
+	}
+
+	return selectiveAck
+}
+
+func (conn *Conn) run() {
+	ticker := time.NewTicker(tickInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-conn.done:
+			return
+		}
+
+		conn.mutex.Lock()
+		conn.checkTimeoutsLocked()
+		conn.mutex.Unlock()
+	}
+}
+
+func (conn *Conn) checkTimeoutsLocked() {
+	if conn.finished {
+		return
+	}
+
+	now := time.Now()
+
+	if conn.connected && now.Sub(conn.lastReceived) > idleTimeout {
+		conn.failLocked(errTimeout)
+		return
+	}
+
+	if len(conn.outgoing) == 0 {
+		// Keeps NAT mappings alive.
+		if conn.connected && now.Sub(conn.lastSent) > keepAliveInterval {
+			conn.sendStateLocked()
+		}
+
+		return
+	}
+
+	if now.Sub(conn.outgoing[0].sentAt) < conn.timeout {
+		return
+	}
+
+	conn.timeouts++
+	limit := maxTimeouts
+	if !conn.connected {
+		limit = maxSynTimeouts
+	}
+
+	if conn.timeouts > limit {
+		conn.failLocked(errTimeout)
+		return
+	}
+
+	conn.timeout = min(conn.timeout*2, maxTimeout)
+	conn.maxWindow = minWindow
+
+	for _, sent := range conn.outgoing {
+		conn.markForResendLocked(sent)
+	}
+
+	conn.transmitLocked(conn.outgoing[0])
+	conn.resendLocked()
+}
+
+// Releases the mutex until the state changes or the deadline is reached.
+func (conn *Conn) waitLocked(deadline time.Time) error {
+	if !deadline.IsZero() && !time.Now().Before(deadline) {
+		return errTimeout
+	}
+
+	changed := conn.changed
+	conn.mutex.Unlock()
+	defer conn.mutex.Lock()
+
+	if deadline.IsZero() {
+		<-changed
+		return nil
+	}
+
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+
+	select {
+	case <-changed:
+		return nil
+	case <-timer.C:
+		return errTimeout
+	}
+}
+
+func (conn *Conn) signalLocked() {
+	close(conn.changed)
+	conn.changed = make(chan struct{})
+}
+
+func (conn *Conn) fail(err error) {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	conn.failLocked(err)
+}
+
+func (conn *Conn) failLocked(err error) {
+	if conn.err == nil {
+		conn.err = err
+	}
+
+	conn.finishLocked()
+}
+
+func (conn *Conn) finishLocked() {
+	if conn.finished {
+		return
+	}
+
+	conn.finished = true
+	close(conn.done)
+	conn.socket.removeConn(conn)
+	conn.signalLocked()
+}
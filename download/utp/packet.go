@@ -0,0 +1,121 @@
+package utp
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+const headerLength = 20
+const protocolVersion = 1
+
+type packetType uint8
+
+const (
+	stData  packetType = 0
+	stFin   packetType = 1
+	stState packetType = 2
+	stReset packetType = 3
+	stSyn   packetType = 4
+)
+
+const (
+	extensionNone         uint8 = 0
+	extensionSelectiveAck uint8 = 1
+)
+
+// 0       4       8               16              24              32
+// +-------+-------+---------------+---------------+---------------+
+// | type  | ver   | extension     | connection_id                 |
+// +-------+-------+---------------+---------------+---------------+
+// | timestamp_microseconds                                        |
+// +---------------+---------------+---------------+---------------+
+// | timestamp_difference_microseconds                             |
+// +---------------+---------------+---------------+---------------+
+// | wnd_size                                                      |
+// +---------------+---------------+---------------+---------------+
+// | seq_nr                        | ack_nr                        |
+// +---------------+---------------+---------------+---------------+
+type packet struct {
+	packetType          packetType
+	connectionID        uint16
+	timestamp           uint32
+	timestampDifference uint32
+	windowSize          uint32
+	seqNr               uint16
+	ackNr               uint16
+	// Bit i is set when packet ack_nr + 2 + i is received.
+	selectiveAck []byte
+	payload      []byte
+}
+
+func (packet *packet) encode() []byte {
+	encoded := make([]byte, headerLength, headerLength+len(packet.selectiveAck)+2+len(packet.payload))
+
+	encoded[0] = byte(packet.packetType)<<4 | protocolVersion
+	encoded[1] = extensionNone
+	if len(packet.selectiveAck) != 0 {
+		encoded[1] = extensionSelectiveAck
+	}
+	binary.BigEndian.PutUint16(encoded[2:4], packet.connectionID)
+	binary.BigEndian.PutUint32(encoded[4:8], packet.timestamp)
+	binary.BigEndian.PutUint32(encoded[8:12], packet.timestampDifference)
+	binary.BigEndian.PutUint32(encoded[12:16], packet.windowSize)
+	binary.BigEndian.PutUint16(encoded[16:18], packet.seqNr)
+	binary.BigEndian.PutUint16(encoded[18:20], packet.ackNr)
+
+	if len(packet.selectiveAck) != 0 {
+		encoded = append(encoded, extensionNone, byte(len(packet.selectiveAck)))
+		encoded = append(encoded, packet.selectiveAck...)
+	}
+
+	return append(encoded, packet.payload...)
+}
+
+func decodePacket(data []byte) (*packet, error) {
+	if len(data) < headerLength {
+		return nil, fmt.Errorf("packet is too short: %d bytes", len(data))
+	}
+
+	if data[0]&0x0F != protocolVersion {
+		return nil, fmt.Errorf("unsupported protocol version %d", data[0]&0x0F)
+	}
+
+	decoded := packet{
+		packetType:          packetType(data[0] >> 4),
+		connectionID:        binary.BigEndian.Uint16(data[2:4]),
+		timestamp:           binary.BigEndian.Uint32(data[4:8]),
+		timestampDifference: binary.BigEndian.Uint32(data[8:12]),
+		windowSize:          binary.BigEndian.Uint32(data[12:16]),
+		seqNr:               binary.BigEndian.Uint16(data[16:18]),
+		ackNr:               binary.BigEndian.Uint16(data[18:20]),
+	}
+
+	if decoded.packetType > stSyn {
+		return nil, fmt.Errorf("unknown packet type %d", decoded.packetType)
+	}
+
+	extension := data[1]
+	data = data[headerLength:]
+	for extension != extensionNone {
+		if len(data) < 2 || len(data) < 2+int(data[1]) {
+			return nil, fmt.Errorf("invalid extension %d", extension)
+		}
+
+		nextExtension, length := data[0], int(data[1])
+		if extension == extensionSelectiveAck {
+			decoded.selectiveAck = data[2 : 2+length]
+		}
+
+		extension = nextExtension
+		data = data[2+length:]
+	}
+
+	decoded.payload = data
+
+	return &decoded, nil
+}
+
+// Sequence numbers wrap around, so they're compared by the distance between them.
+func seqLess(lhs uint16, rhs uint16) bool {
+	return int16(lhs-rhs) < 0
+}
@@ -0,0 +1,275 @@
+package utp
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"time"
+)
+
+const readBufferSize = 65535
+const acceptQueueLength = 32
+const sharedQueueLength = 256
+
+type connectionKey struct {
+	address netip.AddrPort
+	recvID  uint16
+}
+
+// Socket multiplexes uTP connections over a single UDP socket and accepts the incoming ones.
+type Socket struct {
+	conn *net.UDPConn
+
+	conns      map[connectionKey]*Conn
+	connsMutex sync.Mutex
+
+	accepted chan *Conn
+	shared   *SharedConn
+
+	closed    chan struct{}
+	closeOnce sync.Once
+	// Closed once the serve goroutine exits.
+	served chan struct{}
+
+	// Outgoing packets are dropped when it returns true, used to simulate packet loss.
+	dropPacket func() bool
+}
+
+func Listen(address string) (*Socket, error) {
+	return listen(address, nil)
+}
+
+func listen(address string, dropPacket func() bool) (*Socket, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve address %s: %w", address, err)
+	}
+
+	conn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create UDP listener: %w", err)
+	}
+
+	socket := &Socket{
+		conn:       conn,
+		conns:      make(map[connectionKey]*Conn),
+		accepted:   make(chan *Conn, acceptQueueLength),
+		closed:     make(chan struct{}),
+		served:     make(chan struct{}),
+		dropPacket: dropPacket,
+	}
+	socket.shared = &SharedConn{socket: socket, packets: make(chan sharedPacket, sharedQueueLength)}
+
+	go socket.serve()
+
+	return socket, nil
+}
+
+func (socket *Socket) Accept() (net.Conn, error) {
+	select {
+	case conn := <-socket.accepted:
+		return conn, nil
+	case <-socket.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (socket *Socket) Addr() net.Addr {
+	return socket.conn.LocalAddr()
+}
+
+// No packets are handled after Close returns.
+func (socket *Socket) Close() error {
+	socket.closeOnce.Do(func() {
+		close(socket.closed)
+	})
+
+	err := socket.conn.Close()
+	<-socket.served
+
+	return err
+}
+
+// Datagrams that are not uTP packets, e.g. DHT messages, are delivered to the shared connection.
+func (socket *Socket) SharedConn() *SharedConn {
+	return socket.shared
+}
+
+func (socket *Socket) Dial(ctx context.Context, address string) (net.Conn, error) {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		udpAddr, err := net.ResolveUDPAddr("udp", address)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve address %s: %w", address, err)
+		}
+
+		addrPort = udpAddr.AddrPort()
+	}
+	addrPort = netip.AddrPortFrom(addrPort.Addr().Unmap(), addrPort.Port())
+
+	socket.connsMutex.Lock()
+	var recvID uint16
+	for {
+		recvID = uint16(rand.Uint32())
+		_, exists := socket.conns[connectionKey{address: addrPort, recvID: recvID}]
+		if !exists {
+			break
+		}
+	}
+	conn := newConn(socket, addrPort, recvID, recvID+1)
+	socket.conns[connectionKey{address: addrPort, recvID: recvID}] = conn
+	socket.connsMutex.Unlock()
+
+	err = conn.connect(ctx)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to connect to %s: %w", address, err)
+	}
+
+	return conn, nil
+}
+
+func (socket *Socket) serve() {
+	defer close(socket.served)
+
+	buffer := make([]byte, readBufferSize)
+	for {
+		length, source, err := socket.conn.ReadFromUDPAddrPort(buffer)
+		if err != nil {
+			select {
+			case <-socket.closed:
+			default:
+				log.Printf("failed to read uTP packet: %v", err)
+			}
+
+			socket.closeConns()
+			return
+		}
+
+		source = netip.AddrPortFrom(source.Addr().Unmap(), source.Port())
+		data := buffer[:length]
+
+		received, err := decodePacket(data)
+		if err != nil {
+			select {
+			case socket.shared.packets <- sharedPacket{data: append([]byte(nil), data...), source: source}:
+			default:
+			}
+
+			continue
+		}
+
+		// Payload is delivered to the connection, so buffer can't be reused.
+		received.payload = append([]byte(nil), received.payload...)
+
+		socket.route(received, source)
+	}
+}
+
+func (socket *Socket) route(received *packet, source netip.AddrPort) {
+	// SYN carries the connection ID of the initiator, responses to it are sent with ID + 1.
+	recvID := received.connectionID
+	if received.packetType == stSyn {
+		recvID++
+	}
+
+	socket.connsMutex.Lock()
+	conn, ok := socket.conns[connectionKey{address: source, recvID: recvID}]
+	if !ok && received.packetType == stSyn {
+		conn = newConn(socket, source, recvID, received.connectionID)
+
+		select {
+		case socket.accepted <- conn:
+			socket.conns[connectionKey{address: source, recvID: recvID}] = conn
+			ok = true
+		default:
+			log.Printf("dropping uTP connection from %s: too many pending connections", source.String())
+		}
+	}
+	socket.connsMutex.Unlock()
+
+	if !ok {
+		if received.packetType != stReset {
+			socket.send(&packet{packetType: stReset, connectionID: received.connectionID, ackNr: received.seqNr}, source)
+		}
+
+		return
+	}
+
+	conn.handlePacket(received)
+}
+
+func (socket *Socket) send(toSend *packet, address netip.AddrPort) error {
+	if socket.dropPacket != nil && socket.dropPacket() {
+		return nil
+	}
+
+	_, err := socket.conn.WriteToUDPAddrPort(toSend.encode(), address)
+	return err
+}
+
+func (socket *Socket) removeConn(conn *Conn) {
+	socket.connsMutex.Lock()
+	defer socket.connsMutex.Unlock()
+
+	key := connectionKey{address: conn.remoteAddress, recvID: conn.recvID}
+	if socket.conns[key] == conn {
+		delete(socket.conns, key)
+	}
+}
+
+func (socket *Socket) closeConns() {
+	socket.connsMutex.Lock()
+	conns := make([]*Conn, 0, len(socket.conns))
+	for _, conn := range socket.conns {
+		conns = append(conns, conn)
+	}
+	socket.connsMutex.Unlock()
+
+	for _, conn := range conns {
+		conn.fail(net.ErrClosed)
+	}
+}
+
+type sharedPacket struct {
+	data   []byte
+	source netip.AddrPort
+}
+
+// Lets other protocols use the port of the uTP socket.
+type SharedConn struct {
+	socket  *Socket
+	packets chan sharedPacket
+}
+
+func (conn *SharedConn) ReadFromUDPAddrPort(buffer []byte) (int, netip.AddrPort, error) {
+	select {
+	case received := <-conn.packets:
+		return copy(buffer, received.data), received.source, nil
+	case <-conn.socket.closed:
+		return 0, netip.AddrPort{}, net.ErrClosed
+	}
+}
+
+func (conn *SharedConn) WriteToUDPAddrPort(data []byte, address netip.AddrPort) (int, error) {
+	return conn.socket.conn.WriteToUDPAddrPort(data, address)
+}
+
+func (conn *SharedConn) LocalAddr() net.Addr {
+	return conn.socket.conn.LocalAddr()
+}
+
+func (conn *SharedConn) Close() error {
+	return conn.socket.Close()
+}
+
+func microseconds(now time.Time) uint32 {
+	return uint32(now.UnixMicro())
+}
+
+var errTimeout = os.ErrDeadlineExceeded
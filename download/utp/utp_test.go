@@ -0,0 +1,251 @@
+package utp
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand/v2"
+	"net/netip"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPacketEncodeDecode(t *testing.T) {
+	original := packet{
+		packetType:          stState,
+		connectionID:        0x1234,
+		timestamp:           1,
+		timestampDifference: 2,
+		windowSize:          3,
+		seqNr:               4,
+		ackNr:               5,
+		selectiveAck:        []byte{0b101, 0, 0, 0x80},
+		payload:             []byte("payload"),
+	}
+
+	decoded, err := decodePacket(original.encode())
+	if err != nil {
+		t.Fatalf("failed to decode packet: %v", err)
+	}
+
+	if !reflect.DeepEqual(*decoded, original) {
+		t.Errorf("values don't match: expected %+v, got %+v", original, *decoded)
+	}
+
+	if !selectiveAckContains(decoded, 7) || selectiveAckContains(decoded, 8) || !selectiveAckContains(decoded, 38) {
+		t.Errorf("selective ack is decoded incorrectly")
+	}
+
+	_, err = decodePacket([]byte("d1:ad2:id20:abcdefghij0123456789e1:q4:ping1:t2:aa1:y1:qe"))
+	if err == nil {
+		t.Errorf("DHT message is decoded as uTP packet")
+	}
+}
+
+func TestTransferWithPacketLoss(t *testing.T) {
+	setTestTimeouts(t)
+
+	var randMutex sync.Mutex
+	lossRandom := rand.New(rand.NewPCG(1, 2))
+	dropPacket := func() bool {
+		randMutex.Lock()
+		defer randMutex.Unlock()
+
+		return lossRandom.IntN(10) == 0
+	}
+	listener, dialer := socketPair(dropPacket, t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	dialed, err := dialer.Dial(ctx, listener.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+
+	accepted, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("failed to accept: %v", err)
+	}
+
+	sent := make([]byte, 1<<20)
+	for i := range sent {
+		sent[i] = byte(i * 7)
+	}
+
+	writeErrors := make(chan error, 2)
+	go func() {
+		_, err := dialed.Write(sent)
+		writeErrors <- err
+	}()
+	go func() {
+		_, err := accepted.Write(sent[:1<<16])
+		writeErrors <- err
+	}()
+
+	received := make([]byte, len(sent))
+	accepted.SetReadDeadline(time.Now().Add(time.Second * 30))
+	_, err = io.ReadFull(accepted, received)
+	if err != nil {
+		t.Fatalf("failed to receive data: %v", err)
+	}
+
+	if !bytes.Equal(received, sent) {
+		t.Errorf("received data doesn't match the sent one")
+	}
+
+	dialed.SetReadDeadline(time.Now().Add(time.Second * 30))
+	_, err = io.ReadFull(dialed, received[:1<<16])
+	if err != nil {
+		t.Fatalf("failed to receive data: %v", err)
+	}
+
+	if !bytes.Equal(received[:1<<16], sent[:1<<16]) {
+		t.Errorf("received data doesn't match the sent one")
+	}
+
+	for range 2 {
+		if err := <-writeErrors; err != nil {
+			t.Errorf("failed to send data: %v", err)
+		}
+	}
+
+	dialed.Close()
+
+	_, err = accepted.Read(make([]byte, 1))
+	if err != io.EOF {
+		t.Errorf("expected EOF after the connection is closed, got %v", err)
+	}
+}
+
+func TestConcurrentWritesAreNotInterleaved(t *testing.T) {
+	setTestTimeouts(t)
+
+	var randMutex sync.Mutex
+	lossRandom := rand.New(rand.NewPCG(3, 4))
+	dropPacket := func() bool {
+		randMutex.Lock()
+		defer randMutex.Unlock()
+
+		return lossRandom.IntN(10) == 0
+	}
+	listener, dialer := socketPair(dropPacket, t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	dialed, err := dialer.Dial(ctx, listener.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer dialed.Close()
+
+	accepted, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("failed to accept: %v", err)
+	}
+	defer accepted.Close()
+
+	// Every message consists of the same byte repeated, so interleaving is easy to detect.
+	const writers = 8
+	const messagesPerWriter = 8
+	const messageLength = 1 << 15
+
+	writeErrors := make(chan error, writers)
+	for writer := range writers {
+		go func() {
+			message := bytes.Repeat([]byte{byte(writer)}, messageLength)
+			for range messagesPerWriter {
+				_, err := dialed.Write(message)
+				if err != nil {
+					writeErrors <- err
+					return
+				}
+			}
+
+			writeErrors <- nil
+		}()
+	}
+
+	accepted.SetReadDeadline(time.Now().Add(time.Second * 30))
+	message := make([]byte, messageLength)
+	for range writers * messagesPerWriter {
+		_, err := io.ReadFull(accepted, message)
+		if err != nil {
+			t.Fatalf("failed to receive data: %v", err)
+		}
+
+		if !bytes.Equal(message, bytes.Repeat(message[:1], messageLength)) {
+			t.Fatalf("messages of concurrent writers are interleaved")
+		}
+	}
+
+	for range writers {
+		if err := <-writeErrors; err != nil {
+			t.Errorf("failed to send data: %v", err)
+		}
+	}
+}
+
+func TestDialTimeout(t *testing.T) {
+	setTestTimeouts(t)
+
+	listener, dialer := socketPair(func() bool { return true }, t)
+
+	_, err := dialer.Dial(context.Background(), listener.Addr().String())
+	if err == nil {
+		t.Errorf("dial succeeded without response from the peer")
+	}
+}
+
+func TestSharedConn(t *testing.T) {
+	listener, dialer := socketPair(nil, t)
+
+	message := []byte("d1:ad2:id20:abcdefghij0123456789e1:q4:ping1:t2:aa1:y1:qe")
+	address := netip.MustParseAddrPort(listener.Addr().String())
+	_, err := dialer.SharedConn().WriteToUDPAddrPort(message, address)
+	if err != nil {
+		t.Fatalf("failed to send message: %v", err)
+	}
+
+	buffer := make([]byte, 1024)
+	length, source, err := listener.SharedConn().ReadFromUDPAddrPort(buffer)
+	if err != nil {
+		t.Fatalf("failed to receive message: %v", err)
+	}
+
+	if !bytes.Equal(buffer[:length], message) {
+		t.Errorf("unexpected message received: %q", buffer[:length])
+	}
+
+	if source.Port() != netip.MustParseAddrPort(dialer.Addr().String()).Port() {
+		t.Errorf("unexpected message source %s", source.String())
+	}
+}
+
+func setTestTimeouts(t *testing.T) {
+	previousInitial, previousMin := initialTimeout, minTimeout
+	initialTimeout, minTimeout = time.Millisecond*100, time.Millisecond*50
+
+	t.Cleanup(func() {
+		initialTimeout, minTimeout = previousInitial, previousMin
+	})
+}
+
+func socketPair(dropPacket func() bool, t *testing.T) (*Socket, *Socket) {
+	listener, err := listen("127.0.0.1:0", dropPacket)
+	if err != nil {
+		t.Fatalf("failed to create socket: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	dialer, err := listen("127.0.0.1:0", dropPacket)
+	if err != nil {
+		t.Fatalf("failed to create socket: %v", err)
+	}
+	t.Cleanup(func() { dialer.Close() })
+
+	return listener, dialer
+}
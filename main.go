@@ -2,10 +2,19 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
 
 	"github.com/mertwole/bittorrent-cli/download"
+	"github.com/mertwole/bittorrent-cli/download/ip_filter"
+	"github.com/mertwole/bittorrent-cli/download/mse"
+	"github.com/mertwole/bittorrent-cli/download/pieces"
+	"github.com/mertwole/bittorrent-cli/download/rate_limiter"
 	"github.com/mertwole/bittorrent-cli/ui"
 )
 
@@ -15,10 +24,102 @@ var torrentFileName = flag.String("torrent", "./data/torrent.torrent", "Path to
 var magnetLink = flag.String("magnet", "", "Magnet link to download from")
 var downloadFolderName = flag.String("download", "./data", "Path to the download folder")
 var interactiveMode = flag.Bool("interactive", true, "Whether the client should be run in an interactive mode")
+var files = flag.String(
+	"files",
+	"",
+	"Comma-separated list of file indexes to download with optional priority, e.g. 0=high,2,5=low. "+
+		"Files that are not listed are skipped. All files are downloaded if not specified",
+)
+var encryption = flag.String(
+	"encryption",
+	mse.Prefer.String(),
+	"Peer connection encryption policy: disabled, prefer or require",
+)
+var downloadLimit = flag.Int("download-limit", 0, "Global download rate limit in KiB/s, 0 means unlimited")
+var uploadLimit = flag.Int("upload-limit", 0, "Global upload rate limit in KiB/s, 0 means unlimited")
+var altDownloadLimit = flag.Int(
+	"alt-download-limit",
+	0,
+	"Global download rate limit in KiB/s while the alternative speed is enabled, 0 means unlimited",
+)
+var altUploadLimit = flag.Int(
+	"alt-upload-limit",
+	0,
+	"Global upload rate limit in KiB/s while the alternative speed is enabled, 0 means unlimited",
+)
+var altSpeedSchedule = flag.String(
+	"alt-speed-schedule",
+	"",
+	"Time of day interval when the alternative speed is enabled, e.g. 09:00-18:00",
+)
+var maxConnections = flag.Int("max-connections", 200, "Maximum number of peer connections, 0 means unlimited")
+var maxHalfOpenConnections = flag.Int(
+	"max-half-open",
+	20,
+	"Maximum number of outgoing connection attempts in progress, 0 means unlimited",
+)
+var maxConnectionsPerTorrent = flag.Int(
+	"max-connections-per-torrent",
+	50,
+	"Maximum number of peer connections of a single torrent, 0 means unlimited",
+)
+var ipFilterFiles = flag.String(
+	"ip-filter",
+	"",
+	"Comma-separated list of IP filter files in eMule ipfilter.dat, PeerGuardian P2P or CIDR format. "+
+		"Filter is reloaded on SIGHUP",
+)
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == scrapeCommand {
+		runScrape(os.Args[2:])
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == trackerCommand {
+		runTracker(os.Args[2:])
+		return
+	}
+
 	flag.Parse()
 
+	encryptionPolicy, ok := mse.ParsePolicy(*encryption)
+	if !ok {
+		log.Fatalf("unknown encryption policy %s", *encryption)
+	}
+
+	for _, limit := range []int{*downloadLimit, *uploadLimit, *altDownloadLimit, *altUploadLimit} {
+		if limit < 0 {
+			log.Fatalf("rate limit can't be negative: %d", limit)
+		}
+	}
+
+	for _, limit := range []int{*maxConnections, *maxHalfOpenConnections, *maxConnectionsPerTorrent} {
+		if limit < 0 {
+			log.Fatalf("connection limit can't be negative: %d", limit)
+		}
+	}
+
+	var schedule *rate_limiter.Schedule
+	if *altSpeedSchedule != "" {
+		parsed, err := rate_limiter.ParseSchedule(*altSpeedSchedule)
+		if err != nil {
+			log.Fatalf("failed to parse alternative speed schedule: %v", err)
+		}
+
+		schedule = parsed
+	}
+
+	var filter *ip_filter.Filter
+	if *ipFilterFiles != "" {
+		loaded, err := ip_filter.New(strings.Split(*ipFilterFiles, ","))
+		if err != nil {
+			log.Fatalf("failed to load IP filter: %v", err)
+		}
+
+		filter = loaded
+	}
+
 	if *interactiveMode {
 		logFile, err := os.OpenFile(logFileName, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0666)
 		if err != nil {
@@ -29,23 +130,107 @@ func main() {
 		log.SetOutput(logFile)
 	}
 
+	session, err := download.NewSession(download.SessionOptions{
+		EncryptionPolicy: encryptionPolicy,
+		RateLimits:       download.RateLimits{Download: *downloadLimit * 1024, Upload: *uploadLimit * 1024},
+		AltRateLimits:    download.RateLimits{Download: *altDownloadLimit * 1024, Upload: *altUploadLimit * 1024},
+		AltSpeedSchedule: schedule,
+
+		MaxConnections:           *maxConnections,
+		MaxHalfOpenConnections:   *maxHalfOpenConnections,
+		MaxConnectionsPerTorrent: *maxConnectionsPerTorrent,
+
+		IPFilter: filter,
+	})
+	if err != nil {
+		log.Fatalf("failed to start session: %v", err)
+	}
+	defer session.Close()
+
+	if filter != nil {
+		reloads := make(chan os.Signal, 1)
+		signal.Notify(reloads, syscall.SIGHUP)
+		go func() {
+			for range reloads {
+				err := session.ReloadIPFilter()
+				if err != nil {
+					log.Printf("failed to reload IP filter: %v", err)
+				}
+			}
+		}()
+	}
+
 	if *interactiveMode {
-		ui.StartUI()
+		ui.StartUI(session)
 	} else {
+		var newDownload *download.Download
+
 		if *magnetLink != "" {
-			download, err := download.LoadFromMagnetLink(*magnetLink, *downloadFolderName)
+			newDownload, err = download.LoadFromMagnetLink(session, *magnetLink, *downloadFolderName)
 			if err != nil {
 				log.Fatalf("failed to start download from magnet link: %v", err)
 			}
-
-			download.Start()
 		} else {
-			download, err := download.New(*torrentFileName, *downloadFolderName)
+			newDownload, err = download.New(session, *torrentFileName, *downloadFolderName)
 			if err != nil {
 				log.Fatalf("failed to start download from torrent file: %v", err)
 			}
+		}
+
+		if *files != "" {
+			priorities, err := parseFilePriorities(*files, len(newDownload.GetFiles()))
+			if err != nil {
+				log.Fatalf("failed to parse file priorities: %v", err)
+			}
 
-			download.Start()
+			err = newDownload.SetFilePriorities(priorities)
+			if err != nil {
+				log.Fatalf("failed to set file priorities: %v", err)
+			}
 		}
+
+		interrupts := make(chan os.Signal, 1)
+		signal.Notify(interrupts, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			<-interrupts
+			newDownload.Stop()
+			os.Exit(0)
+		}()
+
+		newDownload.Start()
 	}
 }
+
+func parseFilePriorities(spec string, fileCount int) ([]pieces.Priority, error) {
+	priorities := make([]pieces.Priority, fileCount)
+	for i := range priorities {
+		priorities[i] = pieces.Skip
+	}
+
+	for entry := range strings.SplitSeq(spec, ",") {
+		indexString, priorityString, hasPriority := strings.Cut(strings.TrimSpace(entry), "=")
+
+		index, err := strconv.Atoi(indexString)
+		if err != nil {
+			return nil, fmt.Errorf("invalid file index %s: %w", indexString, err)
+		}
+
+		if index < 0 || index >= fileCount {
+			return nil, fmt.Errorf("file index %d is out of range, torrent has %d files", index, fileCount)
+		}
+
+		priority := pieces.Normal
+		if hasPriority {
+			parsed, ok := pieces.ParsePriority(priorityString)
+			if !ok {
+				return nil, fmt.Errorf("unknown priority %s", priorityString)
+			}
+
+			priority = parsed
+		}
+
+		priorities[index] = priority
+	}
+
+	return priorities, nil
+}
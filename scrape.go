@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"flag"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"slices"
+
+	"github.com/mertwole/bittorrent-cli/download/magnet_link"
+	"github.com/mertwole/bittorrent-cli/download/torrent_info"
+	"github.com/mertwole/bittorrent-cli/download/tracker"
+)
+
+const scrapeCommand = "scrape"
+
+func runScrape(args []string) {
+	flags := flag.NewFlagSet(scrapeCommand, flag.ExitOnError)
+	torrentFileName := flags.String("torrent", "./data/torrent.torrent", "Path to the .torrent file")
+	magnetLink := flags.String("magnet", "", "Magnet link to scrape trackers from")
+	flags.Parse(args)
+
+	var infoHash [sha1.Size]byte
+	var trackers []*url.URL
+
+	if *magnetLink != "" {
+		parsed, err := magnet_link.Decode(*magnetLink)
+		if err != nil {
+			log.Fatalf("failed to decode magnet link: %v", err)
+		}
+
+		infoHash = parsed.InfoHash
+		trackers = parsed.Trackers
+	} else {
+		torrentFile, err := os.Open(*torrentFileName)
+		if err != nil {
+			log.Fatalf("failed to open torrent file: %v", err)
+		}
+		defer torrentFile.Close()
+
+		torrentInfo, err := torrent_info.Decode(torrentFile)
+		if err != nil {
+			log.Fatalf("failed to decode torrent file: %v", err)
+		}
+
+		infoHash = torrentInfo.InfoHash
+		trackers = slices.Concat(torrentInfo.Trackers...)
+	}
+
+	for _, trackerURL := range trackers {
+		results, err := tracker.Scrape(context.Background(), trackerURL, [][sha1.Size]byte{infoHash})
+		if err != nil {
+			fmt.Printf("%s: %v\n", trackerURL, err)
+			continue
+		}
+
+		result, ok := results[infoHash]
+		if !ok {
+			fmt.Printf("%s: torrent is unknown to the tracker\n", trackerURL)
+			continue
+		}
+
+		fmt.Printf(
+			"%s: %d seeders, %d leechers, %d completed\n",
+			trackerURL,
+			result.Seeders,
+			result.Leechers,
+			result.Completed,
+		)
+	}
+}
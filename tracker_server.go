@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/mertwole/bittorrent-cli/download/tracker"
+)
+
+const trackerCommand = "tracker"
+const trackerServeCommand = "serve"
+
+func runTracker(args []string) {
+	if len(args) == 0 || args[0] != trackerServeCommand {
+		log.Fatalf("usage: %s %s [flags]", trackerCommand, trackerServeCommand)
+	}
+
+	flags := flag.NewFlagSet(trackerCommand+" "+trackerServeCommand, flag.ExitOnError)
+	httpAddress := flags.String("http", ":8000", "Address to serve HTTP tracker on, empty to disable")
+	udpAddress := flags.String("udp", ":8000", "Address to serve UDP tracker on, empty to disable")
+	interval := flags.Duration("interval", time.Minute*30, "Announce interval sent to the clients")
+	whitelistFileName := flags.String(
+		"whitelist",
+		"",
+		"Path to the file with allowed info hashes, one hex-encoded hash per line. All torrents are allowed if not specified",
+	)
+	flags.Parse(args[1:])
+
+	var whitelist [][sha1.Size]byte
+	if *whitelistFileName != "" {
+		var err error
+		whitelist, err = readWhitelist(*whitelistFileName)
+		if err != nil {
+			log.Fatalf("failed to read whitelist: %v", err)
+		}
+	}
+
+	if *httpAddress == "" && *udpAddress == "" {
+		log.Fatalf("either HTTP or UDP address should be specified")
+	}
+
+	server := tracker.NewServer(*interval, whitelist)
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	if *udpAddress != "" {
+		conn, err := net.ListenPacket("udp", *udpAddress)
+		if err != nil {
+			log.Fatalf("failed to listen on UDP address %s: %v", *udpAddress, err)
+		}
+
+		log.Printf("serving UDP tracker on %s", conn.LocalAddr())
+
+		go func() {
+			err := server.ServeUDP(ctx, conn)
+			if err != nil {
+				log.Fatalf("UDP tracker failed: %v", err)
+			}
+		}()
+	}
+
+	if *httpAddress != "" {
+		httpServer := &http.Server{Addr: *httpAddress, Handler: server}
+		go func() {
+			<-ctx.Done()
+			httpServer.Close()
+		}()
+
+		log.Printf("serving HTTP tracker on %s", *httpAddress)
+
+		err := httpServer.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			log.Fatalf("HTTP tracker failed: %v", err)
+		}
+	}
+
+	<-ctx.Done()
+}
+
+func readWhitelist(fileName string) ([][sha1.Size]byte, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	whitelist := make([][sha1.Size]byte, 0)
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		infoHash, err := hex.DecodeString(line)
+		if err != nil || len(infoHash) != sha1.Size {
+			return nil, fmt.Errorf("invalid info hash %s", line)
+		}
+
+		whitelist = append(whitelist, [sha1.Size]byte(infoHash))
+	}
+
+	return whitelist, scanner.Err()
+}
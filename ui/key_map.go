@@ -12,6 +12,20 @@ type keyMap struct {
 	pauseUnpauseTorrent key.Binding
 	removeTorrent       key.Binding
 
+	toggleFiles        key.Binding
+	changeFilePriority key.Binding
+
+	toggleTrackers key.Binding
+	togglePeers    key.Binding
+
+	changeDownloadLimit        key.Binding
+	changeUploadLimit          key.Binding
+	changeTorrentDownloadLimit key.Binding
+	changeTorrentUploadLimit   key.Binding
+	toggleAltSpeed             key.Binding
+
+	reloadIPFilter key.Binding
+
 	toggleHelp key.Binding
 
 	quit key.Binding
@@ -25,6 +39,9 @@ func (k keyMap) FullHelp() [][]key.Binding {
 	return [][]key.Binding{
 		{k.moveUp, k.moveDown, k.nextPage, k.previousPage},
 		{k.addTorrent, k.pauseUnpauseTorrent, k.removeTorrent},
+		{k.toggleFiles, k.changeFilePriority, k.toggleTrackers, k.togglePeers},
+		{k.changeDownloadLimit, k.changeUploadLimit, k.changeTorrentDownloadLimit, k.changeTorrentUploadLimit},
+		{k.toggleAltSpeed, k.reloadIPFilter},
 		{k.toggleHelp, k.quit},
 	}
 }
@@ -59,6 +76,46 @@ func defaultKeyMap() keyMap {
 			key.WithKeys("-"),
 			key.WithHelp("-", "remove selected torrent"),
 		),
+		toggleFiles: key.NewBinding(
+			key.WithKeys("f"),
+			key.WithHelp("f", "show/hide files of selected torrent"),
+		),
+		changeFilePriority: key.NewBinding(
+			key.WithKeys(" "),
+			key.WithHelp("space", "change priority of selected file"),
+		),
+		toggleTrackers: key.NewBinding(
+			key.WithKeys("t"),
+			key.WithHelp("t", "show/hide trackers of selected torrent"),
+		),
+		togglePeers: key.NewBinding(
+			key.WithKeys("c"),
+			key.WithHelp("c", "show/hide connected peers of selected torrent"),
+		),
+		changeDownloadLimit: key.NewBinding(
+			key.WithKeys("d"),
+			key.WithHelp("d", "change global download limit"),
+		),
+		changeUploadLimit: key.NewBinding(
+			key.WithKeys("u"),
+			key.WithHelp("u", "change global upload limit"),
+		),
+		changeTorrentDownloadLimit: key.NewBinding(
+			key.WithKeys("D"),
+			key.WithHelp("D", "change download limit of selected torrent"),
+		),
+		changeTorrentUploadLimit: key.NewBinding(
+			key.WithKeys("U"),
+			key.WithHelp("U", "change upload limit of selected torrent"),
+		),
+		toggleAltSpeed: key.NewBinding(
+			key.WithKeys("a"),
+			key.WithHelp("a", "toggle alternative speed"),
+		),
+		reloadIPFilter: key.NewBinding(
+			key.WithKeys("r"),
+			key.WithHelp("r", "reload IP filter"),
+		),
 		toggleHelp: key.NewBinding(
 			key.WithKeys("?"),
 			key.WithHelp("?", "toggle help"),
@@ -18,12 +18,16 @@ import (
 
 	"github.com/mertwole/bittorrent-cli/download"
 	"github.com/mertwole/bittorrent-cli/download/bitfield"
+	"github.com/mertwole/bittorrent-cli/download/pieces"
 )
 
 const torrentFileExtension = ".torrent"
 const updateDownloadedPiecesPollInterval = time.Millisecond * 100
 
-func StartUI() {
+// Rate limits the limit keys cycle through, in bytes per second. 0 means unlimited.
+var rateLimitSteps = []int{0, 64 << 10, 256 << 10, 1 << 20, 4 << 20, 16 << 20}
+
+func StartUI(session *download.Session) {
 	keyMap := defaultKeyMap()
 
 	newList := list.New(make([]list.Item, 0), downloadItemDelegate{}, 20, 20)
@@ -39,6 +43,27 @@ func StartUI() {
 		PrevPage:   keyMap.previousPage,
 	}
 
+	fileList := list.New(make([]list.Item, 0), fileItemDelegate{}, 20, 20)
+	fileList.SetShowTitle(false)
+	fileList.SetFilteringEnabled(false)
+	fileList.SetShowStatusBar(false)
+	fileList.SetShowHelp(false)
+	fileList.KeyMap = newList.KeyMap
+
+	trackerList := list.New(make([]list.Item, 0), trackerItemDelegate{}, 20, 20)
+	trackerList.SetShowTitle(false)
+	trackerList.SetFilteringEnabled(false)
+	trackerList.SetShowStatusBar(false)
+	trackerList.SetShowHelp(false)
+	trackerList.KeyMap = newList.KeyMap
+
+	peerList := list.New(make([]list.Item, 0), peerItemDelegate{}, 20, 20)
+	peerList.SetShowTitle(false)
+	peerList.SetFilteringEnabled(false)
+	peerList.SetShowStatusBar(false)
+	peerList.SetShowHelp(false)
+	peerList.KeyMap = newList.KeyMap
+
 	filePicker := filepicker.New()
 	filePicker.AllowedTypes = []string{torrentFileExtension}
 	filePicker.AutoHeight = true
@@ -50,7 +75,11 @@ func StartUI() {
 	filePicker.CurrentDirectory = home
 
 	mainScreen := tea.NewProgram(mainScreen{
+		session:         session,
 		downloadList:    &newList,
+		fileList:        &fileList,
+		trackerList:     &trackerList,
+		peerList:        &peerList,
 		filePicker:      &filePicker,
 		keyMap:          keyMap,
 		help:            help.New(),
@@ -65,13 +94,22 @@ type mainScreen struct {
 	Width  int
 	Height int
 
+	session *download.Session
+
 	downloadList *list.Model
+	fileList     *list.Model
+	trackerList  *list.Model
+	peerList     *list.Model
 	filePicker   *filepicker.Model
 
 	keyMap keyMap
 	help   help.Model
 
 	additionRequest bool
+	showingFiles    bool
+	showingTrackers bool
+	// Peers of this download are shown and refreshed on every tick.
+	showingPeers *download.Download
 }
 
 func (screen mainScreen) Init() tea.Cmd {
@@ -109,13 +147,27 @@ func (screen *mainScreen) updateDownloadedPieces() {
 func (screen mainScreen) Update(message tea.Msg) (tea.Model, tea.Cmd) {
 	command := tea.Batch()
 
-	var downloadListCmd tea.Cmd
-	*screen.downloadList, downloadListCmd = screen.downloadList.Update(message)
-	command = tea.Batch(command, downloadListCmd)
+	if screen.showingFiles {
+		var fileListCmd tea.Cmd
+		*screen.fileList, fileListCmd = screen.fileList.Update(message)
+		command = tea.Batch(command, fileListCmd)
+	} else if screen.showingTrackers {
+		var trackerListCmd tea.Cmd
+		*screen.trackerList, trackerListCmd = screen.trackerList.Update(message)
+		command = tea.Batch(command, trackerListCmd)
+	} else if screen.showingPeers != nil {
+		var peerListCmd tea.Cmd
+		*screen.peerList, peerListCmd = screen.peerList.Update(message)
+		command = tea.Batch(command, peerListCmd)
+	} else {
+		var downloadListCmd tea.Cmd
+		*screen.downloadList, downloadListCmd = screen.downloadList.Update(message)
+		command = tea.Batch(command, downloadListCmd)
 
-	var paginatorCmd tea.Cmd
-	screen.downloadList.Paginator, paginatorCmd = screen.downloadList.Paginator.Update(message)
-	command = tea.Batch(command, paginatorCmd)
+		var paginatorCmd tea.Cmd
+		screen.downloadList.Paginator, paginatorCmd = screen.downloadList.Paginator.Update(message)
+		command = tea.Batch(command, paginatorCmd)
+	}
 
 	var filePickerCmd tea.Cmd
 	*screen.filePicker, filePickerCmd = screen.filePicker.Update(message)
@@ -125,6 +177,15 @@ func (screen mainScreen) Update(message tea.Msg) (tea.Model, tea.Cmd) {
 	case tea.KeyMsg:
 		switch {
 		case key.Matches(message, screen.keyMap.quit):
+			for _, item := range screen.downloadList.Items() {
+				if item, ok := item.(downloadItem); ok {
+					err := item.model.SaveResumeData()
+					if err != nil {
+						log.Printf("failed to save resume data: %v", err)
+					}
+				}
+			}
+
 			command = tea.Batch(command, tea.Quit)
 		case key.Matches(message, screen.keyMap.toggleHelp):
 			screen.help.ShowAll = !screen.help.ShowAll
@@ -132,6 +193,78 @@ func (screen mainScreen) Update(message tea.Msg) (tea.Model, tea.Cmd) {
 			screen.additionRequest = true
 			filePickerCmd := screen.filePicker.Init()
 			command = tea.Batch(command, filePickerCmd)
+		case key.Matches(message, screen.keyMap.toggleTrackers):
+			if screen.showingTrackers {
+				screen.showingTrackers = false
+				break
+			}
+
+			if screen.showingFiles || screen.showingPeers != nil {
+				break
+			}
+
+			selected := screen.downloadList.SelectedItem()
+			if item, ok := selected.(downloadItem); ok {
+				trackers := make([]list.Item, 0)
+				for i := range item.model.GetTrackerStatuses() {
+					trackers = append(trackers, trackerItem{model: item.model, index: i})
+				}
+
+				screen.trackerList.SetItems(trackers)
+				screen.trackerList.ResetSelected()
+				screen.showingTrackers = true
+			}
+		case screen.showingTrackers:
+		case key.Matches(message, screen.keyMap.togglePeers):
+			if screen.showingPeers != nil {
+				screen.showingPeers = nil
+				break
+			}
+
+			if screen.showingFiles {
+				break
+			}
+
+			selected := screen.downloadList.SelectedItem()
+			if item, ok := selected.(downloadItem); ok {
+				screen.showingPeers = item.model
+				screen.refreshPeers()
+				screen.peerList.ResetSelected()
+			}
+		case screen.showingPeers != nil:
+		case key.Matches(message, screen.keyMap.toggleFiles):
+			if screen.showingFiles {
+				screen.showingFiles = false
+				break
+			}
+
+			selected := screen.downloadList.SelectedItem()
+			if item, ok := selected.(downloadItem); ok {
+				files := make([]list.Item, 0)
+				for i := range item.model.GetFiles() {
+					files = append(files, fileItem{model: item.model, index: i})
+				}
+
+				screen.fileList.SetItems(files)
+				screen.fileList.ResetSelected()
+				screen.showingFiles = true
+			}
+		case key.Matches(message, screen.keyMap.changeFilePriority):
+			if !screen.showingFiles {
+				break
+			}
+
+			selected := screen.fileList.SelectedItem()
+			if item, ok := selected.(fileItem); ok {
+				priority := item.model.GetFiles()[item.index].Priority
+				nextPriority := (priority + 1) % (pieces.High + 1)
+
+				err := item.model.SetFilePriority(item.index, nextPriority)
+				if err != nil {
+					log.Printf("failed to change file priority: %v", err)
+				}
+			}
+		case screen.showingFiles:
 		case key.Matches(message, screen.keyMap.pauseUnpauseTorrent):
 			selected := screen.downloadList.SelectedItem()
 			if item, ok := selected.(downloadItem); ok {
@@ -145,11 +278,44 @@ func (screen mainScreen) Update(message tea.Msg) (tea.Model, tea.Cmd) {
 				selectedIndex := screen.downloadList.GlobalIndex()
 				screen.downloadList.RemoveItem(selectedIndex)
 			}
+		case key.Matches(message, screen.keyMap.changeDownloadLimit):
+			limits := screen.session.GetRateLimits()
+			limits.Download = nextRateLimit(limits.Download)
+			screen.session.SetRateLimits(limits)
+		case key.Matches(message, screen.keyMap.changeUploadLimit):
+			limits := screen.session.GetRateLimits()
+			limits.Upload = nextRateLimit(limits.Upload)
+			screen.session.SetRateLimits(limits)
+		case key.Matches(message, screen.keyMap.changeTorrentDownloadLimit):
+			selected := screen.downloadList.SelectedItem()
+			if item, ok := selected.(downloadItem); ok {
+				limits := item.model.GetRateLimits()
+				limits.Download = nextRateLimit(limits.Download)
+				item.model.SetRateLimits(limits)
+			}
+		case key.Matches(message, screen.keyMap.changeTorrentUploadLimit):
+			selected := screen.downloadList.SelectedItem()
+			if item, ok := selected.(downloadItem); ok {
+				limits := item.model.GetRateLimits()
+				limits.Upload = nextRateLimit(limits.Upload)
+				item.model.SetRateLimits(limits)
+			}
+		case key.Matches(message, screen.keyMap.toggleAltSpeed):
+			screen.session.SetAltSpeedEnabled(!screen.session.IsAltSpeedEnabled())
+		case key.Matches(message, screen.keyMap.reloadIPFilter):
+			err := screen.session.ReloadIPFilter()
+			if err != nil {
+				log.Printf("failed to reload IP filter: %v", err)
+			}
 		}
 	case tea.WindowSizeMsg:
 		screen.Width = message.Width
 		screen.Height = message.Height
 	case tickMsg:
+		if screen.showingPeers != nil {
+			screen.refreshPeers()
+		}
+
 		command = tea.Batch(tickCmd())
 	}
 
@@ -158,7 +324,7 @@ func (screen mainScreen) Update(message tea.Msg) (tea.Model, tea.Cmd) {
 		screen.additionRequest = false
 
 		// TODO: Determine download path.
-		newDownload, err := download.New(filePath, "./data")
+		newDownload, err := download.New(screen.session, filePath, "./data")
 		if err != nil {
 			// TODO: Show this error to the user.
 			log.Panicf("failed to add file to downloads: %v", err)
@@ -186,10 +352,55 @@ func (screen mainScreen) View() string {
 		help := screen.help.View(screen.keyMap)
 		helpHeight := lipgloss.Height(help)
 
-		screen.downloadList.SetSize(screen.Width, screen.Height-helpHeight)
+		if screen.showingFiles {
+			screen.fileList.SetSize(screen.Width, screen.Height-helpHeight)
+
+			return screen.fileList.View() + "\n" + help
+		}
+
+		if screen.showingTrackers {
+			screen.trackerList.SetSize(screen.Width, screen.Height-helpHeight)
+
+			return screen.trackerList.View() + "\n" + help
+		}
+
+		if screen.showingPeers != nil {
+			screen.peerList.SetSize(screen.Width, screen.Height-helpHeight)
+
+			return screen.peerList.View() + "\n" + help
+		}
+
+		rateLimits := screen.rateLimitsView()
+		screen.downloadList.SetSize(screen.Width, screen.Height-helpHeight-lipgloss.Height(rateLimits))
+
+		return screen.downloadList.View() + "\n" + rateLimits + "\n" + help
+	}
+}
+
+func (screen *mainScreen) refreshPeers() {
+	peers := make([]list.Item, 0)
+	for _, status := range screen.showingPeers.GetPeers() {
+		peers = append(peers, peerItem{status: status})
+	}
 
-		return screen.downloadList.View() + "\n" + help
+	screen.peerList.SetItems(peers)
+}
+
+func (screen mainScreen) rateLimitsView() string {
+	limits := screen.session.GetRateLimits()
+	label := fmt.Sprintf("↓ %s  ↑ %s", formatRateLimit(limits.Download), formatRateLimit(limits.Upload))
+
+	if screen.session.IsAltSpeedEnabled() {
+		label += "  (alternative speed)"
 	}
+
+	if blockedRanges := screen.session.GetIPFilterRangeCount(); blockedRanges != 0 {
+		label += fmt.Sprintf("  %d blocked IP ranges", blockedRanges)
+	}
+
+	return lipgloss.NewStyle().
+		Foreground(lipgloss.AdaptiveColor{Light: "#383838", Dark: "#ADADAD"}).
+		Render(label)
 }
 
 type downloadItem struct {
@@ -247,6 +458,29 @@ func (d downloadItemDelegate) Render(w io.Writer, m list.Model, index int, listI
 		downloadProgressLabel = "paused"
 	}
 
+	if downloadStatus == download.Downloading || downloadStatus == download.Done {
+		downloadProgressLabel = fmt.Sprintf("%d peers  %s", model.GetConnectionCount(), downloadProgressLabel)
+	}
+
+	rateLimits := model.GetRateLimits()
+	if rateLimits.Download != 0 || rateLimits.Upload != 0 {
+		downloadProgressLabel = fmt.Sprintf(
+			"↓ %s ↑ %s  %s",
+			formatRateLimit(rateLimits.Download),
+			formatRateLimit(rateLimits.Upload),
+			downloadProgressLabel,
+		)
+	}
+
+	if scrapeResult, ok := model.GetScrapeResult(); ok {
+		downloadProgressLabel = fmt.Sprintf(
+			"%d seeders %d leechers  %s",
+			scrapeResult.Seeders,
+			scrapeResult.Leechers,
+			downloadProgressLabel,
+		)
+	}
+
 	switch downloadStatus {
 	case download.PreparingFiles:
 		// TODO: Display something?
@@ -257,9 +491,24 @@ func (d downloadItemDelegate) Render(w io.Writer, m list.Model, index int, listI
 			ViewAs(float64(hashCheckProgress.SetPiecesCount()) / float64(hashCheckProgress.PieceCount()))
 	case download.Downloading, download.Paused, download.Done:
 		downloadProgress := model.GetProgress()
+		wanted := model.GetWanted()
+
+		wantedCount := 0
+		wantedDownloadedCount := 0
+		for piece := range wanted.PieceCount() {
+			if wanted.ContainsPiece(piece) {
+				wantedCount++
+
+				if downloadProgress.ContainsPiece(piece) {
+					wantedDownloadedCount++
+				}
+			}
+		}
 
-		downloadPercent := float64(downloadProgress.SetPiecesCount()) /
-			float64(downloadProgress.PieceCount()) * 100.
+		downloadPercent := 100.
+		if wantedCount != 0 {
+			downloadPercent = float64(wantedDownloadedCount) / float64(wantedCount) * 100.
+		}
 
 		maxPercentageLength := len(" 100.0%")
 		progressBarWidth -= maxPercentageLength
@@ -297,6 +546,236 @@ func (d downloadItemDelegate) Render(w io.Writer, m list.Model, index int, listI
 	fmt.Fprintf(w, "%s\n%s", statusLabel, progressBar)
 }
 
+type fileItem struct {
+	model *download.Download
+	index int
+}
+
+func (i fileItem) FilterValue() string { return "" }
+
+type fileItemDelegate struct{}
+
+func (d fileItemDelegate) Height() int {
+	return 1
+}
+
+func (d fileItemDelegate) Spacing() int {
+	return 0
+}
+
+func (d fileItemDelegate) Update(_ tea.Msg, _ *list.Model) tea.Cmd {
+	return nil
+}
+
+func (d fileItemDelegate) Render(w io.Writer, m list.Model, index int, listItem list.Item) {
+	item, ok := listItem.(fileItem)
+	if !ok {
+		return
+	}
+
+	file := item.model.GetFiles()[item.index]
+
+	totalWidth := m.Width()
+	if index == m.Index() {
+		totalWidth -= 2
+	}
+
+	infoLabel := fmt.Sprintf("%s  %6s", formatSize(file.Length), file.Priority.String())
+
+	paddingLength := max(totalWidth-lipgloss.Width(file.Name), lipgloss.Width(infoLabel)+1)
+	label := fmt.Sprintf("%s%*s", file.Name, paddingLength, infoLabel)
+
+	if index == m.Index() {
+		label = "┆ " + label
+	}
+
+	normalStyle := lipgloss.NewStyle().
+		Foreground(lipgloss.AdaptiveColor{Light: "#2E6B38", Dark: "#66F27D"})
+	skippedStyle := lipgloss.NewStyle().
+		Foreground(lipgloss.AdaptiveColor{Light: "#383838", Dark: "#ADADAD"})
+
+	appliedStyle := normalStyle
+	if file.Priority == pieces.Skip {
+		appliedStyle = skippedStyle
+	}
+
+	fmt.Fprint(w, appliedStyle.Render(label))
+}
+
+type trackerItem struct {
+	model *download.Download
+	index int
+}
+
+func (i trackerItem) FilterValue() string { return "" }
+
+type trackerItemDelegate struct{}
+
+func (d trackerItemDelegate) Height() int {
+	return 2
+}
+
+func (d trackerItemDelegate) Spacing() int {
+	return 0
+}
+
+func (d trackerItemDelegate) Update(_ tea.Msg, _ *list.Model) tea.Cmd {
+	return nil
+}
+
+func (d trackerItemDelegate) Render(w io.Writer, m list.Model, index int, listItem list.Item) {
+	item, ok := listItem.(trackerItem)
+	if !ok {
+		return
+	}
+
+	statuses := item.model.GetTrackerStatuses()
+	if item.index >= len(statuses) {
+		return
+	}
+	status := statuses[item.index]
+
+	var statusLabel, messageLabel string
+	switch {
+	case status.Working:
+		statusLabel = "working"
+		if status.Warning != "" {
+			messageLabel = "warning: " + status.Warning
+		}
+	case status.Error != "":
+		statusLabel = "not working"
+		messageLabel = status.Error
+	default:
+		statusLabel = "not contacted"
+	}
+
+	totalWidth := m.Width()
+	if index == m.Index() {
+		totalWidth -= 2
+	}
+
+	paddingLength := max(totalWidth-lipgloss.Width(status.URL), lipgloss.Width(statusLabel)+1)
+	label := fmt.Sprintf("%s%*s", status.URL, paddingLength, statusLabel)
+
+	if index == m.Index() {
+		label = "┆ " + label
+		messageLabel = "┆ " + messageLabel
+	}
+
+	normalStyle := lipgloss.NewStyle().
+		Foreground(lipgloss.AdaptiveColor{Light: "#2E6B38", Dark: "#66F27D"})
+	failedStyle := lipgloss.NewStyle().
+		Foreground(lipgloss.AdaptiveColor{Light: "#383838", Dark: "#ADADAD"})
+
+	appliedStyle := normalStyle
+	if !status.Working {
+		appliedStyle = failedStyle
+	}
+
+	fmt.Fprintf(w, "%s\n%s", appliedStyle.Render(label), appliedStyle.Render(messageLabel))
+}
+
+type peerItem struct {
+	status download.PeerStatus
+}
+
+func (i peerItem) FilterValue() string { return "" }
+
+type peerItemDelegate struct{}
+
+func (d peerItemDelegate) Height() int {
+	return 1
+}
+
+func (d peerItemDelegate) Spacing() int {
+	return 0
+}
+
+func (d peerItemDelegate) Update(_ tea.Msg, _ *list.Model) tea.Cmd {
+	return nil
+}
+
+func (d peerItemDelegate) Render(w io.Writer, m list.Model, index int, listItem list.Item) {
+	item, ok := listItem.(peerItem)
+	if !ok {
+		return
+	}
+
+	status := item.status
+
+	nameLabel := status.Address
+	if status.ClientName != "" {
+		nameLabel += "  " + status.ClientName
+	}
+
+	var infoLabel string
+	if status.Banned {
+		infoLabel = fmt.Sprintf("%d hash failures  banned", status.HashFailures)
+	} else {
+		infoLabel = fmt.Sprintf(
+			"↓ %s ↑ %s  %d hash failures",
+			formatSize(status.Downloaded),
+			formatSize(status.Uploaded),
+			status.HashFailures,
+		)
+	}
+
+	totalWidth := m.Width()
+	if index == m.Index() {
+		totalWidth -= 2
+	}
+
+	paddingLength := max(totalWidth-lipgloss.Width(nameLabel), lipgloss.Width(infoLabel)+1)
+	label := fmt.Sprintf("%s%*s", nameLabel, paddingLength, infoLabel)
+
+	if index == m.Index() {
+		label = "┆ " + label
+	}
+
+	normalStyle := lipgloss.NewStyle().
+		Foreground(lipgloss.AdaptiveColor{Light: "#2E6B38", Dark: "#66F27D"})
+	bannedStyle := lipgloss.NewStyle().
+		Foreground(lipgloss.AdaptiveColor{Light: "#383838", Dark: "#ADADAD"})
+
+	appliedStyle := normalStyle
+	if status.Banned {
+		appliedStyle = bannedStyle
+	}
+
+	fmt.Fprint(w, appliedStyle.Render(label))
+}
+
+func formatSize(size uint64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+
+	value := float64(size)
+	unit := 0
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+
+	return fmt.Sprintf("%.1f %s", value, units[unit])
+}
+
+func formatRateLimit(limit int) string {
+	if limit == 0 {
+		return "unlimited"
+	}
+
+	return formatSize(uint64(limit)) + "/s"
+}
+
+func nextRateLimit(current int) int {
+	for _, step := range rateLimitSteps {
+		if step > current {
+			return step
+		}
+	}
+
+	return rateLimitSteps[0]
+}
+
 func composeDownloadedPiecesString(bitfield *bitfield.Bitfield, targetLength int) string {
 	pieceCount := bitfield.PieceCount()
 